@@ -0,0 +1,267 @@
+// Package main implements the admin_list_files Lambda function
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	// statusCreatedIndex is the GSI (status, createdAt) used to list recent
+	// files across all users
+	statusCreatedIndex = "StatusCreatedIndex"
+	defaultPageSize    = 50
+	maxPageSize        = 200
+	// maxFilteredPages bounds how many pages are read to find a non-empty one
+	maxFilteredPages = 5
+
+	// scopeKey marks nextTokens with the scope they were issued for
+	scopeKey = "adminScope"
+)
+
+// validStatuses are the statuses recent files can be listed by
+var validStatuses = map[string]bool{
+	"pending":           true,
+	"uploaded":          true,
+	"confirmed":         true,
+	"deleted":           true,
+	"rejected":          true,
+	"size_mismatch":     true,
+	"corrupt":           true,
+	"multipart_pending": true,
+}
+
+// FileItem is a file record with its owner and full metadata, for support
+type FileItem struct {
+	UserID          string            `dynamodbav:"userId" json:"userId"`
+	FileID          string            `dynamodbav:"fileId" json:"fileId"`
+	FileName        string            `dynamodbav:"fileName" json:"fileName"`
+	ContentType     string            `dynamodbav:"contentType" json:"contentType"`
+	ContentEncoding string            `dynamodbav:"contentEncoding" json:"contentEncoding,omitempty"`
+	FileSize        int64             `dynamodbav:"fileSize" json:"fileSize"`
+	S3Key           string            `dynamodbav:"s3Key" json:"s3Key"`
+	Status          string            `dynamodbav:"status" json:"status"`
+	PreviousStatus  string            `dynamodbav:"previousStatus" json:"previousStatus,omitempty"`
+	CreatedAt       string            `dynamodbav:"createdAt" json:"createdAt"`
+	UpdatedAt       string            `dynamodbav:"updatedAt" json:"updatedAt,omitempty"`
+	DeletedAt       string            `dynamodbav:"deletedAt" json:"deletedAt,omitempty"`
+	ExpiresAt       string            `dynamodbav:"expiresAt" json:"expiresAt,omitempty"`
+	Folder          string            `dynamodbav:"folder" json:"folder,omitempty"`
+	Description     string            `dynamodbav:"description" json:"description,omitempty"`
+	Tags            map[string]string `dynamodbav:"tags" json:"tags,omitempty"`
+	ACL             []string          `dynamodbav:"acl,stringset" json:"acl,omitempty"`
+	ShareReferers   []string          `dynamodbav:"shareReferers,stringset" json:"shareReferers,omitempty"`
+	ShareCIDRs      []string          `dynamodbav:"shareCidrs,stringset" json:"shareCidrs,omitempty"`
+	LegalHold       bool              `dynamodbav:"legalHold" json:"legalHold,omitempty"`
+	LegalHoldReason string            `dynamodbav:"legalHoldReason" json:"legalHoldReason,omitempty"`
+	Pinned          bool              `dynamodbav:"pinned" json:"pinned,omitempty"`
+	ChecksumSHA256  string            `dynamodbav:"checksumSha256" json:"checksumSha256,omitempty"`
+	VersionID       string            `dynamodbav:"versionId" json:"versionId,omitempty"`
+	ETag            string            `dynamodbav:"etag" json:"etag,omitempty"`
+	TransferredFrom string            `dynamodbav:"transferredFrom" json:"transferredFrom,omitempty"`
+}
+
+// ListResponse represents the response body
+type ListResponse struct {
+	// Scope is "owner" with OwnerUserID, or "recent" with Status
+	Scope       string     `json:"scope"`
+	OwnerUserID string     `json:"ownerUserId,omitempty"`
+	Status      string     `json:"status,omitempty"`
+	Files       []FileItem `json:"files"`
+	Count       int        `json:"count"`
+	NextToken   *string    `json:"nextToken"`
+	// HasMore is true whenever nextToken is set, even if this page is empty
+	HasMore bool `json:"hasMore"`
+}
+
+var (
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+	// queryClient runs the listing queries; tests replace it
+	queryClient common.QueryAPI
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+	queryClient = dynamoClient
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.CaptureSourceIP,
+	common.RequireUser,
+	common.RequireAdmin,
+)(handleAdminList)
+
+// handleAdminList lists one user's files (?ownerUserId=), or the most recent
+// files across all users with a status (?status=, default uploaded)
+func handleAdminList(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	adminID := common.UserID(ctx)
+	params := request.QueryStringParameters
+
+	limit := defaultPageSize
+	if v := params["limit"]; v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			return common.Fail(common.Validation("Invalid limit: must be a positive integer"))
+		}
+		limit = parsed
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	response := ListResponse{Files: []FileItem{}}
+	var input *dynamodb.QueryInput
+	if owner := params["ownerUserId"]; owner != "" {
+		if !common.IsValidUserID(owner) {
+			return common.Fail(common.Validation("Invalid ownerUserId"))
+		}
+		if params["status"] != "" {
+			return common.Fail(common.Validation("status cannot be combined with ownerUserId"))
+		}
+		response.Scope, response.OwnerUserID = "owner", owner
+		input = ownerInput(owner)
+	} else {
+		status := params["status"]
+		if status == "" {
+			status = "uploaded"
+		}
+		if !validStatuses[status] {
+			return common.Fail(common.Validation(fmt.Sprintf("Invalid status '%s'", status)))
+		}
+		response.Scope, response.Status = "recent", status
+		input = recentInput(status)
+	}
+	input.Limit = aws.Int32(int32(limit))
+
+	scope := tokenScope(response)
+	startKey, err := decodeAdminToken(params["nextToken"], scope)
+	if err != nil {
+		return common.Fail(common.Validation("Invalid nextToken"))
+	}
+	input.ExclusiveStartKey = startKey
+
+	items, lastKey, err := common.QueryPage(ctx, queryClient, input, maxFilteredPages)
+	if err != nil {
+		return common.Fail(common.Internal("DynamoDB query error", err))
+	}
+	if err := attributevalue.UnmarshalListOfMaps(items, &response.Files); err != nil {
+		return common.Fail(common.Internal("Unmarshal error", err))
+	}
+	response.Count = len(response.Files)
+
+	if token, err := encodeAdminToken(lastKey, scope); err != nil {
+		log.Printf("Token encode error: %v", err)
+	} else if token != "" {
+		response.NextToken = &token
+		response.HasMore = true
+	}
+
+	// Support access to other users' files is recorded in the admin's trail
+	metadata := map[string]interface{}{
+		"reason": "admin_list_files",
+		"scope":  response.Scope,
+		"count":  response.Count,
+	}
+	if response.OwnerUserID != "" {
+		metadata["ownerUserId"] = response.OwnerUserID
+	} else {
+		metadata["status"] = response.Status
+	}
+	auditLog.Log(ctx, adminID, "*", "view", metadata)
+
+	return common.BuildResponse(200, response), nil
+}
+
+// ownerInput queries one user's partition, newest fileId first
+func ownerInput(owner string) *dynamodb.QueryInput {
+	return &dynamodb.QueryInput{
+		TableName:              aws.String(userFilesTable),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: owner},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+}
+
+// recentInput queries the status GSI, most recently created first
+func recentInput(status string) *dynamodb.QueryInput {
+	return &dynamodb.QueryInput{
+		TableName:              aws.String(userFilesTable),
+		IndexName:              aws.String(statusCreatedIndex),
+		KeyConditionExpression: aws.String("#status = :status"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: status},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+}
+
+// tokenScope names what a listing covers, so a nextToken can't be replayed
+// against another owner or status
+func tokenScope(response ListResponse) string {
+	if response.OwnerUserID != "" {
+		return "owner:" + response.OwnerUserID
+	}
+	return "recent:" + response.Status
+}
+
+// encodeAdminToken encodes lastKey together with the listing scope
+func encodeAdminToken(lastKey map[string]types.AttributeValue, scope string) (string, error) {
+	if len(lastKey) == 0 {
+		return "", nil
+	}
+	key := make(map[string]types.AttributeValue, len(lastKey)+1)
+	for k, v := range lastKey {
+		key[k] = v
+	}
+	key[scopeKey] = &types.AttributeValueMemberS{Value: scope}
+	return common.EncodeToken(key)
+}
+
+// decodeAdminToken decodes a nextToken, rejecting tokens of another scope.
+// Keys span users, so unlike get_files there is no owner to check.
+func decodeAdminToken(token, scope string) (map[string]types.AttributeValue, error) {
+	key, err := common.DecodeToken(token)
+	if err != nil || key == nil {
+		return key, err
+	}
+	if v, ok := key[scopeKey].(*types.AttributeValueMemberS); !ok || v.Value != scope {
+		return nil, common.ErrInvalidToken
+	}
+	delete(key, scopeKey)
+	return key, nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+func TestAdminListRequiresAdmin(t *testing.T) {
+	request := events.APIGatewayProxyRequest{QueryStringParameters: map[string]string{"ownerUserId": "user-999"}}
+	request.RequestContext.Authorizer = map[string]interface{}{
+		"claims": map[string]interface{}{"sub": "user-123", "cognito:groups": "users"},
+	}
+	handler := common.Chain(common.HandleErrors, common.RequireUser, common.RequireAdmin)(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		t.Fatal("handler reached by a non-admin")
+		return events.APIGatewayProxyResponse{}, nil
+	})
+	response, err := handler(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 403 {
+		t.Errorf("status = %d, want 403", response.StatusCode)
+	}
+}
+
+func TestAdminTokenScope(t *testing.T) {
+	lastKey := map[string]types.AttributeValue{
+		"userId":    &types.AttributeValueMemberS{Value: "user-999"},
+		"fileId":    &types.AttributeValueMemberS{Value: "f1"},
+		"status":    &types.AttributeValueMemberS{Value: "uploaded"},
+		"createdAt": &types.AttributeValueMemberS{Value: "2024-03-10T09:30:00Z"},
+	}
+	recent := tokenScope(ListResponse{Status: "uploaded"})
+	token, err := encodeAdminToken(lastKey, recent)
+	if err != nil || token == "" {
+		t.Fatalf("encodeAdminToken = %q, %v", token, err)
+	}
+
+	key, err := decodeAdminToken(token, recent)
+	if err != nil {
+		t.Fatalf("decodeAdminToken error: %v", err)
+	}
+	if _, ok := key[scopeKey]; ok || len(key) != len(lastKey) {
+		t.Errorf("decoded key = %v, want the last key without the scope", key)
+	}
+
+	for _, other := range []string{tokenScope(ListResponse{Status: "deleted"}), tokenScope(ListResponse{OwnerUserID: "user-999"})} {
+		if _, err := decodeAdminToken(token, other); err == nil {
+			t.Errorf("token for %s accepted for %s", recent, other)
+		}
+	}
+
+	// A get_files token has no scope
+	plain, _ := common.EncodeToken(lastKey)
+	if _, err := decodeAdminToken(plain, recent); err == nil {
+		t.Error("unscoped token accepted")
+	}
+}
+
+func TestRecentInputUsesStatusIndex(t *testing.T) {
+	input := recentInput("pending")
+	if aws.ToString(input.IndexName) != statusCreatedIndex || aws.ToBool(input.ScanIndexForward) {
+		t.Errorf("recentInput = index %q, forward %v; want %s, newest first", aws.ToString(input.IndexName), aws.ToBool(input.ScanIndexForward), statusCreatedIndex)
+	}
+	if v := input.ExpressionAttributeValues[":status"].(*types.AttributeValueMemberS).Value; v != "pending" {
+		t.Errorf(":status = %q, want pending", v)
+	}
+}
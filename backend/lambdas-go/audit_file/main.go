@@ -3,11 +3,17 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	// Embedded so tz works on Lambda runtimes without zoneinfo files
+	_ "time/tzdata"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -22,17 +28,59 @@ import (
 
 const (
 	fileAuditTable = "FileAudit"
+	userFilesTable = "UserFiles"
 	defaultLimit   = 50
 	maxLimit       = 100
+	// maxFilteredPages bounds how many pages are read to find a non-empty one
+	maxFilteredPages = 5
+
+	maxMetadataKeys   = 20
+	maxMetadataKeyLen = 64
+
+	// Values of the order query parameter
+	orderDesc = "desc"
+	orderAsc  = "asc"
+	// cursorScopeKey carries the cursor's scope inside nextToken
+	cursorScopeKey = "cursorScope"
+
+	// metaMaxAge is how long clients may cache the audit_meta response
+	metaMaxAge = time.Hour
 )
 
-var validActions = map[string]bool{
-	"view":           true,
-	"download":       true,
-	"upload":         true,
-	"delete":         true,
-	"share":          true,
-	"access_attempt": true,
+// validActions maps each action stored in the audit table to a description,
+// which GET /audit/meta hands to clients so they don't keep their own list
+var validActions = map[string]string{
+	"view":            "File details were viewed",
+	"download":        "A download URL was issued",
+	"upload":          "A file was uploaded",
+	"delete":          "A file was moved to trash",
+	"purge":           "A file was permanently deleted",
+	"export":          "Files were exported",
+	"tag":             "Tags were changed",
+	"update":          "File metadata or status changed",
+	"share":           "Access was granted or revoked",
+	"access_attempt":  "Access was refused",
+	"legal_hold":      "A legal hold was placed or released",
+	"transfer":        "File ownership was transferred",
+	"restore":         "A file was restored from trash",
+	"security_alert":  "Something unsafe was detected, e.g. an insecure download URL",
+	"share_exhausted": "A limited share used its last download",
+}
+
+// activityActions are what the activity feed shows when no action is given
+var activityActions = []string{"upload", "download", "delete"}
+
+// actionAliases maps alternative action names sent by clients to canonical actions
+var actionAliases = map[string]string{
+	"get":      "download",
+	"put":      "upload",
+	"read":     "view",
+	"remove":   "delete",
+	"rm":       "delete",
+	"attempt":  "access_attempt",
+	"access":   "access_attempt",
+	"shared":   "share",
+	"uploaded": "upload",
 }
 
 // AuditRequest represents the POST request body
@@ -49,6 +97,37 @@ type AuditEntry struct {
 	FileID    string                 `dynamodbav:"fileId" json:"fileId"`
 	Action    string                 `dynamodbav:"action" json:"action"`
 	Metadata  map[string]interface{} `dynamodbav:"metadata" json:"metadata,omitempty"`
+	// IPAddress mirrors metadata.ipAddress so it can be filtered on. Entries
+	// written before it was added only have the metadata copy.
+	IPAddress string `dynamodbav:"ipAddress,omitempty" json:"ipAddress,omitempty"`
+	// CorrelationID is metadata.correlationId, the request ID of the
+	// invocation that wrote the entry, surfaced for tracing it to its logs
+	CorrelationID string `dynamodbav:"-" json:"correlationId,omitempty"`
+}
+
+// AuditMetaResponse represents the GET /audit/meta response
+type AuditMetaResponse struct {
+	// Actions are sorted by name
+	Actions []ActionInfo `json:"actions"`
+	// Aliases maps accepted alternative names to their action
+	Aliases map[string]string `json:"aliases"`
+	Limits  AuditLimits       `json:"limits"`
+	// RetentionDays is how long entries are kept; null means indefinitely
+	RetentionDays *int `json:"retentionDays"`
+}
+
+// ActionInfo describes one audit action
+type ActionInfo struct {
+	Action      string `json:"action"`
+	Description string `json:"description"`
+}
+
+// AuditLimits are the bounds audit_file applies to requests
+type AuditLimits struct {
+	DefaultLimit      int `json:"defaultLimit"`
+	MaxLimit          int `json:"maxLimit"`
+	MaxMetadataKeys   int `json:"maxMetadataKeys"`
+	MaxMetadataKeyLen int `json:"maxMetadataKeyLen"`
 }
 
 // AuditCreateResponse represents the POST response
@@ -67,51 +146,129 @@ type AuditEntrySummary struct {
 
 // AuditListResponse represents the GET response
 type AuditListResponse struct {
-	AuditLogs []AuditEntry `json:"auditLogs"`
-	Count     int          `json:"count"`
-	NextToken *string      `json:"nextToken"`
+	AuditLogs    []AuditEntry   `json:"auditLogs"`
+	Count        int            `json:"count"`
+	ActionCounts map[string]int `json:"actionCounts,omitempty"`
+	NextToken    *string        `json:"nextToken"`
+	// HasMore is true whenever nextToken is set, even if this page is empty
+	HasMore bool `json:"hasMore"`
+}
+
+// ActivityResponse represents the GET /audit/activity response
+type ActivityResponse struct {
+	// Activity is newest first
+	Activity []ActivityItem `json:"activity"`
+	Count    int            `json:"count"`
+	// Incomplete is set when some files couldn't be read; their file is null
+	// as if they no longer existed
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// ActivityItem is one event of the activity feed
+type ActivityItem struct {
+	Timestamp string `json:"timestamp"`
+	Action    string `json:"action"`
+	FileID    string `json:"fileId"`
+	// FileName is the name recorded with the event, kept for files that are
+	// gone or renamed since
+	FileName string `json:"fileName,omitempty"`
+	// File is the file as it is now, or null when it no longer exists
+	File *ActivityFile `json:"file"`
 }
 
-var dynamoClient *dynamodb.Client
+// ActivityFile is the current name and status of a file in the feed
+type ActivityFile struct {
+	FileName string `json:"fileName"`
+	Status   string `json:"status"`
+}
+
+var (
+	dynamoClient *dynamodb.Client
+	// queryClient runs the GET queries; tests replace it
+	queryClient common.QueryAPI
+	// fileClient checks that POSTed entries name the caller's file; tests
+	// replace it
+	fileClient common.GetItemAPI
+	// batchClient reads the files of the activity feed; tests replace it
+	batchClient common.BatchGetItemAPI
+)
 
 func init() {
 	cfg, err := config.LoadDefaultConfig(context.Background())
 	if err != nil {
 		log.Fatalf("Failed to load AWS config: %v", err)
 	}
-	dynamoClient = dynamodb.NewFromConfig(cfg)
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	queryClient = dynamoClient
+	fileClient = dynamoClient
+	batchClient = dynamoClient
 }
 
 // Handler is the Lambda function handler
-func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Log authorizer context for debugging
-	log.Printf("Authorizer context: %+v", request.RequestContext.Authorizer)
-
-	// Extract user ID
-	userID, err := common.ExtractUserID(request)
-	if err != nil {
-		log.Printf("Auth error: %v", err)
-		return common.BuildErrorResponse(401, "Unauthorized: userId not found"), nil
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard("GET"),
+	common.RequireUser,
+)(routes.Serve)
+
+// routes maps audit_file's methods to their handlers; others get 405
+var routes = common.NewRouter().
+	Handle("GET", "", withUserID(handleGetAuditLogs)).
+	Handle("GET", "meta", handleAuditMeta).
+	Handle("GET", "activity", withUserID(handleActivity)).
+	Handle("POST", "", withUserID(handleCreateAuditLog))
+
+// withUserID adapts a handler that takes the authenticated caller's userId
+func withUserID(handler func(ctx context.Context, userID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)) common.HandlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return handler(ctx, common.UserID(ctx), request)
 	}
+}
 
-	// Route based on HTTP method
-	httpMethod := request.HTTPMethod
-	if httpMethod == "" {
-		httpMethod = request.RequestContext.HTTPMethod
+// handleAuditMeta describes the actions and limits audit_file accepts, so
+// clients stay in sync with validActions. The answer only changes with a
+// deployment, so clients may cache it.
+func handleAuditMeta(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	actions := make([]ActionInfo, 0, len(validActions))
+	for _, name := range actionNames() {
+		actions = append(actions, ActionInfo{Action: name, Description: validActions[name]})
 	}
 
-	switch httpMethod {
-	case "GET":
-		return handleGetAuditLogs(ctx, userID, request.QueryStringParameters)
-	case "POST":
-		return handleCreateAuditLog(ctx, userID, request)
-	default:
-		return common.BuildErrorResponse(405, "Method not allowed"), nil
+	response := common.BuildResponse(200, AuditMetaResponse{
+		Actions: actions,
+		Aliases: actionAliases,
+		Limits: AuditLimits{
+			DefaultLimit:      defaultLimit,
+			MaxLimit:          maxLimit,
+			MaxMetadataKeys:   maxMetadataKeys,
+			MaxMetadataKeyLen: maxMetadataKeyLen,
+		},
+		// FileAudit has no TTL; entries are never removed
+		RetentionDays: nil,
+	})
+	// The same for every user, but requests carry Authorization, so only
+	// the client may cache it
+	response.Headers["Cache-Control"] = fmt.Sprintf("private, max-age=%d", int(metaMaxAge.Seconds()))
+	return response, nil
+}
+
+// actionNames returns the valid actions sorted by name
+func actionNames() []string {
+	names := make([]string, 0, len(validActions))
+	for name := range validActions {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
 
 // handleGetAuditLogs handles GET requests to query audit logs
-func handleGetAuditLogs(ctx context.Context, userID string, queryParams map[string]string) (events.APIGatewayProxyResponse, error) {
+func handleGetAuditLogs(ctx context.Context, userID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	queryParams := request.QueryStringParameters
+
 	// Parse limit
 	limit := defaultLimit
 	if limitStr := queryParams["limit"]; limitStr != "" {
@@ -132,9 +289,30 @@ func handleGetAuditLogs(ctx context.Context, userID string, queryParams map[stri
 		"#timestamp": "timestamp",
 	}
 
-	// Add date range filter if provided
-	startDate := queryParams["startDate"]
-	endDate := queryParams["endDate"]
+	// Add date range filter if provided. Dates and times without an offset
+	// are local to tz (IANA name, default UTC) and converted to UTC bounds.
+	loc := time.UTC
+	if tz := queryParams["tz"]; tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return common.Fail(common.Validation(fmt.Sprintf("Unknown time zone '%s'", tz)))
+		}
+	}
+	startDate, err := parseDateBound(queryParams["startDate"], loc, false)
+	if err != nil {
+		return common.Fail(common.Validation(fmt.Sprintf("Invalid startDate '%s'", queryParams["startDate"])))
+	}
+	endDate, err := parseDateBound(queryParams["endDate"], loc, true)
+	if err != nil {
+		return common.Fail(common.Validation(fmt.Sprintf("Invalid endDate '%s'", queryParams["endDate"])))
+	}
+
+	// An inverted range would silently match nothing
+	if startDate != "" && endDate != "" && startDate > endDate {
+		errs := &common.ValidationErrors{}
+		errs.Add("startDate+endDate", "startDate is after endDate")
+		return common.Fail(errs)
+	}
 
 	if startDate != "" && endDate != "" {
 		keyConditionExpr += " AND #timestamp BETWEEN :startDate AND :endDate"
@@ -148,16 +326,76 @@ func handleGetAuditLogs(ctx context.Context, userID string, queryParams map[stri
 		exprAttrValues[":endDate"] = &types.AttributeValueMemberS{Value: endDate}
 	}
 
-	// Parse next token for pagination
-	var exclusiveStartKey map[string]types.AttributeValue
-	if nextToken := queryParams["nextToken"]; nextToken != "" {
-		decoded, err := base64.StdEncoding.DecodeString(nextToken)
-		if err == nil {
-			var keyMap map[string]interface{}
-			if json.Unmarshal(decoded, &keyMap) == nil {
-				exclusiveStartKey, _ = attributevalue.MarshalMap(keyMap)
+	// Add action filter if provided (repeated or comma-separated), e.g. for a
+	// security dashboard polling access_attempt and delete events across all files
+	var filterExpr string
+	var actions []string
+	if actionParams := common.QueryValues(request, "action"); len(actionParams) > 0 {
+		placeholders := []string{}
+		for _, raw := range actionParams {
+			action := normalizeAction(raw)
+			if _, ok := validActions[action]; !ok {
+				return common.Fail(common.Validation(fmt.Sprintf("Invalid action filter '%s'", raw)))
 			}
+			placeholder := fmt.Sprintf(":action%d", len(placeholders))
+			placeholders = append(placeholders, placeholder)
+			exprAttrValues[placeholder] = &types.AttributeValueMemberS{Value: action}
+			actions = append(actions, action)
+		}
+		exprAttrNames["#action"] = "action"
+		filterExpr = fmt.Sprintf("#action IN (%s)", strings.Join(placeholders, ", "))
+	}
+
+	// Add IP filter if provided, e.g. to find everything done from an address.
+	// The address is stored truncated or hashed as STORE_CLIENT_IP says, so it
+	// goes through the same transform before matching.
+	if rawIP := queryParams["ipAddress"]; rawIP != "" {
+		if net.ParseIP(rawIP) == nil {
+			return common.Fail(common.Validation(fmt.Sprintf("Invalid ipAddress filter '%s'", rawIP)))
+		}
+		ipAddress, ok := common.StoredAuditIP(rawIP)
+		if !ok {
+			return common.Fail(common.Validation("Client IP addresses are not stored (STORE_CLIENT_IP=false)"))
+		}
+		exprAttrNames["#ipAddress"] = "ipAddress"
+		exprAttrValues[":ipAddress"] = &types.AttributeValueMemberS{Value: ipAddress}
+		if filterExpr != "" {
+			filterExpr += " AND "
+		}
+		filterExpr += "#ipAddress = :ipAddress"
+	}
+
+	// Add file filter if provided, for a single file's activity timeline
+	fileID := queryParams["fileId"]
+	if fileID != "" {
+		exprAttrNames["#fileId"] = "fileId"
+		exprAttrValues[":fileId"] = &types.AttributeValueMemberS{Value: fileID}
+		if filterExpr != "" {
+			filterExpr += " AND "
 		}
+		filterExpr += "#fileId = :fileId"
+	}
+
+	// Newest first by default; "load older" keeps paging in the same order
+	order := queryParams["order"]
+	if order == "" {
+		order = orderDesc
+	}
+	if order != orderDesc && order != orderAsc {
+		return common.Fail(common.Validation("Invalid order: must be one of asc, desc"))
+	}
+
+	// Parse next token for pagination. Restarting from the top on a bad token
+	// would repeat entries the client already has, so it is rejected instead.
+	scope := cursorScope(order, fileID)
+	exclusiveStartKey, err := decodeAuditToken(queryParams["nextToken"], userID, scope)
+	if errors.Is(err, errTokenScope) {
+		errs := &common.ValidationErrors{}
+		errs.Add("nextToken", "nextToken was issued with a different order or fileId; repeat them as in the request that returned it")
+		return common.Fail(errs)
+	}
+	if err != nil {
+		return common.Fail(common.Validation("Invalid nextToken"))
 	}
 
 	// Query DynamoDB
@@ -168,59 +406,191 @@ func handleGetAuditLogs(ctx context.Context, userID string, queryParams map[stri
 		ExpressionAttributeValues: exprAttrValues,
 		Limit:                     aws.Int32(int32(limit)),
 		ExclusiveStartKey:         exclusiveStartKey,
-		ScanIndexForward:          aws.Bool(false), // Most recent first
+		ScanIndexForward:          aws.Bool(order == orderAsc),
+	}
+	if filterExpr != "" {
+		input.FilterExpression = aws.String(filterExpr)
 	}
 
-	result, err := dynamoClient.Query(ctx, input)
+	// Skip pages the filter emptied so clients don't mistake them for the end
+	items, lastKey, err := common.QueryPage(ctx, queryClient, input, maxFilteredPages)
 	if err != nil {
-		log.Printf("DynamoDB query error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+		return common.Fail(common.Internal("DynamoDB query error", err))
 	}
 
 	// Unmarshal items
 	var auditLogs []AuditEntry
-	if err := attributevalue.UnmarshalListOfMaps(result.Items, &auditLogs); err != nil {
-		log.Printf("Unmarshal error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+	if err := attributevalue.UnmarshalListOfMaps(items, &auditLogs); err != nil {
+		return common.Fail(common.Internal("Unmarshal error", err))
+	}
+	for i := range auditLogs {
+		auditLogs[i].CorrelationID, _ = auditLogs[i].Metadata["correlationId"].(string)
 	}
 
 	// Build next token
 	var nextToken *string
-	if result.LastEvaluatedKey != nil {
-		var keyMap map[string]interface{}
-		if attributevalue.UnmarshalMap(result.LastEvaluatedKey, &keyMap) == nil {
-			if encoded, err := json.Marshal(keyMap); err == nil {
-				token := base64.StdEncoding.EncodeToString(encoded)
-				nextToken = &token
-			}
-		}
+	if token, err := encodeAuditToken(lastKey, scope); err != nil {
+		log.Printf("Token encode error: %v", err)
+	} else if token != "" {
+		nextToken = &token
 	}
 
 	response := AuditListResponse{
 		AuditLogs: auditLogs,
 		Count:     len(auditLogs),
 		NextToken: nextToken,
+		HasMore:   nextToken != nil,
+	}
+
+	// Report per-action counts for the page when filtering by action
+	if len(actions) > 0 {
+		response.ActionCounts = make(map[string]int, len(actions))
+		for _, action := range actions {
+			response.ActionCounts[action] = 0
+		}
+		for _, entry := range auditLogs {
+			response.ActionCounts[entry.Action]++
+		}
 	}
 
 	return common.BuildResponse(200, response), nil
 }
 
+// handleActivity returns the caller's most recent events for a dashboard,
+// uploads, downloads and deletes unless ?action= picks others, each with the
+// current name and status of its file
+func handleActivity(ctx context.Context, userID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	limit := defaultLimit
+	if limitStr := request.QueryStringParameters["limit"]; limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
+			limit = parsedLimit
+		}
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+
+	actions := activityActions
+	if actionParams := common.QueryValues(request, "action"); len(actionParams) > 0 {
+		actions = nil
+		for _, raw := range actionParams {
+			action := normalizeAction(raw)
+			if _, ok := validActions[action]; !ok {
+				return common.Fail(common.Validation(fmt.Sprintf("Invalid action filter '%s'", raw)))
+			}
+			actions = append(actions, action)
+		}
+	}
+
+	entries, err := recentEntries(ctx, userID, actions, limit)
+	if err != nil {
+		return common.Fail(common.Internal("DynamoDB query error", err))
+	}
+
+	// Entries not tied to one file, such as exports, have fileId "*"
+	var fileIDs []string
+	for _, entry := range entries {
+		if entry.FileID != "*" {
+			fileIDs = append(fileIDs, entry.FileID)
+		}
+	}
+	files, err := common.GetOwnedFiles(ctx, batchClient, userFilesTable, userID, fileIDs)
+	incomplete := false
+	switch {
+	case errors.Is(err, common.ErrIncompleteBatch):
+		log.Printf("Activity feed incomplete: %v", err)
+		incomplete = true
+	case err != nil:
+		return common.Fail(common.Internal("DynamoDB batch get error", err))
+	}
+
+	activity := make([]ActivityItem, len(entries))
+	for i, entry := range entries {
+		activity[i] = ActivityItem{
+			Timestamp: entry.Timestamp,
+			Action:    entry.Action,
+			FileID:    entry.FileID,
+		}
+		activity[i].FileName, _ = entry.Metadata["fileName"].(string)
+		if file, ok := files[entry.FileID]; ok {
+			activity[i].File = &ActivityFile{FileName: file.FileName, Status: file.Status}
+		}
+	}
+
+	return common.BuildResponse(200, ActivityResponse{
+		Activity:   activity,
+		Count:      len(activity),
+		Incomplete: incomplete,
+	}), nil
+}
+
+// recentEntries reads up to limit of userID's newest entries with one of
+// actions. The filter is applied after each page is read, so it follows
+// LastEvaluatedKey for at most maxFilteredPages pages.
+func recentEntries(ctx context.Context, userID string, actions []string, limit int) ([]AuditEntry, error) {
+	exprAttrValues := map[string]types.AttributeValue{
+		":userId": &types.AttributeValueMemberS{Value: userID},
+	}
+	placeholders := make([]string, len(actions))
+	for i, action := range actions {
+		placeholders[i] = fmt.Sprintf(":action%d", i)
+		exprAttrValues[placeholders[i]] = &types.AttributeValueMemberS{Value: action}
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(fileAuditTable),
+		KeyConditionExpression:    aws.String("userId = :userId"),
+		FilterExpression:          aws.String(fmt.Sprintf("#action IN (%s)", strings.Join(placeholders, ", "))),
+		ExpressionAttributeNames:  map[string]string{"#action": "action"},
+		ExpressionAttributeValues: exprAttrValues,
+		Limit:                     aws.Int32(int32(limit)),
+		ScanIndexForward:          aws.Bool(false),
+	}
+
+	var entries []AuditEntry
+	for page := 0; page < maxFilteredPages && len(entries) < limit; page++ {
+		opCtx, cancel := common.WithDeadline(ctx)
+		result, err := queryClient.Query(opCtx, input)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+
+		var items []AuditEntry
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &items); err != nil {
+			return nil, err
+		}
+		entries = append(entries, items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
 // handleCreateAuditLog handles POST requests to create audit logs
 func handleCreateAuditLog(ctx context.Context, userID string, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	// Parse request body
 	var req AuditRequest
 	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
-		return common.BuildErrorResponse(400, "Invalid request body"), nil
+		return common.Fail(common.Validation("Invalid request body"))
 	}
 
-	// Validate required fields
-	if req.FileID == "" || req.Action == "" {
-		return common.BuildErrorResponse(400, "Missing required fields: fileId, action"), nil
+	// Validate all fields, reporting every problem at once
+	if errs := validateAuditRequest(&req); errs.HasErrors() {
+		return common.Fail(errs)
 	}
 
-	// Validate action type
-	if !validActions[req.Action] {
-		return common.BuildErrorResponse(400, "Invalid action. Must be one of: view, download, upload, delete, share, access_attempt"), nil
+	// Entries can only be made about the caller's own files, trash included
+	exists, _, err := common.FileExists(ctx, fileClient, userFilesTable, userID, req.FileID)
+	if err != nil {
+		return common.Fail(common.Internal("DynamoDB get error", err))
+	}
+	if !exists {
+		return common.Fail(common.NotFound("File not found"))
 	}
 
 	// Build metadata with IP and user agent
@@ -229,11 +599,8 @@ func handleCreateAuditLog(ctx context.Context, userID string, request events.API
 		metadata = make(map[string]interface{})
 	}
 
-	ipAddress := request.RequestContext.Identity.SourceIP
-	if ipAddress == "" {
-		ipAddress = "unknown"
-	}
-	metadata["ipAddress"] = ipAddress
+	// Stored, truncated, hashed or dropped according to STORE_CLIENT_IP
+	ipAddress := common.SetAuditIP(metadata, request.RequestContext.Identity.SourceIP)
 
 	userAgent := request.Headers["User-Agent"]
 	if userAgent == "" {
@@ -244,6 +611,11 @@ func handleCreateAuditLog(ctx context.Context, userID string, request events.API
 	}
 	metadata["userAgent"] = userAgent
 
+	// Coarse location of the caller; lookup failures record "unknown"
+	metadata["geo"] = common.ResolveGeo(ctx, request.RequestContext.Identity.SourceIP)
+	// Ties the entry to this request's logs; a client-supplied value is replaced
+	common.SetCorrelationID(ctx, metadata)
+
 	// Create audit entry
 	timestamp := time.Now().UTC().Format(time.RFC3339)
 	entry := AuditEntry{
@@ -252,21 +624,22 @@ func handleCreateAuditLog(ctx context.Context, userID string, request events.API
 		FileID:    req.FileID,
 		Action:    req.Action,
 		Metadata:  metadata,
+		IPAddress: ipAddress,
 	}
 
 	item, err := attributevalue.MarshalMap(entry)
 	if err != nil {
-		log.Printf("Marshal error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+		return common.Fail(common.Internal("Marshal error", err))
 	}
 
-	_, err = dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+	opCtx, cancel := common.WithDeadline(ctx)
+	_, err = dynamoClient.PutItem(opCtx, &dynamodb.PutItemInput{
 		TableName: aws.String(fileAuditTable),
 		Item:      item,
 	})
+	cancel()
 	if err != nil {
-		log.Printf("DynamoDB put error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+		return common.Fail(common.Internal("DynamoDB put error", err))
 	}
 
 	response := AuditCreateResponse{
@@ -282,6 +655,121 @@ func handleCreateAuditLog(ctx context.Context, userID string, request events.API
 	return common.BuildResponse(201, response), nil
 }
 
+// validateAuditRequest checks every field of the request and normalizes the action
+func validateAuditRequest(req *AuditRequest) *common.ValidationErrors {
+	errs := &common.ValidationErrors{}
+
+	if req.FileID == "" {
+		errs.Add("fileId", "is required")
+	}
+
+	if req.Action == "" {
+		errs.Add("action", "is required")
+	} else {
+		req.Action = normalizeAction(req.Action)
+		if _, ok := validActions[req.Action]; !ok {
+			errs.Add("action", "must be one of: "+strings.Join(actionNames(), ", "))
+		}
+	}
+
+	if len(req.Metadata) > maxMetadataKeys {
+		errs.Addf("metadata", "must have at most %d keys", maxMetadataKeys)
+	}
+	for key := range req.Metadata {
+		if key == "" || len(key) > maxMetadataKeyLen {
+			errs.Addf("metadata."+key, "key must be 1-%d characters", maxMetadataKeyLen)
+		}
+	}
+
+	return errs
+}
+
+// cursorScope identifies the ordering and file filter a nextToken was issued
+// for. A token resumes the query right after its key, so using it with
+// another order or file would skip or repeat entries.
+func cursorScope(order, fileID string) string {
+	return order + "|" + fileID
+}
+
+// encodeAuditToken encodes lastKey together with the query's scope
+func encodeAuditToken(lastKey map[string]types.AttributeValue, scope string) (string, error) {
+	if len(lastKey) == 0 {
+		return "", nil
+	}
+	key := make(map[string]types.AttributeValue, len(lastKey)+1)
+	for name, value := range lastKey {
+		key[name] = value
+	}
+	key[cursorScopeKey] = &types.AttributeValueMemberS{Value: scope}
+	return common.EncodeToken(key)
+}
+
+// errTokenScope is returned by decodeAuditToken for a token of the caller
+// issued with another order or fileId
+var errTokenScope = errors.New("nextToken issued for another scope")
+
+// decodeAuditToken decodes a nextToken into an ExclusiveStartKey. It fails
+// for tokens minted for another user's partition, and with errTokenScope for
+// another scope.
+func decodeAuditToken(token, userID, scope string) (map[string]types.AttributeValue, error) {
+	key, err := common.DecodeToken(token)
+	if err != nil || key == nil {
+		return key, err
+	}
+	if common.TokenOwner(key) != userID {
+		return nil, common.ErrInvalidToken
+	}
+	v, ok := key[cursorScopeKey].(*types.AttributeValueMemberS)
+	if !ok {
+		return nil, common.ErrInvalidToken
+	}
+	if v.Value != scope {
+		return nil, errTokenScope
+	}
+	delete(key, cursorScopeKey)
+	return key, nil
+}
+
+// localLayouts are the accepted date formats without an offset, interpreted
+// in the caller's time zone
+var localLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// parseDateBound converts a startDate or endDate to the UTC RFC3339 form
+// timestamps are stored in. Values with an offset keep it; others are read
+// in loc. A bare date covers the whole local day, so as an end bound it
+// becomes the last second of that day. An empty value stays empty.
+func parseDateBound(value string, loc *time.Location, end bool) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC().Format(time.RFC3339), nil
+	}
+
+	for _, layout := range localLayouts {
+		t, err := time.ParseInLocation(layout, value, loc)
+		if err != nil {
+			continue
+		}
+		if end && layout == "2006-01-02" {
+			// Midnight of the next local day, which may be 23 or 25 hours away
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc).Add(-time.Second)
+		}
+		return t.UTC().Format(time.RFC3339), nil
+	}
+	return "", fmt.Errorf("unrecognized date %q", value)
+}
+
+// normalizeAction lowercases and trims an action name and resolves aliases
+// to the canonical action stored in the audit table
+func normalizeAction(action string) string {
+	action = strings.ToLower(strings.TrimSpace(action))
+	if canonical, ok := actionAliases[action]; ok {
+		return canonical
+	}
+	return action
+}
+
 func main() {
 	lambda.Start(Handler)
 }
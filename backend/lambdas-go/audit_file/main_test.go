@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+func TestParseDateBound(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		loc   *time.Location
+		end   bool
+		want  string
+	}{
+		{"empty", "", time.UTC, false, ""},
+		{"utc date start", "2024-03-10", time.UTC, false, "2024-03-10T00:00:00Z"},
+		{"utc date end", "2024-03-10", time.UTC, true, "2024-03-10T23:59:59Z"},
+		{"offset kept", "2024-03-10T12:00:00+02:00", newYork, false, "2024-03-10T10:00:00Z"},
+		{"local time", "2024-01-15T09:30", newYork, false, "2024-01-15T14:30:00Z"},
+		// DST starts 2024-03-10 at 02:00 EST, so the local day is 23 hours long
+		{"spring forward start", "2024-03-10", newYork, false, "2024-03-10T05:00:00Z"},
+		{"spring forward end", "2024-03-10", newYork, true, "2024-03-11T03:59:59Z"},
+		{"after spring forward", "2024-03-10T12:00:00", newYork, false, "2024-03-10T16:00:00Z"},
+		// DST ends 2024-11-03 at 02:00 EDT, so the local day is 25 hours long
+		{"fall back start", "2024-11-03", newYork, false, "2024-11-03T04:00:00Z"},
+		{"fall back end", "2024-11-03", newYork, true, "2024-11-04T04:59:59Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDateBound(tt.value, tt.loc, tt.end)
+			if err != nil {
+				t.Fatalf("parseDateBound error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseDateBound(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDateBoundInvalid(t *testing.T) {
+	for _, value := range []string{"yesterday", "2024-13-01", "03/10/2024"} {
+		if _, err := parseDateBound(value, time.UTC, false); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
+
+// fakeAuditTable simulates a Query over one user's FileAudit partition:
+// sort by timestamp, resume after ExclusiveStartKey, evaluate Limit items,
+// then apply the fileId filter
+type fakeAuditTable struct {
+	items []map[string]types.AttributeValue // ascending by timestamp
+}
+
+func (f *fakeAuditTable) Query(ctx context.Context, in *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	ordered := append([]map[string]types.AttributeValue(nil), f.items...)
+	if !aws.ToBool(in.ScanIndexForward) {
+		sort.SliceStable(ordered, func(i, j int) bool { return attr(ordered[i], "timestamp") > attr(ordered[j], "timestamp") })
+	}
+
+	start := 0
+	if in.ExclusiveStartKey != nil {
+		for i, item := range ordered {
+			if attr(item, "timestamp") == attr(in.ExclusiveStartKey, "timestamp") {
+				start = i + 1
+			}
+		}
+	}
+
+	end := start + int(aws.ToInt32(in.Limit))
+	if end > len(ordered) {
+		end = len(ordered)
+	}
+
+	out := &dynamodb.QueryOutput{}
+	for _, item := range ordered[start:end] {
+		if want, ok := in.ExpressionAttributeValues[":fileId"]; ok && attr(item, "fileId") != want.(*types.AttributeValueMemberS).Value {
+			continue
+		}
+		if !matchesActions(in, attr(item, "action")) {
+			continue
+		}
+		out.Items = append(out.Items, item)
+	}
+	if end < len(ordered) {
+		last := ordered[end-1]
+		out.LastEvaluatedKey = map[string]types.AttributeValue{"userId": last["userId"], "timestamp": last["timestamp"]}
+	}
+	return out, nil
+}
+
+// matchesActions evaluates the action IN (...) filter, if the query has one
+func matchesActions(in *dynamodb.QueryInput, action string) bool {
+	filtered := false
+	for name, value := range in.ExpressionAttributeValues {
+		if strings.HasPrefix(name, ":action") {
+			filtered = true
+			if value.(*types.AttributeValueMemberS).Value == action {
+				return true
+			}
+		}
+	}
+	return !filtered
+}
+
+func attr(item map[string]types.AttributeValue, name string) string {
+	if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func auditItem(i int, fileID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":    &types.AttributeValueMemberS{Value: "user-123"},
+		"timestamp": &types.AttributeValueMemberS{Value: time.Date(2024, 1, 1, 0, 0, i, 0, time.UTC).Format(time.RFC3339)},
+		"fileId":    &types.AttributeValueMemberS{Value: fileID},
+		"action":    &types.AttributeValueMemberS{Value: "view"},
+	}
+}
+
+func getAuditPage(t *testing.T, params map[string]string) AuditListResponse {
+	t.Helper()
+	response, err := handleGetAuditLogs(context.Background(), "user-123", events.APIGatewayProxyRequest{QueryStringParameters: params})
+	if err != nil {
+		t.Fatalf("handleGetAuditLogs error: %v", err)
+	}
+	var body AuditListResponse
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("response body is not JSON: %v", err)
+	}
+	return body
+}
+
+func TestFileTimelineLoadsOlderPages(t *testing.T) {
+	defer func(client common.QueryAPI) { queryClient = client }(queryClient)
+
+	// 30 entries, every third one for file-a, interleaved with other files
+	table := &fakeAuditTable{}
+	var want []string
+	for i := 0; i < 30; i++ {
+		fileID := "file-b"
+		if i%3 == 0 {
+			fileID = "file-a"
+			want = append([]string{attr(auditItem(i, ""), "timestamp")}, want...) // newest first
+		}
+		table.items = append(table.items, auditItem(i, fileID))
+	}
+	queryClient = table
+
+	params := map[string]string{"fileId": "file-a", "limit": "4"}
+	var got []string
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("timeline did not end")
+		}
+		page := getAuditPage(t, params)
+		for _, entry := range page.AuditLogs {
+			if entry.FileID != "file-a" {
+				t.Fatalf("entry for %s in file-a's timeline", entry.FileID)
+			}
+			got = append(got, entry.Timestamp)
+		}
+		if !page.HasMore {
+			break
+		}
+		params["nextToken"] = *page.NextToken
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("timeline =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestAuditTokenScope(t *testing.T) {
+	defer func(client common.QueryAPI) { queryClient = client }(queryClient)
+	table := &fakeAuditTable{}
+	for i := 0; i < 10; i++ {
+		table.items = append(table.items, auditItem(i, "file-a"))
+	}
+	queryClient = table
+
+	page := getAuditPage(t, map[string]string{"fileId": "file-a", "limit": "3"})
+	if page.NextToken == nil {
+		t.Fatal("expected a nextToken")
+	}
+
+	for name, params := range map[string]map[string]string{
+		"other order": {"fileId": "file-a", "order": "asc", "nextToken": *page.NextToken},
+		"other file":  {"fileId": "file-b", "nextToken": *page.NextToken},
+		"no filter":   {"nextToken": *page.NextToken},
+	} {
+		_, err := handleGetAuditLogs(context.Background(), "user-123", events.APIGatewayProxyRequest{QueryStringParameters: params})
+		if err == nil {
+			t.Errorf("%s: token accepted outside its scope", name)
+		}
+	}
+
+	_, err := handleGetAuditLogs(context.Background(), "user-999", events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"fileId": "file-a", "nextToken": *page.NextToken},
+	})
+	if err == nil {
+		t.Error("token accepted for another user")
+	}
+}
+
+func TestRoutesRejectOtherMethods(t *testing.T) {
+	response, err := routes.Serve(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "DELETE", Path: "/audit/"})
+	if err != nil {
+		t.Fatalf("Serve() error: %v", err)
+	}
+	if response.StatusCode != 405 {
+		t.Errorf("status = %d, want 405", response.StatusCode)
+	}
+	if got := response.Headers["Allow"]; got != "GET, POST" {
+		t.Errorf("Allow = %q, want GET, POST", got)
+	}
+}
+
+func TestAuditMetaListsValidActions(t *testing.T) {
+	response, err := routes.Serve(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/audit/meta"})
+	if err != nil {
+		t.Fatalf("Serve() error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("status = %d, want 200", response.StatusCode)
+	}
+	if got := response.Headers["Cache-Control"]; got != "private, max-age=3600" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+
+	var meta AuditMetaResponse
+	if err := json.Unmarshal([]byte(response.Body), &meta); err != nil {
+		t.Fatalf("body: %v", err)
+	}
+	if len(meta.Actions) != len(validActions) {
+		t.Fatalf("actions = %d, want %d", len(meta.Actions), len(validActions))
+	}
+	for i, info := range meta.Actions {
+		if i > 0 && meta.Actions[i-1].Action >= info.Action {
+			t.Errorf("actions not sorted at %s", info.Action)
+		}
+		if info.Description == "" {
+			t.Errorf("action %s has no description", info.Action)
+		}
+	}
+	if meta.Limits.MaxLimit != maxLimit || meta.Aliases["rm"] != "delete" || meta.RetentionDays != nil {
+		t.Errorf("meta = %+v", meta)
+	}
+}
+
+func TestAuditLogsSurfaceCorrelationID(t *testing.T) {
+	defer func(client common.QueryAPI) { queryClient = client }(queryClient)
+
+	traced := auditItem(1, "file-a")
+	traced["metadata"] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+		"correlationId": &types.AttributeValueMemberS{Value: "req-1"},
+	}}
+	queryClient = &fakeAuditTable{items: []map[string]types.AttributeValue{auditItem(0, "file-a"), traced}}
+
+	page := getAuditPage(t, nil)
+	if len(page.AuditLogs) != 2 {
+		t.Fatalf("got %d entries, want 2", len(page.AuditLogs))
+	}
+	if got := page.AuditLogs[0].CorrelationID; got != "req-1" {
+		t.Errorf("correlationId = %q, want req-1", got)
+	}
+	if got := page.AuditLogs[1].CorrelationID; got != "" {
+		t.Errorf("correlationId of an older entry = %q, want none", got)
+	}
+}
+
+func TestAuditRejectsMalformedTokens(t *testing.T) {
+	defer func(client common.QueryAPI) { queryClient = client }(queryClient)
+	t.Setenv("PAGINATION_TOKEN_SECRET", "test-secret")
+	table := &fakeAuditTable{}
+	for i := 0; i < 10; i++ {
+		table.items = append(table.items, auditItem(i, "file-a"))
+	}
+	queryClient = table
+
+	page := getAuditPage(t, map[string]string{"limit": "3"})
+	if page.NextToken == nil {
+		t.Fatal("expected a nextToken")
+	}
+	valid := *page.NextToken
+	payload, signature, _ := strings.Cut(valid, ".")
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		t.Fatalf("token payload is not base64: %v", err)
+	}
+	// The same cursor moved into another user's partition, keeping the signature
+	otherUser := base64.StdEncoding.EncodeToString([]byte(strings.Replace(string(decoded), "user-123", "user-999", 1)))
+
+	handler := common.HandleErrors(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return handleGetAuditLogs(ctx, "user-123", request)
+	})
+	for name, token := range map[string]string{
+		"not base64":     "%%%not-base64%%%",
+		"not json":       base64.StdEncoding.EncodeToString([]byte("not json")),
+		"json array":     base64.StdEncoding.EncodeToString([]byte(`["user-123"]`)),
+		"unsigned":       payload,
+		"bad signature":  payload + ".AAAA",
+		"other user":     otherUser + "." + signature,
+		"truncated":      valid[:len(valid)/2],
+		"trailing bytes": valid + "x",
+	} {
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+			QueryStringParameters: map[string]string{"limit": "3", "nextToken": token},
+		})
+		if err != nil || response.StatusCode != 400 {
+			t.Errorf("%s: status %d, %v; want 400", name, response.StatusCode, err)
+		}
+	}
+
+	// Restarting from the top instead would repeat entries, so only the
+	// untouched token resumes
+	next := getAuditPage(t, map[string]string{"limit": "3", "nextToken": valid})
+	if len(next.AuditLogs) == 0 || next.AuditLogs[0].Timestamp >= page.AuditLogs[len(page.AuditLogs)-1].Timestamp {
+		t.Errorf("valid token did not resume after the first page: %+v", next.AuditLogs)
+	}
+}
+
+// noFiles is a UserFiles table without any file
+type noFiles struct{ projection string }
+
+func (f *noFiles) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.projection = aws.ToString(params.ProjectionExpression)
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func TestCreateAuditLogRequiresOwnedFile(t *testing.T) {
+	defer func(client common.GetItemAPI) { fileClient = client }(fileClient)
+	files := &noFiles{}
+	fileClient = files
+
+	handler := common.HandleErrors(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return handleCreateAuditLog(ctx, "user-123", request)
+	})
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{Body: `{"fileId":"someone-elses","action":"view"}`})
+	if err != nil || response.StatusCode != 404 {
+		t.Errorf("status %d, %v; want 404", response.StatusCode, err)
+	}
+	if files.projection != "#status" {
+		t.Errorf("projection = %q, want only status", files.projection)
+	}
+}
+
+// activityFiles is a UserFiles table answering BatchGetItem
+type activityFiles struct {
+	items map[string]map[string]types.AttributeValue
+}
+
+func (f *activityFiles) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	out := &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{}}
+	for table, req := range params.RequestItems {
+		for _, key := range req.Keys {
+			if item, ok := f.items[attr(key, "fileId")]; ok {
+				out.Responses[table] = append(out.Responses[table], item)
+			}
+		}
+	}
+	return out, nil
+}
+
+func TestActivityFeed(t *testing.T) {
+	defer func(client common.QueryAPI) { queryClient = client }(queryClient)
+	defer func(client common.BatchGetItemAPI) { batchClient = client }(batchClient)
+
+	event := func(i int, fileID, action, fileName string) map[string]types.AttributeValue {
+		item := auditItem(i, fileID)
+		item["action"] = &types.AttributeValueMemberS{Value: action}
+		item["metadata"] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			"fileName": &types.AttributeValueMemberS{Value: fileName},
+		}}
+		return item
+	}
+	queryClient = &fakeAuditTable{items: []map[string]types.AttributeValue{
+		event(1, "file-a", "upload", "a.txt"),
+		event(2, "file-gone", "download", "gone.txt"),
+		event(3, "file-a", "view", "a.txt"),
+		event(4, "file-b", "delete", "b.txt"),
+	}}
+	batchClient = &activityFiles{items: map[string]map[string]types.AttributeValue{
+		"file-a": {
+			"userId":   &types.AttributeValueMemberS{Value: "user-123"},
+			"fileId":   &types.AttributeValueMemberS{Value: "file-a"},
+			"fileName": &types.AttributeValueMemberS{Value: "renamed.txt"},
+			"status":   &types.AttributeValueMemberS{Value: "uploaded"},
+		},
+		"file-b": {
+			"userId":   &types.AttributeValueMemberS{Value: "user-123"},
+			"fileId":   &types.AttributeValueMemberS{Value: "file-b"},
+			"fileName": &types.AttributeValueMemberS{Value: "b.txt"},
+			"status":   &types.AttributeValueMemberS{Value: common.StatusDeleted},
+		},
+	}}
+
+	response, err := handleActivity(context.Background(), "user-123", events.APIGatewayProxyRequest{QueryStringParameters: map[string]string{"limit": "2"}})
+	if err != nil {
+		t.Fatalf("handleActivity error: %v", err)
+	}
+	var body ActivityResponse
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("response body is not JSON: %v", err)
+	}
+
+	if body.Count != 2 || len(body.Activity) != 2 {
+		t.Fatalf("activity = %+v, want the 2 newest feed events", body.Activity)
+	}
+	deleted, downloaded := body.Activity[0], body.Activity[1]
+	if deleted.Action != "delete" || deleted.File == nil || deleted.File.Status != common.StatusDeleted {
+		t.Errorf("first item = %+v, want the delete of file-b in trash", deleted)
+	}
+	if downloaded.Action != "download" || downloaded.File != nil || downloaded.FileName != "gone.txt" {
+		t.Errorf("second item = %+v, want the download of a file that no longer exists", downloaded)
+	}
+
+	response, err = handleActivity(context.Background(), "user-123", events.APIGatewayProxyRequest{QueryStringParameters: map[string]string{"action": "upload"}})
+	if err != nil {
+		t.Fatalf("handleActivity error: %v", err)
+	}
+	body = ActivityResponse{}
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("response body is not JSON: %v", err)
+	}
+	if body.Count != 1 || body.Activity[0].File == nil || body.Activity[0].File.FileName != "renamed.txt" {
+		t.Errorf("upload feed = %+v, want file-a with its current name", body.Activity)
+	}
+}
+
+func TestAuditRejectsConflictingParams(t *testing.T) {
+	defer func(client common.QueryAPI) { queryClient = client }(queryClient)
+	table := &fakeAuditTable{}
+	for i := 0; i < 10; i++ {
+		table.items = append(table.items, auditItem(i, "file-a"))
+	}
+	queryClient = table
+
+	page := getAuditPage(t, map[string]string{"limit": "3"})
+	if page.NextToken == nil {
+		t.Fatal("expected a nextToken")
+	}
+
+	handler := common.HandleErrors(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return handleGetAuditLogs(ctx, "user-123", request)
+	})
+	tests := []struct {
+		name   string
+		params map[string]string
+		field  string
+	}{
+		{"inverted range", map[string]string{"startDate": "2024-03-10", "endDate": "2024-03-09"}, "startDate+endDate"},
+		{"token of another order", map[string]string{"order": "asc", "nextToken": *page.NextToken}, "nextToken"},
+		{"token of another file", map[string]string{"fileId": "file-a", "nextToken": *page.NextToken}, "nextToken"},
+	}
+	for _, tt := range tests {
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{QueryStringParameters: tt.params})
+		if err != nil || response.StatusCode != 400 {
+			t.Errorf("%s: status %d, %v; want 400", tt.name, response.StatusCode, err)
+			continue
+		}
+		var body common.ValidationErrorResponse
+		if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+			t.Fatalf("%s: body is not JSON: %v", tt.name, err)
+		}
+		if len(body.Errors) != 1 || body.Errors[0].Field != tt.field {
+			t.Errorf("%s: errors = %+v, want one for %s", tt.name, body.Errors, tt.field)
+		}
+	}
+
+	// A one-day range is not inverted
+	if got := getAuditPage(t, map[string]string{"startDate": "2024-01-01", "endDate": "2024-01-01"}); got.Count == 0 {
+		t.Error("same-day range matched nothing")
+	}
+}
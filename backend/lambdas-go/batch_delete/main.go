@@ -0,0 +1,552 @@
+// Package main implements the batch_delete Lambda function
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	maxFileIDs     = 100
+	maxConcurrency = 10
+	// maxTagFilters bounds the tags of one filter, as in get_files
+	maxTagFilters = 10
+
+	// maxSelected bounds how many matching files one filter request deletes;
+	// the client repeats the request with the selectionToken for the rest
+	maxSelected = 500
+	// maxPreviewMatches bounds how many matching files a dry run counts
+	maxPreviewMatches = 5000
+	// selectionPageSize and maxSelectionPages bound the reads of one request
+	selectionPageSize = 200
+	maxSelectionPages = 50
+
+	// selectionScopeKey binds a selectionToken to the filter it was issued for
+	selectionScopeKey = "selectionScope"
+)
+
+// Outcomes of a delete. Only outcomeDeleted changes the file; dry runs
+// report outcomeWouldDelete instead.
+const (
+	outcomeDeleted        = "deleted"
+	outcomeWouldDelete    = "would_delete"
+	outcomeNotFound       = "not_found"
+	outcomeAlreadyDeleted = "already_deleted"
+	outcomeLegalHold      = "legal_hold"
+	outcomeError          = "error"
+)
+
+// BatchDeleteRequest represents the request body. Exactly one of fileIds and
+// filter must be given.
+type BatchDeleteRequest struct {
+	FileIDs []string `json:"fileIds"`
+	// Filter selects every matching non-deleted file instead of listing them
+	Filter *SelectionFilter `json:"filter"`
+	// SelectionToken continues a filter delete that stopped at maxSelected.
+	// It is only valid with the same filter.
+	SelectionToken string `json:"selectionToken"`
+	// DryRun reports what would be deleted without changing anything
+	DryRun bool `json:"dryRun"`
+}
+
+// SelectionFilter selects files like the get_files and browse_folder
+// parameters. At least one criterion is required.
+type SelectionFilter struct {
+	// Folder matches files directly in it; "" is the root. Unset matches
+	// every folder.
+	Folder *string `json:"folder"`
+	// IncludeSubfolders also matches files in folders below Folder
+	IncludeSubfolders bool `json:"includeSubfolders"`
+	// Tags are key or key:value, all of which a file must have
+	Tags []string `json:"tags"`
+}
+
+// BatchDeleteResponse represents the response body
+type BatchDeleteResponse struct {
+	// Results has one entry per file, except for filter dry runs, which can
+	// match thousands of files and only report counts
+	Results []DeleteResult `json:"results,omitempty"`
+	// Counts is the number of files per outcome
+	Counts map[string]int `json:"counts"`
+	// Matched is the number of files the filter selected in this request
+	Matched int  `json:"matched"`
+	DryRun  bool `json:"dryRun,omitempty"`
+	// BytesFreed is the storage a dry run would reclaim once purged
+	BytesFreed int64 `json:"bytesFreed,omitempty"`
+	// SelectionToken is set when a filter delete stopped before reaching the
+	// last matching file
+	SelectionToken *string `json:"selectionToken,omitempty"`
+	// HasMore is true when more files may match: call again with the
+	// selectionToken, or for a dry run, Counts is only a lower bound
+	HasMore bool `json:"hasMore"`
+}
+
+// DeleteResult is the outcome for one file
+type DeleteResult struct {
+	FileID   string `json:"fileId"`
+	Outcome  string `json:"outcome"`
+	FileName string `json:"fileName,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// fileSize adds up to BytesFreed in dry runs
+	fileSize int64
+}
+
+var (
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+	// queryClient runs the selection queries; tests replace it
+	queryClient common.QueryAPI
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable, Geo: true}
+	queryClient = dynamoClient
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleBatchDelete)
+
+// handleBatchDelete handles an authenticated request
+func handleBatchDelete(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req BatchDeleteRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+
+	fileIDs, errs := validateBatchDeleteRequest(&req)
+	if errs.HasErrors() {
+		return common.Fail(errs)
+	}
+
+	response := BatchDeleteResponse{Counts: map[string]int{}, DryRun: req.DryRun}
+
+	if req.Filter == nil {
+		// Failures are reported per file so one bad file doesn't hide the others
+		response.Results = runAll(len(fileIDs), func(i int) DeleteResult {
+			return deleteByID(ctx, userID, fileIDs[i], req.DryRun)
+		})
+	} else {
+		scope := selectionScope(req.Filter)
+		startKey, err := decodeSelectionToken(req.SelectionToken, userID, scope)
+		if err != nil {
+			return common.Fail(common.Validation("Invalid selectionToken"))
+		}
+
+		limit := maxSelected
+		if req.DryRun {
+			limit = maxPreviewMatches
+		}
+		files, lastKey, err := selectFiles(ctx, userID, req.Filter, startKey, limit)
+		if err != nil {
+			return common.Fail(common.Internal("DynamoDB query error", err))
+		}
+		response.Matched = len(files)
+		response.HasMore = lastKey != nil
+
+		response.Results = runAll(len(files), func(i int) DeleteResult {
+			return deleteFile(ctx, userID, &files[i], req.DryRun, true)
+		})
+
+		if lastKey != nil && !req.DryRun {
+			token, err := encodeSelectionToken(lastKey, scope)
+			if err != nil {
+				return common.Fail(common.Internal("Token encode error", err))
+			}
+			response.SelectionToken = &token
+		}
+	}
+
+	for _, result := range response.Results {
+		response.Counts[result.Outcome]++
+		if result.Outcome == outcomeWouldDelete {
+			response.BytesFreed += result.fileSize
+		}
+	}
+	if req.DryRun && req.Filter != nil {
+		response.Results = nil
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// validateBatchDeleteRequest checks the request, normalizing the filter, and
+// returns the de-duplicated file IDs
+func validateBatchDeleteRequest(req *BatchDeleteRequest) ([]string, *common.ValidationErrors) {
+	errs := &common.ValidationErrors{}
+
+	switch {
+	case len(req.FileIDs) > 0 && req.Filter != nil:
+		errs.Add("filter", "must not be combined with fileIds")
+		return nil, errs
+	case req.Filter != nil:
+		validateFilter(req.Filter, errs)
+		return nil, errs
+	case req.SelectionToken != "":
+		errs.Add("selectionToken", "requires filter")
+		return nil, errs
+	case len(req.FileIDs) == 0:
+		errs.Add("fileIds", "is required unless filter is given")
+		return nil, errs
+	}
+
+	seen := make(map[string]bool, len(req.FileIDs))
+	fileIDs := make([]string, 0, len(req.FileIDs))
+	for i, fileID := range req.FileIDs {
+		if fileID == "" {
+			errs.Add(fmt.Sprintf("fileIds.%d", i), "must not be empty")
+			continue
+		}
+		if !seen[fileID] {
+			seen[fileID] = true
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	if len(fileIDs) > maxFileIDs {
+		errs.Addf("fileIds", "must have at most %d entries", maxFileIDs)
+	}
+
+	return fileIDs, errs
+}
+
+// validateFilter checks a filter, trimming its folder and sorting and
+// de-duplicating its tags so equal filters get the same selection scope
+func validateFilter(filter *SelectionFilter, errs *common.ValidationErrors) {
+	if filter.Folder != nil {
+		folder := strings.TrimSpace(*filter.Folder)
+		filter.Folder = &folder
+		if err := common.ValidateFolder(folder); err != nil {
+			errs.Add("filter.folder", err.Error())
+		}
+	} else if filter.IncludeSubfolders {
+		errs.Add("filter.includeSubfolders", "requires folder")
+	}
+
+	seen := make(map[string]bool, len(filter.Tags))
+	tags := make([]string, 0, len(filter.Tags))
+	for i, tag := range filter.Tags {
+		if tag == "" || strings.HasPrefix(tag, ":") {
+			errs.Add(fmt.Sprintf("filter.tags.%d", i), "must be key or key:value")
+			continue
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxTagFilters {
+		errs.Addf("filter.tags", "must have at most %d entries", maxTagFilters)
+	}
+	sort.Strings(tags)
+	filter.Tags = tags
+
+	// A filter must narrow the selection; deleting every file takes an
+	// explicit folder or tag
+	everything := filter.Folder == nil || (*filter.Folder == "" && filter.IncludeSubfolders)
+	if everything && len(tags) == 0 {
+		errs.Add("filter", "must select a folder or at least one tag")
+	}
+}
+
+// selectionInput queries the user's non-deleted files matching filter
+func selectionInput(userID string, filter *SelectionFilter, startKey map[string]types.AttributeValue, limit int) *dynamodb.QueryInput {
+	filters := []string{"#status <> :deleted"}
+	names := map[string]string{"#status": "status"}
+	values := map[string]types.AttributeValue{
+		":userId":  &types.AttributeValueMemberS{Value: userID},
+		":deleted": &types.AttributeValueMemberS{Value: common.StatusDeleted},
+	}
+
+	if filter.Folder != nil {
+		folder := *filter.Folder
+		switch {
+		case folder == "" && filter.IncludeSubfolders:
+		case folder == "":
+			filters = append(filters, "attribute_not_exists(folder)")
+		case filter.IncludeSubfolders:
+			filters = append(filters, "(folder = :folder OR begins_with(folder, :prefix))")
+			values[":folder"] = &types.AttributeValueMemberS{Value: folder}
+			values[":prefix"] = &types.AttributeValueMemberS{Value: folder + "/"}
+		default:
+			filters = append(filters, "folder = :folder")
+			values[":folder"] = &types.AttributeValueMemberS{Value: folder}
+		}
+	}
+
+	// Tag names are placeholders since tag keys can contain any character
+	for i, tag := range filter.Tags {
+		key, value, hasValue := strings.Cut(tag, ":")
+		keyName := fmt.Sprintf("#tag%d", i)
+		names["#tags"] = "tags"
+		names[keyName] = key
+		if hasValue {
+			valueName := fmt.Sprintf(":tag%d", i)
+			filters = append(filters, fmt.Sprintf("#tags.%s = %s", keyName, valueName))
+			values[valueName] = &types.AttributeValueMemberS{Value: value}
+		} else {
+			filters = append(filters, fmt.Sprintf("attribute_exists(#tags.%s)", keyName))
+		}
+	}
+
+	return &dynamodb.QueryInput{
+		TableName:                 aws.String(userFilesTable),
+		KeyConditionExpression:    aws.String("userId = :userId"),
+		FilterExpression:          aws.String(strings.Join(filters, " AND ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		Limit:                     aws.Int32(int32(limit)),
+		ExclusiveStartKey:         startKey,
+	}
+}
+
+// selectFiles reads up to limit files matching filter, starting after
+// startKey. A non-nil lastKey means more files may match.
+func selectFiles(ctx context.Context, userID string, filter *SelectionFilter, startKey map[string]types.AttributeValue, limit int) ([]common.File, map[string]types.AttributeValue, error) {
+	var files []common.File
+	lastKey := startKey
+	for page := 0; page < maxSelectionPages; page++ {
+		// Never read more items than there is room for, so the selection
+		// stops exactly at a key the next request can resume from
+		pageSize := selectionPageSize
+		if room := limit - len(files); room < pageSize {
+			pageSize = room
+		}
+
+		opCtx, cancel := common.WithDeadline(ctx)
+		result, err := queryClient.Query(opCtx, selectionInput(userID, filter, lastKey, pageSize))
+		cancel()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var matched []common.File
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &matched); err != nil {
+			return nil, nil, err
+		}
+		files = append(files, matched...)
+		lastKey = result.LastEvaluatedKey
+		if len(lastKey) == 0 {
+			return files, nil, nil
+		}
+		if len(files) >= limit {
+			break
+		}
+	}
+	return files, lastKey, nil
+}
+
+// runAll calls fn for 0..n-1 with at most maxConcurrency in flight. Results
+// are in index order.
+func runAll(n int, fn func(i int) DeleteResult) []DeleteResult {
+	results := make([]DeleteResult, n)
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// deleteByID moves one of the user's files, given by ID, to trash
+func deleteByID(ctx context.Context, userID, fileID string, dryRun bool) DeleteResult {
+	file, err := common.GetOwnedFile(ctx, dynamoClient, userFilesTable, userID, fileID, false)
+	switch {
+	case errors.Is(err, common.ErrNotFound):
+		return DeleteResult{FileID: fileID, Outcome: outcomeNotFound}
+	case errors.Is(err, common.ErrDeleted):
+		return DeleteResult{FileID: fileID, Outcome: outcomeAlreadyDeleted, FileName: file.FileName}
+	case err != nil:
+		return failed(DeleteResult{FileID: fileID}, "DynamoDB get error", err)
+	}
+	return deleteFile(ctx, userID, file, dryRun, false)
+}
+
+// deleteFile moves a file to trash like delete_file, keeping the S3 object
+// so it can be restored. selected marks files chosen by a filter.
+func deleteFile(ctx context.Context, userID string, file *common.File, dryRun, selected bool) DeleteResult {
+	result := DeleteResult{FileID: file.FileID, FileName: file.FileName}
+
+	// Files under legal hold can't be deleted until the hold is released
+	if file.LegalHold {
+		result.Outcome = outcomeLegalHold
+		if !dryRun {
+			auditLog.Log(ctx, userID, file.FileID, "access_attempt", map[string]interface{}{
+				"reason":    "legal_hold",
+				"operation": "delete",
+				"fileName":  file.FileName,
+			})
+		}
+		return result
+	}
+	if dryRun {
+		result.Outcome = outcomeWouldDelete
+		result.fileSize = file.FileSize
+		return result
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	opCtx, cancel := common.WithDeadline(ctx)
+	updated, err := dynamoClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: file.FileID},
+		},
+		// Shares are revoked like in delete_file
+		UpdateExpression:    aws.String("SET previousStatus = #status, #status = :deleted, deletedAt = :deletedAt, updatedAt = :updatedAt " + common.RevokeSharesUpdate),
+		ConditionExpression: aws.String("attribute_exists(fileId) AND #status <> :deleted AND " + common.NoLegalHoldCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":deleted":   &types.AttributeValueMemberS{Value: common.StatusDeleted},
+			":deletedAt": &types.AttributeValueMemberS{Value: now},
+			":updatedAt": &types.AttributeValueMemberS{Value: now},
+		},
+		ReturnValues:                        types.ReturnValueAllOld,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			// Changed by a concurrent request since it was read
+			result.Outcome = conditionFailureOutcome(conditionErr.Item)
+			return result
+		}
+		return failed(result, "DynamoDB update error", err)
+	}
+	result.Outcome = outcomeDeleted
+
+	// The acl as the update found it, which may differ from the earlier read
+	var old common.File
+	if err := attributevalue.UnmarshalMap(updated.Attributes, &old); err != nil {
+		log.Printf("Unmarshal error for file %s: %v", file.FileID, err)
+		old.ACL = file.ACL
+	}
+	revoked := old.ACL
+	if revoked == nil {
+		revoked = []string{}
+	}
+
+	metadata := map[string]interface{}{
+		"fileName":       file.FileName,
+		"s3Key":          file.S3Key,
+		"hardDelete":     false,
+		"reason":         "batch_delete",
+		"sharesRevoked":  len(revoked),
+		"revokedUserIds": revoked,
+	}
+	if selected {
+		metadata["selection"] = true
+	}
+	auditLog.Log(ctx, userID, file.FileID, "delete", metadata)
+	return result
+}
+
+// conditionFailureOutcome explains why the guarded delete of item, the
+// record as it was when the condition failed, did not apply
+func conditionFailureOutcome(item map[string]types.AttributeValue) string {
+	if len(item) == 0 {
+		return outcomeNotFound
+	}
+	if _, held := item["legalHold"]; held {
+		return outcomeLegalHold
+	}
+	return outcomeAlreadyDeleted
+}
+
+// failed logs err and records it on result without exposing the details
+func failed(result DeleteResult, message string, err error) DeleteResult {
+	log.Printf("%s for file %s: %v", message, result.FileID, err)
+	result.Outcome = outcomeError
+	result.Error = "Could not delete the file, please retry"
+	return result
+}
+
+// selectionScope identifies a normalized filter, so a selectionToken can't
+// resume a different selection
+func selectionScope(filter *SelectionFilter) string {
+	encoded, _ := json.Marshal(filter)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:16])
+}
+
+// encodeSelectionToken stores the position of a filter delete in a token
+// bound to the filter's scope; lastKey carries the user
+func encodeSelectionToken(lastKey map[string]types.AttributeValue, scope string) (string, error) {
+	key := make(map[string]types.AttributeValue, len(lastKey)+1)
+	for k, v := range lastKey {
+		key[k] = v
+	}
+	key[selectionScopeKey] = &types.AttributeValueMemberS{Value: scope}
+	return common.EncodeToken(key)
+}
+
+// decodeSelectionToken reads a selectionToken; no token starts from the
+// newest file. Tokens of another user or filter are rejected.
+func decodeSelectionToken(token, userID, scope string) (map[string]types.AttributeValue, error) {
+	key, err := common.DecodeToken(token)
+	if err != nil || key == nil {
+		return key, err
+	}
+	if common.TokenOwner(key) != userID {
+		return nil, common.ErrInvalidToken
+	}
+	if v, ok := key[selectionScopeKey].(*types.AttributeValueMemberS); !ok || v.Value != scope {
+		return nil, common.ErrInvalidToken
+	}
+	delete(key, selectionScopeKey)
+	return key, nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
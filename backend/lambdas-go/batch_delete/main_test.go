@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+// fakeFilesTable simulates one user's UserFiles partition, applying the
+// status and folder filters batch_delete sends
+type fakeFilesTable struct {
+	items   []map[string]types.AttributeValue
+	queries int
+}
+
+func (f *fakeFilesTable) Query(ctx context.Context, in *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	f.queries++
+	start := 0
+	if in.ExclusiveStartKey != nil {
+		for i, item := range f.items {
+			if str(item, "fileId") == str(in.ExclusiveStartKey, "fileId") {
+				start = i + 1
+			}
+		}
+	}
+	end := len(f.items)
+	if in.Limit != nil && start+int(*in.Limit) < end {
+		end = start + int(*in.Limit)
+	}
+
+	filter := aws.ToString(in.FilterExpression)
+	out := &dynamodb.QueryOutput{}
+	for _, item := range f.items[start:end] {
+		if str(item, "status") == common.StatusDeleted {
+			continue
+		}
+		if strings.Contains(filter, "folder = :folder") && str(item, "folder") != str(in.ExpressionAttributeValues, ":folder") {
+			continue
+		}
+		out.Items = append(out.Items, item)
+	}
+	if end < len(f.items) {
+		out.LastEvaluatedKey = map[string]types.AttributeValue{"userId": f.items[end-1]["userId"], "fileId": f.items[end-1]["fileId"]}
+	}
+	return out, nil
+}
+
+func str(item map[string]types.AttributeValue, name string) string {
+	if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func file(id, folder, status string, size int64) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":   &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId":   &types.AttributeValueMemberS{Value: id},
+		"fileName": &types.AttributeValueMemberS{Value: id + ".txt"},
+		"folder":   &types.AttributeValueMemberS{Value: folder},
+		"status":   &types.AttributeValueMemberS{Value: status},
+		"fileSize": &types.AttributeValueMemberN{Value: strconv.FormatInt(size, 10)},
+	}
+}
+
+func folder(path string) *string { return &path }
+
+func TestValidateBatchDeleteRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     BatchDeleteRequest
+		wantErr string
+	}{
+		{"file IDs", BatchDeleteRequest{FileIDs: []string{"a", "b", "a"}}, ""},
+		{"nothing", BatchDeleteRequest{}, "fileIds"},
+		{"both", BatchDeleteRequest{FileIDs: []string{"a"}, Filter: &SelectionFilter{Folder: folder("x")}}, "filter"},
+		{"token without filter", BatchDeleteRequest{FileIDs: []string{"a"}, SelectionToken: "abc"}, "selectionToken"},
+		{"folder", BatchDeleteRequest{Filter: &SelectionFilter{Folder: folder("projects/2024")}}, ""},
+		{"root folder", BatchDeleteRequest{Filter: &SelectionFilter{Folder: folder("")}}, ""},
+		{"tag only", BatchDeleteRequest{Filter: &SelectionFilter{Tags: []string{"temp"}}}, ""},
+		{"empty filter", BatchDeleteRequest{Filter: &SelectionFilter{}}, "filter"},
+		{"whole tree", BatchDeleteRequest{Filter: &SelectionFilter{Folder: folder(""), IncludeSubfolders: true}}, "filter"},
+		{"subfolders without folder", BatchDeleteRequest{Filter: &SelectionFilter{IncludeSubfolders: true, Tags: []string{"a"}}}, "filter.includeSubfolders"},
+		{"bad folder", BatchDeleteRequest{Filter: &SelectionFilter{Folder: folder("a//b")}}, "filter.folder"},
+		{"bad tag", BatchDeleteRequest{Filter: &SelectionFilter{Tags: []string{":x"}}}, "filter.tags.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileIDs, errs := validateBatchDeleteRequest(&tt.req)
+			if tt.wantErr == "" {
+				if errs.HasErrors() {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+				if tt.req.Filter == nil && len(fileIDs) != 2 {
+					t.Errorf("fileIDs = %v, want de-duplicated", fileIDs)
+				}
+				return
+			}
+			encoded, _ := json.Marshal(errs)
+			if !strings.Contains(string(encoded), `"`+tt.wantErr+`"`) {
+				t.Errorf("errors = %s, want one for %s", encoded, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSelectionInputFolderConditions(t *testing.T) {
+	tests := []struct {
+		filter SelectionFilter
+		want   string
+	}{
+		{SelectionFilter{Folder: folder("")}, "#status <> :deleted AND attribute_not_exists(folder)"},
+		{SelectionFilter{Folder: folder("a")}, "#status <> :deleted AND folder = :folder"},
+		{SelectionFilter{Folder: folder("a"), IncludeSubfolders: true}, "#status <> :deleted AND (folder = :folder OR begins_with(folder, :prefix))"},
+		{SelectionFilter{Tags: []string{"env:prod", "temp"}}, "#status <> :deleted AND #tags.#tag0 = :tag0 AND attribute_exists(#tags.#tag1)"},
+	}
+
+	for _, tt := range tests {
+		input := selectionInput("user-123", &tt.filter, nil, 10)
+		if got := aws.ToString(input.FilterExpression); got != tt.want {
+			t.Errorf("FilterExpression = %q, want %q", got, tt.want)
+		}
+		if tt.filter.IncludeSubfolders && str(input.ExpressionAttributeValues, ":prefix") != "a/" {
+			t.Errorf(":prefix = %q, want a/", str(input.ExpressionAttributeValues, ":prefix"))
+		}
+	}
+}
+
+func TestSelectFilesStopsAtLimitAndResumes(t *testing.T) {
+	table := &fakeFilesTable{}
+	for i := 0; i < 7; i++ {
+		table.items = append(table.items, file("f"+strconv.Itoa(i), "x", "uploaded", 10))
+	}
+	queryClient = table
+	filter := &SelectionFilter{Folder: folder("x")}
+
+	files, lastKey, err := selectFiles(context.Background(), "user-123", filter, nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || lastKey == nil || str(lastKey, "fileId") != "f2" {
+		t.Fatalf("got %d files, lastKey %v; want 3 files ending at f2", len(files), lastKey)
+	}
+
+	files, lastKey, err = selectFiles(context.Background(), "user-123", filter, lastKey, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 || files[0].FileID != "f3" || lastKey != nil {
+		t.Fatalf("got %d files from %q, lastKey %v; want f3..f6 and no lastKey", len(files), files[0].FileID, lastKey)
+	}
+}
+
+func TestSelectionTokenIsScopedToUserAndFilter(t *testing.T) {
+	lastKey := map[string]types.AttributeValue{
+		"userId": &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId": &types.AttributeValueMemberS{Value: "f2"},
+	}
+	scope := selectionScope(&SelectionFilter{Folder: folder("x")})
+	token, err := encodeSelectionToken(lastKey, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := decodeSelectionToken(token, "user-123", scope)
+	if err != nil || str(key, "fileId") != "f2" {
+		t.Fatalf("decode = %v, %v; want the f2 key", key, err)
+	}
+	if _, ok := key[selectionScopeKey]; ok {
+		t.Error("decoded key still carries the scope")
+	}
+
+	if _, err := decodeSelectionToken(token, "user-456", scope); err == nil {
+		t.Error("token accepted for another user")
+	}
+	other := selectionScope(&SelectionFilter{Folder: folder("y")})
+	if _, err := decodeSelectionToken(token, "user-123", other); err == nil {
+		t.Error("token accepted for another filter")
+	}
+}
+
+func TestFilterDryRunCountsMatches(t *testing.T) {
+	held := file("f1", "x", "uploaded", 100)
+	held["legalHold"] = &types.AttributeValueMemberBOOL{Value: true}
+	queryClient = &fakeFilesTable{items: []map[string]types.AttributeValue{
+		file("f0", "x", "uploaded", 10),
+		held,
+		file("f2", "x", "deleted", 1000),
+		file("f3", "y", "uploaded", 1000),
+		file("f4", "x", "pending", 5),
+	}}
+
+	body, _ := json.Marshal(BatchDeleteRequest{Filter: &SelectionFilter{Folder: folder("x")}, DryRun: true})
+	handler := common.Chain(common.HandleErrors, common.RequireUser)(handleBatchDelete)
+	resp, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		Body: string(body),
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Authorizer: map[string]interface{}{"claims": map[string]interface{}{"sub": "user-123"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status = %d: %s", resp.StatusCode, resp.Body)
+	}
+
+	var got BatchDeleteResponse
+	if err := json.Unmarshal([]byte(resp.Body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Matched != 3 || got.Counts[outcomeWouldDelete] != 2 || got.Counts[outcomeLegalHold] != 1 {
+		t.Errorf("matched = %d, counts = %v; want 3 matched, 2 would_delete, 1 legal_hold", got.Matched, got.Counts)
+	}
+	if got.BytesFreed != 15 {
+		t.Errorf("bytesFreed = %d, want 15", got.BytesFreed)
+	}
+	if len(got.Results) != 0 || got.SelectionToken != nil || got.HasMore {
+		t.Errorf("dry run returned results %v, token %v, hasMore %v", got.Results, got.SelectionToken, got.HasMore)
+	}
+}
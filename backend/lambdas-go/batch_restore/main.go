@@ -0,0 +1,291 @@
+// Package main implements the batch_restore Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	maxFileIDs     = 100
+	maxConcurrency = 10
+
+	// fallbackStatus is restored for files deleted before previousStatus was
+	// recorded; trash was almost always filled with uploaded files
+	fallbackStatus = "uploaded"
+)
+
+// Outcomes of a restore. Only outcomeRestored changes the file.
+const (
+	outcomeRestored      = "restored"
+	outcomeNotFound      = "not_found"
+	outcomeNotDeleted    = "not_deleted"
+	outcomeWindowExpired = "window_expired"
+	outcomeError         = "error"
+)
+
+// RestoreRequest represents the request body
+type RestoreRequest struct {
+	FileIDs []string `json:"fileIds"`
+}
+
+// RestoreResponse represents the response body
+type RestoreResponse struct {
+	Results []RestoreResult `json:"results"`
+	// Counts is the number of results per outcome
+	Counts map[string]int `json:"counts"`
+}
+
+// RestoreResult is the outcome for one file
+type RestoreResult struct {
+	FileID   string `json:"fileId"`
+	Outcome  string `json:"outcome"`
+	FileName string `json:"fileName,omitempty"`
+	// Status is the status the file was restored to
+	Status string `json:"status,omitempty"`
+	// ExpiryCleared is set when the file's past-due expiry was removed so
+	// expire_files doesn't put it straight back in trash
+	ExpiryCleared bool   `json:"expiryCleared,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+var (
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+	// restoreWindow is how long a file can be restored after it went to
+	// trash, from RESTORE_WINDOW (Go duration, e.g. "720h"). Zero disables it.
+	restoreWindow time.Duration
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable, Geo: true}
+
+	if v := os.Getenv("RESTORE_WINDOW"); v != "" {
+		restoreWindow, err = time.ParseDuration(v)
+		if err != nil || restoreWindow < 0 {
+			log.Fatalf("Invalid RESTORE_WINDOW: %q", v)
+		}
+	}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleRestore)
+
+// handleRestore handles an authenticated request
+func handleRestore(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req RestoreRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+
+	fileIDs, errs := validateRestoreRequest(&req)
+	if errs.HasErrors() {
+		return common.Fail(errs)
+	}
+
+	// Failures are reported per file so one bad file doesn't hide the others
+	results := restoreAll(ctx, userID, fileIDs)
+	response := RestoreResponse{Results: results, Counts: map[string]int{}}
+	for _, result := range results {
+		response.Counts[result.Outcome]++
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// validateRestoreRequest checks the request and returns the de-duplicated file IDs
+func validateRestoreRequest(req *RestoreRequest) ([]string, *common.ValidationErrors) {
+	errs := &common.ValidationErrors{}
+
+	if len(req.FileIDs) == 0 {
+		errs.Add("fileIds", "is required")
+		return nil, errs
+	}
+
+	seen := make(map[string]bool, len(req.FileIDs))
+	fileIDs := make([]string, 0, len(req.FileIDs))
+	for i, fileID := range req.FileIDs {
+		if fileID == "" {
+			errs.Add(fmt.Sprintf("fileIds.%d", i), "must not be empty")
+			continue
+		}
+		if !seen[fileID] {
+			seen[fileID] = true
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	if len(fileIDs) > maxFileIDs {
+		errs.Addf("fileIds", "must have at most %d entries", maxFileIDs)
+	}
+
+	return fileIDs, errs
+}
+
+// restoreAll restores every file with at most maxConcurrency in flight.
+// Results are in the same order as fileIDs.
+func restoreAll(ctx context.Context, userID string, fileIDs []string) []RestoreResult {
+	results := make([]RestoreResult, len(fileIDs))
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+
+	for i, fileID := range fileIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, fileID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = restoreOne(ctx, userID, fileID)
+		}(i, fileID)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// restoreOne takes a file out of trash, back to the status it had before
+func restoreOne(ctx context.Context, userID, fileID string) RestoreResult {
+	result := RestoreResult{FileID: fileID}
+
+	file, err := common.GetOwnedFile(ctx, dynamoClient, userFilesTable, userID, fileID, true)
+	switch {
+	case errors.Is(err, common.ErrNotFound):
+		result.Outcome = outcomeNotFound
+		return result
+	case err == nil:
+		result.Outcome = outcomeNotDeleted
+		return result
+	case !errors.Is(err, common.ErrDeleted):
+		return failed(result, "DynamoDB get error", err)
+	}
+	result.FileName = file.FileName
+
+	now := time.Now().UTC()
+	if !withinWindow(file.DeletedAt, now, restoreWindow) {
+		result.Outcome = outcomeWindowExpired
+		return result
+	}
+	status := restoredStatus(file)
+	expiryCleared := file.ExpiryEpoch > 0 && file.ExpiryEpoch <= now.Unix()
+
+	// Guarded so a file purged, or deleted again, meanwhile is left alone
+	timestamp := now.Format(time.RFC3339)
+	update := "SET #status = :status, updatedAt = :now REMOVE deletedAt, previousStatus"
+	if expiryCleared {
+		update += ", expiresAt, expiryEpoch"
+	}
+	opCtx, cancel := common.WithDeadline(ctx)
+	_, err = dynamoClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
+		UpdateExpression:    aws.String(update),
+		ConditionExpression: aws.String("#status = :deleted AND deletedAt = :deletedAt"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status":    &types.AttributeValueMemberS{Value: status},
+			":now":       &types.AttributeValueMemberS{Value: timestamp},
+			":deleted":   &types.AttributeValueMemberS{Value: common.StatusDeleted},
+			":deletedAt": &types.AttributeValueMemberS{Value: file.DeletedAt},
+		},
+	})
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			// Purged or restored by a concurrent request
+			result.Outcome = outcomeNotDeleted
+			return result
+		}
+		return failed(result, "DynamoDB update error", err)
+	}
+	result.Outcome = outcomeRestored
+	result.Status = status
+	result.ExpiryCleared = expiryCleared
+
+	metadata := map[string]interface{}{
+		"fileName":  file.FileName,
+		"status":    status,
+		"deletedAt": file.DeletedAt,
+		"reason":    "batch_restore",
+	}
+	if expiryCleared {
+		metadata["expiresAt"] = file.ExpiresAt
+		metadata["expiryCleared"] = true
+	}
+	auditLog.Log(ctx, userID, fileID, "restore", metadata)
+	return result
+}
+
+// withinWindow reports whether a file deleted at deletedAt (RFC3339) can
+// still be restored at now. A zero window never closes.
+func withinWindow(deletedAt string, now time.Time, window time.Duration) bool {
+	if window == 0 {
+		return true
+	}
+	parsed, err := time.Parse(time.RFC3339, deletedAt)
+	if err != nil {
+		// Without a deletion time the window can't be checked; let it through
+		// rather than make the file unrecoverable
+		log.Printf("Invalid deletedAt %q, ignoring the restore window", deletedAt)
+		return true
+	}
+	return now.Before(parsed.Add(window))
+}
+
+// restoredStatus is the status a file in trash goes back to
+func restoredStatus(file *common.File) string {
+	if file.PreviousStatus == "" || file.PreviousStatus == common.StatusDeleted {
+		return fallbackStatus
+	}
+	return file.PreviousStatus
+}
+
+// failed logs err and records it on result without exposing the details
+func failed(result RestoreResult, message string, err error) RestoreResult {
+	log.Printf("%s for file %s: %v", message, result.FileID, err)
+	result.Outcome = outcomeError
+	result.Error = "Could not restore the file, please retry"
+	return result
+}
+
+func main() {
+	lambda.Start(Handler)
+}
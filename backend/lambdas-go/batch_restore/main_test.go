@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+func TestWithinWindow(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		deletedAt string
+		window    time.Duration
+		want      bool
+	}{
+		{"no window", "2020-01-01T00:00:00Z", 0, true},
+		{"inside", "2024-06-09T12:00:00Z", 48 * time.Hour, true},
+		{"closed", "2024-06-01T12:00:00Z", 48 * time.Hour, false},
+		{"exactly at the end", "2024-06-08T12:00:00Z", 48 * time.Hour, false},
+		{"unparseable", "yesterday", 48 * time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withinWindow(tt.deletedAt, now, tt.window); got != tt.want {
+				t.Errorf("withinWindow(%q) = %v, want %v", tt.deletedAt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoredStatus(t *testing.T) {
+	tests := []struct {
+		previous string
+		want     string
+	}{
+		{"pending", "pending"},
+		{"uploaded", "uploaded"},
+		{"corrupt", "corrupt"},
+		{"", fallbackStatus},
+		{common.StatusDeleted, fallbackStatus},
+	}
+	for _, tt := range tests {
+		if got := restoredStatus(&common.File{PreviousStatus: tt.previous}); got != tt.want {
+			t.Errorf("restoredStatus(%q) = %q, want %q", tt.previous, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRestoreRequest(t *testing.T) {
+	fileIDs, errs := validateRestoreRequest(&RestoreRequest{FileIDs: []string{"a", "b", "a"}})
+	if errs.HasErrors() {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(fileIDs) != 2 {
+		t.Errorf("fileIDs = %v, want duplicates removed", fileIDs)
+	}
+
+	if _, errs := validateRestoreRequest(&RestoreRequest{}); !errs.HasErrors() {
+		t.Error("empty fileIds accepted")
+	}
+
+	tooMany := make([]string, maxFileIDs+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("file-%d", i)
+	}
+	if _, errs := validateRestoreRequest(&RestoreRequest{FileIDs: tooMany}); !errs.HasErrors() {
+		t.Errorf("%d fileIds accepted", len(tooMany))
+	}
+}
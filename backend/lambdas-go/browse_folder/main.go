@@ -0,0 +1,349 @@
+// Package main implements the browse_folder Lambda function
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	userFilesTable  = "UserFiles"
+	defaultPageSize = 50
+	maxPageSize     = 200
+	// maxFilteredPages bounds how many pages are read to find a non-empty one
+	maxFilteredPages = 5
+	// maxFolderScanPages bounds the partition pages read to discover
+	// subfolders; beyond it the folder list is marked truncated
+	maxFolderScanPages = 50
+
+	// Cursor fields stored next to the DynamoDB key in nextToken
+	cursorPhaseKey  = "browsePhase"
+	cursorOffsetKey = "browseOffset"
+	cursorFolderKey = "browseFolder"
+	phaseFolders    = "folders"
+	phaseFiles      = "files"
+)
+
+// FolderEntry is a direct subfolder of the browsed folder
+type FolderEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// FileItem represents a file record from DynamoDB
+type FileItem struct {
+	FileID      string `dynamodbav:"fileId" json:"fileId"`
+	FileName    string `dynamodbav:"fileName" json:"fileName"`
+	ContentType string `dynamodbav:"contentType" json:"contentType"`
+	FileSize    int64  `dynamodbav:"fileSize" json:"fileSize"`
+	Status      string `dynamodbav:"status" json:"status"`
+	CreatedAt   string `dynamodbav:"createdAt" json:"createdAt"`
+	UpdatedAt   string `dynamodbav:"updatedAt" json:"updatedAt,omitempty"`
+	Pinned      bool   `dynamodbav:"pinned" json:"pinned,omitempty"`
+	// Category groups contentType for display (common.FileCategory)
+	Category string `dynamodbav:"-" json:"category"`
+}
+
+// BrowseResponse represents the response body. A page lists folders first,
+// then files; a page can hold the last folders and the first files.
+type BrowseResponse struct {
+	Folder  string        `json:"folder"`
+	Folders []FolderEntry `json:"folders"`
+	Files   []FileItem    `json:"files"`
+	// FoldersTruncated is set when the partition was too large to discover
+	// every subfolder in one request
+	FoldersTruncated bool    `json:"foldersTruncated,omitempty"`
+	NextToken        *string `json:"nextToken"`
+	// HasMore is true whenever nextToken is set, even if this page is empty
+	HasMore bool `json:"hasMore"`
+}
+
+// cursor is the decoded position of a browse: an offset into the sorted
+// subfolders, or a key into the folder's files
+type cursor struct {
+	phase  string
+	offset int
+	key    map[string]types.AttributeValue
+}
+
+var (
+	dynamoClient *dynamodb.Client
+	// queryClient runs the browse queries; tests replace it
+	queryClient common.QueryAPI
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	queryClient = dynamoClient
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.HandleErrors,
+	common.CORS,
+	common.RequireUser,
+)(handleBrowse)
+
+// handleBrowse lists a folder's direct subfolders, then its files, for a
+// file-browser view. Folders only exist as the folder attribute of files,
+// so subfolders are found by reading the folders of every file below.
+func handleBrowse(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+	params := request.QueryStringParameters
+
+	folder := strings.TrimSpace(params["folder"])
+	if err := common.ValidateFolder(folder); err != nil {
+		return common.Fail(common.Validation("Invalid folder: " + err.Error()))
+	}
+
+	limit := defaultPageSize
+	if v := params["limit"]; v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 {
+			return common.Fail(common.Validation("Invalid limit: must be a positive integer"))
+		}
+		limit = parsed
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	pos, err := decodeCursor(params["nextToken"], userID, folder)
+	if err != nil {
+		return common.Fail(common.Validation("Invalid nextToken"))
+	}
+
+	response := BrowseResponse{Folder: folder, Folders: []FolderEntry{}, Files: []FileItem{}}
+	var next *cursor
+
+	if pos.phase == phaseFolders {
+		folders, truncated, err := listSubfolders(ctx, userID, folder)
+		if err != nil {
+			return common.Fail(common.Internal("DynamoDB query error", err))
+		}
+		response.FoldersTruncated = truncated
+
+		if pos.offset > len(folders) {
+			pos.offset = len(folders)
+		}
+		end := pos.offset + limit
+		if end > len(folders) {
+			end = len(folders)
+		}
+		response.Folders = folders[pos.offset:end]
+
+		if end < len(folders) {
+			next = &cursor{phase: phaseFolders, offset: end}
+		} else {
+			// Folders are done; the rest of the page goes to files
+			pos = cursor{phase: phaseFiles}
+			limit -= len(response.Folders)
+		}
+	}
+
+	if next == nil && limit == 0 {
+		// The page filled up exactly with the last folders
+		next = &cursor{phase: phaseFiles}
+	} else if next == nil {
+		items, lastKey, err := common.QueryPage(ctx, queryClient, filesInput(userID, folder, limit, pos.key), maxFilteredPages)
+		if err != nil {
+			return common.Fail(common.Internal("DynamoDB query error", err))
+		}
+		if err := attributevalue.UnmarshalListOfMaps(items, &response.Files); err != nil {
+			return common.Fail(common.Internal("Unmarshal error", err))
+		}
+		for i := range response.Files {
+			response.Files[i].Category = common.FileCategory(response.Files[i].ContentType)
+		}
+		if len(lastKey) > 0 {
+			next = &cursor{phase: phaseFiles, key: lastKey}
+		}
+	}
+
+	if next != nil {
+		token, err := encodeCursor(*next, userID, folder)
+		if err != nil {
+			return common.Fail(common.Internal("Token encode error", err))
+		}
+		response.NextToken = &token
+		response.HasMore = true
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// listSubfolders returns the direct subfolders of folder, sorted by name,
+// from the folder attribute of the user's non-deleted files below it
+func listSubfolders(ctx context.Context, userID, folder string) ([]FolderEntry, bool, error) {
+	prefix := ""
+	if folder != "" {
+		prefix = folder + "/"
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(userFilesTable),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		FilterExpression:       aws.String("#status <> :deleted AND attribute_exists(folder)"),
+		ProjectionExpression:   aws.String("folder"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId":  &types.AttributeValueMemberS{Value: userID},
+			":deleted": &types.AttributeValueMemberS{Value: common.StatusDeleted},
+		},
+	}
+	if prefix != "" {
+		input.FilterExpression = aws.String("#status <> :deleted AND begins_with(folder, :prefix)")
+		input.ExpressionAttributeValues[":prefix"] = &types.AttributeValueMemberS{Value: prefix}
+	}
+
+	names := map[string]bool{}
+	truncated := true
+	for page := 0; page < maxFolderScanPages; page++ {
+		opCtx, cancel := common.WithDeadline(ctx)
+		result, err := queryClient.Query(opCtx, input)
+		cancel()
+		if err != nil {
+			return nil, false, err
+		}
+		for _, item := range result.Items {
+			if v, ok := item["folder"].(*types.AttributeValueMemberS); ok {
+				if name := childFolder(v.Value, prefix); name != "" {
+					names[name] = true
+				}
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			truncated = false
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	folders := make([]FolderEntry, 0, len(names))
+	for name := range names {
+		folders = append(folders, FolderEntry{Name: name, Path: prefix + name})
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Name < folders[j].Name })
+	return folders, truncated, nil
+}
+
+// childFolder returns the first segment of path below prefix, so with prefix
+// "a/" both "a/b" and "a/b/c" give "b". It returns "" for paths outside it.
+func childFolder(path, prefix string) string {
+	rest, ok := strings.CutPrefix(path, prefix)
+	if !ok || rest == "" {
+		return ""
+	}
+	name, _, _ := strings.Cut(rest, "/")
+	return name
+}
+
+// filesInput queries the non-deleted files directly in folder, most recent first
+func filesInput(userID, folder string, limit int, startKey map[string]types.AttributeValue) *dynamodb.QueryInput {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(userFilesTable),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId":  &types.AttributeValueMemberS{Value: userID},
+			":deleted": &types.AttributeValueMemberS{Value: common.StatusDeleted},
+		},
+		Limit:             aws.Int32(int32(limit)),
+		ExclusiveStartKey: startKey,
+		ScanIndexForward:  aws.Bool(false),
+	}
+	if folder == "" {
+		input.FilterExpression = aws.String("#status <> :deleted AND attribute_not_exists(folder)")
+	} else {
+		input.FilterExpression = aws.String("#status <> :deleted AND folder = :folder")
+		input.ExpressionAttributeValues[":folder"] = &types.AttributeValueMemberS{Value: folder}
+	}
+	return input
+}
+
+// encodeCursor stores the position in a nextToken bound to the user and folder
+func encodeCursor(c cursor, userID, folder string) (string, error) {
+	key := map[string]types.AttributeValue{
+		"userId": &types.AttributeValueMemberS{Value: userID},
+	}
+	for k, v := range c.key {
+		key[k] = v
+	}
+	key[cursorPhaseKey] = &types.AttributeValueMemberS{Value: c.phase}
+	key[cursorFolderKey] = &types.AttributeValueMemberS{Value: folder}
+	if c.phase == phaseFolders {
+		key[cursorOffsetKey] = &types.AttributeValueMemberN{Value: strconv.Itoa(c.offset)}
+	}
+	return common.EncodeToken(key)
+}
+
+// decodeCursor reads a nextToken; no token starts with the folders. Tokens
+// of another user or folder are rejected.
+func decodeCursor(token, userID, folder string) (cursor, error) {
+	key, err := common.DecodeToken(token)
+	if err != nil {
+		return cursor{}, err
+	}
+	if key == nil {
+		return cursor{phase: phaseFolders}, nil
+	}
+	if common.TokenOwner(key) != userID {
+		return cursor{}, common.ErrInvalidToken
+	}
+	if v, ok := key[cursorFolderKey].(*types.AttributeValueMemberS); !ok || v.Value != folder {
+		return cursor{}, common.ErrInvalidToken
+	}
+	phase, _ := key[cursorPhaseKey].(*types.AttributeValueMemberS)
+	delete(key, cursorPhaseKey)
+	delete(key, cursorFolderKey)
+
+	switch {
+	case phase == nil:
+		return cursor{}, common.ErrInvalidToken
+	case phase.Value == phaseFolders:
+		offset, ok := key[cursorOffsetKey].(*types.AttributeValueMemberN)
+		if !ok {
+			return cursor{}, common.ErrInvalidToken
+		}
+		n, err := strconv.Atoi(offset.Value)
+		if err != nil || n < 0 {
+			return cursor{}, common.ErrInvalidToken
+		}
+		return cursor{phase: phaseFolders, offset: n}, nil
+	case phase.Value == phaseFiles:
+		if _, ok := key["fileId"]; !ok {
+			// Files start from the beginning
+			return cursor{phase: phaseFiles}, nil
+		}
+		return cursor{phase: phaseFiles, key: key}, nil
+	default:
+		return cursor{}, common.ErrInvalidToken
+	}
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+// fakeFilesTable simulates one user's UserFiles partition, newest fileId
+// first, applying the folder filters browse_folder sends
+type fakeFilesTable struct {
+	items []map[string]types.AttributeValue // descending by fileId
+}
+
+func (f *fakeFilesTable) Query(ctx context.Context, in *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	start := 0
+	if in.ExclusiveStartKey != nil {
+		for i, item := range f.items {
+			if str(item, "fileId") == str(in.ExclusiveStartKey, "fileId") {
+				start = i + 1
+			}
+		}
+	}
+	end := len(f.items)
+	if in.Limit != nil && start+int(*in.Limit) < end {
+		end = start + int(*in.Limit)
+	}
+
+	filter := aws.ToString(in.FilterExpression)
+	values := in.ExpressionAttributeValues
+	out := &dynamodb.QueryOutput{}
+	for _, item := range f.items[start:end] {
+		folder, hasFolder := item["folder"]
+		switch {
+		case str(item, "status") == common.StatusDeleted:
+			continue
+		case strings.Contains(filter, "attribute_not_exists(folder)") && hasFolder:
+			continue
+		case strings.Contains(filter, "attribute_exists(folder)") && !hasFolder:
+			continue
+		case strings.Contains(filter, "folder = :folder") && (!hasFolder || str(item, "folder") != str(values, ":folder")):
+			continue
+		case strings.Contains(filter, "begins_with") && (!hasFolder || !strings.HasPrefix(str(item, "folder"), str(values, ":prefix"))):
+			continue
+		}
+		if aws.ToString(in.ProjectionExpression) == "folder" {
+			out.Items = append(out.Items, map[string]types.AttributeValue{"folder": folder})
+			continue
+		}
+		out.Items = append(out.Items, item)
+	}
+	if end < len(f.items) {
+		out.LastEvaluatedKey = map[string]types.AttributeValue{"userId": f.items[end-1]["userId"], "fileId": f.items[end-1]["fileId"]}
+	}
+	return out, nil
+}
+
+func str(item map[string]types.AttributeValue, name string) string {
+	if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func file(id, folder, status string) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"userId":   &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId":   &types.AttributeValueMemberS{Value: id},
+		"fileName": &types.AttributeValueMemberS{Value: id + ".txt"},
+		"status":   &types.AttributeValueMemberS{Value: status},
+	}
+	if folder != "" {
+		item["folder"] = &types.AttributeValueMemberS{Value: folder}
+	}
+	return item
+}
+
+func browse(t *testing.T, params map[string]string) (BrowseResponse, int) {
+	t.Helper()
+	request := events.APIGatewayProxyRequest{QueryStringParameters: params}
+	request.RequestContext.Authorizer = map[string]interface{}{
+		"claims": map[string]interface{}{"sub": "user-123"},
+	}
+	response, err := common.Chain(common.HandleErrors, common.RequireUser)(handleBrowse)(context.Background(), request)
+	if err != nil {
+		t.Fatalf("handleBrowse error: %v", err)
+	}
+	var body BrowseResponse
+	if response.StatusCode == 200 {
+		if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+			t.Fatalf("decode body: %v", err)
+		}
+	}
+	return body, response.StatusCode
+}
+
+func TestChildFolder(t *testing.T) {
+	tests := []struct {
+		path, prefix, want string
+	}{
+		{"docs", "", "docs"},
+		{"docs/2024/q1", "", "docs"},
+		{"docs/2024", "docs/", "2024"},
+		{"docs/2024/q1", "docs/", "2024"},
+		{"docsextra/a", "docs/", ""},
+		{"photos", "docs/", ""},
+	}
+	for _, tt := range tests {
+		if got := childFolder(tt.path, tt.prefix); got != tt.want {
+			t.Errorf("childFolder(%q, %q) = %q, want %q", tt.path, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestBrowsePagesFoldersThenFiles(t *testing.T) {
+	table := &fakeFilesTable{items: []map[string]types.AttributeValue{
+		file("f9", "docs", "uploaded"),
+		file("f8", "docs/2024/q1", "uploaded"),
+		file("f7", "docs/2023", "uploaded"),
+		file("f6", "docs", common.StatusDeleted),
+		file("f5", "docs/old", common.StatusDeleted),
+		file("f4", "docs", "pending"),
+		file("f3", "docsextra", "uploaded"),
+		file("f2", "docs", "uploaded"),
+		file("f1", "", "uploaded"),
+	}}
+	original := queryClient
+	queryClient = table
+	defer func() { queryClient = original }()
+
+	var folders, files []string
+	var token string
+	for page := 0; page < 10; page++ {
+		params := map[string]string{"folder": "docs", "limit": "2"}
+		if token != "" {
+			params["nextToken"] = token
+		}
+		body, status := browse(t, params)
+		if status != 200 {
+			t.Fatalf("page %d: status %d", page, status)
+		}
+		if len(body.Folders)+len(body.Files) > 2 {
+			t.Fatalf("page %d: %d entries, limit is 2", page, len(body.Folders)+len(body.Files))
+		}
+		for _, f := range body.Folders {
+			if len(files) > 0 {
+				t.Fatalf("folder %q listed after files", f.Path)
+			}
+			folders = append(folders, f.Path)
+		}
+		for _, f := range body.Files {
+			files = append(files, f.FileID)
+		}
+		if body.NextToken == nil {
+			break
+		}
+		token = *body.NextToken
+	}
+
+	if want := []string{"docs/2023", "docs/2024"}; !reflect.DeepEqual(folders, want) {
+		t.Errorf("folders = %v, want %v", folders, want)
+	}
+	if want := []string{"f9", "f4", "f2"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("files = %v, want %v", files, want)
+	}
+}
+
+func TestBrowseRoot(t *testing.T) {
+	table := &fakeFilesTable{items: []map[string]types.AttributeValue{
+		file("f3", "photos/2024", "uploaded"),
+		file("f2", "docs", "uploaded"),
+		file("f1", "", "uploaded"),
+	}}
+	original := queryClient
+	queryClient = table
+	defer func() { queryClient = original }()
+
+	body, status := browse(t, nil)
+	if status != 200 {
+		t.Fatalf("status = %d", status)
+	}
+	want := []FolderEntry{{Name: "docs", Path: "docs"}, {Name: "photos", Path: "photos"}}
+	if !reflect.DeepEqual(body.Folders, want) {
+		t.Errorf("folders = %v, want %v", body.Folders, want)
+	}
+	if len(body.Files) != 1 || body.Files[0].FileID != "f1" {
+		t.Errorf("files = %v, want only f1", body.Files)
+	}
+	if body.HasMore {
+		t.Error("hasMore set on the only page")
+	}
+}
+
+func TestBrowseTokenScope(t *testing.T) {
+	table := &fakeFilesTable{}
+	for i := 0; i < 3; i++ {
+		table.items = append(table.items, file(fmt.Sprintf("f%d", 9-i), fmt.Sprintf("docs/sub%d", i), "uploaded"))
+	}
+	original := queryClient
+	queryClient = table
+	defer func() { queryClient = original }()
+
+	body, status := browse(t, map[string]string{"folder": "docs", "limit": "1"})
+	if status != 200 || body.NextToken == nil {
+		t.Fatalf("status = %d, nextToken = %v", status, body.NextToken)
+	}
+
+	if _, status := browse(t, map[string]string{"folder": "photos", "nextToken": *body.NextToken}); status != 400 {
+		t.Errorf("token reused for another folder: status = %d, want 400", status)
+	}
+
+	foreign, err := encodeCursor(cursor{phase: phaseFolders, offset: 1}, "user-999", "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, status := browse(t, map[string]string{"folder": "docs", "nextToken": foreign}); status != 400 {
+		t.Errorf("another user's token: status = %d, want 400", status)
+	}
+
+	if _, status := browse(t, map[string]string{"folder": "../docs"}); status != 400 {
+		t.Errorf("invalid folder: status = %d, want 400", status)
+	}
+}
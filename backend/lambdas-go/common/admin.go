@@ -0,0 +1,71 @@
+package common
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const defaultAdminGroup = "admin"
+
+// adminGroup is the Cognito group whose members may call admin endpoints
+// (ADMIN_GROUP)
+var adminGroup = envOrDefault("ADMIN_GROUP", defaultAdminGroup)
+
+// envOrDefault returns the environment variable name, or fallback when unset
+func envOrDefault(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// CognitoGroups returns the caller's Cognito groups from the authorizer
+// claims. API Gateway passes them as one string, either "a,b" or "[a b]".
+func CognitoGroups(request events.APIGatewayProxyRequest) []string {
+	claims, ok := request.RequestContext.Authorizer["claims"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var groups []string
+	switch v := claims["cognito:groups"].(type) {
+	case string:
+		groups = strings.FieldsFunc(strings.Trim(v, "[]"), func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok && s != "" {
+				groups = append(groups, s)
+			}
+		}
+	}
+	return groups
+}
+
+// IsAdmin reports whether the caller is in the ADMIN_GROUP Cognito group.
+// Handlers open to owners and admins use it; admin-only ones use RequireAdmin.
+func IsAdmin(request events.APIGatewayProxyRequest) bool {
+	for _, group := range CognitoGroups(request) {
+		if group == adminGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireAdmin returns 403 unless the caller is in the ADMIN_GROUP Cognito
+// group. It goes after RequireUser.
+func RequireAdmin(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if IsAdmin(request) {
+			return next(ctx, request)
+		}
+		log.Printf("Admin access denied for user %s", UserID(ctx))
+		return ToResponse(Forbidden("Admin access required")), nil
+	}
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func requestWithGroups(groups interface{}) events.APIGatewayProxyRequest {
+	var request events.APIGatewayProxyRequest
+	request.RequestContext.Authorizer = map[string]interface{}{
+		"claims": map[string]interface{}{"sub": "user-1", "cognito:groups": groups},
+	}
+	return request
+}
+
+func TestCognitoGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups interface{}
+		want   []string
+	}{
+		{"single", "admin", []string{"admin"}},
+		{"comma separated", "admin,editors", []string{"admin", "editors"}},
+		{"bracketed", "[admin editors]", []string{"admin", "editors"}},
+		{"list", []interface{}{"admin", "editors"}, []string{"admin", "editors"}},
+		{"missing", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CognitoGroups(requestWithGroups(tt.groups)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CognitoGroups = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	handler := RequireAdmin(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return BuildResponse(200, nil), nil
+	})
+
+	response, _ := handler(context.Background(), requestWithGroups("[editors admin]"))
+	if response.StatusCode != 200 {
+		t.Errorf("admin got status %d", response.StatusCode)
+	}
+	response, _ = handler(context.Background(), requestWithGroups("editors"))
+	if response.StatusCode != 403 {
+		t.Errorf("non-admin got status %d, want 403", response.StatusCode)
+	}
+}
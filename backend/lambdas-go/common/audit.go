@@ -0,0 +1,91 @@
+package common
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// AuditEntry represents an audit log entry
+type AuditEntry struct {
+	UserID    string                 `dynamodbav:"userId"`
+	Timestamp string                 `dynamodbav:"timestamp"`
+	FileID    string                 `dynamodbav:"fileId"`
+	Action    string                 `dynamodbav:"action"`
+	Metadata  map[string]interface{} `dynamodbav:"metadata"`
+	// IPAddress mirrors metadata.ipAddress so audit_file can filter on it
+	IPAddress string `dynamodbav:"ipAddress,omitempty"`
+}
+
+// PutItemAPI is the subset of the DynamoDB client used by AuditLogger
+type PutItemAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+// AuditLogger writes a Lambda's audit entries to Table. Entries carry the
+// invocation's correlation ID and, unless NoClientIP is set, the caller's IP
+// address as STORE_CLIENT_IP says. Every write is counted by
+// RecordAuditWrite; failures are only logged, so an audit entry never fails
+// the operation it records.
+type AuditLogger struct {
+	Client PutItemAPI
+	Table  string
+	// Geo records the caller's coarse location as metadata.geo
+	Geo bool
+	// NoClientIP leaves out the caller's IP address, for Lambdas invoked by
+	// events rather than by a user
+	NoClientIP bool
+}
+
+// Log queues an audit event. It is written in the background and flushed
+// before the handler returns.
+func (l *AuditLogger) Log(ctx context.Context, userID, fileID, action string, metadata map[string]interface{}) {
+	Background(ctx, func() { l.Write(ctx, userID, fileID, action, metadata) })
+}
+
+// Write writes an audit event to DynamoDB before returning, for Lambdas
+// without FlushBackground
+func (l *AuditLogger) Write(ctx context.Context, userID, fileID, action string, metadata map[string]interface{}) {
+	if l.Geo {
+		// Coarse location of the caller; lookup failures record "unknown"
+		metadata["geo"] = ResolveGeo(ctx, SourceIP(ctx))
+	}
+	var ipAddress string
+	if !l.NoClientIP {
+		// Stored, truncated, hashed or dropped according to STORE_CLIENT_IP
+		ipAddress = SetAuditIP(metadata, SourceIP(ctx))
+	}
+	// Ties the entry to the invocation's logs
+	SetCorrelationID(ctx, metadata)
+
+	entry := AuditEntry{
+		UserID:    userID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		FileID:    fileID,
+		Action:    action,
+		Metadata:  metadata,
+		IPAddress: ipAddress,
+	}
+
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		log.Printf("Audit marshal error: %v", err)
+		RecordAuditWrite(0, err)
+		return
+	}
+
+	// Runs without a per-operation deadline so it can use the reserved budget
+	start := time.Now()
+	_, err = l.Client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(l.Table),
+		Item:      item,
+	})
+	RecordAuditWrite(time.Since(start), err)
+	if err != nil {
+		log.Printf("Audit log error: %v", err)
+	}
+}
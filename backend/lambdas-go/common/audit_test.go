@@ -0,0 +1,96 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// fakeAuditTable records the entries put into it
+type fakeAuditTable struct {
+	entries []AuditEntry
+	table   string
+	err     error
+}
+
+func (f *fakeAuditTable) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.table = aws.ToString(params.TableName)
+	var entry AuditEntry
+	if err := attributevalue.UnmarshalMap(params.Item, &entry); err != nil {
+		return nil, err
+	}
+	f.entries = append(f.entries, entry)
+	return &dynamodb.PutItemOutput{}, f.err
+}
+
+func TestAuditLoggerWrite(t *testing.T) {
+	defer func(policy string) { clientIPPolicy = policy }(clientIPPolicy)
+	clientIPPolicy = ClientIPFull
+	ctx := context.WithValue(context.Background(), sourceIPKey, "203.0.113.7")
+	ctx = context.WithValue(ctx, requestIDKey, "req-1")
+
+	table := &fakeAuditTable{}
+	logger := &AuditLogger{Client: table, Table: "FileAudit"}
+	lines := captureMetrics(t, func() {
+		logger.Write(ctx, "user-1", "file-1", "download", map[string]interface{}{"fileName": "a.txt"})
+	})
+	if table.table != "FileAudit" || len(table.entries) != 1 {
+		t.Fatalf("wrote %d entries to %q", len(table.entries), table.table)
+	}
+	entry := table.entries[0]
+	if entry.UserID != "user-1" || entry.FileID != "file-1" || entry.Action != "download" || entry.Timestamp == "" {
+		t.Errorf("entry = %+v", entry)
+	}
+	if entry.IPAddress != "203.0.113.7" || entry.Metadata[auditIPKey] != "203.0.113.7" {
+		t.Errorf("ipAddress = %q, metadata %v", entry.IPAddress, entry.Metadata[auditIPKey])
+	}
+	if entry.Metadata["correlationId"] != "req-1" {
+		t.Errorf("correlationId = %v", entry.Metadata["correlationId"])
+	}
+	if _, ok := entry.Metadata["geo"]; ok {
+		t.Error("geo recorded without Geo")
+	}
+	if len(lines) != 1 || lines[0][MetricAuditWriteSuccess] != 1.0 {
+		t.Errorf("metrics = %v, want one success", lines)
+	}
+}
+
+func TestAuditLoggerWithoutClientIP(t *testing.T) {
+	table := &fakeAuditTable{}
+	logger := &AuditLogger{Client: table, Table: "FileAudit", NoClientIP: true}
+	captureMetrics(t, func() {
+		logger.Write(context.Background(), "user-1", "file-1", "expire", map[string]interface{}{})
+	})
+	if len(table.entries) != 1 {
+		t.Fatalf("wrote %d entries", len(table.entries))
+	}
+	if entry := table.entries[0]; entry.IPAddress != "" || entry.Metadata[auditIPKey] != nil {
+		t.Errorf("event entry has an IP address: %+v", entry)
+	}
+}
+
+func TestAuditLoggerGeo(t *testing.T) {
+	table := &fakeAuditTable{}
+	logger := &AuditLogger{Client: table, Table: "FileAudit", Geo: true}
+	captureMetrics(t, func() {
+		logger.Write(context.Background(), "user-1", "file-1", "upload", map[string]interface{}{})
+	})
+	if _, ok := table.entries[0].Metadata["geo"]; !ok {
+		t.Error("geo missing with Geo set")
+	}
+}
+
+func TestAuditLoggerFailureIsCounted(t *testing.T) {
+	table := &fakeAuditTable{err: errors.New("throttled")}
+	logger := &AuditLogger{Client: table, Table: "FileAudit"}
+	lines := captureMetrics(t, func() {
+		logger.Write(context.Background(), "user-1", "file-1", "delete", map[string]interface{}{})
+	})
+	if len(lines) != 1 || lines[0][MetricAuditWriteFailure] != 1.0 {
+		t.Errorf("metrics = %v, want one failure", lines)
+	}
+}
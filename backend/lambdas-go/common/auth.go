@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -68,6 +69,14 @@ func ExtractUserID(request events.APIGatewayProxyRequest) (string, error) {
 	return "", fmt.Errorf("unauthorized: userId not found")
 }
 
+// userIDPattern matches Cognito subs and usernames
+var userIDPattern = regexp.MustCompile(`^[A-Za-z0-9@._:+-]{1,128}$`)
+
+// IsValidUserID reports whether s looks like a user ID we issue
+func IsValidUserID(s string) bool {
+	return userIDPattern.MatchString(s)
+}
+
 // extractUserIDFromJWT decodes the JWT payload and extracts the user ID
 func extractUserIDFromJWT(token string) (string, error) {
 	parts := strings.Split(token, ".")
@@ -129,6 +138,8 @@ func BuildResponse(statusCode int, body interface{}) events.APIGatewayProxyRespo
 // ErrorResponse represents an error response body
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// Code is a stable, machine-readable error kind, set by ToResponse
+	Code string `json:"code,omitempty"`
 }
 
 // BuildErrorResponse creates an error response
@@ -0,0 +1,147 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	retryAttempts  = 3
+	retryBaseDelay = 100 * time.Millisecond
+)
+
+// throttlingCodes are AWS error codes that mean the request was rate limited
+// and can be retried later
+var throttlingCodes = map[string]bool{
+	"ThrottlingException":                    true,
+	"ProvisionedThroughputExceededException": true,
+	"RequestLimitExceeded":                   true,
+	"TooManyRequestsException":               true,
+	"SlowDown":                               true,
+}
+
+// accessDeniedCodes mean the Lambda's role may not make the call
+var accessDeniedCodes = map[string]bool{
+	"AccessDenied":                true,
+	"AccessDeniedException":       true,
+	"UnauthorizedOperation":       true,
+	"ExpiredToken":                true,
+	"ExpiredTokenException":       true,
+	"InvalidAccessKeyId":          true,
+	"SignatureDoesNotMatch":       true,
+	"UnrecognizedClientException": true,
+}
+
+// notFoundCodes mean the object, item or resource does not exist
+var notFoundCodes = map[string]bool{
+	"NoSuchKey":                 true,
+	"NoSuchBucket":              true,
+	"NoSuchUpload":              true,
+	"NotFound":                  true,
+	"ResourceNotFoundException": true,
+}
+
+// validationCodes mean AWS rejected the request's parameters
+var validationCodes = map[string]bool{
+	"ValidationException": true,
+	"InvalidArgument":     true,
+	"InvalidRequest":      true,
+	"InvalidParameter":    true,
+	"EntityTooLarge":      true,
+	"KeyTooLongError":     true,
+	"MalformedXML":        true,
+	"InvalidPart":         true,
+	"InvalidPartOrder":    true,
+	"EntityTooSmall":      true,
+}
+
+// ClassifyAWSError maps an error from an AWS SDK call to a Kind and reports
+// whether retrying the call can help: KindThrottled for rate limiting,
+// KindForbidden for access denied, KindNotFound, KindValidation for rejected
+// parameters, KindConflict for failed conditions, and KindInternal for service faults,
+// network errors and anything unrecognized. Throttling, service faults,
+// network errors and timeouts are retryable.
+func ClassifyAWSError(err error) (Kind, bool) {
+	if err == nil {
+		return KindInternal, false
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code := apiErr.ErrorCode()
+		switch {
+		case throttlingCodes[code]:
+			return KindThrottled, true
+		case accessDeniedCodes[code]:
+			return KindForbidden, false
+		case notFoundCodes[code]:
+			return KindNotFound, false
+		case validationCodes[code]:
+			return KindValidation, false
+		case code == "ConditionalCheckFailedException":
+			return KindConflict, false
+		case apiErr.ErrorFault() == smithy.FaultServer:
+			return KindInternal, true
+		}
+	}
+
+	var responseErr *smithyhttp.ResponseError
+	if errors.As(err, &responseErr) {
+		status := responseErr.HTTPStatusCode()
+		switch {
+		case status == 429:
+			return KindThrottled, true
+		case status == 403:
+			return KindForbidden, false
+		case status == 404:
+			return KindNotFound, false
+		case status >= 500:
+			return KindInternal, true
+		}
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return KindInternal, false
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return KindInternal, true
+	}
+	return KindInternal, false
+}
+
+// Retry calls fn until it succeeds, up to retryAttempts times, backing off
+// with jitter between attempts. It stops early on errors ClassifyAWSError
+// says are not retryable, or once ctx is done. The SDK already retries each
+// call a few times; use Retry for operations worth a longer wait, such as
+// writes that would otherwise be lost.
+func Retry(ctx context.Context, fn func(ctx context.Context) error) error {
+	var err error
+	for attempt := 0; attempt < retryAttempts; attempt++ {
+		if attempt > 0 {
+			delay := retryBaseDelay << (attempt - 1)
+			delay += time.Duration(rand.Int63n(int64(delay)))
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+		if _, retryable := ClassifyAWSError(err); !retryable {
+			return err
+		}
+	}
+	return err
+}
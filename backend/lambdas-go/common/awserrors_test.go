@@ -0,0 +1,86 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+func TestClassifyAWSError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		kind      Kind
+		retryable bool
+	}{
+		{"throttling", &smithy.GenericAPIError{Code: "ThrottlingException"}, KindThrottled, true},
+		{"wrapped throttling", fmt.Errorf("put item: %w", &smithy.GenericAPIError{Code: "SlowDown"}), KindThrottled, true},
+		{"access denied", &smithy.GenericAPIError{Code: "AccessDenied"}, KindForbidden, false},
+		{"not found", &smithy.GenericAPIError{Code: "NoSuchKey"}, KindNotFound, false},
+		{"validation", &smithy.GenericAPIError{Code: "ValidationException"}, KindValidation, false},
+		{"condition", &smithy.GenericAPIError{Code: "ConditionalCheckFailedException"}, KindConflict, false},
+		{"server fault", &smithy.GenericAPIError{Code: "InternalServerError", Fault: smithy.FaultServer}, KindInternal, true},
+		{"unknown client fault", &smithy.GenericAPIError{Code: "Whatever", Fault: smithy.FaultClient}, KindInternal, false},
+		{"http 503", responseError(503), KindInternal, true},
+		{"http 404", responseError(404), KindNotFound, false},
+		{"deadline", context.DeadlineExceeded, KindInternal, true},
+		{"canceled", context.Canceled, KindInternal, false},
+		{"plain error", errors.New("boom"), KindInternal, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, retryable := ClassifyAWSError(tt.err)
+			if kind != tt.kind || retryable != tt.retryable {
+				t.Errorf("ClassifyAWSError = (%v, %t), want (%v, %t)", kind, retryable, tt.kind, tt.retryable)
+			}
+		})
+	}
+}
+
+func responseError(status int) error {
+	return &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+		Err:      errors.New("http error"),
+	}
+}
+
+func TestRetry(t *testing.T) {
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException"}
+
+	calls := 0
+	err := Retry(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 2 {
+			return throttled
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("retryable error: err = %v after %d calls, want success after 2", err, calls)
+	}
+
+	calls = 0
+	err = Retry(context.Background(), func(ctx context.Context) error {
+		calls++
+		return throttled
+	})
+	if !errors.Is(err, throttled) || calls != retryAttempts {
+		t.Errorf("persistent error: err = %v after %d calls, want it after %d", err, calls, retryAttempts)
+	}
+
+	calls = 0
+	denied := &smithy.GenericAPIError{Code: "AccessDenied"}
+	err = Retry(context.Background(), func(ctx context.Context) error {
+		calls++
+		return denied
+	})
+	if !errors.Is(err, denied) || calls != 1 {
+		t.Errorf("non-retryable error: err = %v after %d calls, want it after 1", err, calls)
+	}
+}
@@ -0,0 +1,116 @@
+package common
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	defaultFlushTimeout = 2 * time.Second
+	backgroundWorkers   = 4
+	backgroundQueueSize = 16
+)
+
+// flushTimeout bounds how long FlushBackground waits for queued work after
+// the handler returns (BACKGROUND_FLUSH_TIMEOUT)
+var flushTimeout = durationFromEnv("BACKGROUND_FLUSH_TIMEOUT", defaultFlushTimeout)
+
+const backgroundKey contextKey = "background"
+
+// backgroundQueue runs a request's background work on a few workers
+type backgroundQueue struct {
+	jobs   chan func()
+	wg     sync.WaitGroup
+	start  sync.Once
+	mu     sync.Mutex
+	closed bool
+}
+
+// submit queues fn, starting the workers on first use. Work submitted after
+// the queue is flushed runs in its own goroutine, as without a queue.
+func (q *backgroundQueue) submit(fn func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		go fn()
+		return
+	}
+
+	q.start.Do(func() {
+		for i := 0; i < backgroundWorkers; i++ {
+			go q.work()
+		}
+	})
+	q.wg.Add(1)
+	q.jobs <- fn
+}
+
+// work runs jobs until the queue is closed
+func (q *backgroundQueue) work() {
+	for fn := range q.jobs {
+		func() {
+			defer q.wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Panic in background work: %v", r)
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+// flush closes the queue and waits for queued work, giving up at timeout or
+// when ctx is done. It reports whether everything finished.
+func (q *backgroundQueue) flush(ctx context.Context, timeout time.Duration) bool {
+	q.mu.Lock()
+	q.closed = true
+	close(q.jobs)
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// Background runs fn off the request path. Under FlushBackground it is queued
+// and finished before the handler returns, so Lambda can't freeze the
+// environment with the work half done; otherwise it runs in a goroutine.
+func Background(ctx context.Context, fn func()) {
+	if q, ok := ctx.Value(backgroundKey).(*backgroundQueue); ok {
+		q.submit(fn)
+		return
+	}
+	go fn()
+}
+
+// FlushBackground gives the request a queue for Background work and drains it
+// once the handler is done, waiting at most BACKGROUND_FLUSH_TIMEOUT. Audit
+// writes go through it so they aren't lost when Lambda freezes the
+// environment right after the response.
+func FlushBackground(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		q := &backgroundQueue{jobs: make(chan func(), backgroundQueueSize)}
+		response, err := next(context.WithValue(ctx, backgroundKey, q), request)
+		if !q.flush(ctx, flushTimeout) {
+			log.Printf("Background work still running after %s, continuing without it", flushTimeout)
+		}
+		return response, err
+	}
+}
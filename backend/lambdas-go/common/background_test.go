@@ -0,0 +1,77 @@
+package common
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestFlushBackgroundWaitsForWork(t *testing.T) {
+	var written atomic.Int32
+	handler := FlushBackground(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		for i := 0; i < 20; i++ {
+			Background(ctx, func() {
+				time.Sleep(10 * time.Millisecond) // a slow audit write
+				written.Add(1)
+			})
+		}
+		return BuildResponse(200, nil), nil
+	})
+
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{})
+	if err != nil || response.StatusCode != 200 {
+		t.Fatalf("unexpected response %d, %v", response.StatusCode, err)
+	}
+	if got := written.Load(); got != 20 {
+		t.Errorf("%d of 20 writes finished before the handler returned", got)
+	}
+}
+
+func TestFlushBackgroundTimesOut(t *testing.T) {
+	defer func(timeout time.Duration) { flushTimeout = timeout }(flushTimeout)
+	flushTimeout = 20 * time.Millisecond
+
+	release := make(chan struct{})
+	defer close(release)
+	handler := FlushBackground(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		Background(ctx, func() { <-release })
+		return BuildResponse(200, nil), nil
+	})
+
+	start := time.Now()
+	if _, err := handler(context.Background(), events.APIGatewayProxyRequest{}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("handler waited %s for stuck work", elapsed)
+	}
+}
+
+func TestFlushBackgroundSurvivesPanic(t *testing.T) {
+	var written atomic.Bool
+	handler := FlushBackground(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		Background(ctx, func() { panic("boom") })
+		Background(ctx, func() { written.Store(true) })
+		return BuildResponse(200, nil), nil
+	})
+
+	if _, err := handler(context.Background(), events.APIGatewayProxyRequest{}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !written.Load() {
+		t.Error("work after a panicking job did not run")
+	}
+}
+
+func TestBackgroundWithoutQueue(t *testing.T) {
+	done := make(chan struct{})
+	Background(context.Background(), func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("background work did not run without a queue")
+	}
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// BuildBinaryResponse returns data as a base64-encoded body, which API Gateway
+// decodes back to bytes when the content type is listed in its binary media
+// types. With compress, data is gzipped and Content-Encoding is set; callers
+// should only ask for it when AcceptsGzip reports the client supports it.
+func BuildBinaryResponse(statusCode int, contentType string, data []byte, compress bool) events.APIGatewayProxyResponse {
+	headers := map[string]string{
+		"Content-Type":                 contentType,
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Headers": "Content-Type,Authorization",
+		"Vary":                         "Accept-Encoding",
+	}
+
+	if compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(data)
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			return ToResponse(Internal("Compression error", err))
+		}
+		data = buf.Bytes()
+		headers["Content-Encoding"] = "gzip"
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode:      statusCode,
+		Headers:         headers,
+		Body:            base64.StdEncoding.EncodeToString(data),
+		IsBase64Encoded: true,
+	}
+}
+
+// AcceptsGzip reports whether the request's Accept-Encoding allows gzip.
+// API Gateway keeps the client's header casing, so the lookup ignores case.
+func AcceptsGzip(request events.APIGatewayProxyRequest) bool {
+	for name, value := range request.Headers {
+		if !strings.EqualFold(name, "Accept-Encoding") {
+			continue
+		}
+		for _, coding := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(coding, ";")
+			coding = strings.TrimSpace(coding)
+			if !strings.EqualFold(coding, "gzip") && coding != "*" {
+				continue
+			}
+			// "gzip;q=0" explicitly refuses it
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
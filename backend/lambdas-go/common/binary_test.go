@@ -0,0 +1,70 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestBuildBinaryResponse(t *testing.T) {
+	data := []byte("fileId,fileName\n1,a.txt\n")
+
+	response := BuildBinaryResponse(200, "text/csv", data, false)
+	if !response.IsBase64Encoded {
+		t.Error("IsBase64Encoded not set")
+	}
+	if response.Headers["Content-Type"] != "text/csv" {
+		t.Errorf("Content-Type = %q", response.Headers["Content-Type"])
+	}
+	if _, ok := response.Headers["Content-Encoding"]; ok {
+		t.Error("Content-Encoding set without compression")
+	}
+	body, err := base64.StdEncoding.DecodeString(response.Body)
+	if err != nil || !bytes.Equal(body, data) {
+		t.Errorf("body = %q, %v; want %q", body, err, data)
+	}
+}
+
+func TestBuildBinaryResponseCompressed(t *testing.T) {
+	data := bytes.Repeat([]byte("zip"), 1000)
+
+	response := BuildBinaryResponse(200, "application/zip", data, true)
+	if response.Headers["Content-Encoding"] != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", response.Headers["Content-Encoding"])
+	}
+	compressed, err := base64.StdEncoding.DecodeString(response.Body)
+	if err != nil {
+		t.Fatalf("body is not base64: %v", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("body is not gzip: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil || !bytes.Equal(body, data) {
+		t.Errorf("decompressed body differs (%v)", err)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		headers map[string]string
+		want    bool
+	}{
+		{nil, false},
+		{map[string]string{"Accept-Encoding": "gzip, deflate, br"}, true},
+		{map[string]string{"accept-encoding": "br;q=1.0, GZIP;q=0.5"}, true},
+		{map[string]string{"Accept-Encoding": "*"}, true},
+		{map[string]string{"Accept-Encoding": "gzip;q=0"}, false},
+		{map[string]string{"Accept-Encoding": "identity"}, false},
+	}
+	for _, tt := range tests {
+		if got := AcceptsGzip(events.APIGatewayProxyRequest{Headers: tt.headers}); got != tt.want {
+			t.Errorf("AcceptsGzip(%v) = %v, want %v", tt.headers, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/smithy-go/middleware"
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerWindow    = 30 * time.Second
+	defaultBreakerCooldown  = 15 * time.Second
+)
+
+// dynamoBreaker guards every DynamoDB client built with DynamoDBCircuitBreaker.
+// It is nil, and calls are never short-circuited, when
+// DYNAMODB_BREAKER_THRESHOLD is 0.
+var dynamoBreaker = dynamoBreakerFromEnv()
+
+// CircuitOpenError is returned instead of making a call while a breaker is
+// open. ToResponse turns it into a 503 with Retry-After.
+type CircuitOpenError struct {
+	Name string
+	// RetryAfter is the time left until the breaker lets a call through again
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s circuit breaker is open, retry in %s", e.Name, e.RetryAfter.Round(time.Second))
+}
+
+// CircuitBreaker stops calls to a failing dependency so handlers fail fast
+// instead of each waiting for its own timeout. After threshold consecutive
+// outage errors (see isOutage), all within window, it opens and rejects calls
+// for cooldown. Then a single trial call goes through: success closes the
+// breaker, failure opens it for another cooldown. The state lives in the
+// Lambda container, so each container trips on its own.
+type CircuitBreaker struct {
+	name      string
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu           sync.Mutex
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time
+	// probing is set while the trial call after a cooldown is in flight
+	probing bool
+}
+
+// NewCircuitBreaker returns a closed breaker
+func NewCircuitBreaker(name string, threshold int, window, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{name: name, threshold: threshold, window: window, cooldown: cooldown, now: time.Now}
+}
+
+// Allow reports whether a call may go ahead, returning a *CircuitOpenError
+// if not. Every allowed call must be followed by Record.
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openUntil.IsZero() {
+		return nil
+	}
+	now := b.now()
+	if now.Before(b.openUntil) {
+		return &CircuitOpenError{Name: b.name, RetryAfter: b.openUntil.Sub(now)}
+	}
+	if b.probing {
+		return &CircuitOpenError{Name: b.name, RetryAfter: time.Second}
+	}
+	b.probing = true
+	return nil
+}
+
+// Record reports the result of an allowed call
+func (b *CircuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if !isOutage(err) {
+		if !b.openUntil.IsZero() {
+			log.Printf("%s circuit breaker closed", b.name)
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.probing = false
+		return
+	}
+
+	if b.probing {
+		// The trial call failed: stay open for another cooldown
+		b.probing = false
+		b.openUntil = now.Add(b.cooldown)
+		return
+	}
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures >= b.threshold && b.openUntil.IsZero() {
+		log.Printf("%s circuit breaker opened after %d failures: %v", b.name, b.failures, err)
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// isOutage reports whether err suggests the service is down or unreachable:
+// server faults, network errors and timeouts. Client errors, throttling and
+// failed conditions mean the service answered and don't trip the breaker.
+func isOutage(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	kind, retryable := ClassifyAWSError(err)
+	return kind == KindInternal && retryable
+}
+
+// addMiddleware runs every operation of a client through the breaker. It is
+// added to the initialize step, so the SDK's own retries of one call count
+// as a single attempt.
+func (b *CircuitBreaker) addMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CircuitBreaker",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			if err := b.Allow(); err != nil {
+				return middleware.InitializeOutput{}, middleware.Metadata{}, err
+			}
+			out, metadata, err := next.HandleInitialize(ctx, in)
+			b.Record(err)
+			return out, metadata, err
+		}), middleware.Before)
+}
+
+// DynamoDBCircuitBreaker is a dynamodb.NewFromConfig option that puts the
+// client behind the shared DynamoDB breaker, so during an outage handlers
+// answer 503 at once instead of timing out
+func DynamoDBCircuitBreaker(o *dynamodb.Options) {
+	if dynamoBreaker != nil {
+		o.APIOptions = append(o.APIOptions, dynamoBreaker.addMiddleware)
+	}
+}
+
+// dynamoBreakerFromEnv builds the DynamoDB breaker from
+// DYNAMODB_BREAKER_THRESHOLD (consecutive failures, 0 disables it),
+// DYNAMODB_BREAKER_WINDOW and DYNAMODB_BREAKER_COOLDOWN (Go durations)
+func dynamoBreakerFromEnv() *CircuitBreaker {
+	threshold := defaultBreakerThreshold
+	if v := os.Getenv("DYNAMODB_BREAKER_THRESHOLD"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			log.Printf("Invalid DYNAMODB_BREAKER_THRESHOLD %q, using %d", v, defaultBreakerThreshold)
+		} else {
+			threshold = parsed
+		}
+	}
+	if threshold == 0 {
+		return nil
+	}
+	return NewCircuitBreaker("DynamoDB", threshold,
+		durationFromEnv("DYNAMODB_BREAKER_WINDOW", defaultBreakerWindow),
+		durationFromEnv("DYNAMODB_BREAKER_COOLDOWN", defaultBreakerCooldown))
+}
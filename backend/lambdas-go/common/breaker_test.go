@@ -0,0 +1,173 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+var errOutage = &smithy.GenericAPIError{Code: "InternalServerError", Fault: smithy.FaultServer}
+
+// testBreaker returns a breaker with a clock the test moves by hand
+func testBreaker(threshold int) (*CircuitBreaker, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := NewCircuitBreaker("test", threshold, 10*time.Second, 30*time.Second)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func mustAllow(t *testing.T, b *CircuitBreaker) {
+	t.Helper()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow() = %v, want the call let through", err)
+	}
+}
+
+func mustReject(t *testing.T, b *CircuitBreaker) *CircuitOpenError {
+	t.Helper()
+	var openErr *CircuitOpenError
+	if err := b.Allow(); !errors.As(err, &openErr) {
+		t.Fatalf("Allow() = %v, want a CircuitOpenError", err)
+	}
+	return openErr
+}
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b, now := testBreaker(3)
+
+	for i := 0; i < 3; i++ {
+		mustAllow(t, b)
+		b.Record(errOutage)
+	}
+
+	openErr := mustReject(t, b)
+	if openErr.RetryAfter != 30*time.Second {
+		t.Errorf("RetryAfter = %s, want 30s", openErr.RetryAfter)
+	}
+	*now = now.Add(20 * time.Second)
+	if openErr := mustReject(t, b); openErr.RetryAfter != 10*time.Second {
+		t.Errorf("RetryAfter = %s, want 10s", openErr.RetryAfter)
+	}
+}
+
+func TestCircuitBreakerIgnoresSpreadOutAndNonOutageErrors(t *testing.T) {
+	b, now := testBreaker(3)
+
+	// A success resets the count
+	b.Record(errOutage)
+	b.Record(errOutage)
+	b.Record(nil)
+	b.Record(errOutage)
+	mustAllow(t, b)
+
+	// Failures further apart than the window don't add up
+	b, now = testBreaker(3)
+	for i := 0; i < 5; i++ {
+		b.Record(errOutage)
+		*now = now.Add(6 * time.Second)
+	}
+	mustAllow(t, b)
+
+	// The service answered, so these don't count
+	b, _ = testBreaker(2)
+	for _, err := range []error{
+		&smithy.GenericAPIError{Code: "ConditionalCheckFailedException"},
+		&smithy.GenericAPIError{Code: "ProvisionedThroughputExceededException"},
+		&smithy.GenericAPIError{Code: "ValidationException"},
+		context.Canceled,
+	} {
+		b.Record(err)
+	}
+	mustAllow(t, b)
+}
+
+func TestCircuitBreakerProbesAfterCooldown(t *testing.T) {
+	b, now := testBreaker(1)
+	b.Record(errOutage)
+	mustReject(t, b)
+
+	// After the cooldown one trial call goes through, others wait for it
+	*now = now.Add(30 * time.Second)
+	mustAllow(t, b)
+	mustReject(t, b)
+
+	// A failed trial opens the breaker for another cooldown
+	b.Record(errOutage)
+	if openErr := mustReject(t, b); openErr.RetryAfter != 30*time.Second {
+		t.Errorf("RetryAfter = %s, want 30s", openErr.RetryAfter)
+	}
+
+	// A successful trial closes it
+	*now = now.Add(30 * time.Second)
+	mustAllow(t, b)
+	b.Record(nil)
+	mustAllow(t, b)
+	mustAllow(t, b)
+}
+
+// failingTransport answers every request with a 500
+type failingTransport struct {
+	requests int
+}
+
+func (f *failingTransport) Do(req *http.Request) (*http.Response, error) {
+	f.requests++
+	return &http.Response{
+		StatusCode: 500,
+		Header:     http.Header{"Content-Type": []string{"application/x-amz-json-1.0"}},
+		Body:       io.NopCloser(strings.NewReader(`{"__type":"com.amazonaws.dynamodb.v20120810#InternalServerError","message":"down"}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestCircuitBreakerShortCircuitsDynamoDBClient(t *testing.T) {
+	b, _ := testBreaker(2)
+	transport := &failingTransport{}
+	client := dynamodb.New(dynamodb.Options{
+		Region:           "us-east-1",
+		BaseEndpoint:     aws.String("http://localhost:8000"),
+		Credentials:      aws.AnonymousCredentials{},
+		HTTPClient:       transport,
+		RetryMaxAttempts: 1,
+		APIOptions:       []func(*middleware.Stack) error{b.addMiddleware},
+	})
+	call := func() error {
+		_, err := client.GetItem(context.Background(), &dynamodb.GetItemInput{
+			TableName: aws.String("UserFiles"),
+			Key:       map[string]types.AttributeValue{"userId": &types.AttributeValueMemberS{Value: "user-123"}},
+		})
+		return err
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := call(); err == nil {
+			t.Fatal("call succeeded against a failing service")
+		}
+	}
+	err := call()
+	var openErr *CircuitOpenError
+	if !errors.As(err, &openErr) {
+		t.Fatalf("third call = %v, want a CircuitOpenError", err)
+	}
+	if transport.requests != 2 {
+		t.Errorf("service got %d requests, want 2", transport.requests)
+	}
+
+	response := ToResponse(Internal("DynamoDB get error", err))
+	if response.StatusCode != 503 {
+		t.Errorf("status = %d, want 503", response.StatusCode)
+	}
+	if response.Headers["Retry-After"] != "30" {
+		t.Errorf("Retry-After = %q, want 30", response.Headers["Retry-After"])
+	}
+}
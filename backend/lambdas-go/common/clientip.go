@@ -0,0 +1,91 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// Values of STORE_CLIENT_IP, which controls how the caller's IP address is
+// kept in audit metadata
+const (
+	ClientIPFull     = "true"     // store the address as is (default)
+	ClientIPOmit     = "false"    // don't store it
+	ClientIPTruncate = "truncate" // keep the /24 (IPv4) or /48 (IPv6) network
+	ClientIPHash     = "hash"     // store a SHA-256 of CLIENT_IP_HASH_SALT + address
+)
+
+const auditIPKey = "ipAddress"
+
+var (
+	// clientIPPolicy is read once per container
+	clientIPPolicy = clientIPPolicyFromEnv()
+	// clientIPHashSalt keeps hashed addresses from being reversed by hashing
+	// the whole IPv4 space; set it whenever STORE_CLIENT_IP=hash
+	clientIPHashSalt = os.Getenv("CLIENT_IP_HASH_SALT")
+)
+
+// clientIPPolicyFromEnv parses STORE_CLIENT_IP. An invalid value omits the
+// address, so a typo never stores more than intended.
+func clientIPPolicyFromEnv() string {
+	v := strings.ToLower(strings.TrimSpace(os.Getenv("STORE_CLIENT_IP")))
+	switch v {
+	case "":
+		return ClientIPFull
+	case ClientIPFull, ClientIPOmit, ClientIPTruncate, ClientIPHash:
+		return v
+	default:
+		log.Printf("Invalid STORE_CLIENT_IP %q, not storing client IPs", v)
+		return ClientIPOmit
+	}
+}
+
+// SetAuditIP records ip under metadata "ipAddress" as allowed by
+// STORE_CLIENT_IP and returns the stored value, for the entry's top-level
+// ipAddress attribute. When the policy omits addresses any existing
+// "ipAddress" key is removed, so clients can't store one either, and it
+// returns "".
+func SetAuditIP(metadata map[string]interface{}, ip string) string {
+	value, ok := auditIP(clientIPPolicy, clientIPHashSalt, ip)
+	if !ok {
+		delete(metadata, auditIPKey)
+		return ""
+	}
+	metadata[auditIPKey] = value
+	return value
+}
+
+// StoredAuditIP returns the form ip is stored in under STORE_CLIENT_IP, so a
+// query for an address matches truncated or hashed entries. It reports false
+// when addresses are not stored.
+func StoredAuditIP(ip string) (string, bool) {
+	return auditIP(clientIPPolicy, clientIPHashSalt, ip)
+}
+
+// auditIP returns the form of ip to store under policy and whether to store it
+func auditIP(policy, salt, ip string) (string, bool) {
+	if policy == ClientIPOmit {
+		return "", false
+	}
+
+	addr := net.ParseIP(strings.TrimSpace(ip))
+	if addr == nil {
+		return geoUnknown, true
+	}
+
+	switch policy {
+	case ClientIPTruncate:
+		if v4 := addr.To4(); v4 != nil {
+			return v4.Mask(net.CIDRMask(24, 32)).String(), true
+		}
+		return addr.Mask(net.CIDRMask(48, 128)).String(), true
+	case ClientIPHash:
+		sum := sha256.Sum256([]byte(salt + addr.String()))
+		return "sha256:" + hex.EncodeToString(sum[:]), true
+	default:
+		return addr.String(), true
+	}
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuditIP(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		ip     string
+		want   string
+		stored bool
+	}{
+		{"full", ClientIPFull, "203.0.113.42", "203.0.113.42", true},
+		{"full missing", ClientIPFull, "", "unknown", true},
+		{"omit", ClientIPOmit, "203.0.113.42", "", false},
+		{"omit missing", ClientIPOmit, "", "", false},
+		{"truncate v4", ClientIPTruncate, "203.0.113.42", "203.0.113.0", true},
+		{"truncate v6", ClientIPTruncate, "2001:db8:abcd:12::1", "2001:db8:abcd::", true},
+		{"truncate invalid", ClientIPTruncate, "not-an-ip", "unknown", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, stored := auditIP(tt.policy, "", tt.ip)
+			if got != tt.want || stored != tt.stored {
+				t.Errorf("auditIP(%q, %q) = %q, %v; want %q, %v", tt.policy, tt.ip, got, stored, tt.want, tt.stored)
+			}
+		})
+	}
+}
+
+func TestAuditIPHash(t *testing.T) {
+	first, stored := auditIP(ClientIPHash, "salt", "203.0.113.42")
+	if !stored || !strings.HasPrefix(first, "sha256:") || strings.Contains(first, "203.0.113") {
+		t.Fatalf("unexpected hashed value %q", first)
+	}
+	if again, _ := auditIP(ClientIPHash, "salt", "203.0.113.42"); again != first {
+		t.Errorf("hash is not stable: %q != %q", again, first)
+	}
+	if other, _ := auditIP(ClientIPHash, "other-salt", "203.0.113.42"); other == first {
+		t.Error("salt does not change the hash")
+	}
+}
+
+func TestSetAuditIP(t *testing.T) {
+	defer func(policy string) { clientIPPolicy = policy }(clientIPPolicy)
+
+	clientIPPolicy = ClientIPFull
+	metadata := map[string]interface{}{}
+	stored := SetAuditIP(metadata, "203.0.113.42")
+	if metadata["ipAddress"] != "203.0.113.42" || stored != "203.0.113.42" {
+		t.Errorf("full policy stored %v, returned %q", metadata["ipAddress"], stored)
+	}
+
+	clientIPPolicy = ClientIPOmit
+	metadata = map[string]interface{}{"ipAddress": "198.51.100.7"}
+	stored = SetAuditIP(metadata, "203.0.113.42")
+	if _, ok := metadata["ipAddress"]; ok || stored != "" {
+		t.Errorf("omit policy kept ipAddress %v, returned %q", metadata["ipAddress"], stored)
+	}
+}
+
+func TestStoredAuditIPMatchesSetAuditIP(t *testing.T) {
+	defer func(policy string) { clientIPPolicy = policy }(clientIPPolicy)
+
+	for _, policy := range []string{ClientIPFull, ClientIPTruncate, ClientIPHash} {
+		clientIPPolicy = policy
+		stored := SetAuditIP(map[string]interface{}{}, "203.0.113.42")
+		if query, ok := StoredAuditIP("203.0.113.42"); !ok || query != stored {
+			t.Errorf("%s: query value %q does not match stored %q", policy, query, stored)
+		}
+	}
+}
+
+func TestClientIPPolicyFromEnv(t *testing.T) {
+	tests := map[string]string{
+		"":         ClientIPFull,
+		"true":     ClientIPFull,
+		"FALSE":    ClientIPOmit,
+		"truncate": ClientIPTruncate,
+		"hash":     ClientIPHash,
+		"yes":      ClientIPOmit,
+	}
+	for value, want := range tests {
+		t.Setenv("STORE_CLIENT_IP", value)
+		if got := clientIPPolicyFromEnv(); got != want {
+			t.Errorf("STORE_CLIENT_IP=%q: got %q, want %q", value, got, want)
+		}
+	}
+}
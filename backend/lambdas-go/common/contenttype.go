@@ -0,0 +1,116 @@
+package common
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// SniffLen is how many leading bytes SniffContentType looks at
+const SniffLen = 512
+
+// oleSignature starts OLE2 compound files such as legacy Word documents,
+// which http.DetectContentType doesn't recognize
+var oleSignature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+// sniffedTypes lists, for declared types that can be told from their first
+// bytes, the types SniffContentType reports for valid content of that type
+var sniffedTypes = map[string][]string{
+	"image/jpeg":         {"image/jpeg"},
+	"image/png":          {"image/png"},
+	"image/gif":          {"image/gif"},
+	"image/webp":         {"image/webp"},
+	"application/pdf":    {"application/pdf"},
+	"application/msword": {"application/x-ole-storage"},
+	// Office Open XML documents are zip archives
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": {"application/zip"},
+	// HTML is left out on purpose: served as text it is harmless, but a
+	// mislabeled page is how stored XSS gets in
+	"text/plain":       {"text/plain", "text/xml"},
+	"application/json": {"text/plain"},
+}
+
+// NormalizeContentType reduces a Content-Type value to its lowercase base
+// media type, so "Text/Plain; charset=utf-8" becomes "text/plain"
+func NormalizeContentType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// SniffContentType identifies content from its first SniffLen bytes with
+// http.DetectContentType, adding OLE2 compound files, and returns the
+// normalized type
+func SniffContentType(data []byte) string {
+	if bytes.HasPrefix(data, oleSignature) {
+		return "application/x-ole-storage"
+	}
+	return NormalizeContentType(http.DetectContentType(data))
+}
+
+// ContentMatches reports whether content SniffContentType identified as
+// sniffed can be of the declared type. Declared types without a known
+// signature always match, since nothing tells them from arbitrary bytes.
+func ContentMatches(declared, sniffed string) bool {
+	expected, ok := sniffedTypes[NormalizeContentType(declared)]
+	if !ok {
+		return true
+	}
+	for _, t := range expected {
+		if t == sniffed {
+			return true
+		}
+	}
+	return false
+}
+
+// File categories returned by FileCategory
+const (
+	CategoryImage    = "image"
+	CategoryDocument = "document"
+	CategoryArchive  = "archive"
+	CategoryText     = "text"
+	CategoryOther    = "other"
+)
+
+// categoriesByType maps media types whose category can't be read from the
+// top-level type alone
+var categoriesByType = map[string]string{
+	"application/pdf":    CategoryDocument,
+	"application/msword": CategoryDocument,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   CategoryDocument,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         CategoryDocument,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": CategoryDocument,
+	"application/vnd.ms-excel":                CategoryDocument,
+	"application/vnd.ms-powerpoint":           CategoryDocument,
+	"application/vnd.oasis.opendocument.text": CategoryDocument,
+	"application/rtf":                         CategoryDocument,
+	"application/json":                        CategoryText,
+	"application/xml":                         CategoryText,
+	"application/zip":                         CategoryArchive,
+	"application/gzip":                        CategoryArchive,
+	"application/x-gzip":                      CategoryArchive,
+	"application/x-tar":                       CategoryArchive,
+	"application/x-7z-compressed":             CategoryArchive,
+	"application/x-rar-compressed":            CategoryArchive,
+	"application/vnd.rar":                     CategoryArchive,
+	"application/x-bzip2":                     CategoryArchive,
+}
+
+// FileCategory classifies a Content-Type for display, so clients can pick an
+// icon without their own mapping: "image", "document", "archive", "text" or
+// "other"
+func FileCategory(contentType string) string {
+	contentType = NormalizeContentType(contentType)
+	if category, ok := categoriesByType[contentType]; ok {
+		return category
+	}
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return CategoryImage
+	case strings.HasPrefix(contentType, "text/"):
+		return CategoryText
+	}
+	return CategoryOther
+}
@@ -0,0 +1,86 @@
+package common
+
+import "testing"
+
+func TestNormalizeContentType(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"image/jpeg", "image/jpeg"},
+		{"Image/JPEG", "image/jpeg"},
+		{"text/plain; charset=utf-8", "text/plain"},
+		{"Text/Plain;Charset=UTF-8", "text/plain"},
+		{"  application/json  ", "application/json"},
+		{"application/json ; charset=utf-8", "application/json"},
+		{"multipart/form-data; boundary=abc; foo=bar", "multipart/form-data"},
+		{"", ""},
+		{";charset=utf-8", ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeContentType(tt.in); got != tt.want {
+			t.Errorf("NormalizeContentType(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFileCategory(t *testing.T) {
+	tests := []struct {
+		contentType, want string
+	}{
+		// Every type upload_file accepts
+		{"image/jpeg", CategoryImage},
+		{"image/png", CategoryImage},
+		{"image/gif", CategoryImage},
+		{"image/webp", CategoryImage},
+		{"application/pdf", CategoryDocument},
+		{"application/msword", CategoryDocument},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", CategoryDocument},
+		{"text/plain", CategoryText},
+		{"application/json", CategoryText},
+
+		{"Image/SVG+XML", CategoryImage},
+		{"text/csv; charset=utf-8", CategoryText},
+		{"application/zip", CategoryArchive},
+		{"application/x-tar", CategoryArchive},
+		{"application/octet-stream", CategoryOther},
+		{"video/mp4", CategoryOther},
+		{"", CategoryOther},
+	}
+	for _, tt := range tests {
+		if got := FileCategory(tt.contentType); got != tt.want {
+			t.Errorf("FileCategory(%q) = %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestContentMatches(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	exe := []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff\x00\x00")
+	doc := append([]byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}, make([]byte, 16)...)
+	docx := []byte("PK\x03\x04\x14\x00\x06\x00")
+
+	tests := []struct {
+		name     string
+		declared string
+		data     []byte
+		want     bool
+	}{
+		{"png", "image/png", png, true},
+		{"executable as png", "image/png", exe, false},
+		{"png as jpeg", "Image/JPEG", png, false},
+		{"legacy word", "application/msword", doc, true},
+		{"executable as word", "application/msword", exe, false},
+		{"docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", docx, true},
+		{"text", "text/plain; charset=utf-8", []byte("hello, world\n"), true},
+		{"empty text", "text/plain", nil, true},
+		{"json", "application/json", []byte(`{"a": 1}`), true},
+		{"html as text", "text/plain", []byte("<!DOCTYPE html><script>"), false},
+		{"executable as json", "application/json", exe, false},
+		{"no known signature", "video/mp4", exe, true},
+	}
+	for _, tt := range tests {
+		if got := ContentMatches(tt.declared, SniffContentType(tt.data)); got != tt.want {
+			t.Errorf("%s: ContentMatches(%q, %q) = %t, want %t", tt.name, tt.declared, SniffContentType(tt.data), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package common
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// originPattern is one ALLOWED_ORIGINS entry. With wildcard set, host is the
+// suffix after "*." and exactly one extra label must precede it.
+type originPattern struct {
+	scheme   string
+	host     string
+	port     string
+	wildcard bool
+	// origin is the normalized entry, sent as the fallback for exact entries
+	origin string
+}
+
+// allowedOrigins holds the parsed ALLOWED_ORIGINS, e.g.
+// "https://app.example.com,https://*.example.com,http://localhost:3000".
+// Nil allows any origin with "*", as before the list existed.
+var allowedOrigins = allowedOriginsFromEnv()
+
+// allowedOriginsFromEnv parses ALLOWED_ORIGINS
+func allowedOriginsFromEnv() []originPattern {
+	v := strings.TrimSpace(os.Getenv("ALLOWED_ORIGINS"))
+	if v == "" || v == "*" {
+		return nil
+	}
+	return parseAllowedOrigins(strings.Split(v, ","))
+}
+
+// parseAllowedOrigins parses allowlist entries. Invalid entries are logged
+// and skipped rather than widening access.
+func parseAllowedOrigins(entries []string) []originPattern {
+	patterns := []originPattern{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, ok := parseOriginPattern(entry)
+		if !ok {
+			log.Printf("Invalid ALLOWED_ORIGINS entry %q, ignoring it", entry)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// SetAllowedOrigins replaces the ALLOWED_ORIGINS list, for Lambdas that load
+// it from somewhere else at init. An empty list (or just "*") goes back to
+// allowing any origin.
+func SetAllowedOrigins(origins []string) {
+	if len(origins) == 0 || (len(origins) == 1 && strings.TrimSpace(origins[0]) == "*") {
+		allowedOrigins = nil
+		return
+	}
+	allowedOrigins = parseAllowedOrigins(origins)
+}
+
+// parseOriginPattern parses "scheme://host[:port]" where host may start with
+// "*." followed by at least two labels, so "*.com" is refused
+func parseOriginPattern(entry string) (originPattern, bool) {
+	scheme, host, ok := strings.Cut(strings.ToLower(entry), "://")
+	if !ok || (scheme != "https" && scheme != "http") {
+		return originPattern{}, false
+	}
+	pattern := originPattern{scheme: scheme}
+	if rest, ok := strings.CutPrefix(host, "*."); ok {
+		pattern.wildcard = true
+		host = rest
+	}
+	u, err := url.Parse(scheme + "://" + host)
+	if err != nil || u.Host != host || u.Hostname() == "" || strings.Contains(u.Hostname(), "*") {
+		return originPattern{}, false
+	}
+	pattern.host, pattern.port = u.Hostname(), u.Port()
+	if pattern.wildcard && !strings.Contains(pattern.host, ".") {
+		return originPattern{}, false
+	}
+	pattern.origin = scheme + "://" + u.Host
+	return pattern, true
+}
+
+// matches reports whether a request Origin is allowed by the pattern. The
+// origin is parsed rather than compared by substring, so
+// "https://example.com.evil.com" never matches "https://*.example.com".
+func (p originPattern) matches(origin string) bool {
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Scheme != p.scheme || u.User != nil || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return false
+	}
+	if u.Port() != p.port {
+		return false
+	}
+	host := u.Hostname()
+	if !p.wildcard {
+		return host == p.host
+	}
+	label, ok := strings.CutSuffix(host, "."+p.host)
+	return ok && label != "" && !strings.Contains(label, ".")
+}
+
+// AllowedOrigin returns the Access-Control-Allow-Origin value for a request
+// Origin: "*" when no list is configured, the origin itself when a pattern
+// matches, and otherwise the first exact (non-wildcard) entry, which the
+// browser will refuse for the caller. It is "" when every entry is a wildcard.
+func AllowedOrigin(origin string) string {
+	if allowedOrigins == nil {
+		return "*"
+	}
+	for _, pattern := range allowedOrigins {
+		if pattern.matches(origin) {
+			return origin
+		}
+	}
+	for _, pattern := range allowedOrigins {
+		if !pattern.wildcard {
+			return pattern.origin
+		}
+	}
+	return ""
+}
+
+// applyAllowedOrigin replaces the "*" set by BuildResponse with the origin
+// chosen by AllowedOrigin, or drops the header when there is none. With a
+// list configured, credentials are allowed since the origin is never "*".
+func applyAllowedOrigin(request events.APIGatewayProxyRequest, response *events.APIGatewayProxyResponse) {
+	if allowedOrigins == nil {
+		return
+	}
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	response.Headers["Vary"] = addVary(response.Headers["Vary"], "Origin")
+	if origin := AllowedOrigin(requestHeader(request, "Origin")); origin != "" {
+		response.Headers["Access-Control-Allow-Origin"] = origin
+		response.Headers["Access-Control-Allow-Credentials"] = "true"
+	} else {
+		delete(response.Headers, "Access-Control-Allow-Origin")
+		delete(response.Headers, "Access-Control-Allow-Credentials")
+	}
+}
+
+// BuildResponseForRequest is BuildResponse with the CORS origin chosen for
+// request, for handlers that don't run behind the CORS middleware
+func BuildResponseForRequest(request events.APIGatewayProxyRequest, statusCode int, body interface{}) events.APIGatewayProxyResponse {
+	response := BuildResponse(statusCode, body)
+	applyAllowedOrigin(request, &response)
+	return response
+}
+
+// requestHeader looks a header up ignoring case, since API Gateway keeps the
+// client's casing
+func requestHeader(request events.APIGatewayProxyRequest, name string) string {
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// addVary appends value to a Vary header unless it is already listed
+func addVary(vary, value string) string {
+	if vary == "" {
+		return value
+	}
+	for _, v := range strings.Split(vary, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return vary
+		}
+	}
+	return vary + ", " + value
+}
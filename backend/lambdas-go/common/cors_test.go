@@ -0,0 +1,132 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestAllowedOrigin(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", "https://app.example.com, https://*.tenants.example.com,http://localhost:3000,*.com,https://*.io,ftp://x.example.com")
+	defer func(patterns []originPattern) { allowedOrigins = patterns }(allowedOrigins)
+	allowedOrigins = allowedOriginsFromEnv()
+	if len(allowedOrigins) != 3 {
+		t.Fatalf("parsed %d patterns, want 3 (invalid entries skipped)", len(allowedOrigins))
+	}
+
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"https://acme.tenants.example.com", true},
+		{"http://localhost:3000", true},
+
+		{"", false},
+		{"null", false},
+		{"http://app.example.com", false},           // scheme
+		{"https://app.example.com:8443", false},     // port
+		{"http://localhost:3001", false},            // port
+		{"https://app.example.com.evil.com", false}, // suffix trick
+		{"https://evilapp.example.com", false},      // not a subdomain
+		{"https://tenants.example.com", false},      // wildcard needs a label
+		{"https://a.b.tenants.example.com", false},  // one label only
+		{"https://acme.tenants.example.com.evil.com", false},
+		{"https://eviltenants.example.com", false},
+		{"https://acme.tenants.example.com/path", false},
+		{"https://user@acme.tenants.example.com", false},
+		{"https://x.io", false}, // "*.io" was rejected as too broad
+	}
+	for _, tt := range tests {
+		got := AllowedOrigin(tt.origin)
+		if tt.ok && got != tt.origin {
+			t.Errorf("AllowedOrigin(%q) = %q, want the origin echoed", tt.origin, got)
+		}
+		// unmatched origins get the first exact entry, which the browser refuses
+		if !tt.ok && got != "https://app.example.com" {
+			t.Errorf("AllowedOrigin(%q) = %q, want the fallback origin", tt.origin, got)
+		}
+	}
+}
+
+func TestAllowedOriginUnset(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", "")
+	if patterns := allowedOriginsFromEnv(); patterns != nil {
+		t.Errorf("patterns = %v, want nil", patterns)
+	}
+	defer func(patterns []originPattern) { allowedOrigins = patterns }(allowedOrigins)
+	allowedOrigins = nil
+	if got := AllowedOrigin("https://anything.example"); got != "*" {
+		t.Errorf("AllowedOrigin = %q, want *", got)
+	}
+}
+
+func TestCORSEchoesAllowedOrigin(t *testing.T) {
+	defer func(patterns []originPattern) { allowedOrigins = patterns }(allowedOrigins)
+	pattern, _ := parseOriginPattern("https://*.example.com")
+	allowedOrigins = []originPattern{pattern}
+
+	handler := CORS(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return BuildResponse(200, nil), nil
+	})
+	for _, method := range []string{"GET", "OPTIONS"} {
+		response, _ := handler(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod: method,
+			Headers:    map[string]string{"origin": "https://acme.example.com"},
+		})
+		if got := response.Headers["Access-Control-Allow-Origin"]; got != "https://acme.example.com" {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q", method, got)
+		}
+		if response.Headers["Vary"] != "Origin" {
+			t.Errorf("%s: Vary = %q, want Origin", method, response.Headers["Vary"])
+		}
+
+		response, _ = handler(context.Background(), events.APIGatewayProxyRequest{
+			HTTPMethod: method,
+			Headers:    map[string]string{"Origin": "https://example.com.evil.com"},
+		})
+		if got, ok := response.Headers["Access-Control-Allow-Origin"]; ok {
+			t.Errorf("%s: disallowed origin got Access-Control-Allow-Origin %q", method, got)
+		}
+	}
+}
+
+func TestBuildResponseForRequestFallsBackToFirstOrigin(t *testing.T) {
+	defer func(patterns []originPattern) { allowedOrigins = patterns }(allowedOrigins)
+	SetAllowedOrigins([]string{"https://*.tenants.example.com", "https://APP.example.com", "http://localhost:3000"})
+	if len(allowedOrigins) != 3 {
+		t.Fatalf("parsed %d patterns, want 3", len(allowedOrigins))
+	}
+
+	tests := []struct {
+		origin string
+		want   string
+	}{
+		{"http://localhost:3000", "http://localhost:3000"},
+		{"https://acme.tenants.example.com", "https://acme.tenants.example.com"},
+		{"https://evil.example", "https://app.example.com"},
+		{"", "https://app.example.com"},
+	}
+	for _, tt := range tests {
+		response := BuildResponseForRequest(events.APIGatewayProxyRequest{
+			Headers: map[string]string{"Origin": tt.origin},
+		}, 200, nil)
+		if got := response.Headers["Access-Control-Allow-Origin"]; got != tt.want {
+			t.Errorf("Origin %q: Access-Control-Allow-Origin = %q, want %q", tt.origin, got, tt.want)
+		}
+		if response.Headers["Access-Control-Allow-Credentials"] != "true" {
+			t.Errorf("Origin %q: credentials not allowed", tt.origin)
+		}
+	}
+
+	SetAllowedOrigins(nil)
+	response := BuildResponseForRequest(events.APIGatewayProxyRequest{}, 200, nil)
+	if got := response.Headers["Access-Control-Allow-Origin"]; got != "*" {
+		t.Errorf("after SetAllowedOrigins(nil): Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if _, ok := response.Headers["Access-Control-Allow-Credentials"]; ok {
+		t.Error("credentials allowed with a wildcard origin")
+	}
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	defaultOperationTimeout = 5 * time.Second
+	defaultDeadlineReserve  = 500 * time.Millisecond
+)
+
+var (
+	// operationTimeout bounds a single AWS SDK call (OPERATION_TIMEOUT)
+	operationTimeout = durationFromEnv("OPERATION_TIMEOUT", defaultOperationTimeout)
+	// deadlineReserve is kept back from the Lambda deadline so there is
+	// always time left to write the audit entry and return a response
+	// (DEADLINE_RESERVE)
+	deadlineReserve = durationFromEnv("DEADLINE_RESERVE", defaultDeadlineReserve)
+)
+
+// WithDeadline derives a context for a single AWS SDK call. Its deadline is
+// the per-operation timeout or, if sooner, the Lambda's remaining time minus
+// the reserve. The Lambda runtime sets the invocation deadline on the context
+// it passes to the handler; without one only the operation timeout applies.
+func WithDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline := time.Now().Add(operationTimeout)
+	if lambdaDeadline, ok := ctx.Deadline(); ok {
+		if budget := lambdaDeadline.Add(-deadlineReserve); budget.Before(deadline) {
+			deadline = budget
+		}
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// WithStreamDeadline derives a context for a long-running transfer, such as
+// reading a whole S3 object. Unlike WithDeadline it has no per-operation cap:
+// it only keeps the reserve before the Lambda deadline, if there is one.
+func WithStreamDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if lambdaDeadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(ctx, lambdaDeadline.Add(-deadlineReserve))
+	}
+	return context.WithCancel(ctx)
+}
+
+// durationFromEnv parses a Go duration from an env var, falling back to def
+// when it is unset or invalid
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s %q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
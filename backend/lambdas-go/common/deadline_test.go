@@ -0,0 +1,65 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWithDeadlineUsesOperationTimeout(t *testing.T) {
+	ctx, cancel := WithDeadline(context.Background())
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Fatal("expected a deadline")
+	}
+	if remaining := time.Until(deadline); remaining > operationTimeout || remaining < operationTimeout-time.Second {
+		t.Errorf("expected about %s remaining, got %s", operationTimeout, remaining)
+	}
+}
+
+func TestWithDeadlineKeepsReserveBeforeLambdaDeadline(t *testing.T) {
+	lambdaDeadline := time.Now().Add(2 * time.Second)
+	parent, cancelParent := context.WithDeadline(context.Background(), lambdaDeadline)
+	defer cancelParent()
+
+	ctx, cancel := WithDeadline(parent)
+	defer cancel()
+
+	deadline, _ := ctx.Deadline()
+	if want := lambdaDeadline.Add(-deadlineReserve); !deadline.Equal(want) {
+		t.Errorf("expected deadline %s, got %s", want, deadline)
+	}
+}
+
+func TestWithStreamDeadline(t *testing.T) {
+	ctx, cancel := WithStreamDeadline(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expected no deadline without a Lambda deadline")
+	}
+
+	lambdaDeadline := time.Now().Add(time.Minute)
+	parent, cancelParent := context.WithDeadline(context.Background(), lambdaDeadline)
+	defer cancelParent()
+
+	ctx, cancel = WithStreamDeadline(parent)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	if want := lambdaDeadline.Add(-deadlineReserve); !deadline.Equal(want) {
+		t.Errorf("expected deadline %s, got %s", want, deadline)
+	}
+}
+
+func TestDurationFromEnv(t *testing.T) {
+	t.Setenv("TEST_DURATION", "250ms")
+	if d := durationFromEnv("TEST_DURATION", time.Second); d != 250*time.Millisecond {
+		t.Errorf("expected 250ms, got %s", d)
+	}
+
+	t.Setenv("TEST_DURATION", "not-a-duration")
+	if d := durationFromEnv("TEST_DURATION", time.Second); d != time.Second {
+		t.Errorf("expected fallback 1s, got %s", d)
+	}
+}
@@ -0,0 +1,204 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Kind classifies an AppError and decides its HTTP status
+type Kind int
+
+const (
+	KindInternal Kind = iota
+	KindNotFound
+	KindUnauthorized
+	KindValidation
+	KindConflict
+	KindThrottled
+	KindForbidden
+	KindLocked
+	KindUnavailable
+	KindGone
+	KindMethodNotAllowed
+)
+
+// kindInfo is the HTTP mapping for one Kind
+type kindInfo struct {
+	status  int
+	code    string
+	message string // used when the AppError has no message of its own
+}
+
+var kinds = map[Kind]kindInfo{
+	KindInternal:         {500, "internal", "Internal server error"},
+	KindNotFound:         {404, "not_found", "Not found"},
+	KindUnauthorized:     {401, "unauthorized", "Unauthorized"},
+	KindValidation:       {400, "validation_failed", "Validation failed"},
+	KindConflict:         {409, "conflict", "Conflict"},
+	KindThrottled:        {429, "throttled", "Too many requests, try again later"},
+	KindForbidden:        {403, "forbidden", "Forbidden"},
+	KindLocked:           {423, "locked", "Resource is locked"},
+	KindUnavailable:      {503, "unavailable", "Service temporarily unavailable"},
+	KindGone:             {410, "gone", "No longer available"},
+	KindMethodNotAllowed: {405, "method_not_allowed", "Method not allowed"},
+}
+
+// AppError is an error a handler returns to have it turned into an HTTP
+// response by ToResponse. Message is shown to the client; Err is the
+// underlying cause and is only logged.
+type AppError struct {
+	Kind    Kind
+	Message string
+	Err     error
+}
+
+// Error implements the error interface
+func (e *AppError) Error() string {
+	message := e.Message
+	if message == "" {
+		message = kinds[e.Kind].message
+	}
+	if e.Err != nil {
+		return message + ": " + e.Err.Error()
+	}
+	return message
+}
+
+// Unwrap returns the underlying cause
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// NotFound reports a missing resource
+func NotFound(message string) *AppError {
+	return &AppError{Kind: KindNotFound, Message: message}
+}
+
+// Unauthorized reports a caller that could not be identified
+func Unauthorized(message string) *AppError {
+	return &AppError{Kind: KindUnauthorized, Message: message}
+}
+
+// Validation reports a bad request that isn't tied to a single field. Use
+// ValidationErrors for per-field problems.
+func Validation(message string) *AppError {
+	return &AppError{Kind: KindValidation, Message: message}
+}
+
+// Conflict reports a request that clashes with the current state of a resource
+func Conflict(message string) *AppError {
+	return &AppError{Kind: KindConflict, Message: message}
+}
+
+// Throttled reports a request rejected by a rate limit or budget
+func Throttled(message string) *AppError {
+	return &AppError{Kind: KindThrottled, Message: message}
+}
+
+// Forbidden reports a caller who is identified but not allowed to do this
+func Forbidden(message string) *AppError {
+	return &AppError{Kind: KindForbidden, Message: message}
+}
+
+// Locked reports a resource that can't be changed right now, e.g. a file
+// under legal hold
+func Locked(message string) *AppError {
+	return &AppError{Kind: KindLocked, Message: message}
+}
+
+// Unavailable reports a service that is temporarily not accepting the
+// request, e.g. writes during maintenance
+func Unavailable(message string) *AppError {
+	return &AppError{Kind: KindUnavailable, Message: message}
+}
+
+// Gone reports a resource that existed but can no longer be used, e.g. a
+// share whose download limit is used up
+func Gone(message string) *AppError {
+	return &AppError{Kind: KindGone, Message: message}
+}
+
+// MethodNotAllowed reports a request whose HTTP method the route doesn't
+// serve. Router adds the Allow header.
+func MethodNotAllowed(message string) *AppError {
+	return &AppError{Kind: KindMethodNotAllowed, Message: message}
+}
+
+// Internal wraps an unexpected failure. message describes the operation for
+// the log, e.g. "DynamoDB get error"; the client only sees a generic 500.
+func Internal(message string, err error) *AppError {
+	return &AppError{Kind: KindInternal, Message: message, Err: err}
+}
+
+// ToResponse maps an error to an API Gateway response. ValidationErrors keep
+// their per-field body, AppErrors use the status and code of their Kind, and
+// anything else is an internal error. Internal errors are classified with
+// ClassifyAWSError: throttling becomes 429 so clients back off instead of
+// seeing a 500, and the rest stay 500 with the classification logged. Calls
+// rejected by an open circuit breaker become 503 with Retry-After.
+func ToResponse(err error) events.APIGatewayProxyResponse {
+	var validationErrs *ValidationErrors
+	if errors.As(err, &validationErrs) {
+		return BuildValidationErrorResponse(validationErrs)
+	}
+
+	var appErr *AppError
+	if !errors.As(err, &appErr) {
+		appErr = Internal("Unhandled error", err)
+	}
+
+	kind := appErr.Kind
+	var awsKind Kind
+	var retryable bool
+	var openErr *CircuitOpenError
+	if kind == KindInternal {
+		awsKind, retryable = ClassifyAWSError(appErr.Err)
+		switch {
+		case awsKind == KindThrottled:
+			kind = KindThrottled
+		case errors.As(appErr.Err, &openErr):
+			kind = KindUnavailable
+		}
+	}
+	info := kinds[kind]
+
+	message := appErr.Message
+	switch {
+	case kind == KindInternal:
+		log.Printf("%s (class=%s, retryable=%t)", appErr.Error(), kinds[awsKind].code, retryable)
+		message = info.message
+	case kind != appErr.Kind:
+		log.Printf("%s", appErr.Error())
+		message = info.message
+	case message == "":
+		message = info.message
+	}
+
+	response := BuildResponse(info.status, ErrorResponse{Error: message, Code: info.code})
+	if openErr != nil {
+		response.Headers["Retry-After"] = strconv.Itoa(int(math.Ceil(openErr.RetryAfter.Seconds())))
+	}
+	return response
+}
+
+// Fail returns an empty response and err, for handlers wrapped in HandleErrors
+func Fail(err error) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{}, err
+}
+
+// HandleErrors turns an error returned by the wrapped handler into a response
+// through ToResponse, so every handler maps errors the same way
+func HandleErrors(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		response, err := next(ctx, request)
+		if err != nil {
+			return ToResponse(err), nil
+		}
+		return response, nil
+	}
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/smithy-go"
+)
+
+func TestToResponseKinds(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		code    string
+		message string
+	}{
+		{"not found", NotFound("File not found"), 404, "not_found", "File not found"},
+		{"unauthorized", Unauthorized("Unauthorized: userId not found"), 401, "unauthorized", "Unauthorized: userId not found"},
+		{"validation", Validation("Invalid request body"), 400, "validation_failed", "Invalid request body"},
+		{"conflict", Conflict("File is no longer in trash"), 409, "conflict", "File is no longer in trash"},
+		{"throttled", Throttled(""), 429, "throttled", "Too many requests, try again later"},
+		{"forbidden", Forbidden(""), 403, "forbidden", "Forbidden"},
+		{"locked", Locked("File is under legal hold"), 423, "locked", "File is under legal hold"},
+		{"gone", Gone("Download limit reached"), 410, "gone", "Download limit reached"},
+		{"method not allowed", MethodNotAllowed(""), 405, "method_not_allowed", "Method not allowed"},
+		{"internal hides cause", Internal("DynamoDB get error", errors.New("secret detail")), 500, "internal", "Internal server error"},
+		{"wrapped app error", fmt.Errorf("lookup: %w", NotFound("File not found")), 404, "not_found", "File not found"},
+		{"plain error", errors.New("boom"), 500, "internal", "Internal server error"},
+		{
+			"aws throttling",
+			Internal("DynamoDB get error", &smithy.GenericAPIError{Code: "ProvisionedThroughputExceededException"}),
+			429, "throttled", "Too many requests, try again later",
+		},
+		{
+			"other aws error",
+			Internal("DynamoDB get error", &smithy.GenericAPIError{Code: "ResourceNotFoundException"}),
+			500, "internal", "Internal server error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := ToResponse(tt.err)
+			if response.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", response.StatusCode, tt.status)
+			}
+			var body ErrorResponse
+			if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+				t.Fatalf("response body is not JSON: %v", err)
+			}
+			if body.Code != tt.code {
+				t.Errorf("code = %q, want %q", body.Code, tt.code)
+			}
+			if body.Error != tt.message {
+				t.Errorf("error = %q, want %q", body.Error, tt.message)
+			}
+		})
+	}
+}
+
+func TestToResponseValidationErrors(t *testing.T) {
+	errs := &ValidationErrors{}
+	errs.Add("fileId", "is required")
+	errs.Add("fileName", "must not be empty")
+
+	response := ToResponse(errs)
+	if response.StatusCode != 400 {
+		t.Errorf("status = %d, want 400", response.StatusCode)
+	}
+	var body ValidationErrorResponse
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("response body is not JSON: %v", err)
+	}
+	if body.Code != "validation_failed" || len(body.Errors) != 2 {
+		t.Errorf("unexpected body %+v", body)
+	}
+}
+
+func TestHandleErrors(t *testing.T) {
+	handler := HandleErrors(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return Fail(Conflict("A file with this fileId already exists"))
+	})
+
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if response.StatusCode != 409 {
+		t.Errorf("status = %d, want 409", response.StatusCode)
+	}
+	if response.Headers["Access-Control-Allow-Origin"] == "" {
+		t.Error("expected CORS headers on error response")
+	}
+}
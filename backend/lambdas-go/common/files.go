@@ -0,0 +1,264 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	// StatusUploaded is the status of a file whose object is in S3, set by
+	// register_upload, complete_upload and verify_batch
+	StatusUploaded = "uploaded"
+	// StatusConfirmed is the status of a file confirmed through
+	// verify_batch's /confirm, which also records the size S3 reports
+	StatusConfirmed = "confirmed"
+	// StatusDeleted is the status of a file that has been moved to trash
+	StatusDeleted = "deleted"
+	// StatusRejected is the status of a file whose content didn't match its
+	// declared type; verify_batch moves its object to quarantine
+	StatusRejected = "rejected"
+	// StatusMultipartPending is the status of a file whose multipart upload
+	// was started by upload_file and not yet completed or aborted
+	StatusMultipartPending = "multipart_pending"
+	// NoLegalHoldCondition is a condition expression that fails for files
+	// under legal hold. Releasing a hold removes the attribute.
+	NoLegalHoldCondition = "attribute_not_exists(legalHold)"
+	// RevokeSharesUpdate is an update clause removing every share of a file:
+	// its acl and the restrictions and download limit that came with it.
+	// Soft deletes add it so shared links stop working and a restored file
+	// comes back unshared.
+	RevokeSharesUpdate = "REMOVE acl, shareReferers, shareCidrs, shareMaxDownloads, shareDownloadsLeft"
+)
+
+// Confirmed reports whether a file with this status has its object confirmed
+// in S3: uploaded or confirmed
+func Confirmed(status string) bool {
+	return status == StatusUploaded || status == StatusConfirmed
+}
+
+var (
+	// ErrNotFound is returned when the user has no file with the given ID
+	ErrNotFound = errors.New("file not found")
+	// ErrDeleted is returned when the file exists but has been moved to trash
+	ErrDeleted = errors.New("file has been deleted")
+	// ErrObjectMissing is returned when a file's record exists but its S3
+	// object doesn't, e.g. an upload that hasn't finished
+	ErrObjectMissing = errors.New("file object not found")
+	// ErrNotConfirmed is returned for a file that can't be served because
+	// its upload isn't confirmed (see Confirmed), e.g. pending or rejected
+	ErrNotConfirmed = errors.New("file upload is not confirmed")
+	// ErrIncompleteBatch is returned by GetOwnedFiles, together with the files
+	// it did read, when DynamoDB still left keys unprocessed after retrying
+	ErrIncompleteBatch = errors.New("batch read left keys unprocessed")
+)
+
+const (
+	// maxBatchGetKeys is the most keys DynamoDB accepts in one BatchGetItem
+	maxBatchGetKeys = 100
+	// batchGetAttempts bounds how often GetOwnedFiles asks for unprocessed keys
+	batchGetAttempts = 3
+)
+
+// File is a row of the UserFiles table. Every handler reads and writes rows
+// through it, so an attribute is added here once. Optional attributes are
+// omitempty so writes don't store empty values. The json tags name the
+// attributes in responses, but a File is never sent as is: each handler
+// clears what its callers mustn't see, e.g. userId or s3Key.
+type File struct {
+	UserID             string            `dynamodbav:"userId" json:"userId,omitempty"`
+	FileID             string            `dynamodbav:"fileId" json:"fileId"`
+	FileName           string            `dynamodbav:"fileName" json:"fileName"`
+	ContentType        string            `dynamodbav:"contentType" json:"contentType"`
+	Category           string            `dynamodbav:"category,omitempty" json:"category,omitempty"` // stored by migrate_files, see FileCategory
+	Folder             string            `dynamodbav:"folder,omitempty" json:"folder,omitempty"`
+	Description        string            `dynamodbav:"description,omitempty" json:"description,omitempty"`
+	Tags               map[string]string `dynamodbav:"tags,omitempty" json:"tags,omitempty"`
+	ContentEncoding    string            `dynamodbav:"contentEncoding,omitempty" json:"contentEncoding,omitempty"` // only set for pre-compressed files
+	FileSize           int64             `dynamodbav:"fileSize" json:"fileSize"`
+	S3Key              string            `dynamodbav:"s3Key" json:"s3Key,omitempty"`
+	Status             string            `dynamodbav:"status" json:"status"`
+	PreviousStatus     string            `dynamodbav:"previousStatus,omitempty" json:"previousStatus,omitempty"` // status before the file went to trash
+	CreatedAt          string            `dynamodbav:"createdAt" json:"createdAt"`
+	UploadStartedAt    string            `dynamodbav:"uploadStartedAt,omitempty" json:"uploadStartedAt,omitempty"`       // when upload_file presigned the upload
+	UploadCompletedAt  string            `dynamodbav:"uploadCompletedAt,omitempty" json:"uploadCompletedAt,omitempty"`   // when the object landed in S3
+	UploadID           string            `dynamodbav:"uploadId,omitempty" json:"-"`                                      // S3 multipart upload, while multipart_pending
+	MultipartParts     int32             `dynamodbav:"multipartParts,omitempty" json:"multipartParts,omitempty"`         // parts presigned for the multipart upload
+	MultipartPartSize  int64             `dynamodbav:"multipartPartSize,omitempty" json:"multipartPartSize,omitempty"`   // size of every part but the last
+	UploadedParts      map[string]string `dynamodbav:"uploadedParts,omitempty" json:"-"`                                 // part number to ETag, as reported to complete_upload
+	VerifiedAt         string            `dynamodbav:"verifiedAt,omitempty" json:"verifiedAt,omitempty"`                 // set by verify_batch
+	SniffedContentType string            `dynamodbav:"sniffedContentType,omitempty" json:"sniffedContentType,omitempty"` // what a rejected file's content looked like
+	QuarantineKey      string            `dynamodbav:"quarantineKey,omitempty" json:"-"`                                 // where a rejected file's object was moved
+	UpdatedAt          string            `dynamodbav:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+	DeletedAt          string            `dynamodbav:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	ExpiresAt          string            `dynamodbav:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	ExpiryEpoch        int64             `dynamodbav:"expiryEpoch,omitempty" json:"-"` // expiresAt for the expire_files scan
+	ACL                []string          `dynamodbav:"acl,stringset,omitempty" json:"acl,omitempty"`
+	ShareReferers      []string          `dynamodbav:"shareReferers,stringset,omitempty" json:"shareReferers,omitempty"` // origins users in acl must come from
+	ShareCIDRs         []string          `dynamodbav:"shareCidrs,stringset,omitempty" json:"shareCidrs,omitempty"`       // networks users in acl must download from
+	ShareMaxDownloads  int64             `dynamodbav:"shareMaxDownloads,omitempty" json:"shareMaxDownloads,omitempty"`   // download limit for users in acl, unset means unlimited
+	ShareDownloadsLeft int64             `dynamodbav:"shareDownloadsLeft,omitempty" json:"shareDownloadsLeft,omitempty"` // counts down from ShareMaxDownloads
+	ScanStatus         string            `dynamodbav:"scanStatus,omitempty" json:"scanStatus,omitempty"`                 // set by the virus scanner, see ScanGate
+	LegalHold          bool              `dynamodbav:"legalHold,omitempty" json:"legalHold,omitempty"`
+	LegalHoldAt        string            `dynamodbav:"legalHoldAt,omitempty" json:"legalHoldAt,omitempty"`
+	LegalHoldBy        string            `dynamodbav:"legalHoldBy,omitempty" json:"legalHoldBy,omitempty"`
+	LegalHoldReason    string            `dynamodbav:"legalHoldReason,omitempty" json:"legalHoldReason,omitempty"`
+	ChecksumSHA256     string            `dynamodbav:"checksumSha256,omitempty" json:"checksumSha256,omitempty"` // hex, declared at upload or set by compute_checksum
+	ChecksumMD5        string            `dynamodbav:"checksumMd5,omitempty" json:"checksumMd5,omitempty"`
+	ChecksumAt         string            `dynamodbav:"checksumAt,omitempty" json:"checksumAt,omitempty"`
+	Pinned             bool              `dynamodbav:"pinned,omitempty" json:"pinned,omitempty"`
+	PinnedAt           string            `dynamodbav:"pinnedAt,omitempty" json:"pinnedAt,omitempty"`   // sort key of the sparse PinnedIndex
+	VersionID          string            `dynamodbav:"versionId,omitempty" json:"versionId,omitempty"` // S3 version, only on versioned buckets
+	ETag               string            `dynamodbav:"etag,omitempty" json:"etag,omitempty"`
+	TransferredFrom    string            `dynamodbav:"transferredFrom,omitempty" json:"transferredFrom,omitempty"`
+	TransferredAt      string            `dynamodbav:"transferredAt,omitempty" json:"transferredAt,omitempty"`
+}
+
+// GetItemAPI is the subset of the DynamoDB client used by GetOwnedFile
+type GetItemAPI interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+}
+
+// GetOwnedFile fetches userID's file fileID from table. It returns ErrNotFound
+// if there is no such file and ErrDeleted, together with the record, if the
+// file is in trash. consistentRead requests a strongly consistent read, which
+// costs twice the read capacity.
+func GetOwnedFile(ctx context.Context, db GetItemAPI, table, userID, fileID string, consistentRead bool) (*File, error) {
+	opCtx, cancel := WithDeadline(ctx)
+	result, err := db.GetItem(opCtx, &dynamodb.GetItemInput{
+		TableName: aws.String(table),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
+		ConsistentRead: aws.Bool(consistentRead),
+	})
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrNotFound
+	}
+
+	var file File
+	if err := attributevalue.UnmarshalMap(result.Item, &file); err != nil {
+		return nil, err
+	}
+
+	if file.Status == StatusDeleted {
+		return &file, ErrDeleted
+	}
+	return &file, nil
+}
+
+// FileExists reports whether userID has a file fileID in table and returns
+// its status, so callers can tell files in trash apart. It only projects
+// status: the response is smaller and nothing else is unmarshalled, though
+// DynamoDB still charges read capacity for the whole item. The read is
+// eventually consistent.
+func FileExists(ctx context.Context, db GetItemAPI, table, userID, fileID string) (bool, string, error) {
+	opCtx, cancel := WithDeadline(ctx)
+	result, err := db.GetItem(opCtx, &dynamodb.GetItemInput{
+		TableName: aws.String(table),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
+		ProjectionExpression:     aws.String("#status"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+	})
+	cancel()
+	if err != nil {
+		return false, "", err
+	}
+	if result.Item == nil {
+		return false, "", nil
+	}
+
+	var file struct {
+		Status string `dynamodbav:"status"`
+	}
+	if err := attributevalue.UnmarshalMap(result.Item, &file); err != nil {
+		return false, "", err
+	}
+	return true, file.Status, nil
+}
+
+// BatchGetItemAPI is the subset of the DynamoDB client used by GetOwnedFiles
+type BatchGetItemAPI interface {
+	BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+}
+
+// GetOwnedFiles fetches several of userID's files from table with
+// BatchGetItem, keyed by fileId. Files that don't exist are missing from the
+// map; files in trash are included. Keys DynamoDB leaves unprocessed, e.g.
+// under throttling, are asked for again a few times; if some remain, the
+// files read so far are returned with ErrIncompleteBatch.
+func GetOwnedFiles(ctx context.Context, db BatchGetItemAPI, table, userID string, fileIDs []string) (map[string]*File, error) {
+	files := make(map[string]*File, len(fileIDs))
+	seen := make(map[string]bool, len(fileIDs))
+	var keys []map[string]types.AttributeValue
+	for _, fileID := range fileIDs {
+		if seen[fileID] {
+			continue
+		}
+		seen[fileID] = true
+		keys = append(keys, map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: fileID},
+		})
+	}
+
+	for start := 0; start < len(keys); start += maxBatchGetKeys {
+		end := start + maxBatchGetKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+		pending := keys[start:end]
+		for attempt := 1; len(pending) > 0; attempt++ {
+			if attempt > batchGetAttempts {
+				return files, ErrIncompleteBatch
+			}
+			if attempt > 1 {
+				time.Sleep(time.Duration(attempt-1) * 50 * time.Millisecond)
+			}
+
+			opCtx, cancel := WithDeadline(ctx)
+			result, err := db.BatchGetItem(opCtx, &dynamodb.BatchGetItemInput{
+				RequestItems: map[string]types.KeysAndAttributes{
+					table: {Keys: pending},
+				},
+			})
+			cancel()
+			if err != nil {
+				return files, err
+			}
+
+			for _, item := range result.Responses[table] {
+				var file File
+				if err := attributevalue.UnmarshalMap(item, &file); err != nil {
+					return files, err
+				}
+				files[file.FileID] = &file
+			}
+			pending = result.UnprocessedKeys[table].Keys
+		}
+	}
+	return files, nil
+}
+
+// ObjectVersionID returns the VersionId of an S3 response, or "" when the
+// bucket is not versioned. Buckets with versioning suspended report "null".
+func ObjectVersionID(versionID *string) string {
+	if v := aws.ToString(versionID); v != "null" {
+		return v
+	}
+	return ""
+}
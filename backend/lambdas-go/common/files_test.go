@@ -0,0 +1,223 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeGetItem returns a canned item and records the last request
+type fakeGetItem struct {
+	item  map[string]types.AttributeValue
+	err   error
+	input *dynamodb.GetItemInput
+}
+
+func (f *fakeGetItem) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.input = params
+	if f.err != nil {
+		return nil, f.err
+	}
+	if params.ProjectionExpression == nil || f.item == nil {
+		return &dynamodb.GetItemOutput{Item: f.item}, nil
+	}
+	// Only the projected attributes; FileExists projects through names
+	projected := map[string]types.AttributeValue{}
+	for _, name := range params.ExpressionAttributeNames {
+		if v, ok := f.item[name]; ok {
+			projected[name] = v
+		}
+	}
+	return &dynamodb.GetItemOutput{Item: projected}, nil
+}
+
+func fileItem(status string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":   &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId":   &types.AttributeValueMemberS{Value: "file-456"},
+		"fileName": &types.AttributeValueMemberS{Value: "report.pdf"},
+		"fileSize": &types.AttributeValueMemberN{Value: "2048"},
+		"status":   &types.AttributeValueMemberS{Value: status},
+	}
+}
+
+func TestGetOwnedFile(t *testing.T) {
+	db := &fakeGetItem{item: fileItem("uploaded")}
+
+	file, err := GetOwnedFile(context.Background(), db, "UserFiles", "user-123", "file-456", true)
+	if err != nil {
+		t.Fatalf("GetOwnedFile error: %v", err)
+	}
+	if file.FileName != "report.pdf" || file.FileSize != 2048 {
+		t.Errorf("unexpected file %+v", file)
+	}
+	if !*db.input.ConsistentRead || *db.input.TableName != "UserFiles" {
+		t.Errorf("unexpected input %+v", db.input)
+	}
+	if v := db.input.Key["userId"].(*types.AttributeValueMemberS).Value; v != "user-123" {
+		t.Errorf("queried userId %q, want user-123", v)
+	}
+}
+
+func TestGetOwnedFileNotFound(t *testing.T) {
+	file, err := GetOwnedFile(context.Background(), &fakeGetItem{}, "UserFiles", "user-123", "file-456", false)
+	if !errors.Is(err, ErrNotFound) || file != nil {
+		t.Errorf("GetOwnedFile = %v, %v; want nil, ErrNotFound", file, err)
+	}
+}
+
+func TestGetOwnedFileDeleted(t *testing.T) {
+	db := &fakeGetItem{item: fileItem(StatusDeleted)}
+
+	file, err := GetOwnedFile(context.Background(), db, "UserFiles", "user-123", "file-456", false)
+	if !errors.Is(err, ErrDeleted) {
+		t.Fatalf("error = %v, want ErrDeleted", err)
+	}
+	// The record is still returned for callers that report on trashed files
+	if file == nil || file.FileID != "file-456" {
+		t.Errorf("unexpected file %+v", file)
+	}
+}
+
+func TestGetOwnedFileError(t *testing.T) {
+	dbErr := errors.New("throttled")
+
+	_, err := GetOwnedFile(context.Background(), &fakeGetItem{err: dbErr}, "UserFiles", "user-123", "file-456", false)
+	if !errors.Is(err, dbErr) || errors.Is(err, ErrNotFound) {
+		t.Errorf("error = %v, want the DynamoDB error", err)
+	}
+}
+
+func TestFileExists(t *testing.T) {
+	for _, status := range []string{"uploaded", StatusDeleted} {
+		db := &fakeGetItem{item: fileItem(status)}
+		exists, got, err := FileExists(context.Background(), db, "UserFiles", "user-123", "file-456")
+		if err != nil || !exists || got != status {
+			t.Errorf("FileExists = %t, %q, %v; want true, %q", exists, got, err, status)
+		}
+		if aws.ToString(db.input.ProjectionExpression) != "#status" || db.input.ExpressionAttributeNames["#status"] != "status" {
+			t.Errorf("projection = %q %v, want only status", aws.ToString(db.input.ProjectionExpression), db.input.ExpressionAttributeNames)
+		}
+		if key := db.input.Key["fileId"].(*types.AttributeValueMemberS).Value; key != "file-456" {
+			t.Errorf("fileId key = %q", key)
+		}
+	}
+
+	exists, status, err := FileExists(context.Background(), &fakeGetItem{}, "UserFiles", "user-123", "missing")
+	if err != nil || exists || status != "" {
+		t.Errorf("missing file: FileExists = %t, %q, %v", exists, status, err)
+	}
+
+	boom := errors.New("throttled")
+	if _, _, err := FileExists(context.Background(), &fakeGetItem{err: boom}, "UserFiles", "user-123", "file-456"); !errors.Is(err, boom) {
+		t.Errorf("error = %v, want %v", err, boom)
+	}
+}
+
+// fakeBatchGet holds files by fileId and answers at most perCall keys per
+// BatchGetItem, leaving the rest unprocessed as DynamoDB does under load
+type fakeBatchGet struct {
+	files   map[string]map[string]types.AttributeValue
+	perCall int
+	calls   int
+}
+
+func (f *fakeBatchGet) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	f.calls++
+	out := &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{}}
+	for table, req := range params.RequestItems {
+		for i, key := range req.Keys {
+			if f.perCall > 0 && i >= f.perCall {
+				out.UnprocessedKeys = map[string]types.KeysAndAttributes{table: {Keys: req.Keys[i:]}}
+				break
+			}
+			if item, ok := f.files[key["fileId"].(*types.AttributeValueMemberS).Value]; ok {
+				out.Responses[table] = append(out.Responses[table], item)
+			}
+		}
+	}
+	return out, nil
+}
+
+func batchFile(fileID, status string) map[string]types.AttributeValue {
+	item := fileItem(status)
+	item["fileId"] = &types.AttributeValueMemberS{Value: fileID}
+	return item
+}
+
+func TestGetOwnedFiles(t *testing.T) {
+	db := &fakeBatchGet{files: map[string]map[string]types.AttributeValue{
+		"a": batchFile("a", "uploaded"),
+		"b": batchFile("b", StatusDeleted),
+	}, perCall: 2}
+
+	files, err := GetOwnedFiles(context.Background(), db, "UserFiles", "user-123", []string{"a", "gone", "b", "a"})
+	if err != nil {
+		t.Fatalf("GetOwnedFiles error: %v", err)
+	}
+	if len(files) != 2 || files["a"].Status != "uploaded" || files["b"].Status != StatusDeleted {
+		t.Errorf("files = %+v, want a and b, trash included", files)
+	}
+	if files["gone"] != nil {
+		t.Errorf("missing file returned: %+v", files["gone"])
+	}
+	if db.calls != 2 {
+		t.Errorf("BatchGetItem called %d times, want 2 to pick up the unprocessed key", db.calls)
+	}
+}
+
+func TestGetOwnedFilesGivesUp(t *testing.T) {
+	db := &fakeBatchGet{files: map[string]map[string]types.AttributeValue{
+		"a": batchFile("a", "uploaded"),
+		"b": batchFile("b", "uploaded"),
+		"c": batchFile("c", "uploaded"),
+		"d": batchFile("d", "uploaded"),
+		"e": batchFile("e", "uploaded"),
+	}, perCall: 1}
+
+	files, err := GetOwnedFiles(context.Background(), db, "UserFiles", "user-123", []string{"a", "b", "c", "d", "e"})
+	if !errors.Is(err, ErrIncompleteBatch) {
+		t.Fatalf("error = %v, want ErrIncompleteBatch", err)
+	}
+	if len(files) != batchGetAttempts {
+		t.Errorf("got %d files, want the %d read before giving up", len(files), batchGetAttempts)
+	}
+}
+
+func TestRevokeSharesUpdateCoversShareAttributes(t *testing.T) {
+	removed := map[string]bool{}
+	for _, name := range strings.Split(strings.TrimPrefix(RevokeSharesUpdate, "REMOVE "), ",") {
+		removed[strings.TrimSpace(name)] = true
+	}
+
+	// A share attribute added to File must be revoked with the others
+	fileType := reflect.TypeOf(File{})
+	for i := 0; i < fileType.NumField(); i++ {
+		name, _, _ := strings.Cut(fileType.Field(i).Tag.Get("dynamodbav"), ",")
+		if (name == "acl" || strings.HasPrefix(name, "share")) && !removed[name] {
+			t.Errorf("RevokeSharesUpdate does not remove %s", name)
+		}
+	}
+}
+
+func TestObjectVersionID(t *testing.T) {
+	tests := []struct {
+		in   *string
+		want string
+	}{
+		{nil, ""},
+		{aws.String("null"), ""},
+		{aws.String("3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY"), "3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY"},
+	}
+	for _, tt := range tests {
+		if got := ObjectVersionID(tt.in); got != tt.want {
+			t.Errorf("ObjectVersionID(%v) = %q, want %q", aws.ToString(tt.in), got, tt.want)
+		}
+	}
+}
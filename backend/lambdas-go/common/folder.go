@@ -0,0 +1,64 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// MaxFolderLen bounds the whole folder path, which ends up in S3 keys
+	MaxFolderLen          = 512
+	defaultMaxFolderDepth = 10
+)
+
+// maxFolderDepth is the number of segments a folder may have (MAX_FOLDER_DEPTH)
+var maxFolderDepth = folderDepthFromEnv()
+
+// ValidateFolder checks a folder path such as "projects/2024". The empty
+// string is the root. Leading or trailing slashes, empty, '.' or '..'
+// segments, control characters and paths that are too long or too deep are
+// rejected, so "/a", "a/" and "a//b" are all invalid.
+func ValidateFolder(folder string) error {
+	if folder == "" {
+		return nil
+	}
+	if len(folder) > MaxFolderLen {
+		return fmt.Errorf("must be at most %d characters", MaxFolderLen)
+	}
+	if strings.IndexFunc(folder, unicode.IsControl) >= 0 {
+		return errors.New("must not contain control characters")
+	}
+	if strings.HasPrefix(folder, "/") || strings.HasSuffix(folder, "/") {
+		return errors.New("must not start or end with '/'")
+	}
+	segments := strings.Split(folder, "/")
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return errors.New("must not contain empty, '.' or '..' segments")
+		}
+	}
+	if len(segments) > maxFolderDepth {
+		return fmt.Errorf("must be at most %d levels deep", maxFolderDepth)
+	}
+	return nil
+}
+
+// folderDepthFromEnv parses MAX_FOLDER_DEPTH, falling back to the default
+// when it is unset or invalid
+func folderDepthFromEnv() int {
+	v := os.Getenv("MAX_FOLDER_DEPTH")
+	if v == "" {
+		return defaultMaxFolderDepth
+	}
+	depth, err := strconv.Atoi(v)
+	if err != nil || depth <= 0 {
+		log.Printf("Invalid MAX_FOLDER_DEPTH %q, using %d", v, defaultMaxFolderDepth)
+		return defaultMaxFolderDepth
+	}
+	return depth
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateFolder(t *testing.T) {
+	deep := strings.Repeat("a/", defaultMaxFolderDepth) + "a"
+	tests := []struct {
+		name   string
+		folder string
+		ok     bool
+	}{
+		{"root", "", true},
+		{"single", "projects", true},
+		{"nested", "projects/2024/q1", true},
+		{"max depth", strings.Repeat("a/", defaultMaxFolderDepth-1) + "a", true},
+		{"too deep", deep, false},
+		{"leading slash", "/projects", false},
+		{"trailing slash", "projects/", false},
+		{"only slash", "/", false},
+		{"empty segment", "projects//2024", false},
+		{"dot segment", "projects/./2024", false},
+		{"dotdot segment", "projects/../secrets", false},
+		{"control character", "projects/\x00", false},
+		{"too long", strings.Repeat("x", MaxFolderLen+1), false},
+		{"many slashes", strings.Repeat("/", 5000), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateFolder(tt.folder); (err == nil) != tt.ok {
+				t.Errorf("ValidateFolder(%q) = %v, want ok=%v", tt.folder, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidateFolderDepthFromEnv(t *testing.T) {
+	defer func(depth int) { maxFolderDepth = depth }(maxFolderDepth)
+
+	t.Setenv("MAX_FOLDER_DEPTH", "2")
+	maxFolderDepth = folderDepthFromEnv()
+	if err := ValidateFolder("a/b"); err != nil {
+		t.Errorf("a/b: %v", err)
+	}
+	if err := ValidateFolder("a/b/c"); err == nil {
+		t.Error("a/b/c accepted with MAX_FOLDER_DEPTH=2")
+	}
+
+	t.Setenv("MAX_FOLDER_DEPTH", "zero")
+	if got := folderDepthFromEnv(); got != defaultMaxFolderDepth {
+		t.Errorf("invalid value gave depth %d, want %d", got, defaultMaxFolderDepth)
+	}
+}
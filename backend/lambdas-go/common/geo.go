@@ -0,0 +1,114 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// geoLookupURLEnv names the env var holding the lookup service URL. "{ip}"
+	// in it is replaced with the address; the service must answer with JSON
+	// containing "country" and "region". Without it every IP is "unknown".
+	geoLookupURLEnv = "GEO_LOOKUP_URL"
+
+	geoUnknown      = "unknown"
+	geoCacheMaxSize = 1000
+)
+
+// geoLookupTimeout bounds a single lookup (GEO_LOOKUP_TIMEOUT)
+var geoLookupTimeout = durationFromEnv("GEO_LOOKUP_TIMEOUT", 500*time.Millisecond)
+
+// Geo is a coarse location attached to audit metadata
+type Geo struct {
+	Country string `json:"country" dynamodbav:"country"`
+	Region  string `json:"region" dynamodbav:"region"`
+}
+
+// geoCache keeps lookups for the lifetime of the Lambda container
+var geoCache = struct {
+	sync.Mutex
+	entries map[string]Geo
+}{entries: map[string]Geo{}}
+
+// UnknownGeo is recorded for private, invalid or unresolvable addresses
+func UnknownGeo() Geo {
+	return Geo{Country: geoUnknown, Region: geoUnknown}
+}
+
+// ResolveGeo maps an IP address to a coarse location. It never fails: private
+// and invalid addresses, a missing lookup service and lookup errors all
+// resolve to UnknownGeo.
+func ResolveGeo(ctx context.Context, ip string) Geo {
+	addr := net.ParseIP(strings.TrimSpace(ip))
+	if addr == nil || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return UnknownGeo()
+	}
+
+	lookupURL := os.Getenv(geoLookupURLEnv)
+	if lookupURL == "" {
+		return UnknownGeo()
+	}
+
+	key := addr.String()
+	geoCache.Lock()
+	cached, ok := geoCache.entries[key]
+	geoCache.Unlock()
+	if ok {
+		return cached
+	}
+
+	geo, err := lookupGeo(ctx, strings.ReplaceAll(lookupURL, "{ip}", url.PathEscape(key)))
+	if err != nil {
+		log.Printf("Geo lookup error for %s: %v", key, err)
+		return UnknownGeo()
+	}
+
+	geoCache.Lock()
+	if len(geoCache.entries) >= geoCacheMaxSize {
+		geoCache.entries = map[string]Geo{}
+	}
+	geoCache.entries[key] = geo
+	geoCache.Unlock()
+	return geo
+}
+
+// lookupGeo queries the lookup service
+func lookupGeo(ctx context.Context, lookupURL string) (Geo, error) {
+	ctx, cancel := context.WithTimeout(ctx, geoLookupTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lookupURL, nil)
+	if err != nil {
+		return Geo{}, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return Geo{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Geo{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var geo Geo
+	if err := json.NewDecoder(resp.Body).Decode(&geo); err != nil {
+		return Geo{}, err
+	}
+	if geo.Country == "" {
+		geo.Country = geoUnknown
+	}
+	if geo.Region == "" {
+		geo.Region = geoUnknown
+	}
+	return geo, nil
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveGeoPrivateAddresses(t *testing.T) {
+	t.Setenv(geoLookupURLEnv, "http://127.0.0.1:1/{ip}")
+
+	for _, ip := range []string{"", "not-an-ip", "10.0.0.1", "192.168.1.5", "127.0.0.1", "::1", "fe80::1"} {
+		if got := ResolveGeo(context.Background(), ip); got != UnknownGeo() {
+			t.Errorf("ResolveGeo(%q) = %+v, want unknown", ip, got)
+		}
+	}
+}
+
+func TestResolveGeoLookup(t *testing.T) {
+	var requested string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Path
+		w.Write([]byte(`{"country":"ES","region":"Madrid"}`))
+	}))
+	defer server.Close()
+	t.Setenv(geoLookupURLEnv, server.URL+"/lookup/{ip}")
+
+	got := ResolveGeo(context.Background(), "203.0.113.7")
+	if got != (Geo{Country: "ES", Region: "Madrid"}) {
+		t.Errorf("ResolveGeo = %+v", got)
+	}
+	if requested != "/lookup/203.0.113.7" {
+		t.Errorf("requested %q", requested)
+	}
+}
+
+func TestResolveGeoLookupFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	t.Setenv(geoLookupURLEnv, server.URL+"/{ip}")
+
+	if got := ResolveGeo(context.Background(), "198.51.100.9"); got != UnknownGeo() {
+		t.Errorf("ResolveGeo = %+v, want unknown", got)
+	}
+}
+
+func TestResolveGeoWithoutService(t *testing.T) {
+	t.Setenv(geoLookupURLEnv, "")
+
+	if got := ResolveGeo(context.Background(), "198.51.100.10"); got != UnknownGeo() {
+		t.Errorf("ResolveGeo = %+v, want unknown", got)
+	}
+}
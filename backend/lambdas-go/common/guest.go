@@ -0,0 +1,120 @@
+package common
+
+import (
+	"context"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// GuestRateWindow is the window GUEST_RATE_LIMIT applies to
+	GuestRateWindow       = time.Minute
+	defaultGuestRateLimit = 30
+)
+
+// guestRateLimit is the number of requests one IP may make to an
+// unauthenticated endpoint per GuestRateWindow (GUEST_RATE_LIMIT). It is
+// deliberately stricter than the per-user limits since callers are anonymous.
+var guestRateLimit = guestRateLimitFromEnv()
+
+// GuestLimiter rate limits unauthenticated requests by client IP. Declare it
+// as a package variable, use its Limit method in the handler chain and call
+// SetClient from init; until then requests pass through.
+type GuestLimiter struct {
+	counter *RateCounter
+}
+
+// SetClient sets the DynamoDB client the limiter counts requests with
+func (g *GuestLimiter) SetClient(client UpdateItemAPI) {
+	g.counter = NewRateCounter(client, "guest", GuestRateWindow)
+}
+
+// Limit returns 429 with a Retry-After header once the caller's IP has used
+// up its requests for the window. A counter error lets the request through,
+// so an unavailable table never takes public endpoints down.
+func (g *GuestLimiter) Limit(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if g.counter == nil {
+			return next(ctx, request)
+		}
+
+		ip := ClientIP(request)
+		if ip == "" {
+			ip = geoUnknown
+		}
+		_, ok, err := g.counter.Add(ctx, ip, 1, guestRateLimit)
+		if err != nil {
+			log.Printf("Guest rate counter error: %v", err)
+			return next(ctx, request)
+		}
+		if !ok {
+			response := ToResponse(Throttled(""))
+			retryAfter := g.counter.ResetIn(time.Now())
+			response.Headers["Retry-After"] = strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+			return response, nil
+		}
+		return next(ctx, request)
+	}
+}
+
+// ResetIn returns how long until the window containing now ends
+func (c *RateCounter) ResetIn(now time.Time) time.Duration {
+	now = now.UTC()
+	return now.Truncate(c.window).Add(c.window).Sub(now)
+}
+
+// ClientIP returns the caller's IP address: the leftmost public address in
+// X-Forwarded-For, falling back to the source IP API Gateway saw. Clients
+// can prepend their own X-Forwarded-For entries, so the result is only good
+// enough for rate limiting, not for authorization.
+func ClientIP(request events.APIGatewayProxyRequest) string {
+	for _, entry := range strings.Split(forwardedFor(request), ",") {
+		addr := net.ParseIP(strings.TrimSpace(entry))
+		if addr != nil && isPublicIP(addr) {
+			return addr.String()
+		}
+	}
+	return request.RequestContext.Identity.SourceIP
+}
+
+// forwardedFor returns the X-Forwarded-For header, whatever its case
+func forwardedFor(request events.APIGatewayProxyRequest) string {
+	for name, value := range request.Headers {
+		if strings.EqualFold(name, "X-Forwarded-For") {
+			return value
+		}
+	}
+	for name, values := range request.MultiValueHeaders {
+		if strings.EqualFold(name, "X-Forwarded-For") {
+			return strings.Join(values, ",")
+		}
+	}
+	return ""
+}
+
+// isPublicIP reports whether addr is routable on the internet
+func isPublicIP(addr net.IP) bool {
+	return !addr.IsPrivate() && !addr.IsLoopback() && !addr.IsLinkLocalUnicast() && !addr.IsUnspecified()
+}
+
+// guestRateLimitFromEnv parses GUEST_RATE_LIMIT, falling back to the default
+// when it is unset or invalid
+func guestRateLimitFromEnv() int64 {
+	v := os.Getenv("GUEST_RATE_LIMIT")
+	if v == "" {
+		return defaultGuestRateLimit
+	}
+	limit, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || limit <= 0 {
+		log.Printf("Invalid GUEST_RATE_LIMIT %q, using %d", v, defaultGuestRateLimit)
+		return defaultGuestRateLimit
+	}
+	return limit
+}
@@ -0,0 +1,122 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		sourceIP string
+		want     string
+	}{
+		{"no header", nil, "203.0.113.9", "203.0.113.9"},
+		{"leftmost public", map[string]string{"X-Forwarded-For": "198.51.100.7, 203.0.113.9"}, "203.0.113.9", "198.51.100.7"},
+		{"skips private", map[string]string{"x-forwarded-for": "10.0.0.1, 192.168.1.5, 198.51.100.7"}, "203.0.113.9", "198.51.100.7"},
+		{"skips garbage", map[string]string{"X-Forwarded-For": "unknown, 198.51.100.7"}, "203.0.113.9", "198.51.100.7"},
+		{"only private", map[string]string{"X-Forwarded-For": "127.0.0.1, 10.1.2.3"}, "203.0.113.9", "203.0.113.9"},
+		{"ipv6", map[string]string{"X-Forwarded-For": "2001:db8::1"}, "203.0.113.9", "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := events.APIGatewayProxyRequest{Headers: tt.headers}
+			request.RequestContext.Identity.SourceIP = tt.sourceIP
+			if got := ClientIP(request); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPMultiValueHeader(t *testing.T) {
+	request := events.APIGatewayProxyRequest{
+		MultiValueHeaders: map[string][]string{"X-Forwarded-For": {"10.0.0.1", "198.51.100.7"}},
+	}
+	if got := ClientIP(request); got != "198.51.100.7" {
+		t.Errorf("ClientIP() = %q, want 198.51.100.7", got)
+	}
+}
+
+// fakeUpdate answers UpdateItem with a fixed result
+type fakeUpdate struct {
+	count int64
+	err   error
+	keys  []string
+}
+
+func (f *fakeUpdate) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.keys = append(f.keys, params.Key["counterKey"].(*types.AttributeValueMemberS).Value)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &dynamodb.UpdateItemOutput{Attributes: map[string]types.AttributeValue{
+		"count": &types.AttributeValueMemberN{Value: strconv.FormatInt(f.count, 10)},
+	}}, nil
+}
+
+func okHandler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return BuildResponse(200, map[string]string{}), nil
+}
+
+func TestGuestLimiterAllows(t *testing.T) {
+	client := &fakeUpdate{count: 1}
+	var limiter GuestLimiter
+	limiter.SetClient(client)
+
+	request := events.APIGatewayProxyRequest{Headers: map[string]string{"X-Forwarded-For": "198.51.100.7"}}
+	response, _ := limiter.Limit(okHandler)(context.Background(), request)
+	if response.StatusCode != 200 {
+		t.Errorf("status = %d, want 200", response.StatusCode)
+	}
+	if len(client.keys) != 1 || client.keys[0][:len("guest#198.51.100.7#")] != "guest#198.51.100.7#" {
+		t.Errorf("unexpected counter keys %v", client.keys)
+	}
+}
+
+func TestGuestLimiterThrottles(t *testing.T) {
+	client := &fakeUpdate{err: &types.ConditionalCheckFailedException{
+		Item: map[string]types.AttributeValue{"count": &types.AttributeValueMemberN{Value: "30"}},
+	}}
+	var limiter GuestLimiter
+	limiter.SetClient(client)
+
+	response, err := limiter.Limit(okHandler)(context.Background(), events.APIGatewayProxyRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if response.StatusCode != 429 {
+		t.Errorf("status = %d, want 429", response.StatusCode)
+	}
+	retryAfter, err := strconv.Atoi(response.Headers["Retry-After"])
+	if err != nil || retryAfter < 1 || retryAfter > int(GuestRateWindow.Seconds()) {
+		t.Errorf("unexpected Retry-After %q", response.Headers["Retry-After"])
+	}
+}
+
+func TestGuestLimiterFailsOpen(t *testing.T) {
+	var limiter GuestLimiter
+	limiter.SetClient(&fakeUpdate{err: errors.New("table unavailable")})
+
+	response, _ := limiter.Limit(okHandler)(context.Background(), events.APIGatewayProxyRequest{})
+	if response.StatusCode != 200 {
+		t.Errorf("status = %d, want 200", response.StatusCode)
+	}
+}
+
+func TestRateCounterResetIn(t *testing.T) {
+	counter := NewRateCounter(nil, "guest", time.Minute)
+	now := time.Date(2024, 1, 2, 3, 4, 45, 0, time.UTC)
+	if got := counter.ResetIn(now); got != 15*time.Second {
+		t.Errorf("ResetIn() = %s, want 15s", got)
+	}
+}
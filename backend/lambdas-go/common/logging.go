@@ -0,0 +1,69 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// debugLogging enables request detail logs such as the authorizer context
+// (LOG_LEVEL=debug). Any other level keeps them off.
+var debugLogging = strings.EqualFold(strings.TrimSpace(os.Getenv("LOG_LEVEL")), "debug")
+
+// sensitiveKeyParts mark authorizer fields whose values are never logged,
+// matched case-insensitively against any part of the key
+var sensitiveKeyParts = []string{"token", "authorization", "jwt", "secret", "password", "credential", "cookie", "signature"}
+
+// Debugf logs only when LOG_LEVEL is debug
+func Debugf(format string, args ...interface{}) {
+	if debugLogging {
+		log.Output(2, fmt.Sprintf(format, args...))
+	}
+}
+
+// RedactAuthorizer returns a copy of an authorizer context with the values
+// of sensitive fields, at any depth, replaced by "[REDACTED]". The original
+// is left untouched since handlers still read it.
+func RedactAuthorizer(authorizer map[string]interface{}) map[string]interface{} {
+	if authorizer == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(authorizer))
+	for key, value := range authorizer {
+		if isSensitiveKey(key) {
+			out[key] = redacted
+			continue
+		}
+		out[key] = redactValue(value)
+	}
+	return out
+}
+
+// redactValue redacts maps and slices nested in an authorizer value
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return RedactAuthorizer(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redactValue(item)
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
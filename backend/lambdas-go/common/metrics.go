@@ -0,0 +1,103 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultMetricsNamespace = "CompincheFileManager"
+
+// Metric units used with EmitMetrics
+const (
+	UnitCount        = "Count"
+	UnitMilliseconds = "Milliseconds"
+)
+
+// Audit write metrics, emitted by RecordAuditWrite
+const (
+	MetricAuditWriteSuccess = "AuditWriteSuccess"
+	MetricAuditWriteFailure = "AuditWriteFailure"
+	MetricAuditWriteLatency = "AuditWriteLatency"
+)
+
+var (
+	// metricsNamespace is the CloudWatch namespace of emitted metrics
+	// (METRICS_NAMESPACE)
+	metricsNamespace = stringFromEnv("METRICS_NAMESPACE", defaultMetricsNamespace)
+	// functionName is the metrics' only dimension
+	functionName = os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+
+	// metricsOut receives the EMF lines; tests replace it
+	metricsOut io.Writer = os.Stdout
+	// metricsMu keeps concurrent lines from interleaving
+	metricsMu sync.Mutex
+)
+
+// Metric is one value for EmitMetrics
+type Metric struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// EmitMetrics writes metrics as one CloudWatch Embedded Metric Format line
+// on stdout. Lambda ships stdout to CloudWatch Logs, which extracts the
+// metrics without any API call, so it is safe on the request path. The
+// line must be bare JSON, so it bypasses the log package's prefix.
+func EmitMetrics(metrics ...Metric) {
+	if len(metrics) == 0 {
+		return
+	}
+
+	definitions := make([]map[string]string, 0, len(metrics))
+	line := map[string]interface{}{
+		"FunctionName": functionName,
+	}
+	for _, m := range metrics {
+		definitions = append(definitions, map[string]string{"Name": m.Name, "Unit": m.Unit})
+		line[m.Name] = m.Value
+	}
+	line["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  metricsNamespace,
+			"Dimensions": [][]string{{"FunctionName"}},
+			"Metrics":    definitions,
+		}},
+	}
+
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		log.Printf("Metrics marshal error: %v", err)
+		return
+	}
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	fmt.Fprintln(metricsOut, string(encoded))
+}
+
+// RecordAuditWrite emits the outcome of one audit entry write: a count of
+// AuditWriteSuccess or AuditWriteFailure, and for writes that reached
+// DynamoDB their latency. Audit writes run in the background and only log
+// their errors, so these metrics are what alarms on lost audit entries use.
+// A zero latency means the write failed before it was sent.
+func RecordAuditWrite(latency time.Duration, err error) {
+	outcome := MetricAuditWriteSuccess
+	if err != nil {
+		outcome = MetricAuditWriteFailure
+	}
+	metrics := []Metric{{Name: outcome, Unit: UnitCount, Value: 1}}
+	if latency > 0 {
+		metrics = append(metrics, Metric{
+			Name:  MetricAuditWriteLatency,
+			Unit:  UnitMilliseconds,
+			Value: float64(latency) / float64(time.Millisecond),
+		})
+	}
+	EmitMetrics(metrics...)
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureMetrics collects the EMF lines written while fn runs
+func captureMetrics(t *testing.T, fn func()) []map[string]interface{} {
+	t.Helper()
+	var buf bytes.Buffer
+	defer func(out io.Writer) { metricsOut = out }(metricsOut)
+	metricsOut = &buf
+	fn()
+
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &decoded); err != nil {
+			t.Fatalf("metrics line %q is not JSON: %v", line, err)
+		}
+		lines = append(lines, decoded)
+	}
+	return lines
+}
+
+// metricNames returns the metric names a line declares in its _aws block
+func metricNames(t *testing.T, line map[string]interface{}) []string {
+	t.Helper()
+	directive := line["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+	if directive["Namespace"] != metricsNamespace {
+		t.Errorf("Namespace = %v, want %s", directive["Namespace"], metricsNamespace)
+	}
+	var names []string
+	for _, m := range directive["Metrics"].([]interface{}) {
+		names = append(names, m.(map[string]interface{})["Name"].(string))
+	}
+	return names
+}
+
+func TestRecordAuditWriteSuccess(t *testing.T) {
+	lines := captureMetrics(t, func() { RecordAuditWrite(25*time.Millisecond, nil) })
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1", len(lines))
+	}
+
+	names := metricNames(t, lines[0])
+	if strings.Join(names, ",") != "AuditWriteSuccess,AuditWriteLatency" {
+		t.Errorf("metrics = %v", names)
+	}
+	if lines[0]["AuditWriteSuccess"] != 1.0 || lines[0]["AuditWriteLatency"] != 25.0 {
+		t.Errorf("values = %v, %v; want 1 and 25", lines[0]["AuditWriteSuccess"], lines[0]["AuditWriteLatency"])
+	}
+	if _, ok := lines[0]["FunctionName"]; !ok {
+		t.Error("FunctionName dimension missing")
+	}
+}
+
+func TestRecordAuditWriteFailure(t *testing.T) {
+	lines := captureMetrics(t, func() {
+		RecordAuditWrite(40*time.Millisecond, errors.New("throttled"))
+		RecordAuditWrite(0, errors.New("marshal"))
+	})
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+
+	if names := metricNames(t, lines[0]); strings.Join(names, ",") != "AuditWriteFailure,AuditWriteLatency" {
+		t.Errorf("metrics = %v", names)
+	}
+	// Writes that never reached DynamoDB have no latency
+	if names := metricNames(t, lines[1]); strings.Join(names, ",") != "AuditWriteFailure" {
+		t.Errorf("metrics = %v", names)
+	}
+}
@@ -0,0 +1,157 @@
+package common
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// HandlerFunc is the signature shared by all API Gateway proxy handlers
+type HandlerFunc func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
+
+// Middleware wraps a HandlerFunc with additional behavior
+type Middleware func(next HandlerFunc) HandlerFunc
+
+type contextKey string
+
+const (
+	userIDKey    contextKey = "userId"
+	sourceIPKey  contextKey = "sourceIp"
+	requestIDKey contextKey = "requestId"
+)
+
+// Chain composes middlewares into one. The first middleware is the outermost,
+// so Chain(a, b)(h) runs a, then b, then h.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// Recover converts a panic in the wrapped handler into a 500 response. The
+// response is built with BuildErrorResponse so CORS headers are kept and the
+// browser client sees a normal error instead of a failed invocation.
+func Recover(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Panic recovered: %v\n%s", r, debug.Stack())
+				response = BuildErrorResponse(500, "Internal server error")
+				applyAllowedOrigin(request, &response)
+				err = nil
+			}
+		}()
+		return next(ctx, request)
+	}
+}
+
+// LogRequest logs the method, path, status, duration and request ID of each
+// request, and the redacted authorizer context at LOG_LEVEL=debug. It also
+// stores the request ID in the context for RequestID.
+func LogRequest(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		// Claims are only logged at debug level, and never with tokens
+		Debugf("Authorizer context: %+v", RedactAuthorizer(request.RequestContext.Authorizer))
+
+		requestID := RequestID(ctx)
+		if requestID == "" {
+			requestID = request.RequestContext.RequestID
+		}
+		ctx = context.WithValue(ctx, requestIDKey, requestID)
+
+		start := time.Now()
+		response, err := next(ctx, request)
+		log.Printf("%s %s -> %d (%s) requestId=%s", HTTPMethod(request), request.Path, response.StatusCode, time.Since(start), requestID)
+		return response, err
+	}
+}
+
+// CORS answers preflight OPTIONS requests without invoking the handler. With
+// ALLOWED_ORIGINS set, responses carry the caller's Origin when it is allowed
+// and the first exact entry when it isn't (see AllowedOrigin), which browsers
+// refuse for the caller.
+func CORS(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		if HTTPMethod(request) == "OPTIONS" {
+			response := BuildResponse(200, map[string]string{})
+			response.Headers["Access-Control-Allow-Methods"] = "GET,POST,PUT,PATCH,DELETE,OPTIONS"
+			applyAllowedOrigin(request, &response)
+			return response, nil
+		}
+		response, err := next(ctx, request)
+		applyAllowedOrigin(request, &response)
+		return response, err
+	}
+}
+
+// RequireUser extracts the caller's user ID and stores it in the context,
+// returning 401 if it cannot be found
+func RequireUser(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		userID, err := ExtractUserID(request)
+		if err != nil {
+			log.Printf("Auth error: %v", err)
+			return ToResponse(Unauthorized("Unauthorized: userId not found")), nil
+		}
+		return next(context.WithValue(ctx, userIDKey, userID), request)
+	}
+}
+
+// CaptureSourceIP stores the caller's IP address from the request context so
+// code without access to the request, such as audit writers, can read it
+func CaptureSourceIP(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return next(context.WithValue(ctx, sourceIPKey, request.RequestContext.Identity.SourceIP), request)
+	}
+}
+
+// SourceIP returns the IP address stored in the context by CaptureSourceIP
+func SourceIP(ctx context.Context) string {
+	ip, _ := ctx.Value(sourceIPKey).(string)
+	return ip
+}
+
+// RequestID identifies the current invocation: the Lambda request ID, which
+// CloudWatch Logs attaches to every log line of the invocation, or, outside
+// Lambda, the API Gateway request ID stored by LogRequest. It is "" when
+// neither is known.
+func RequestID(ctx context.Context) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		return lc.AwsRequestID
+	}
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// SetCorrelationID records RequestID in audit metadata as correlationId, so
+// an entry can be traced to the invocation that wrote it and its logs. Any
+// correlationId already in metadata is replaced, or removed when there is no
+// request ID, so clients can't point entries at someone else's request.
+func SetCorrelationID(ctx context.Context, metadata map[string]interface{}) {
+	if requestID := RequestID(ctx); requestID != "" {
+		metadata["correlationId"] = requestID
+	} else {
+		delete(metadata, "correlationId")
+	}
+}
+
+// UserID returns the user ID stored in the context by RequireUser
+func UserID(ctx context.Context) string {
+	userID, _ := ctx.Value(userIDKey).(string)
+	return userID
+}
+
+// HTTPMethod returns the request's HTTP method, falling back to the request context
+func HTTPMethod(request events.APIGatewayProxyRequest) string {
+	if request.HTTPMethod != "" {
+		return request.HTTPMethod
+	}
+	return request.RequestContext.HTTPMethod
+}
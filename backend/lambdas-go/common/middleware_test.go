@@ -0,0 +1,108 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+func TestRecoverReturnsCleanServerError(t *testing.T) {
+	handler := Recover(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		var claims map[string]interface{}
+		claims["sub"] = "boom" // nil map write panics
+		return BuildResponse(200, nil), nil
+	})
+
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{})
+	if err != nil {
+		t.Fatalf("expected nil error, got %v", err)
+	}
+	if response.StatusCode != 500 {
+		t.Errorf("expected status 500, got %d", response.StatusCode)
+	}
+	if response.Headers["Access-Control-Allow-Origin"] == "" {
+		t.Error("expected CORS headers on recovered response")
+	}
+
+	var body ErrorResponse
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("response body is not JSON: %v", err)
+	}
+	if body.Error != "Internal server error" {
+		t.Errorf("unexpected error message %q", body.Error)
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	mark := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+				calls = append(calls, name)
+				return next(ctx, request)
+			}
+		}
+	}
+
+	handler := Chain(mark("a"), mark("b"))(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		calls = append(calls, "handler")
+		return BuildResponse(200, nil), nil
+	})
+	handler(context.Background(), events.APIGatewayProxyRequest{})
+
+	if len(calls) != 3 || calls[0] != "a" || calls[1] != "b" || calls[2] != "handler" {
+		t.Errorf("unexpected call order %v", calls)
+	}
+}
+
+func TestRequireUser(t *testing.T) {
+	var gotUserID string
+	handler := RequireUser(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		gotUserID = UserID(ctx)
+		return BuildResponse(200, nil), nil
+	})
+
+	response, _ := handler(context.Background(), events.APIGatewayProxyRequest{})
+	if response.StatusCode != 401 {
+		t.Errorf("expected 401 without credentials, got %d", response.StatusCode)
+	}
+
+	request := events.APIGatewayProxyRequest{}
+	request.RequestContext.Authorizer = map[string]interface{}{
+		"claims": map[string]interface{}{"sub": "user-123"},
+	}
+	response, _ = handler(context.Background(), request)
+	if response.StatusCode != 200 || gotUserID != "user-123" {
+		t.Errorf("expected 200 with user-123, got %d with %q", response.StatusCode, gotUserID)
+	}
+}
+
+func TestLogRequestStoresRequestID(t *testing.T) {
+	var got map[string]interface{}
+	handler := LogRequest(func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		got = map[string]interface{}{}
+		SetCorrelationID(ctx, got)
+		return BuildResponse(200, nil), nil
+	})
+	request := events.APIGatewayProxyRequest{RequestContext: events.APIGatewayProxyRequestContext{RequestID: "apigw-1"}}
+
+	handler(context.Background(), request)
+	if got["correlationId"] != "apigw-1" {
+		t.Errorf("without a Lambda context correlationId = %v, want apigw-1", got["correlationId"])
+	}
+
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "lambda-1"})
+	handler(ctx, request)
+	if got["correlationId"] != "lambda-1" {
+		t.Errorf("in Lambda correlationId = %v, want lambda-1", got["correlationId"])
+	}
+
+	metadata := map[string]interface{}{"correlationId": "forged"}
+	SetCorrelationID(context.Background(), metadata)
+	if _, ok := metadata["correlationId"]; ok {
+		t.Errorf("without a request ID metadata = %v, want no correlationId", metadata)
+	}
+}
@@ -0,0 +1,182 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// MinPartSize is the smallest part S3 accepts in a multipart upload, except for the last part
+const MinPartSize = 5 * 1024 * 1024
+
+// MaxParts is the most parts S3 accepts in one multipart upload, which caps
+// a MultipartWriter object at MaxParts * MinPartSize (about 48 GiB)
+const MaxParts = 10000
+
+// ErrTooManyParts is returned by MultipartWriter when an object would need
+// more than MaxParts parts
+var ErrTooManyParts = errors.New("multipart upload exceeds the part limit")
+
+// MultipartUploadAPI is the subset of the S3 client used by MultipartWriter
+type MultipartUploadAPI interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// MultipartWriter streams data to an S3 object with bounded memory. Writes are
+// buffered up to MinPartSize and uploaded as parts; Close completes the upload.
+// Objects smaller than one part are written with a single PutObject. Callers
+// must call Abort instead of Close on failure so no incomplete upload is left
+// behind.
+type MultipartWriter struct {
+	ctx         context.Context
+	client      MultipartUploadAPI
+	bucket      string
+	key         string
+	contentType string
+
+	buf      bytes.Buffer
+	uploadID string
+	parts    []types.CompletedPart
+	written  int64
+}
+
+// NewMultipartWriter creates a writer for s3://bucket/key
+func NewMultipartWriter(ctx context.Context, client MultipartUploadAPI, bucket, key, contentType string) *MultipartWriter {
+	return &MultipartWriter{
+		ctx:         ctx,
+		client:      client,
+		bucket:      bucket,
+		key:         key,
+		contentType: contentType,
+	}
+}
+
+// Write buffers p and uploads a part whenever the buffer reaches MinPartSize
+func (w *MultipartWriter) Write(p []byte) (int, error) {
+	n, _ := w.buf.Write(p)
+	w.written += int64(n)
+	for w.buf.Len() >= MinPartSize {
+		if err := w.uploadPart(w.buf.Next(MinPartSize)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Written returns the number of bytes written so far
+func (w *MultipartWriter) Written() int64 {
+	return w.written
+}
+
+// Close uploads any buffered data and completes the object
+func (w *MultipartWriter) Close() error {
+	if w.uploadID == "" {
+		// Everything fit in one part; a plain PutObject is cheaper
+		ctx, cancel := WithDeadline(w.ctx)
+		defer cancel()
+		_, err := w.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(w.bucket),
+			Key:           aws.String(w.key),
+			ContentType:   aws.String(w.contentType),
+			ContentLength: aws.Int64(int64(w.buf.Len())),
+			Body:          bytes.NewReader(w.buf.Bytes()),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to put object: %w", err)
+		}
+		return nil
+	}
+
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(w.buf.Next(w.buf.Len())); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := WithDeadline(w.ctx)
+	defer cancel()
+	_, err := w.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(w.bucket),
+		Key:             aws.String(w.key),
+		UploadId:        aws.String(w.uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: w.parts},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+// Abort discards the upload and any parts already sent. It uses a fresh
+// context so cleanup still runs when the original one was cancelled.
+func (w *MultipartWriter) Abort() error {
+	w.buf.Reset()
+	if w.uploadID == "" {
+		return nil
+	}
+
+	ctx, cancel := WithDeadline(context.Background())
+	defer cancel()
+	_, err := w.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(w.bucket),
+		Key:      aws.String(w.key),
+		UploadId: aws.String(w.uploadID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to abort multipart upload: %w", err)
+	}
+	return nil
+}
+
+func (w *MultipartWriter) uploadPart(data []byte) error {
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if len(w.parts) == MaxParts {
+		return ErrTooManyParts
+	}
+
+	if w.uploadID == "" {
+		ctx, cancel := WithDeadline(w.ctx)
+		created, err := w.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(w.bucket),
+			Key:         aws.String(w.key),
+			ContentType: aws.String(w.contentType),
+		})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to create multipart upload: %w", err)
+		}
+		w.uploadID = aws.ToString(created.UploadId)
+	}
+
+	partNumber := int32(len(w.parts) + 1)
+	ctx, cancel := WithDeadline(w.ctx)
+	defer cancel()
+	uploaded, err := w.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(w.bucket),
+		Key:           aws.String(w.key),
+		UploadId:      aws.String(w.uploadID),
+		PartNumber:    aws.Int32(partNumber),
+		ContentLength: aws.Int64(int64(len(data))),
+		Body:          bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+	}
+
+	w.parts = append(w.parts, types.CompletedPart{
+		ETag:       uploaded.ETag,
+		PartNumber: aws.Int32(partNumber),
+	})
+	return nil
+}
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeMultipart records the calls a MultipartWriter makes
+type fakeMultipart struct {
+	put       []byte
+	parts     [][]byte
+	completed int
+	aborted   int
+}
+
+func (f *fakeMultipart) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	f.put = data
+	return &s3.PutObjectOutput{}, err
+}
+
+func (f *fakeMultipart) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil
+}
+
+func (f *fakeMultipart) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	f.parts = append(f.parts, data)
+	return &s3.UploadPartOutput{ETag: aws.String("etag")}, err
+}
+
+func (f *fakeMultipart) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.completed++
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeMultipart) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.aborted++
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestMultipartWriterSmallObjectUsesPutObject(t *testing.T) {
+	client := &fakeMultipart{}
+	w := NewMultipartWriter(context.Background(), client, "bucket", "key", "text/csv")
+	if _, err := w.Write([]byte("a,b\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(client.put) != "a,b\n" || len(client.parts) != 0 {
+		t.Errorf("put %q and %d parts, want one PutObject", client.put, len(client.parts))
+	}
+}
+
+func TestMultipartWriterStreamsParts(t *testing.T) {
+	client := &fakeMultipart{}
+	w := NewMultipartWriter(context.Background(), client, "bucket", "key", "text/csv")
+	data := bytes.Repeat([]byte("x"), 2*MinPartSize+10)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.parts) != 2 {
+		t.Fatalf("uploaded %d parts before Close, want 2", len(client.parts))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.parts) != 3 || len(client.parts[2]) != 10 || client.completed != 1 {
+		t.Errorf("got %d parts (completed %d times), want 2 full parts and a 10 byte one", len(client.parts), client.completed)
+	}
+	if w.Written() != int64(len(data)) {
+		t.Errorf("Written() = %d, want %d", w.Written(), len(data))
+	}
+}
+
+func TestMultipartWriterAbortsAfterCancel(t *testing.T) {
+	client := &fakeMultipart{}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := NewMultipartWriter(ctx, client, "bucket", "key", "text/csv")
+	if _, err := w.Write(bytes.Repeat([]byte("x"), MinPartSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if _, err := w.Write(bytes.Repeat([]byte("x"), MinPartSize)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Write after cancel = %v, want context.Canceled", err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatalf("Abort after cancel = %v, want nil", err)
+	}
+	if client.aborted != 1 {
+		t.Errorf("aborted %d times, want 1", client.aborted)
+	}
+}
+
+func TestMultipartWriterPartLimit(t *testing.T) {
+	client := &fakeMultipart{}
+	w := NewMultipartWriter(context.Background(), client, "bucket", "key", "text/csv")
+	w.uploadID = "upload-1"
+	w.parts = make([]types.CompletedPart, MaxParts)
+	if _, err := w.Write(bytes.Repeat([]byte("x"), MinPartSize)); !errors.Is(err, ErrTooManyParts) {
+		t.Errorf("Write past MaxParts = %v, want ErrTooManyParts", err)
+	}
+}
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ErrInvalidToken is returned when a pagination token cannot be decoded or verified
+var ErrInvalidToken = errors.New("invalid pagination token")
+
+// tokenSecretEnv names the env var holding the key used to sign pagination tokens.
+// When unset, tokens are encoded but not signed.
+const tokenSecretEnv = "PAGINATION_TOKEN_SECRET"
+
+// EncodeToken encodes a DynamoDB LastEvaluatedKey as an opaque pagination token.
+// A nil or empty key encodes to an empty token.
+func EncodeToken(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+
+	var keyMap map[string]interface{}
+	if err := attributevalue.UnmarshalMap(key, &keyMap); err != nil {
+		return "", fmt.Errorf("failed to unmarshal key: %w", err)
+	}
+
+	encoded, err := json.Marshal(keyMap)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal key: %w", err)
+	}
+
+	token := base64.StdEncoding.EncodeToString(encoded)
+	if secret := os.Getenv(tokenSecretEnv); secret != "" {
+		token += "." + base64.RawURLEncoding.EncodeToString(signToken(secret, encoded))
+	}
+
+	return token, nil
+}
+
+// DecodeToken decodes a pagination token produced by EncodeToken back into an
+// ExclusiveStartKey. An empty token decodes to a nil key. Malformed, tampered
+// or unsigned (when signing is enabled) tokens return ErrInvalidToken.
+func DecodeToken(token string) (map[string]types.AttributeValue, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	payload, signature, signed := strings.Cut(token, ".")
+
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if secret := os.Getenv(tokenSecretEnv); secret != "" {
+		if !signed {
+			return nil, ErrInvalidToken
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(signature)
+		if err != nil || !hmac.Equal(sig, signToken(secret, decoded)) {
+			return nil, ErrInvalidToken
+		}
+	}
+
+	var keyMap map[string]interface{}
+	if err := json.Unmarshal(decoded, &keyMap); err != nil || len(keyMap) == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	// Key attributes are always strings or numbers in our tables
+	for _, v := range keyMap {
+		switch v.(type) {
+		case string, float64:
+		default:
+			return nil, ErrInvalidToken
+		}
+	}
+
+	key, err := attributevalue.MarshalMap(keyMap)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	return key, nil
+}
+
+// TokenOwner returns the userId attribute of a decoded pagination key, or ""
+// if the key has no string userId. Handlers use it to reject tokens minted for
+// another user's partition.
+func TokenOwner(key map[string]types.AttributeValue) string {
+	if v, ok := key["userId"].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func signToken(secret string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// QueryAPI is the subset of the DynamoDB client used by QueryPage
+type QueryAPI interface {
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+}
+
+// QueryPage runs a paginated query. DynamoDB applies Limit before the
+// FilterExpression, so a page can come back empty while later pages still
+// have matches. When that happens QueryPage follows LastEvaluatedKey, issuing
+// at most maxPages queries in total, and returns the first non-empty page.
+// A non-nil lastKey means more results may exist, even if items is empty.
+func QueryPage(ctx context.Context, client QueryAPI, input *dynamodb.QueryInput, maxPages int) (items []map[string]types.AttributeValue, lastKey map[string]types.AttributeValue, err error) {
+	if maxPages < 1 {
+		maxPages = 1
+	}
+
+	in := *input
+	for page := 0; page < maxPages; page++ {
+		opCtx, cancel := WithDeadline(ctx)
+		result, err := client.Query(opCtx, &in)
+		cancel()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		items, lastKey = result.Items, result.LastEvaluatedKey
+		if len(items) > 0 || len(lastKey) == 0 {
+			break
+		}
+		in.ExclusiveStartKey = lastKey
+	}
+	return items, lastKey, nil
+}
+
+// QueryFill runs a paginated query until it has collected limit items, the
+// results end, or maxPages queries were made, so filtered listings still
+// return full pages. Items beyond limit are dropped and lastKey is then built
+// from the last item kept, using keyAttrs (the table's or index's key
+// attributes), so the next page resumes right after it. Like QueryPage, a
+// non-nil lastKey means more results may exist.
+func QueryFill(ctx context.Context, client QueryAPI, input *dynamodb.QueryInput, limit, maxPages int, keyAttrs ...string) (items []map[string]types.AttributeValue, lastKey map[string]types.AttributeValue, err error) {
+	if maxPages < 1 {
+		maxPages = 1
+	}
+
+	in := *input
+	for page := 0; page < maxPages; page++ {
+		opCtx, cancel := WithDeadline(ctx)
+		result, err := client.Query(opCtx, &in)
+		cancel()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		items = append(items, result.Items...)
+		lastKey = result.LastEvaluatedKey
+		if len(items) >= limit {
+			if len(items) > limit {
+				items = items[:limit]
+				lastKey = make(map[string]types.AttributeValue, len(keyAttrs))
+				for _, attr := range keyAttrs {
+					lastKey[attr] = items[limit-1][attr]
+				}
+			}
+			break
+		}
+		if len(lastKey) == 0 {
+			break
+		}
+		in.ExclusiveStartKey = lastKey
+	}
+	return items, lastKey, nil
+}
@@ -0,0 +1,201 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func testKey() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId": &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId": &types.AttributeValueMemberS{Value: "file-456"},
+	}
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	for _, secret := range []string{"", "test-secret"} {
+		t.Setenv(tokenSecretEnv, secret)
+
+		token, err := EncodeToken(testKey())
+		if err != nil || token == "" {
+			t.Fatalf("EncodeToken(secret=%q) = %q, %v", secret, token, err)
+		}
+
+		key, err := DecodeToken(token)
+		if err != nil {
+			t.Fatalf("DecodeToken(secret=%q) error: %v", secret, err)
+		}
+		if TokenOwner(key) != "user-123" {
+			t.Errorf("unexpected owner %q", TokenOwner(key))
+		}
+		if v, ok := key["fileId"].(*types.AttributeValueMemberS); !ok || v.Value != "file-456" {
+			t.Errorf("unexpected fileId %v", key["fileId"])
+		}
+	}
+}
+
+func TestEncodeTokenEmptyKey(t *testing.T) {
+	token, err := EncodeToken(nil)
+	if err != nil || token != "" {
+		t.Errorf("EncodeToken(nil) = %q, %v", token, err)
+	}
+
+	key, err := DecodeToken("")
+	if err != nil || key != nil {
+		t.Errorf("DecodeToken(\"\") = %v, %v", key, err)
+	}
+}
+
+func TestDecodeTokenRejectsInvalid(t *testing.T) {
+	t.Setenv(tokenSecretEnv, "test-secret")
+
+	valid, err := EncodeToken(testKey())
+	if err != nil {
+		t.Fatalf("EncodeToken error: %v", err)
+	}
+	forged := base64.StdEncoding.EncodeToString([]byte(`{"userId":"other-user","fileId":"file-456"}`))
+
+	tests := map[string]string{
+		"not base64":      "%%%not-base64%%%",
+		"not json":        base64.StdEncoding.EncodeToString([]byte("not json")),
+		"empty object":    base64.StdEncoding.EncodeToString([]byte("{}")),
+		"nested value":    base64.StdEncoding.EncodeToString([]byte(`{"userId":{"S":"x"}}`)),
+		"unsigned":        forged,
+		"bad signature":   forged + "." + valid[len(valid)-10:],
+		"truncated sig":   valid[:len(valid)-4],
+		"swapped payload": forged + valid[len(valid)-44:],
+	}
+
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := DecodeToken(token); !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("DecodeToken(%q) error = %v, want ErrInvalidToken", token, err)
+			}
+		})
+	}
+}
+
+// fakeQuery returns canned pages in order and records the start keys it saw
+type fakeQuery struct {
+	pages     []*dynamodb.QueryOutput
+	startKeys []map[string]types.AttributeValue
+}
+
+func (f *fakeQuery) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	f.startKeys = append(f.startKeys, params.ExclusiveStartKey)
+	page := f.pages[len(f.startKeys)-1]
+	return page, nil
+}
+
+func pageKey(fileID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId": &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId": &types.AttributeValueMemberS{Value: fileID},
+	}
+}
+
+func pageItems(n int) []map[string]types.AttributeValue {
+	items := make([]map[string]types.AttributeValue, n)
+	for i := range items {
+		items[i] = pageKey("item")
+	}
+	return items
+}
+
+func TestQueryPageSkipsFilteredPages(t *testing.T) {
+	client := &fakeQuery{pages: []*dynamodb.QueryOutput{
+		{LastEvaluatedKey: pageKey("a")},
+		{LastEvaluatedKey: pageKey("b")},
+		{Items: pageItems(2), LastEvaluatedKey: pageKey("c")},
+	}}
+
+	items, lastKey, err := QueryPage(context.Background(), client, &dynamodb.QueryInput{}, 5)
+	if err != nil {
+		t.Fatalf("QueryPage error: %v", err)
+	}
+	if len(items) != 2 {
+		t.Errorf("got %d items, want 2", len(items))
+	}
+	if v := lastKey["fileId"].(*types.AttributeValueMemberS).Value; v != "c" {
+		t.Errorf("lastKey fileId = %q, want c", v)
+	}
+	if len(client.startKeys) != 3 || client.startKeys[0] != nil {
+		t.Fatalf("unexpected queries: %v", client.startKeys)
+	}
+	if v := client.startKeys[2]["fileId"].(*types.AttributeValueMemberS).Value; v != "b" {
+		t.Errorf("third query started at %q, want b", v)
+	}
+}
+
+func TestQueryPageStopsAtMaxPages(t *testing.T) {
+	client := &fakeQuery{pages: []*dynamodb.QueryOutput{
+		{LastEvaluatedKey: pageKey("a")},
+		{LastEvaluatedKey: pageKey("b")},
+		{Items: pageItems(1)},
+	}}
+
+	items, lastKey, err := QueryPage(context.Background(), client, &dynamodb.QueryInput{}, 2)
+	if err != nil {
+		t.Fatalf("QueryPage error: %v", err)
+	}
+	if len(items) != 0 || len(client.startKeys) != 2 {
+		t.Errorf("got %d items after %d queries, want 0 after 2", len(items), len(client.startKeys))
+	}
+	// An empty page with a key still signals that more results may exist
+	if len(lastKey) == 0 {
+		t.Error("expected lastKey so the caller reports hasMore")
+	}
+}
+
+func TestQueryPageLastPage(t *testing.T) {
+	client := &fakeQuery{pages: []*dynamodb.QueryOutput{{}}}
+
+	items, lastKey, err := QueryPage(context.Background(), client, &dynamodb.QueryInput{}, 5)
+	if err != nil || len(items) != 0 || lastKey != nil {
+		t.Errorf("QueryPage = %v, %v, %v; want empty last page", items, lastKey, err)
+	}
+	if len(client.startKeys) != 1 {
+		t.Errorf("made %d queries, want 1", len(client.startKeys))
+	}
+}
+
+func TestQueryFillCollectsAcrossPages(t *testing.T) {
+	client := &fakeQuery{pages: []*dynamodb.QueryOutput{
+		{Items: pageItems(1), LastEvaluatedKey: pageKey("a")},
+		{LastEvaluatedKey: pageKey("b")},
+		{Items: []map[string]types.AttributeValue{pageKey("x"), pageKey("y"), pageKey("z")}, LastEvaluatedKey: pageKey("c")},
+	}}
+
+	items, lastKey, err := QueryFill(context.Background(), client, &dynamodb.QueryInput{}, 3, 5, "userId", "fileId")
+	if err != nil {
+		t.Fatalf("QueryFill error: %v", err)
+	}
+	if len(items) != 3 || len(client.startKeys) != 3 {
+		t.Fatalf("got %d items after %d queries, want 3 after 3", len(items), len(client.startKeys))
+	}
+	// "z" was dropped, so the next page resumes after "y", not at "c"
+	if v := lastKey["fileId"].(*types.AttributeValueMemberS).Value; v != "y" || len(lastKey) != 2 {
+		t.Errorf("lastKey = %v, want the key of y", lastKey)
+	}
+}
+
+func TestQueryFillStopsAtMaxPages(t *testing.T) {
+	client := &fakeQuery{pages: []*dynamodb.QueryOutput{
+		{Items: pageItems(1), LastEvaluatedKey: pageKey("a")},
+		{LastEvaluatedKey: pageKey("b")},
+		{Items: pageItems(5)},
+	}}
+
+	items, lastKey, err := QueryFill(context.Background(), client, &dynamodb.QueryInput{}, 3, 2, "userId", "fileId")
+	if err != nil || len(items) != 1 || len(client.startKeys) != 2 {
+		t.Fatalf("QueryFill = %d items, %v after %d queries; want 1 item after 2", len(items), err, len(client.startKeys))
+	}
+	if v := lastKey["fileId"].(*types.AttributeValueMemberS).Value; v != "b" {
+		t.Errorf("lastKey fileId = %q, want b", v)
+	}
+}
@@ -0,0 +1,51 @@
+package common
+
+// Actions a caller can take on a file, as listed by AllowedActions
+const (
+	ActionDownload   = "download"
+	ActionUpdate     = "update" // patch_metadata, tag_file, touch_file, set_pinned
+	ActionShare      = "share"
+	ActionTransfer   = "transfer"
+	ActionDelete     = "delete"
+	ActionHardDelete = "hardDelete"
+	ActionPurge      = "purge"
+	ActionRestore    = "restore"
+)
+
+// AllowedActions lists what the owner of a file with this status and legal
+// hold flag may do with it, so clients can show only the options the
+// handlers will accept. admin is whether the caller is in ADMIN_GROUP.
+// Time-based checks, such as the purge waiting period and the restore
+// window, are not included.
+func AllowedActions(status string, legalHold, admin bool) []string {
+	if status == StatusDeleted {
+		if legalHold {
+			return []string{ActionRestore}
+		}
+		return []string{ActionRestore, ActionPurge}
+	}
+
+	// A rejected file's object is in quarantine; it can only be removed
+	if status == StatusRejected {
+		if legalHold {
+			return []string{}
+		}
+		if admin {
+			return []string{ActionDelete, ActionHardDelete}
+		}
+		return []string{ActionDelete}
+	}
+
+	actions := []string{ActionDownload, ActionUpdate, ActionShare}
+	if legalHold {
+		return actions
+	}
+	if Confirmed(status) {
+		actions = append(actions, ActionTransfer)
+	}
+	actions = append(actions, ActionDelete)
+	if admin {
+		actions = append(actions, ActionHardDelete)
+	}
+	return actions
+}
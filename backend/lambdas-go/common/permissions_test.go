@@ -0,0 +1,32 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAllowedActions(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    string
+		legalHold bool
+		admin     bool
+		want      []string
+	}{
+		{"uploaded", "uploaded", false, false, []string{"download", "update", "share", "transfer", "delete"}},
+		{"uploaded as admin", "uploaded", false, true, []string{"download", "update", "share", "transfer", "delete", "hardDelete"}},
+		{"pending", "pending", false, false, []string{"download", "update", "share", "delete"}},
+		{"held", "uploaded", true, true, []string{"download", "update", "share"}},
+		{"in trash", "deleted", false, false, []string{"restore", "purge"}},
+		{"held in trash", "deleted", true, true, []string{"restore"}},
+		{"rejected", "rejected", false, false, []string{"delete"}},
+		{"held and rejected", "rejected", true, true, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AllowedActions(tt.status, tt.legalHold, tt.admin); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AllowedActions = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// signatureParams must survive a host rewrite for a presigned URL to work
+var signatureParams = []string{"X-Amz-Algorithm", "X-Amz-Credential", "X-Amz-Date", "X-Amz-SignedHeaders", "X-Amz-Signature"}
+
+// ErrInsecureURL is returned for a presigned URL that isn't https, which
+// means the S3 endpoint is misconfigured
+var ErrInsecureURL = errors.New("presigned URL is not https")
+
+// forceHTTPS switches http presigned URLs to https instead of rejecting them
+// (FORCE_HTTPS_URLS=true). SigV4 doesn't sign the scheme, so they stay valid.
+var forceHTTPS = os.Getenv("FORCE_HTTPS_URLS") == "true"
+
+// downloadURLHost is the CDN host presigned download URLs are served from
+// (DOWNLOAD_URL_HOST), e.g. "d111111abcdef8.cloudfront.net". Empty keeps
+// the S3 host.
+var downloadURLHost = downloadURLHostFromEnv()
+
+// downloadURLHostFromEnv parses DOWNLOAD_URL_HOST. An invalid value is
+// ignored, so downloads keep working from S3.
+func downloadURLHostFromEnv() string {
+	v := strings.TrimSpace(os.Getenv("DOWNLOAD_URL_HOST"))
+	if v == "" {
+		return ""
+	}
+	if u, err := url.Parse("https://" + v); err != nil || u.Host != v || u.User != nil {
+		log.Printf("Invalid DOWNLOAD_URL_HOST %q, serving downloads from S3", v)
+		return ""
+	}
+	return v
+}
+
+// DownloadURL returns a presigned GET URL as handed to clients: with
+// DOWNLOAD_URL_HOST set, its host is replaced by the CDN's. The signed query
+// string is kept byte for byte. This only works when the distribution
+// forwards the whole query string to the S3 origin and doesn't forward the
+// viewer's Host header, since the signature covers the S3 host. URLs that
+// aren't https are refused, see SecureURL.
+func DownloadURL(presignedURL string) (string, error) {
+	rewritten, err := rewriteURLHost(presignedURL, downloadURLHost)
+	if err != nil {
+		return "", err
+	}
+	return SecureURL(rewritten)
+}
+
+// SecureURL makes sure a presigned URL handed to clients uses https. An http
+// URL is switched to https with FORCE_HTTPS_URLS=true and otherwise returns
+// ErrInsecureURL, like any other scheme.
+func SecureURL(presignedURL string) (string, error) {
+	return requireHTTPS(presignedURL, forceHTTPS)
+}
+
+func requireHTTPS(presignedURL string, force bool) (string, error) {
+	u, err := url.Parse(presignedURL)
+	if err != nil {
+		return "", fmt.Errorf("parse presigned URL: %w", err)
+	}
+	switch {
+	case u.Scheme == "https":
+		return presignedURL, nil
+	case u.Scheme == "http" && force:
+		u.Scheme = "https"
+		return u.String(), nil
+	}
+	return "", fmt.Errorf("%w: scheme %q", ErrInsecureURL, u.Scheme)
+}
+
+// rewriteURLHost replaces the host of a presigned URL, making sure the
+// signature parameters are still there afterwards
+func rewriteURLHost(presignedURL, host string) (string, error) {
+	if host == "" {
+		return presignedURL, nil
+	}
+
+	u, err := url.Parse(presignedURL)
+	if err != nil {
+		return "", fmt.Errorf("parse presigned URL: %w", err)
+	}
+	rawQuery := u.RawQuery
+	u.Scheme = "https"
+	u.Host = host
+
+	rewritten := u.String()
+	check, err := url.Parse(rewritten)
+	if err != nil {
+		return "", fmt.Errorf("parse rewritten URL: %w", err)
+	}
+	if check.RawQuery != rawQuery {
+		return "", fmt.Errorf("query string changed by host rewrite")
+	}
+	query := check.Query()
+	for _, param := range signatureParams {
+		if query.Get(param) == "" {
+			return "", fmt.Errorf("presigned URL is missing %s", param)
+		}
+	}
+	return rewritten, nil
+}
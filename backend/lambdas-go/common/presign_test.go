@@ -0,0 +1,60 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testPresignedURL = "https://bucket.s3.us-east-1.amazonaws.com/users/u/uploads/f-a%20b.pdf?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKID%2F20240102%2Fus-east-1%2Fs3%2Faws4_request&X-Amz-Date=20240102T030405Z&X-Amz-Expires=3600&X-Amz-SignedHeaders=host&response-content-disposition=attachment%3B%20filename%3D%22a%20b.pdf%22&X-Amz-Signature=abc123"
+
+func TestRewriteURLHost(t *testing.T) {
+	got, err := rewriteURLHost(testPresignedURL, "cdn.example.com")
+	if err != nil {
+		t.Fatalf("rewriteURLHost error: %v", err)
+	}
+	want := "https://cdn.example.com/users/u/uploads/f-a%20b.pdf?" + strings.SplitN(testPresignedURL, "?", 2)[1]
+	if got != want {
+		t.Errorf("rewriteURLHost = %s\nwant %s", got, want)
+	}
+}
+
+func TestRewriteURLHostUnset(t *testing.T) {
+	got, err := rewriteURLHost(testPresignedURL, "")
+	if err != nil || got != testPresignedURL {
+		t.Errorf("rewriteURLHost without a host = %s, %v", got, err)
+	}
+}
+
+func TestRewriteURLHostRequiresSignature(t *testing.T) {
+	unsigned := strings.Replace(testPresignedURL, "&X-Amz-Signature=abc123", "", 1)
+	if _, err := rewriteURLHost(unsigned, "cdn.example.com"); err == nil {
+		t.Error("expected an error for a URL without X-Amz-Signature")
+	}
+}
+
+func TestRequireHTTPS(t *testing.T) {
+	if got, err := requireHTTPS(testPresignedURL, false); err != nil || got != testPresignedURL {
+		t.Errorf("requireHTTPS(https) = %s, %v", got, err)
+	}
+
+	// A bucket endpoint misconfigured as plain http
+	insecure := strings.Replace(testPresignedURL, "https://bucket.s3.us-east-1.amazonaws.com", "http://bucket.s3-insecure.example.com", 1)
+	if _, err := requireHTTPS(insecure, false); !errors.Is(err, ErrInsecureURL) {
+		t.Errorf("requireHTTPS(http) error = %v, want ErrInsecureURL", err)
+	}
+
+	got, err := requireHTTPS(insecure, true)
+	if err != nil {
+		t.Fatalf("requireHTTPS(http, force) error: %v", err)
+	}
+	if want := "https" + strings.TrimPrefix(insecure, "http"); got != want {
+		t.Errorf("requireHTTPS(http, force) = %s\nwant %s", got, want)
+	}
+
+	for _, other := range []string{"ftp://bucket.example.com/key", "//bucket.example.com/key", "not a url"} {
+		if _, err := requireHTTPS(other, true); !errors.Is(err, ErrInsecureURL) {
+			t.Errorf("requireHTTPS(%q) error = %v, want ErrInsecureURL", other, err)
+		}
+	}
+}
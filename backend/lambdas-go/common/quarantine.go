@@ -0,0 +1,198 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// DefaultQuarantinePrefix is where objects of rejected files are moved,
+// outside the users/ prefix uploads go to
+const DefaultQuarantinePrefix = "quarantine/"
+
+// QuarantineUpdate is the SET clause recording where a rejected file's
+// object went; Quarantined.AddValues fills in its values
+const QuarantineUpdate = "quarantineKey = :quarantineKey, sniffedContentType = :sniffed"
+
+// ContentAPI is the subset of the S3 client used to sniff and quarantine
+// objects
+type ContentAPI interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// Quarantine checks that an upload's content looks like its declared type
+// before the upload is confirmed. Content that doesn't is copied to
+// quarantine before the row is rejected, and only removed from the user's
+// prefix (Finish) once the row no longer points at it; if the row can't be
+// rejected the copy is dropped instead (Discard).
+type Quarantine struct {
+	Client ContentAPI
+	Bucket string
+	// Prefix is QUARANTINE_PREFIX, ending in "/"
+	Prefix string
+}
+
+// Quarantined is an object Check copied to quarantine
+type Quarantined struct {
+	Key string
+	// SniffedContentType is what the content looked like
+	SniffedContentType string
+}
+
+// NewQuarantine returns a Quarantine for bucket, using QUARANTINE_PREFIX
+// when it is valid and DefaultQuarantinePrefix otherwise
+func NewQuarantine(client ContentAPI, bucket string) *Quarantine {
+	prefix := DefaultQuarantinePrefix
+	if v := os.Getenv("QUARANTINE_PREFIX"); v != "" {
+		parsed, err := ParseQuarantinePrefix(v)
+		if err != nil {
+			log.Printf("Ignoring QUARANTINE_PREFIX: %v", err)
+		} else {
+			prefix = parsed
+		}
+	}
+	return &Quarantine{Client: client, Bucket: bucket, Prefix: prefix}
+}
+
+// ParseQuarantinePrefix checks QUARANTINE_PREFIX. It must stay out of
+// users/, where uploads go and register_upload listens, and gets a
+// trailing "/".
+func ParseQuarantinePrefix(value string) (string, error) {
+	prefix := strings.Trim(value, "/")
+	switch {
+	case prefix == "":
+		return "", errors.New("must not be empty")
+	case prefix == "users" || strings.HasPrefix(prefix, "users/"):
+		return "", errors.New("must not be under users/")
+	}
+	return prefix + "/", nil
+}
+
+// Check sniffs the given version of file's object, size bytes long, and
+// copies it to quarantine when it can't be of file.ContentType. It returns
+// nil when the file may be confirmed. Pre-compressed files are skipped:
+// their bytes are the compressed stream.
+func (q *Quarantine) Check(ctx context.Context, file *File, versionID string, size int64) (*Quarantined, error) {
+	if file.ContentEncoding != "" {
+		return nil, nil
+	}
+	sniffed, err := q.sniff(ctx, file.S3Key, versionID, size)
+	if err != nil {
+		return nil, fmt.Errorf("S3 get: %w", err)
+	}
+	if ContentMatches(file.ContentType, sniffed) {
+		return nil, nil
+	}
+
+	quarantined := &Quarantined{Key: q.Prefix + file.S3Key, SniffedContentType: sniffed}
+	if err := q.copy(ctx, file.S3Key, versionID, quarantined.Key); err != nil {
+		return nil, fmt.Errorf("S3 quarantine copy: %w", err)
+	}
+	return quarantined, nil
+}
+
+// Finish removes the checked version of file's object once the row points at
+// the quarantine copy, so it can't be downloaded by versionId on a versioned
+// bucket either
+func (q *Quarantine) Finish(ctx context.Context, file *File, versionID string) {
+	q.delete(ctx, file.S3Key, versionID)
+}
+
+// Discard removes the quarantine copy of a file whose row couldn't be
+// rejected: the row still points at the original
+func (q *Quarantine) Discard(ctx context.Context, quarantined *Quarantined) {
+	q.delete(ctx, quarantined.Key, "")
+}
+
+// AddValues adds the values of QuarantineUpdate to values
+func (r *Quarantined) AddValues(values map[string]types.AttributeValue) {
+	values[":quarantineKey"] = &types.AttributeValueMemberS{Value: r.Key}
+	values[":sniffed"] = &types.AttributeValueMemberS{Value: r.SniffedContentType}
+}
+
+// AuditMetadata is the metadata of the access_attempt audit entry for file
+func (r *Quarantined) AuditMetadata(file *File) map[string]interface{} {
+	return map[string]interface{}{
+		"reason":             "content_type_mismatch",
+		"operation":          "upload",
+		"fileName":           file.FileName,
+		"contentType":        file.ContentType,
+		"sniffedContentType": r.SniffedContentType,
+		"quarantineKey":      r.Key,
+		"originalS3Key":      file.S3Key,
+	}
+}
+
+// sniff returns what the first SniffLen bytes of key look like to
+// SniffContentType
+func (q *Quarantine) sniff(ctx context.Context, key, versionID string, size int64) (string, error) {
+	// A range request on an empty object fails, and there is nothing to read
+	if size == 0 {
+		return SniffContentType(nil), nil
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(q.Bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", SniffLen-1)),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+
+	opCtx, cancel := WithDeadline(ctx)
+	defer cancel()
+	output, err := q.Client.GetObject(opCtx, input)
+	if err != nil {
+		return "", err
+	}
+	defer output.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(output.Body, SniffLen))
+	if err != nil {
+		return "", err
+	}
+	return SniffContentType(data), nil
+}
+
+// copy copies the checked version of key to target
+func (q *Quarantine) copy(ctx context.Context, key, versionID, target string) error {
+	source := (&url.URL{Path: q.Bucket + "/" + key}).EscapedPath()
+	if versionID != "" {
+		source += "?versionId=" + url.QueryEscape(versionID)
+	}
+	opCtx, cancel := WithDeadline(ctx)
+	defer cancel()
+	_, err := q.Client.CopyObject(opCtx, &s3.CopyObjectInput{
+		Bucket:     aws.String(q.Bucket),
+		Key:        aws.String(target),
+		CopySource: aws.String(source),
+	})
+	return err
+}
+
+// delete deletes key, or one version of it, logging failures: the row has
+// already been settled and a leftover object is only reported
+func (q *Quarantine) delete(ctx context.Context, key, versionID string) {
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(q.Bucket),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	opCtx, cancel := WithDeadline(ctx)
+	defer cancel()
+	if _, err := q.Client.DeleteObject(opCtx, input); err != nil {
+		log.Printf("Failed to delete s3://%s/%s during quarantine: %v", q.Bucket, key, err)
+	}
+}
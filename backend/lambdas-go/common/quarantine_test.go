@@ -0,0 +1,121 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestParseQuarantinePrefix(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"quarantine", "quarantine/", true},
+		{"/quarantine/uploads/", "quarantine/uploads/", true},
+		{"usersquarantine", "usersquarantine/", true},
+		{"/", "", false},
+		{"users", "", false},
+		{"users/quarantine/", "", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuarantinePrefix(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseQuarantinePrefix(%q) = %q, %v; want %q, ok=%t", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// fakeContent serves an object's bytes, honouring the sniffing range, and
+// records copies and deletes
+type fakeContent struct {
+	data    []byte
+	rng     string
+	sources []string
+	deletes []string
+}
+
+func (f *fakeContent) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.rng = aws.ToString(params.Range)
+	data := f.data
+	if len(data) > SniffLen {
+		data = data[:SniffLen]
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeContent) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.sources = append(f.sources, aws.ToString(params.CopySource))
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeContent) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.deletes = append(f.deletes, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestQuarantineSniff(t *testing.T) {
+	fake := &fakeContent{data: append([]byte("MZ\x90\x00"), make([]byte, 4096)...)}
+	q := &Quarantine{Client: fake, Bucket: "bucket", Prefix: DefaultQuarantinePrefix}
+
+	sniffed, err := q.sniff(context.Background(), "users/u1/uploads/f1-cat.png", "", int64(len(fake.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sniffed != "application/octet-stream" || ContentMatches("image/png", sniffed) {
+		t.Errorf("sniffed %q, want an executable to fail as image/png", sniffed)
+	}
+	if fake.rng != "bytes=0-511" {
+		t.Errorf("range %q, want the first 512 bytes", fake.rng)
+	}
+
+	// Empty objects aren't fetched
+	fake.rng = ""
+	if sniffed, err := q.sniff(context.Background(), "users/u1/uploads/f2-empty.txt", "", 0); err != nil || sniffed != "text/plain" || fake.rng != "" {
+		t.Errorf("empty object sniffed %q, %v with range %q", sniffed, err, fake.rng)
+	}
+}
+
+func TestQuarantineCheck(t *testing.T) {
+	exe := append([]byte("MZ\x90\x00"), make([]byte, 60)...)
+	file := &File{S3Key: "users/u1/uploads/f1-my cat.png", ContentType: "image/png", FileName: "my cat.png"}
+
+	fake := &fakeContent{data: exe}
+	q := &Quarantine{Client: fake, Bucket: "bucket", Prefix: "held/"}
+	quarantined, err := q.Check(context.Background(), file, "v1", int64(len(exe)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quarantined == nil || quarantined.Key != "held/users/u1/uploads/f1-my cat.png" {
+		t.Fatalf("quarantined = %+v, want the object under held/", quarantined)
+	}
+	if len(fake.sources) != 1 || fake.sources[0] != "bucket/users/u1/uploads/f1-my%20cat.png?versionId=v1" {
+		t.Errorf("copy sources = %v, want the checked version", fake.sources)
+	}
+	if len(fake.deletes) != 0 {
+		t.Errorf("Check deleted %v before the row was rejected", fake.deletes)
+	}
+
+	q.Finish(context.Background(), file, "v1")
+	if len(fake.deletes) != 1 || fake.deletes[0] != file.S3Key {
+		t.Errorf("deletes = %v, want the original", fake.deletes)
+	}
+
+	// Matching and pre-compressed content is left alone
+	png := &fakeContent{data: []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")}
+	q.Client = png
+	if quarantined, err := q.Check(context.Background(), file, "", 16); quarantined != nil || err != nil {
+		t.Errorf("png quarantined = %+v, %v", quarantined, err)
+	}
+	gzipped := *file
+	gzipped.ContentEncoding = "gzip"
+	q.Client = fake
+	if quarantined, err := q.Check(context.Background(), &gzipped, "", int64(len(exe))); quarantined != nil || err != nil {
+		t.Errorf("gzip quarantined = %+v, %v", quarantined, err)
+	}
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// QueryValues returns every value of a query parameter. Repeated parameters
+// (tag=a&tag=b) arrive in MultiValueQueryStringParameters, which is used when
+// present; QueryStringParameters only keeps the last of them. Each value is
+// also split on commas so tag=a,b works too. Blank values are dropped.
+func QueryValues(request events.APIGatewayProxyRequest, name string) []string {
+	raw, ok := request.MultiValueQueryStringParameters[name]
+	if !ok {
+		if v, ok := request.QueryStringParameters[name]; ok {
+			raw = []string{v}
+		}
+	}
+
+	var values []string
+	for _, v := range raw {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+	return values
+}
+
+// ParamConflict is a combination of query parameters a handler refuses
+// because it can't honour all of them, rather than quietly dropping one
+type ParamConflict struct {
+	Params []string
+	Reason string
+}
+
+// CheckParamConflicts adds an error to errs for every conflict whose params
+// are all in effect. inEffect says whether a parameter changes the result;
+// handlers decide that after parsing, so e.g. pinnedFirst=false can count as
+// absent. The field of each error is the params joined with "+".
+func CheckParamConflicts(errs *ValidationErrors, conflicts []ParamConflict, inEffect map[string]bool) {
+	for _, conflict := range conflicts {
+		all := true
+		for _, param := range conflict.Params {
+			all = all && inEffect[param]
+		}
+		if all {
+			errs.Add(strings.Join(conflict.Params, "+"), conflict.Reason)
+		}
+	}
+}
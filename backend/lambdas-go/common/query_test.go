@@ -0,0 +1,69 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestQueryValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		request events.APIGatewayProxyRequest
+		want    []string
+	}{
+		{
+			"repeated",
+			events.APIGatewayProxyRequest{
+				QueryStringParameters:           map[string]string{"tag": "b"},
+				MultiValueQueryStringParameters: map[string][]string{"tag": {"a", "b"}},
+			},
+			[]string{"a", "b"},
+		},
+		{
+			"single value fallback",
+			events.APIGatewayProxyRequest{QueryStringParameters: map[string]string{"tag": "a"}},
+			[]string{"a"},
+		},
+		{
+			"comma separated",
+			events.APIGatewayProxyRequest{
+				MultiValueQueryStringParameters: map[string][]string{"tag": {"a, b", "c", " "}},
+			},
+			[]string{"a", "b", "c"},
+		},
+		{"missing", events.APIGatewayProxyRequest{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := QueryValues(tt.request, "tag"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("QueryValues() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckParamConflicts(t *testing.T) {
+	conflicts := []ParamConflict{
+		{[]string{"since", "status"}, "since lists every status"},
+		{[]string{"since", "tag"}, "since can't be filtered by tag"},
+	}
+
+	errs := &ValidationErrors{}
+	CheckParamConflicts(errs, conflicts, map[string]bool{"since": true, "status": true, "tag": true})
+	want := []FieldError{
+		{Field: "since+status", Message: "since lists every status"},
+		{Field: "since+tag", Message: "since can't be filtered by tag"},
+	}
+	if !reflect.DeepEqual(errs.Errors, want) {
+		t.Errorf("errors = %+v, want %+v", errs.Errors, want)
+	}
+
+	errs = &ValidationErrors{}
+	CheckParamConflicts(errs, conflicts, map[string]bool{"since": true, "status": false, "tag": false})
+	if errs.HasErrors() {
+		t.Errorf("errors = %+v for parameters not in effect", errs.Errors)
+	}
+}
@@ -0,0 +1,118 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const defaultRateLimitTable = "RateLimits"
+
+// rateLimitTable holds the short-lived counters (RATE_LIMIT_TABLE). Its
+// partition key is "counterKey" and "expiresAt" is the TTL attribute.
+var rateLimitTable = stringFromEnv("RATE_LIMIT_TABLE", defaultRateLimitTable)
+
+// UpdateItemAPI is the subset of the DynamoDB client used by RateCounter
+type UpdateItemAPI interface {
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+// RateCounter counts events per key in fixed time windows. Each window is a
+// separate item that DynamoDB's TTL removes once the window is over.
+type RateCounter struct {
+	client UpdateItemAPI
+	name   string
+	window time.Duration
+}
+
+// NewRateCounter creates a counter. name namespaces the keys, e.g. "presign".
+func NewRateCounter(client UpdateItemAPI, name string, window time.Duration) *RateCounter {
+	return &RateCounter{client: client, name: name, window: window}
+}
+
+// Increment adds one event for key in the current window and returns the new
+// count for that window
+func (c *RateCounter) Increment(ctx context.Context, key string) (int64, error) {
+	total, _, err := c.Add(ctx, key, 1, 0)
+	return total, err
+}
+
+// Add adds n to key's total in the current window. When limit is positive the
+// add only happens if the new total stays within limit; otherwise ok is false,
+// nothing is counted and the returned total is the current usage. A zero limit
+// means unlimited.
+func (c *RateCounter) Add(ctx context.Context, key string, n, limit int64) (total int64, ok bool, err error) {
+	now := time.Now().UTC()
+	windowStart := now.Truncate(c.window)
+	counterKey := fmt.Sprintf("%s#%s#%d", c.name, key, windowStart.Unix())
+	// Keep the item one extra window so late reads still see it
+	expiresAt := windowStart.Add(2 * c.window).Unix()
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(rateLimitTable),
+		Key: map[string]types.AttributeValue{
+			"counterKey": &types.AttributeValueMemberS{Value: counterKey},
+		},
+		UpdateExpression: aws.String("ADD #count :n SET expiresAt = if_not_exists(expiresAt, :expiresAt)"),
+		ExpressionAttributeNames: map[string]string{
+			"#count": "count",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":n":         &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)},
+			":expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt, 10)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	}
+	if limit > 0 {
+		condition := "attribute_not_exists(#count) OR #count <= :room"
+		if n > limit {
+			// Never fits, even in an empty window
+			condition = "#count <= :room"
+		}
+		input.ConditionExpression = aws.String(condition)
+		input.ExpressionAttributeValues[":room"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(limit-n, 10)}
+		input.ReturnValuesOnConditionCheckFailure = types.ReturnValuesOnConditionCheckFailureAllOld
+	}
+
+	opCtx, cancel := WithDeadline(ctx)
+	defer cancel()
+	result, err := c.client.UpdateItem(opCtx, input)
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			if conditionErr.Item == nil {
+				return 0, false, nil
+			}
+			total, err := countFrom(conditionErr.Item, counterKey)
+			return total, false, err
+		}
+		return 0, false, err
+	}
+
+	total, err = countFrom(result.Attributes, counterKey)
+	return total, err == nil, err
+}
+
+// countFrom reads the count attribute from a counter item
+func countFrom(item map[string]types.AttributeValue, counterKey string) (int64, error) {
+	countAttr, ok := item["count"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("rate counter %s: missing count", counterKey)
+	}
+	return strconv.ParseInt(countAttr.Value, 10, 64)
+}
+
+// stringFromEnv returns an env var, falling back to def when it is unset
+func stringFromEnv(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
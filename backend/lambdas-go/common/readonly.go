@@ -0,0 +1,66 @@
+package common
+
+import (
+	"context"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const defaultReadOnlyRetryAfter = 5 * time.Minute
+
+var (
+	// readOnlyMode rejects writes while data is being migrated (READ_ONLY_MODE)
+	readOnlyMode = readOnlyModeFromEnv()
+	// readOnlyRetryAfter is sent as Retry-After on rejected writes
+	// (READ_ONLY_RETRY_AFTER, Go duration)
+	readOnlyRetryAfter = durationFromEnv("READ_ONLY_RETRY_AFTER", defaultReadOnlyRetryAfter)
+)
+
+// ReadOnlyGuard returns a middleware for handlers that change data. In
+// read-only mode it answers 503 with Retry-After instead of calling the
+// handler, except for the listed HTTP methods, which only read (e.g. GET on
+// audit_file). It goes after CORS so preflight requests still succeed.
+func ReadOnlyGuard(readMethods ...string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+			if !readOnlyMode {
+				return next(ctx, request)
+			}
+			method := HTTPMethod(request)
+			for _, m := range readMethods {
+				if method == m {
+					return next(ctx, request)
+				}
+			}
+			response := ToResponse(Unavailable("Down for maintenance: changes are disabled for now, please try again later"))
+			response.Headers["Retry-After"] = strconv.Itoa(int(math.Ceil(readOnlyRetryAfter.Seconds())))
+			return response, nil
+		}
+	}
+}
+
+// ReadOnlyMode reports whether READ_ONLY_MODE is on, for writers outside the
+// HTTP handlers such as scheduled jobs
+func ReadOnlyMode() bool {
+	return readOnlyMode
+}
+
+// readOnlyModeFromEnv parses READ_ONLY_MODE. An invalid value is logged and
+// treated as off, so a typo doesn't take writes down.
+func readOnlyModeFromEnv() bool {
+	v := os.Getenv("READ_ONLY_MODE")
+	if v == "" {
+		return false
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Invalid READ_ONLY_MODE %q, writes stay enabled", v)
+		return false
+	}
+	return on
+}
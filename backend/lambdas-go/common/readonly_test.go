@@ -0,0 +1,69 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestReadOnlyGuard(t *testing.T) {
+	defer func(mode bool, retryAfter time.Duration) {
+		readOnlyMode, readOnlyRetryAfter = mode, retryAfter
+	}(readOnlyMode, readOnlyRetryAfter)
+	readOnlyMode, readOnlyRetryAfter = true, 90*time.Second
+
+	ok := func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return BuildResponse(200, nil), nil
+	}
+	// Chains as the Lambdas build them: reads without the guard, writes with
+	// it, and audit_file's mixed handler allowing GET
+	read := Chain(HandleErrors, CORS)(ok)
+	write := Chain(HandleErrors, CORS, ReadOnlyGuard())(ok)
+	mixed := Chain(HandleErrors, CORS, ReadOnlyGuard("GET"))(ok)
+
+	tests := []struct {
+		name    string
+		handler HandlerFunc
+		method  string
+		status  int
+	}{
+		{"get_files", read, "GET", 200},
+		{"download_file", read, "POST", 200},
+		{"audit GET", mixed, "GET", 200},
+		{"upload_file", write, "POST", 503},
+		{"delete_file", write, "DELETE", 503},
+		{"audit POST", mixed, "POST", 503},
+		{"write preflight", write, "OPTIONS", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := tt.handler(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: tt.method})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if response.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", response.StatusCode, tt.status)
+			}
+			if tt.status == 503 && response.Headers["Retry-After"] != "90" {
+				t.Errorf("Retry-After = %q, want 90", response.Headers["Retry-After"])
+			}
+		})
+	}
+
+	readOnlyMode = false
+	response, _ := write(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "POST"})
+	if response.StatusCode != 200 {
+		t.Errorf("write blocked outside read-only mode: %d", response.StatusCode)
+	}
+}
+
+func TestReadOnlyModeFromEnv(t *testing.T) {
+	for value, want := range map[string]bool{"": false, "true": true, "1": true, "false": false, "yes please": false} {
+		t.Setenv("READ_ONLY_MODE", value)
+		if got := readOnlyModeFromEnv(); got != want {
+			t.Errorf("READ_ONLY_MODE=%q gave %v, want %v", value, got, want)
+		}
+	}
+}
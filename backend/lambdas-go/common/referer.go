@@ -0,0 +1,53 @@
+package common
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// MaxShareReferers bounds the referer allowlist a shared file can carry
+const MaxShareReferers = 10
+
+// maxAuditRefererLen bounds the Referer recorded by Referer
+const maxAuditRefererLen = 512
+
+// NormalizeRefererPattern returns entry, an origin pattern written like an
+// ALLOWED_ORIGINS entry ("https://blog.example.com", "https://*.example.com"),
+// in the form stored on files, or false if it isn't one
+func NormalizeRefererPattern(entry string) (string, bool) {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if _, ok := parseOriginPattern(entry); !ok {
+		return "", false
+	}
+	return entry, true
+}
+
+// Referer returns the request's Referer header, cut to maxAuditRefererLen
+// so it can be recorded in audit entries
+func Referer(request events.APIGatewayProxyRequest) string {
+	referer := requestHeader(request, "Referer")
+	if len(referer) > maxAuditRefererLen {
+		referer = referer[:maxAuditRefererLen]
+	}
+	return referer
+}
+
+// RefererAllowed reports whether the request's Referer header comes from an
+// origin matching one of patterns. Only the referer's origin is compared; a
+// missing or unparseable Referer is never allowed. Referer is set by the
+// client, so this deters hotlinking from other sites but is not access control.
+func RefererAllowed(request events.APIGatewayProxyRequest, patterns []string) bool {
+	referer, err := url.Parse(requestHeader(request, "Referer"))
+	if err != nil || referer.Scheme == "" || referer.Host == "" || referer.User != nil {
+		return false
+	}
+	origin := referer.Scheme + "://" + referer.Host
+	for _, entry := range patterns {
+		if pattern, ok := parseOriginPattern(entry); ok && pattern.matches(origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestNormalizeRefererPattern(t *testing.T) {
+	if got, ok := NormalizeRefererPattern(" https://Blog.Example.com "); !ok || got != "https://blog.example.com" {
+		t.Errorf("NormalizeRefererPattern = %q, %v", got, ok)
+	}
+	for _, bad := range []string{"", "blog.example.com", "ftp://x.example.com", "https://*.com", "https://blog.example.com/path"} {
+		if _, ok := NormalizeRefererPattern(bad); ok {
+			t.Errorf("NormalizeRefererPattern(%q) accepted", bad)
+		}
+	}
+}
+
+func TestRefererAllowed(t *testing.T) {
+	patterns := []string{"https://blog.example.com", "https://*.partners.example.com"}
+	tests := []struct {
+		referer string
+		ok      bool
+	}{
+		{"https://blog.example.com/posts/1?ref=x", true},
+		{"https://blog.example.com", true},
+		{"https://acme.partners.example.com/page", true},
+
+		{"", false},
+		{"not a url", false},
+		{"http://blog.example.com/posts/1", false},
+		{"https://blog.example.com.evil.com/", false},
+		{"https://evil.com/?https://blog.example.com", false},
+		{"https://user@blog.example.com/", false},
+		{"https://a.b.partners.example.com/", false},
+	}
+	for _, tt := range tests {
+		request := events.APIGatewayProxyRequest{Headers: map[string]string{"referer": tt.referer}}
+		if got := RefererAllowed(request, patterns); got != tt.ok {
+			t.Errorf("RefererAllowed(%q) = %v, want %v", tt.referer, got, tt.ok)
+		}
+	}
+}
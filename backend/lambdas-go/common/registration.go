@@ -0,0 +1,83 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// RegistrationMetaKey is the S3 user metadata key (x-amz-meta-registration)
+// that carries a registration token on objects uploaded in event mode
+const RegistrationMetaKey = "registration"
+
+// MaxRegistrationTokenLen keeps the token within S3's 2 KB user metadata limit
+const MaxRegistrationTokenLen = 2000
+
+// ErrInvalidRegistration is returned for a malformed or forged token
+var ErrInvalidRegistration = errors.New("invalid registration token")
+
+// Registration is what upload_file knows about a file when it presigns the
+// upload. In event mode it travels with the object as a signed token and
+// register_upload turns it into the UserFiles row once the object exists.
+type Registration struct {
+	UserID          string `json:"u"`
+	FileID          string `json:"f"`
+	FileName        string `json:"n"`
+	ContentType     string `json:"t"`
+	ContentEncoding string `json:"e,omitempty"`
+	Folder          string `json:"d,omitempty"`
+	FileSize        int64  `json:"s"`
+	S3Key           string `json:"k"`
+	ExpiresAt       string `json:"x,omitempty"`
+	ChecksumSHA256  string `json:"c,omitempty"`
+	UploadStartedAt string `json:"a,omitempty"` // when upload_file presigned the upload
+}
+
+// SignRegistration encodes r as "<payload>.<signature>", both base64url,
+// with an HMAC-SHA256 of the payload under secret
+func SignRegistration(r Registration, secret []byte) (string, error) {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + registrationSignature(encoded, secret), nil
+}
+
+// VerifyRegistration checks token's signature and decodes it
+func VerifyRegistration(token string, secret []byte) (*Registration, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(registrationSignature(encoded, secret))) {
+		return nil, ErrInvalidRegistration
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidRegistration
+	}
+	var r Registration
+	if err := json.Unmarshal(payload, &r); err != nil || r.UserID == "" || r.FileID == "" || r.S3Key == "" {
+		return nil, ErrInvalidRegistration
+	}
+	return &r, nil
+}
+
+// registrationSignature signs an encoded payload
+func registrationSignature(encoded string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// UploadCompletedAt is when an uploaded object landed in S3: its
+// LastModified time, or now when S3 didn't report one
+func UploadCompletedAt(lastModified *time.Time, now time.Time) string {
+	if lastModified != nil && !lastModified.IsZero() {
+		now = *lastModified
+	}
+	return now.UTC().Format(time.RFC3339)
+}
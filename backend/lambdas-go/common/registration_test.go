@@ -0,0 +1,82 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRegistration() Registration {
+	return Registration{
+		UserID:          "user-123",
+		FileID:          "3f6c1b9e-2f4a-4c41-9d0a-8a1b2c3d4e5f",
+		FileName:        "report.pdf",
+		ContentType:     "application/pdf",
+		FileSize:        2048,
+		S3Key:           "users/user-123/uploads/3f6c1b9e-2f4a-4c41-9d0a-8a1b2c3d4e5f-report.pdf",
+		UploadStartedAt: "2024-01-01T12:00:00Z",
+	}
+}
+
+func TestRegistrationRoundTrip(t *testing.T) {
+	secret := []byte("secret")
+	token, err := SignRegistration(testRegistration(), secret)
+	if err != nil {
+		t.Fatalf("SignRegistration error: %v", err)
+	}
+
+	got, err := VerifyRegistration(token, secret)
+	if err != nil {
+		t.Fatalf("VerifyRegistration error: %v", err)
+	}
+	if *got != testRegistration() {
+		t.Errorf("round trip = %+v, want %+v", *got, testRegistration())
+	}
+}
+
+func TestVerifyRegistrationRejectsTampering(t *testing.T) {
+	secret := []byte("secret")
+	token, _ := SignRegistration(testRegistration(), secret)
+
+	other := testRegistration()
+	other.UserID = "attacker"
+	forged, _ := SignRegistration(other, []byte("wrong-secret"))
+	payload, signature, _ := strings.Cut(token, ".")
+	otherPayload, _, _ := strings.Cut(forged, ".")
+
+	tests := map[string]string{
+		"wrong secret":      forged,
+		"swapped payload":   otherPayload + "." + signature,
+		"missing signature": payload,
+		"empty":             "",
+	}
+	for name, token := range tests {
+		if _, err := VerifyRegistration(token, secret); !errors.Is(err, ErrInvalidRegistration) {
+			t.Errorf("%s: expected ErrInvalidRegistration, got %v", name, err)
+		}
+	}
+}
+
+func TestRegistrationTokenFitsMetadata(t *testing.T) {
+	r := testRegistration()
+	r.FileName = strings.Repeat("n", 255)
+	r.Folder = strings.Repeat("f", 512)
+	r.S3Key = "users/" + r.UserID + "/uploads/" + r.FileID + "-" + r.FileName
+	token, _ := SignRegistration(r, []byte("secret"))
+	if len(token) > MaxRegistrationTokenLen {
+		t.Errorf("token of %d bytes exceeds %d", len(token), MaxRegistrationTokenLen)
+	}
+}
+
+func TestUploadCompletedAt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)
+	landed := time.Date(2024, 1, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600))
+
+	if got := UploadCompletedAt(&landed, now); got != "2024-01-01T11:30:00Z" {
+		t.Errorf("UploadCompletedAt(lastModified) = %s, want the object's LastModified in UTC", got)
+	}
+	if got := UploadCompletedAt(nil, now); got != "2024-01-01T13:00:00Z" {
+		t.Errorf("UploadCompletedAt(nil) = %s, want now", got)
+	}
+}
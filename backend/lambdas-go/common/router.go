@@ -0,0 +1,89 @@
+package common
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Router dispatches the requests of one Lambda to a handler by HTTP method
+// and path suffix, for Lambdas that serve more than one verb or route.
+// Methods are matched case-insensitively and trailing slashes are ignored,
+// so "/files/" and "/files" are the same route. A path that matches with
+// another method gets 405 with an Allow header; a path no route matches
+// gets 404.
+type Router struct {
+	routes []route
+}
+
+type route struct {
+	method  string
+	suffix  string
+	handler HandlerFunc
+}
+
+// NewRouter returns a router without routes
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle adds a route and returns the router so routes can be chained.
+// suffix matches whole trailing path segments, e.g. "versions" matches
+// "/files/versions" but not "/files/oldversions"; "" matches every path.
+// When several suffixes match, the longest wins.
+func (r *Router) Handle(method, suffix string, handler HandlerFunc) *Router {
+	r.routes = append(r.routes, route{
+		method:  strings.ToUpper(method),
+		suffix:  strings.Trim(suffix, "/"),
+		handler: handler,
+	})
+	return r
+}
+
+// Serve is the router's HandlerFunc
+func (r *Router) Serve(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	method := strings.ToUpper(HTTPMethod(request))
+	path := normalizePath(request.Path)
+
+	// Only the most specific matching suffix is considered
+	best := -1
+	for _, rt := range r.routes {
+		if len(rt.suffix) > best && pathHasSuffix(path, rt.suffix) {
+			best = len(rt.suffix)
+		}
+	}
+	if best < 0 {
+		return Fail(NotFound("Route not found"))
+	}
+
+	var allowed []string
+	for _, rt := range r.routes {
+		if len(rt.suffix) != best || !pathHasSuffix(path, rt.suffix) {
+			continue
+		}
+		if rt.method == method {
+			return rt.handler(ctx, request)
+		}
+		allowed = append(allowed, rt.method)
+	}
+
+	sort.Strings(allowed)
+	response := ToResponse(MethodNotAllowed(""))
+	response.Headers["Allow"] = strings.Join(allowed, ", ")
+	return response, nil
+}
+
+// normalizePath strips trailing slashes and makes sure the path starts with one
+func normalizePath(path string) string {
+	return "/" + strings.Trim(path, "/")
+}
+
+// pathHasSuffix reports whether the last segments of path are suffix
+func pathHasSuffix(path, suffix string) bool {
+	if suffix == "" {
+		return true
+	}
+	return path == "/"+suffix || strings.HasSuffix(path, "/"+suffix)
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// named returns a handler that answers with its name in the body
+func named(name string) HandlerFunc {
+	return func(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return events.APIGatewayProxyResponse{StatusCode: 200, Body: name}, nil
+	}
+}
+
+func TestRouter(t *testing.T) {
+	router := NewRouter().
+		Handle("GET", "", named("list")).
+		Handle("post", "/", named("create")).
+		Handle("GET", "files/versions", named("versions")).
+		Handle("DELETE", "versions", named("deleteVersion"))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		body   string
+		allow  string
+	}{
+		{"get", "GET", "/files", 200, "list", ""},
+		{"trailing slash", "GET", "/files/", 200, "list", ""},
+		{"lowercase method", "post", "/files", 200, "create", ""},
+		{"longest suffix wins", "GET", "/api/files/versions/", 200, "versions", ""},
+		{"shorter suffix", "DELETE", "/other/versions", 200, "deleteVersion", ""},
+		{"segment boundary", "GET", "/files/oldversions", 200, "list", ""},
+		{"wrong method", "PUT", "/files", 405, "", "GET, POST"},
+		{"wrong method on suffix", "POST", "/files/versions", 405, "", "GET"},
+		{"wrong method on shorter suffix", "PUT", "/x/versions", 405, "", "DELETE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := router.Serve(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: tt.method, Path: tt.path})
+			if err != nil {
+				t.Fatalf("Serve() error: %v", err)
+			}
+			if response.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", response.StatusCode, tt.status)
+			}
+			if tt.body != "" && response.Body != tt.body {
+				t.Errorf("routed to %q, want %q", response.Body, tt.body)
+			}
+			if response.Headers["Allow"] != tt.allow {
+				t.Errorf("Allow = %q, want %q", response.Headers["Allow"], tt.allow)
+			}
+		})
+	}
+}
+
+func TestRouterUnknownPath(t *testing.T) {
+	router := NewRouter().Handle("GET", "files", named("list"))
+
+	_, err := router.Serve(context.Background(), events.APIGatewayProxyRequest{HTTPMethod: "GET", Path: "/audit"})
+	if response := ToResponse(err); response.StatusCode != 404 {
+		t.Errorf("status = %d, want 404", response.StatusCode)
+	}
+}
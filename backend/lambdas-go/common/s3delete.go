@@ -0,0 +1,92 @@
+package common
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// MaxDeleteObjectsKeys is the most keys one S3 DeleteObjects request takes
+const MaxDeleteObjectsKeys = 1000
+
+// DeleteObjectsAPI is the subset of the S3 client used by DeleteObjectsBatched
+type DeleteObjectsAPI interface {
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+}
+
+// DeleteFailure is a key DeleteObjectsBatched could not delete. Code is S3's
+// error code, e.g. "AccessDenied", or empty when the request itself failed.
+type DeleteFailure struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+// DeleteObjectsBatched deletes keys from bucket with as few DeleteObjects
+// requests as possible, MaxDeleteObjectsKeys at a time, and returns the keys
+// that were not deleted. DeleteObjects answers 200 even when some keys fail,
+// listing them in Errors; those become failures, as does every key of a
+// request that failed as a whole. A failed request doesn't stop the others.
+// Keys that don't exist count as deleted, like with DeleteObject.
+func DeleteObjectsBatched(ctx context.Context, client DeleteObjectsAPI, bucket string, keys []string) []DeleteFailure {
+	var failures []DeleteFailure
+	for start := 0; start < len(keys); start += MaxDeleteObjectsKeys {
+		chunk := keys[start:min(start+MaxDeleteObjectsKeys, len(keys))]
+		if err := ctx.Err(); err != nil {
+			failures = append(failures, chunkFailures(keys[start:], err)...)
+			break
+		}
+
+		objects := make([]types.ObjectIdentifier, len(chunk))
+		for i, key := range chunk {
+			objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+
+		var output *s3.DeleteObjectsOutput
+		err := Retry(ctx, func(ctx context.Context) error {
+			opCtx, cancel := WithDeadline(ctx)
+			defer cancel()
+			var err error
+			output, err = client.DeleteObjects(opCtx, &s3.DeleteObjectsInput{
+				Bucket: aws.String(bucket),
+				Delete: &types.Delete{
+					Objects: objects,
+					// Only the failed keys are listed in the response
+					Quiet: aws.Bool(true),
+				},
+			})
+			return err
+		})
+		if err != nil {
+			failures = append(failures, chunkFailures(chunk, err)...)
+			continue
+		}
+
+		for _, e := range output.Errors {
+			failures = append(failures, DeleteFailure{
+				Key:     aws.ToString(e.Key),
+				Code:    aws.ToString(e.Code),
+				Message: aws.ToString(e.Message),
+			})
+		}
+	}
+	return failures
+}
+
+// chunkFailures marks every key as failed with err
+func chunkFailures(keys []string, err error) []DeleteFailure {
+	code := ""
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		code = apiErr.ErrorCode()
+	}
+	failures := make([]DeleteFailure, len(keys))
+	for i, key := range keys {
+		failures[i] = DeleteFailure{Key: key, Code: code, Message: err.Error()}
+	}
+	return failures
+}
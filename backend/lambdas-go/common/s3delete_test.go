@@ -0,0 +1,108 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeDeleter fails keys containing "denied" one by one, and whole requests
+// whose first key contains "broken"
+type fakeDeleter struct {
+	requests [][]string
+}
+
+func (f *fakeDeleter) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	var keys []string
+	output := &s3.DeleteObjectsOutput{}
+	for _, object := range params.Delete.Objects {
+		key := aws.ToString(object.Key)
+		keys = append(keys, key)
+		if strings.Contains(key, "denied") {
+			output.Errors = append(output.Errors, types.Error{
+				Key:     object.Key,
+				Code:    aws.String("AccessDenied"),
+				Message: aws.String("Access Denied"),
+			})
+		}
+	}
+	f.requests = append(f.requests, keys)
+	if strings.Contains(keys[0], "broken") {
+		return nil, &smithy.GenericAPIError{Code: "MalformedXML"}
+	}
+	return output, nil
+}
+
+func testKeys(n int, name func(i int) string) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = name(i)
+	}
+	return keys
+}
+
+func TestDeleteObjectsBatchedChunks(t *testing.T) {
+	deleter := &fakeDeleter{}
+	keys := testKeys(2500, func(i int) string { return fmt.Sprintf("users/user-123/uploads/%d", i) })
+
+	if failures := DeleteObjectsBatched(context.Background(), deleter, "bucket", keys); len(failures) != 0 {
+		t.Errorf("failures = %v, want none", failures)
+	}
+	if len(deleter.requests) != 3 {
+		t.Fatalf("requests = %d, want 3", len(deleter.requests))
+	}
+	for i, want := range []int{1000, 1000, 500} {
+		if got := len(deleter.requests[i]); got != want {
+			t.Errorf("request %d had %d keys, want %d", i, got, want)
+		}
+	}
+}
+
+func TestDeleteObjectsBatchedReportsPartialErrors(t *testing.T) {
+	deleter := &fakeDeleter{}
+	keys := testKeys(1500, func(i int) string {
+		switch {
+		case i == 1000:
+			return "broken-0"
+		case i == 10, i == 999:
+			return fmt.Sprintf("denied-%d", i)
+		}
+		return fmt.Sprintf("ok-%d", i)
+	})
+
+	failures := DeleteObjectsBatched(context.Background(), deleter, "bucket", keys)
+
+	// Two keys of the first request, and all 500 of the failed second one
+	if len(failures) != 502 {
+		t.Fatalf("failures = %d, want 502", len(failures))
+	}
+	if failures[0] != (DeleteFailure{Key: "denied-10", Code: "AccessDenied", Message: "Access Denied"}) {
+		t.Errorf("failures[0] = %+v", failures[0])
+	}
+	if failures[1].Key != "denied-999" {
+		t.Errorf("failures[1].Key = %s, want denied-999", failures[1].Key)
+	}
+	if failures[2].Key != "broken-0" || failures[2].Code != "MalformedXML" {
+		t.Errorf("failures[2] = %+v, want broken-0 with the request's error code", failures[2])
+	}
+	if failures[501].Key != "ok-1499" {
+		t.Errorf("failures[501].Key = %s, want ok-1499", failures[501].Key)
+	}
+}
+
+func TestDeleteObjectsBatchedStopsWhenCancelled(t *testing.T) {
+	deleter := &fakeDeleter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	failures := DeleteObjectsBatched(ctx, deleter, "bucket", testKeys(3, func(i int) string { return fmt.Sprint(i) }))
+	if len(deleter.requests) != 0 || len(failures) != 3 {
+		t.Errorf("requests = %d, failures = %d; want 0 and 3", len(deleter.requests), len(failures))
+	}
+}
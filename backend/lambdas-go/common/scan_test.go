@@ -0,0 +1,87 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestScanGate(t *testing.T) {
+	defer func(v bool) { requireCleanScan = v }(requireCleanScan)
+
+	tests := []struct {
+		scanStatus string
+		required   bool
+		want       error
+	}{
+		{ScanStatusClean, false, nil},
+		{ScanStatusClean, true, nil},
+		{"", false, nil},
+		{"", true, ErrScanPending},
+		{ScanStatusScanning, false, ErrScanPending},
+		{ScanStatusScanning, true, ErrScanPending},
+		{"error", false, ErrScanPending},
+		{ScanStatusInfected, false, ErrInfected},
+		{ScanStatusInfected, true, ErrInfected},
+	}
+	for _, tt := range tests {
+		requireCleanScan = tt.required
+		if got := ScanGate(&File{ScanStatus: tt.scanStatus}); got != tt.want {
+			t.Errorf("ScanGate(%q, required=%t) = %v, want %v", tt.scanStatus, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestScanBlocked(t *testing.T) {
+	tests := []struct {
+		err        error
+		status     int
+		code       string
+		scanStatus string
+	}{
+		{ErrScanPending, 409, "conflict", ScanStatusScanning},
+		{ErrInfected, 423, "locked", ScanStatusInfected},
+	}
+	for _, tt := range tests {
+		response := ScanBlocked(tt.err)
+		if response.StatusCode != tt.status {
+			t.Errorf("%v: status = %d, want %d", tt.err, response.StatusCode, tt.status)
+		}
+		var body ScanBlockedResponse
+		if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+			t.Fatalf("%v: body: %v", tt.err, err)
+		}
+		if body.Code != tt.code || body.ScanStatus != tt.scanStatus || body.Error == "" {
+			t.Errorf("%v: body = %+v", tt.err, body)
+		}
+	}
+}
+
+func TestRequireCleanScanFromEnv(t *testing.T) {
+	for v, want := range map[string]bool{"": false, "false": false, "0": false, "true": true, "1": true, "yes please": true} {
+		t.Setenv("REQUIRE_CLEAN_SCAN", v)
+		if got := requireCleanScanFromEnv(); got != want {
+			t.Errorf("REQUIRE_CLEAN_SCAN=%q: got %t, want %t", v, got, want)
+		}
+	}
+}
+
+func TestScanGateDefaultsToOpen(t *testing.T) {
+	defer func(v bool) { requireCleanScan = v }(requireCleanScan)
+	t.Setenv("REQUIRE_CLEAN_SCAN", "")
+	requireCleanScan = requireCleanScanFromEnv()
+
+	// Never scanned: served, since nothing writes scanStatus yet
+	if err := ScanGate(&File{FileID: "file-1"}); err != nil {
+		t.Errorf("unscanned file: ScanGate = %v, want nil", err)
+	}
+	// Files a scanner did flag stay blocked
+	if err := ScanGate(&File{FileID: "file-1", ScanStatus: ScanStatusInfected}); err != ErrInfected {
+		t.Errorf("infected file: ScanGate = %v, want %v", err, ErrInfected)
+	}
+
+	t.Setenv("REQUIRE_CLEAN_SCAN", "true")
+	requireCleanScan = requireCleanScanFromEnv()
+	if err := ScanGate(&File{FileID: "file-1"}); err != ErrScanPending {
+		t.Errorf("unscanned file with REQUIRE_CLEAN_SCAN=true: ScanGate = %v, want %v", err, ErrScanPending)
+	}
+}
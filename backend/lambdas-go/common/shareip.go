@@ -0,0 +1,109 @@
+package common
+
+import (
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// MaxShareCIDRs bounds the network allowlist a shared file can carry
+const MaxShareCIDRs = 10
+
+// trustedProxyHops is the number of proxies in front of API Gateway, such as
+// a CloudFront distribution (TRUSTED_PROXY_HOPS, default 0). It decides which
+// X-Forwarded-For entry TrustedClientIP believes.
+var trustedProxyHops = trustedProxyHopsFromEnv()
+
+// NormalizeCIDR returns entry, an address ("203.0.113.7", "2001:db8::1") or
+// network ("203.0.113.0/24", "2001:db8::/48"), as the network stored on
+// files, or false if it is neither. A single address becomes a /32 or /128,
+// host bits are cleared and IPv4-mapped IPv6 addresses become IPv4.
+func NormalizeCIDR(entry string) (string, bool) {
+	entry = strings.TrimSpace(entry)
+	if !strings.Contains(entry, "/") {
+		addr, err := netip.ParseAddr(entry)
+		if err != nil || addr.Zone() != "" {
+			return "", false
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()).String(), true
+	}
+
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil {
+		return "", false
+	}
+	if prefix.Addr().Is4In6() {
+		// ::ffff:203.0.113.0/120 is 203.0.113.0/24
+		bits := prefix.Bits() - 96
+		if bits < 0 {
+			return "", false
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), bits)
+	}
+	return prefix.Masked().String(), true
+}
+
+// IPAllowed reports whether ip is in one of cidrs, networks as returned by
+// NormalizeCIDR. An unparseable ip is never allowed.
+func IPAllowed(ip string, cidrs []string) bool {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return false
+	}
+	addr = addr.WithZone("").Unmap()
+	for _, entry := range cidrs {
+		if prefix, err := netip.ParsePrefix(entry); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedClientIP returns the caller's IP address for access decisions.
+// Unlike ClientIP it never believes entries a client could have written
+// itself: X-Forwarded-For is read from the right, where each proxy appends
+// the address it received the request from, skipping one entry per trusted
+// proxy. With no trusted proxies that is the source IP API Gateway saw. If
+// the header is shorter than the proxy chain it returns "", which no
+// allowlist matches.
+func TrustedClientIP(request events.APIGatewayProxyRequest) string {
+	sourceIP := request.RequestContext.Identity.SourceIP
+	if trustedProxyHops == 0 {
+		return sourceIP
+	}
+
+	var hops []string
+	for _, entry := range strings.Split(forwardedFor(request), ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			hops = append(hops, entry)
+		}
+	}
+	// API Gateway appends the address it saw, unless a proxy already did
+	if len(hops) == 0 || hops[len(hops)-1] != sourceIP {
+		hops = append(hops, sourceIP)
+	}
+	if len(hops) <= trustedProxyHops {
+		return ""
+	}
+	return hops[len(hops)-1-trustedProxyHops]
+}
+
+// trustedProxyHopsFromEnv parses TRUSTED_PROXY_HOPS, falling back to 0 when
+// it is unset or invalid
+func trustedProxyHopsFromEnv() int {
+	v := os.Getenv("TRUSTED_PROXY_HOPS")
+	if v == "" {
+		return 0
+	}
+	hops, err := strconv.Atoi(v)
+	if err != nil || hops < 0 {
+		log.Printf("Invalid TRUSTED_PROXY_HOPS %q, using 0", v)
+		return 0
+	}
+	return hops
+}
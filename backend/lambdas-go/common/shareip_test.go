@@ -0,0 +1,91 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestNormalizeCIDR(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  string
+	}{
+		{" 203.0.113.7 ", "203.0.113.7/32"},
+		{"203.0.113.77/24", "203.0.113.0/24"},
+		{"2001:DB8::1", "2001:db8::1/128"},
+		{"2001:db8:1:2::/48", "2001:db8:1::/48"},
+		{"::ffff:203.0.113.7", "203.0.113.7/32"},
+		{"::ffff:203.0.113.0/120", "203.0.113.0/24"},
+	}
+	for _, tt := range tests {
+		if got, ok := NormalizeCIDR(tt.entry); !ok || got != tt.want {
+			t.Errorf("NormalizeCIDR(%q) = %q, %v; want %q", tt.entry, got, ok, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "example.com", "203.0.113.0/33", "fe80::1%eth0", "::ffff:0:0/90", "203.0.113"} {
+		if _, ok := NormalizeCIDR(bad); ok {
+			t.Errorf("NormalizeCIDR(%q) accepted", bad)
+		}
+	}
+}
+
+func TestIPAllowed(t *testing.T) {
+	cidrs := []string{"203.0.113.0/24", "2001:db8:1::/48", "198.51.100.9/32"}
+	tests := []struct {
+		ip string
+		ok bool
+	}{
+		{"203.0.113.200", true},
+		{"::ffff:203.0.113.5", true},
+		{"2001:db8:1:ffff::1", true},
+		{"198.51.100.9", true},
+
+		{"203.0.114.1", false},
+		{"198.51.100.10", false},
+		{"2001:db8:2::1", false},
+		{"", false},
+		{"not-an-ip", false},
+	}
+	for _, tt := range tests {
+		if got := IPAllowed(tt.ip, cidrs); got != tt.ok {
+			t.Errorf("IPAllowed(%q) = %v, want %v", tt.ip, got, tt.ok)
+		}
+	}
+}
+
+func TestTrustedClientIP(t *testing.T) {
+	defer func(hops int) { trustedProxyHops = hops }(trustedProxyHops)
+
+	request := func(forwarded, sourceIP string) events.APIGatewayProxyRequest {
+		r := events.APIGatewayProxyRequest{Headers: map[string]string{}}
+		if forwarded != "" {
+			r.Headers["x-forwarded-for"] = forwarded
+		}
+		r.RequestContext.Identity.SourceIP = sourceIP
+		return r
+	}
+
+	tests := []struct {
+		hops      int
+		forwarded string
+		sourceIP  string
+		want      string
+	}{
+		// Without proxies a forged header changes nothing
+		{0, "198.51.100.9", "203.0.113.7", "203.0.113.7"},
+		// Behind CloudFront the client is left of the edge address
+		{1, "198.51.100.9, 203.0.113.7, 130.176.0.1", "130.176.0.1", "203.0.113.7"},
+		// Same when API Gateway didn't append the source IP itself
+		{1, "198.51.100.9, 203.0.113.7", "130.176.0.1", "203.0.113.7"},
+		{1, "2001:db8::7", "130.176.0.1", "2001:db8::7"},
+		// Too few entries for the proxy chain
+		{2, "203.0.113.7", "130.176.0.1", ""},
+	}
+	for _, tt := range tests {
+		trustedProxyHops = tt.hops
+		if got := TrustedClientIP(request(tt.forwarded, tt.sourceIP)); got != tt.want {
+			t.Errorf("hops %d, X-Forwarded-For %q: TrustedClientIP = %q, want %q", tt.hops, tt.forwarded, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MaxShareDownloads bounds the download limit an owner can put on a share
+const MaxShareDownloads = 1000
+
+// ErrShareExhausted is returned by ConsumeShareDownload once a limited
+// share has no downloads left
+var ErrShareExhausted = errors.New("share download limit reached")
+
+// ShareExhausted reports whether a limited share had no downloads left when
+// file was read. ConsumeShareDownload makes the binding check.
+func ShareExhausted(file *File) bool {
+	return file.ShareMaxDownloads > 0 && file.ShareDownloadsLeft <= 0
+}
+
+// ConsumeShareDownload takes one download off a file shared with a download
+// limit (shareMaxDownloads) and returns how many are left. The decrement is
+// conditional, so concurrent downloads can never use more than the limit;
+// once none are left it returns ErrShareExhausted. Only downloads by users in
+// the acl count, so callers skip it for the owner and for unlimited shares.
+func ConsumeShareDownload(ctx context.Context, db UpdateItemAPI, table string, file *File) (int64, error) {
+	opCtx, cancel := WithDeadline(ctx)
+	result, err := db.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(table),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: file.UserID},
+			"fileId": &types.AttributeValueMemberS{Value: file.FileID},
+		},
+		UpdateExpression:    aws.String("SET shareDownloadsLeft = shareDownloadsLeft - :one"),
+		ConditionExpression: aws.String("shareDownloadsLeft > :zero"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":  &types.AttributeValueMemberN{Value: "1"},
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return 0, ErrShareExhausted
+		}
+		return 0, err
+	}
+
+	left, ok := result.Attributes["shareDownloadsLeft"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, errors.New("shareDownloadsLeft missing from update result")
+	}
+	return strconv.ParseInt(left.Value, 10, 64)
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeShareCounter applies the conditional decrement to a single counter
+type fakeShareCounter struct {
+	mu   sync.Mutex
+	left int64
+}
+
+func (f *fakeShareCounter) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if aws.ToString(params.ConditionExpression) != "shareDownloadsLeft > :zero" {
+		return nil, errors.New("unexpected condition")
+	}
+	if f.left <= 0 {
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	f.left--
+	return &dynamodb.UpdateItemOutput{Attributes: map[string]types.AttributeValue{
+		"shareDownloadsLeft": &types.AttributeValueMemberN{Value: strconv.FormatInt(f.left, 10)},
+	}}, nil
+}
+
+func TestConsumeShareDownloadNeverExceedsLimit(t *testing.T) {
+	counter := &fakeShareCounter{left: 3}
+	file := &File{UserID: "owner", FileID: "file-1", ShareMaxDownloads: 3, ShareDownloadsLeft: 3}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	granted, exhausted := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ConsumeShareDownload(context.Background(), counter, "UserFiles", file)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				granted++
+			case errors.Is(err, ErrShareExhausted):
+				exhausted++
+			default:
+				t.Errorf("ConsumeShareDownload() = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if granted != 3 || exhausted != 7 {
+		t.Errorf("granted %d, exhausted %d; want 3 and 7", granted, exhausted)
+	}
+}
+
+func TestConsumeShareDownloadReturnsDownloadsLeft(t *testing.T) {
+	counter := &fakeShareCounter{left: 2}
+	file := &File{UserID: "owner", FileID: "file-1", ShareMaxDownloads: 2, ShareDownloadsLeft: 2}
+
+	for _, want := range []int64{1, 0} {
+		left, err := ConsumeShareDownload(context.Background(), counter, "UserFiles", file)
+		if err != nil || left != want {
+			t.Fatalf("ConsumeShareDownload() = %d, %v; want %d", left, err, want)
+		}
+	}
+}
+
+func TestShareExhausted(t *testing.T) {
+	tests := []struct {
+		file File
+		want bool
+	}{
+		{File{}, false},
+		{File{ShareMaxDownloads: 1, ShareDownloadsLeft: 1}, false},
+		{File{ShareMaxDownloads: 1}, true},
+	}
+	for _, tt := range tests {
+		if got := ShareExhausted(&tt.file); got != tt.want {
+			t.Errorf("ShareExhausted(%+v) = %t, want %t", tt.file, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ErrUploadChanged is returned by AbortFileUpload when the file's row no
+// longer holds the multipart upload, e.g. because it was completed meanwhile
+var ErrUploadChanged = errors.New("multipart upload is no longer pending")
+
+// AbortMultipartUploadAPI is the subset of the S3 client used by AbortFileUpload
+type AbortMultipartUploadAPI interface {
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// DeleteItemAPI is the subset of the DynamoDB client used by AbortFileUpload
+type DeleteItemAPI interface {
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+}
+
+// PendingUploadCondition is a condition expression that only holds while the
+// row is still waiting for the multipart upload :uploadId
+const PendingUploadCondition = "#status = :multipartPending AND uploadId = :uploadId"
+
+// PendingUploadValues returns the expression values PendingUploadCondition
+// needs; callers also map "#status" to "status"
+func PendingUploadValues(uploadID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		":multipartPending": &types.AttributeValueMemberS{Value: StatusMultipartPending},
+		":uploadId":         &types.AttributeValueMemberS{Value: uploadID},
+	}
+}
+
+// AbortFileUpload aborts a multipart_pending file's S3 upload, which frees
+// the parts already stored, and deletes its UserFiles row. An upload S3 no
+// longer knows is treated as aborted. The delete is conditioned on the row
+// still holding the same upload and returns ErrUploadChanged otherwise.
+func AbortFileUpload(ctx context.Context, s3Client AbortMultipartUploadAPI, db DeleteItemAPI, bucket, table string, file *File) error {
+	opCtx, cancel := WithDeadline(ctx)
+	_, err := s3Client.AbortMultipartUpload(opCtx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(file.S3Key),
+		UploadId: aws.String(file.UploadID),
+	})
+	cancel()
+	if err != nil {
+		if kind, _ := ClassifyAWSError(err); kind != KindNotFound {
+			return fmt.Errorf("failed to abort multipart upload: %w", err)
+		}
+	}
+
+	opCtx, cancel = WithDeadline(ctx)
+	_, err = db.DeleteItem(opCtx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(table),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: file.UserID},
+			"fileId": &types.AttributeValueMemberS{Value: file.FileID},
+		},
+		ConditionExpression:       aws.String(PendingUploadCondition),
+		ExpressionAttributeNames:  map[string]string{"#status": "status"},
+		ExpressionAttributeValues: PendingUploadValues(file.UploadID),
+	})
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return ErrUploadChanged
+		}
+		return fmt.Errorf("failed to delete pending file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// fakeAbort records an abort and a conditional delete
+type fakeAbort struct {
+	abortErr  error
+	deleteErr error
+	aborted   string
+	deleted   *dynamodb.DeleteItemInput
+}
+
+func (f *fakeAbort) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.aborted = aws.ToString(params.UploadId)
+	return &s3.AbortMultipartUploadOutput{}, f.abortErr
+}
+
+func (f *fakeAbort) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.deleted = params
+	return &dynamodb.DeleteItemOutput{}, f.deleteErr
+}
+
+func TestAbortFileUpload(t *testing.T) {
+	file := &File{UserID: "u1", FileID: "f1", S3Key: "users/u1/uploads/f1-a.mp4", UploadID: "up-1"}
+
+	tests := []struct {
+		name      string
+		abortErr  error
+		deleteErr error
+		want      error
+		deletes   bool
+	}{
+		{"aborted", nil, nil, nil, true},
+		{"upload already gone", &smithy.GenericAPIError{Code: "NoSuchUpload"}, nil, nil, true},
+		{"abort fails", &smithy.GenericAPIError{Code: "InternalError", Fault: smithy.FaultServer}, nil, nil, false},
+		{"completed meanwhile", nil, &types.ConditionalCheckFailedException{}, ErrUploadChanged, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeAbort{abortErr: tt.abortErr, deleteErr: tt.deleteErr}
+			err := AbortFileUpload(context.Background(), fake, fake, "bucket", "UserFiles", file)
+			switch {
+			case !tt.deletes && err == nil:
+				t.Fatal("AbortFileUpload = nil, want the abort error")
+			case tt.deletes && !errors.Is(err, tt.want):
+				t.Fatalf("AbortFileUpload = %v, want %v", err, tt.want)
+			}
+			if fake.aborted != "up-1" {
+				t.Errorf("aborted upload %q, want up-1", fake.aborted)
+			}
+			if (fake.deleted != nil) != tt.deletes {
+				t.Fatalf("deleted row = %v, want %v", fake.deleted != nil, tt.deletes)
+			}
+			if tt.deletes {
+				uploadID := fake.deleted.ExpressionAttributeValues[":uploadId"].(*types.AttributeValueMemberS).Value
+				if uploadID != "up-1" || aws.ToString(fake.deleted.ConditionExpression) != PendingUploadCondition {
+					t.Errorf("delete condition %q with uploadId %q", aws.ToString(fake.deleted.ConditionExpression), uploadID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// FieldError describes a validation problem with a single request field.
+// Field is a dotted path into the request body, e.g. "metadata.ipAddress".
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors collects all field errors found in a request
+type ValidationErrors struct {
+	Errors []FieldError
+}
+
+// ValidationErrorResponse represents a 400 response body listing every invalid field
+type ValidationErrorResponse struct {
+	Error  string       `json:"error"`
+	Code   string       `json:"code"`
+	Errors []FieldError `json:"errors"`
+}
+
+// Add records an error for field
+func (v *ValidationErrors) Add(field, message string) {
+	v.Errors = append(v.Errors, FieldError{Field: field, Message: message})
+}
+
+// Addf records a formatted error for field
+func (v *ValidationErrors) Addf(field, format string, args ...interface{}) {
+	v.Add(field, fmt.Sprintf(format, args...))
+}
+
+// HasErrors reports whether any error was recorded
+func (v *ValidationErrors) HasErrors() bool {
+	return len(v.Errors) > 0
+}
+
+// Error implements the error interface
+func (v *ValidationErrors) Error() string {
+	parts := make([]string, len(v.Errors))
+	for i, e := range v.Errors {
+		parts[i] = e.Field + ": " + e.Message
+	}
+	return "validation failed: " + strings.Join(parts, "; ")
+}
+
+// BuildValidationErrorResponse creates a 400 response listing every field error.
+// The top-level error message is kept for clients that only read "error".
+func BuildValidationErrorResponse(v *ValidationErrors) events.APIGatewayProxyResponse {
+	message := "Validation failed"
+	if len(v.Errors) == 1 {
+		message = v.Errors[0].Field + ": " + v.Errors[0].Message
+	}
+	return BuildResponse(400, ValidationErrorResponse{Error: message, Code: kinds[KindValidation].code, Errors: v.Errors})
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBuildValidationErrorResponseListsAllFields(t *testing.T) {
+	errs := &ValidationErrors{}
+	errs.Add("fileName", "is required")
+	errs.Addf("fileSize", "exceeds maximum allowed (%d MB)", 10)
+
+	if !errs.HasErrors() {
+		t.Fatal("expected errors")
+	}
+
+	response := BuildValidationErrorResponse(errs)
+	if response.StatusCode != 400 {
+		t.Errorf("expected 400, got %d", response.StatusCode)
+	}
+
+	var body ValidationErrorResponse
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("invalid JSON body: %v", err)
+	}
+	if body.Error != "Validation failed" {
+		t.Errorf("unexpected error message %q", body.Error)
+	}
+	if len(body.Errors) != 2 || body.Errors[0].Field != "fileName" || body.Errors[1].Field != "fileSize" {
+		t.Errorf("unexpected field errors %+v", body.Errors)
+	}
+	if body.Errors[1].Message != "exceeds maximum allowed (10 MB)" {
+		t.Errorf("unexpected message %q", body.Errors[1].Message)
+	}
+}
+
+func TestBuildValidationErrorResponseSingleField(t *testing.T) {
+	errs := &ValidationErrors{}
+	errs.Add("fileId", "is required")
+
+	var body ValidationErrorResponse
+	if err := json.Unmarshal([]byte(BuildValidationErrorResponse(errs).Body), &body); err != nil {
+		t.Fatalf("invalid JSON body: %v", err)
+	}
+	if body.Error != "fileId: is required" {
+		t.Errorf("unexpected error message %q", body.Error)
+	}
+}
+
+func TestValidationErrorsEmpty(t *testing.T) {
+	errs := &ValidationErrors{}
+	if errs.HasErrors() {
+		t.Error("expected no errors")
+	}
+}
@@ -0,0 +1,593 @@
+// Package main implements the complete_upload Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName     = "660348065850-file-bucket"
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	// maxETagLength bounds reported ETags; S3's are 34 characters with quotes
+	maxETagLength = 128
+)
+
+// CompleteRequest represents the body of POST .../complete
+type CompleteRequest struct {
+	FileID string `json:"fileId"`
+	// Parts are the ETags S3 returned for each part. When omitted they are
+	// read back from S3, so browsers don't need ETag exposed through CORS.
+	Parts []UploadedPart `json:"parts,omitempty"`
+}
+
+// UploadedPart is one part the client uploaded
+type UploadedPart struct {
+	PartNumber int32  `json:"partNumber"`
+	ETag       string `json:"etag"`
+}
+
+// PartRequest represents the body of POST .../part, reporting one uploaded part
+type PartRequest struct {
+	FileID     string `json:"fileId"`
+	PartNumber int32  `json:"partNumber"`
+	ETag       string `json:"etag"`
+}
+
+// PartsResponse is the upload state stored for a multipart upload, returned
+// by POST .../part and GET .../parts so a client can resume
+type PartsResponse struct {
+	FileID        string         `json:"fileId"`
+	FileName      string         `json:"fileName"`
+	UploadID      string         `json:"uploadId"`
+	PartSize      int64          `json:"partSize"`
+	Parts         int32          `json:"parts"`
+	ReportedParts []UploadedPart `json:"reportedParts"`
+	MissingParts  []int32        `json:"missingParts"`
+}
+
+// AbortRequest represents the body of POST .../abort
+type AbortRequest struct {
+	FileID string `json:"fileId"`
+}
+
+// UploadResponse represents the response body
+type UploadResponse struct {
+	Message  string `json:"message"`
+	FileID   string `json:"fileId"`
+	FileName string `json:"fileName"`
+	Status   string `json:"status,omitempty"`
+	FileSize int64  `json:"fileSize,omitempty"`
+}
+
+// uploadAPI is the subset of the S3 client complete_upload uses
+type uploadAPI interface {
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// filesAPI is the subset of the DynamoDB client complete_upload uses
+type filesAPI interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+// Tests replace the clients and quarantine
+var (
+	s3Client     uploadAPI
+	dynamoClient filesAPI
+	auditLog     *common.AuditLogger
+	quarantine   *common.Quarantine
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	client := s3.NewFromConfig(cfg)
+	s3Client = client
+	quarantine = common.NewQuarantine(client, bucketName)
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable, Geo: true}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(routes.Serve)
+
+// routes maps complete_upload's paths to their handlers
+var routes = common.NewRouter().
+	Handle("POST", "complete", handleComplete).
+	Handle("POST", "part", handleReportPart).
+	Handle("GET", "parts", handleParts).
+	Handle("POST", "abort", handleAbort)
+
+// handleComplete finishes a multipart upload started by upload_file and
+// marks the file uploaded with the size S3 reports, or rejected when its
+// content doesn't look like its declared type
+func handleComplete(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	var req CompleteRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+	if req.FileID == "" {
+		return common.Fail(common.Validation("Missing required field: fileId"))
+	}
+
+	file, err := pendingFile(ctx, userID, req.FileID)
+	if err != nil {
+		return common.Fail(err)
+	}
+
+	// S3 forgets the parts once the upload completes, so they are listed
+	// first: their sizes stand in for the object's if HeadObject fails
+	// afterwards. An upload S3 no longer knows may have been completed by an
+	// earlier call that failed before updating the row.
+	listed, listedSize, listErr := listParts(ctx, file)
+	gone := false
+	if listErr != nil {
+		kind, _ := common.ClassifyAWSError(listErr)
+		gone = kind == common.KindNotFound
+	}
+
+	// Parts the client sent win, then the ones it reported along the way;
+	// S3's own list is the fallback for clients that did neither
+	parts, partsFrom := req.Parts, "request"
+	if len(parts) == 0 && len(file.UploadedParts) == int(file.MultipartParts) {
+		parts, partsFrom = reportedParts(file), "reported"
+		if errs := checkParts(parts, file.MultipartParts); errs.HasErrors() {
+			return common.Fail(common.Conflict("Reported parts are inconsistent; complete with parts or abort"))
+		}
+	} else if len(parts) == 0 && gone {
+		// Nothing left to list; the object tells whether it was completed
+		partsFrom = "none"
+	} else if len(parts) == 0 {
+		parts, partsFrom = listed, "listed"
+		if listErr != nil {
+			return common.Fail(common.Internal("S3 list parts error", listErr))
+		}
+		if len(parts) != int(file.MultipartParts) {
+			return common.Fail(common.Conflict(fmt.Sprintf("%d of %d parts uploaded", len(parts), file.MultipartParts)))
+		}
+	} else if errs := checkParts(parts, file.MultipartParts); errs.HasErrors() {
+		return common.Fail(errs)
+	}
+
+	var completedUpload *s3.CompleteMultipartUploadOutput
+	if !gone {
+		completed := make([]s3types.CompletedPart, len(parts))
+		for i, part := range parts {
+			completed[i] = s3types.CompletedPart{PartNumber: aws.Int32(part.PartNumber), ETag: aws.String(part.ETag)}
+		}
+		opCtx, cancel := common.WithDeadline(ctx)
+		completedUpload, err = s3Client.CompleteMultipartUpload(opCtx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(bucketName),
+			Key:             aws.String(file.S3Key),
+			UploadId:        aws.String(file.UploadID),
+			MultipartUpload: &s3types.CompletedMultipartUpload{Parts: completed},
+		})
+		cancel()
+		if err != nil {
+			switch kind, _ := common.ClassifyAWSError(err); kind {
+			case common.KindNotFound:
+				gone = true
+			case common.KindValidation:
+				return common.Fail(common.Validation("S3 rejected the parts: " + err.Error()))
+			default:
+				return common.Fail(common.Internal("S3 complete multipart upload error", err))
+			}
+		}
+	}
+
+	// The object exists now; record what S3 stored rather than what was declared
+	opCtx, cancel := common.WithDeadline(ctx)
+	head, err := s3Client.HeadObject(opCtx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(file.S3Key),
+	})
+	cancel()
+
+	now := time.Now().UTC()
+	completedAt := now.Format(time.RFC3339)
+	var size int64
+	var etag, versionID string
+	headKind, _ := common.ClassifyAWSError(err)
+	switch {
+	case err == nil:
+		if head.LastModified != nil {
+			completedAt = head.LastModified.UTC().Format(time.RFC3339)
+		}
+		size = aws.ToInt64(head.ContentLength)
+		etag = aws.ToString(head.ETag)
+		versionID = common.ObjectVersionID(head.VersionId)
+	case gone && headKind == common.KindNotFound:
+		return common.Fail(common.Conflict("Multipart upload no longer exists; start the upload again"))
+	case completedUpload != nil && listErr == nil:
+		// S3 just completed the object from the listed parts
+		log.Printf("S3 head of %s failed after completing it, using the part sizes: %v", file.S3Key, err)
+		size = listedSize
+		etag = aws.ToString(completedUpload.ETag)
+		versionID = common.ObjectVersionID(completedUpload.VersionId)
+	default:
+		return common.Fail(common.Internal("S3 head error", err))
+	}
+
+	// Content that doesn't look like its declared type is rejected
+	quarantined, err := quarantine.Check(ctx, file, versionID, size)
+	if err != nil {
+		return common.Fail(common.Internal("Content check error", err))
+	}
+	status := common.StatusUploaded
+	if quarantined != nil {
+		status = common.StatusRejected
+	}
+
+	update := "SET #status = :status, fileSize = :fileSize, uploadCompletedAt = :completedAt, updatedAt = :updatedAt, etag = :etag"
+	values := common.PendingUploadValues(file.UploadID)
+	values[":status"] = &types.AttributeValueMemberS{Value: status}
+	values[":fileSize"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(size, 10)}
+	values[":completedAt"] = &types.AttributeValueMemberS{Value: completedAt}
+	values[":updatedAt"] = &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)}
+	values[":etag"] = &types.AttributeValueMemberS{Value: etag}
+	if quarantined != nil {
+		update += ", " + common.QuarantineUpdate
+		quarantined.AddValues(values)
+	} else if versionID != "" {
+		update += ", versionId = :versionId"
+		values[":versionId"] = &types.AttributeValueMemberS{Value: versionID}
+	}
+	update += " REMOVE uploadId, multipartParts, multipartPartSize, uploadedParts"
+
+	opCtx, cancel = common.WithDeadline(ctx)
+	_, err = dynamoClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+		},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(common.PendingUploadCondition),
+		ExpressionAttributeNames:  map[string]string{"#status": "status"},
+		ExpressionAttributeValues: values,
+	})
+	cancel()
+	if err != nil {
+		if quarantined != nil {
+			quarantine.Discard(ctx, quarantined)
+		}
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return common.Fail(common.Conflict("Upload was completed or aborted meanwhile"))
+		}
+		return common.Fail(common.Internal("DynamoDB update error", err))
+	}
+
+	message := "Upload completed"
+	if quarantined != nil {
+		quarantine.Finish(ctx, file, versionID)
+		message = "Upload rejected: its content doesn't match its type"
+	}
+
+	auditMetadata := map[string]interface{}{
+		"fileName":  file.FileName,
+		"s3Key":     file.S3Key,
+		"fileSize":  size,
+		"status":    status,
+		"parts":     len(parts),
+		"partsFrom": partsFrom,
+	}
+	if gone {
+		// Completed in S3 by an earlier call
+		auditMetadata["resumed"] = true
+	}
+	auditLog.Log(ctx, userID, req.FileID, "upload_complete", auditMetadata)
+	if quarantined != nil {
+		auditLog.Log(ctx, userID, req.FileID, "access_attempt", quarantined.AuditMetadata(file))
+	}
+
+	return common.BuildResponse(200, UploadResponse{
+		Message:  message,
+		FileID:   req.FileID,
+		FileName: file.FileName,
+		Status:   status,
+		FileSize: size,
+	}), nil
+}
+
+// handleReportPart records the ETag of a part the client uploaded, so the
+// upload can be resumed and completed without the client keeping them.
+// Parts may be reported in any order and again; the last report wins.
+func handleReportPart(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	var req PartRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+	if req.FileID == "" {
+		return common.Fail(common.Validation("Missing required field: fileId"))
+	}
+
+	file, err := pendingFile(ctx, userID, req.FileID)
+	if err != nil {
+		return common.Fail(err)
+	}
+	if errs := checkPart(req, file.MultipartParts); errs.HasErrors() {
+		return common.Fail(errs)
+	}
+
+	err = recordPart(ctx, file, req.PartNumber, req.ETag)
+	if errors.Is(err, common.ErrUploadChanged) {
+		return common.Fail(common.Conflict("Upload was completed or aborted meanwhile"))
+	}
+	if err != nil {
+		return common.Fail(common.Internal("DynamoDB update error", err))
+	}
+
+	if file.UploadedParts == nil {
+		file.UploadedParts = map[string]string{}
+	}
+	file.UploadedParts[strconv.Itoa(int(req.PartNumber))] = req.ETag
+	return common.BuildResponse(200, partsResponse(file)), nil
+}
+
+// handleParts returns the parts reported so far for a multipart upload, so a
+// client that lost its state knows which parts are left
+func handleParts(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	fileID := request.QueryStringParameters["fileId"]
+	if fileID == "" {
+		return common.Fail(common.Validation("Missing required parameter: fileId"))
+	}
+
+	file, err := pendingFile(ctx, common.UserID(ctx), fileID)
+	if err != nil {
+		return common.Fail(err)
+	}
+	return common.BuildResponse(200, partsResponse(file)), nil
+}
+
+// handleAbort cancels a multipart upload, freeing the parts already stored,
+// and removes the file
+func handleAbort(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	var req AbortRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+	if req.FileID == "" {
+		return common.Fail(common.Validation("Missing required field: fileId"))
+	}
+
+	file, err := pendingFile(ctx, userID, req.FileID)
+	if err != nil {
+		return common.Fail(err)
+	}
+
+	err = common.AbortFileUpload(ctx, s3Client, dynamoClient, bucketName, userFilesTable, file)
+	if errors.Is(err, common.ErrUploadChanged) {
+		return common.Fail(common.Conflict("Upload was completed or aborted meanwhile"))
+	}
+	if err != nil {
+		return common.Fail(common.Internal("Abort error", err))
+	}
+
+	auditLog.Log(ctx, userID, req.FileID, "upload_abort", map[string]interface{}{
+		"fileName": file.FileName,
+		"s3Key":    file.S3Key,
+		"reason":   "client",
+	})
+
+	return common.BuildResponse(200, UploadResponse{
+		Message:  "Upload aborted",
+		FileID:   req.FileID,
+		FileName: file.FileName,
+	}), nil
+}
+
+// pendingFile reads the caller's file and makes sure a multipart upload is
+// in progress for it
+func pendingFile(ctx context.Context, userID, fileID string) (*common.File, error) {
+	file, err := common.GetOwnedFile(ctx, dynamoClient, userFilesTable, userID, fileID, true)
+	switch {
+	case errors.Is(err, common.ErrNotFound):
+		return nil, common.NotFound("File not found")
+	case errors.Is(err, common.ErrDeleted):
+		return nil, common.Conflict("File has been deleted")
+	case err != nil:
+		return nil, common.Internal("DynamoDB get error", err)
+	}
+	if file.Status != common.StatusMultipartPending || file.UploadID == "" {
+		return nil, common.Conflict("File has no multipart upload in progress")
+	}
+	return file, nil
+}
+
+// checkParts validates the parts a client sent: exactly one per presigned
+// part, each with an ETag. They are sorted by part number, as S3 requires.
+func checkParts(parts []UploadedPart, expected int32) *common.ValidationErrors {
+	errs := &common.ValidationErrors{}
+	if len(parts) != int(expected) {
+		errs.Addf("parts", "must list all %d parts", expected)
+		return errs
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	for i, part := range parts {
+		if part.PartNumber != int32(i+1) {
+			errs.Addf("parts", "must number parts 1 to %d, each once", expected)
+			break
+		}
+	}
+	for _, part := range parts {
+		if part.ETag == "" {
+			errs.Addf("parts", "part %d is missing its etag", part.PartNumber)
+			break
+		}
+	}
+	return errs
+}
+
+// checkPart validates a reported part against the parts presigned for the upload
+func checkPart(req PartRequest, expected int32) *common.ValidationErrors {
+	errs := &common.ValidationErrors{}
+	if req.PartNumber < 1 || req.PartNumber > expected {
+		errs.Addf("partNumber", "must be between 1 and %d", expected)
+	}
+	switch {
+	case req.ETag == "":
+		errs.Add("etag", "is required")
+	case len(req.ETag) > maxETagLength:
+		errs.Addf("etag", "must be at most %d characters", maxETagLength)
+	}
+	return errs
+}
+
+// recordPart stores etag under partNumber in the row's uploadedParts map,
+// as long as the row still holds the same upload. The first report creates
+// the map; when two first reports race, the loser retries as a nested update.
+func recordPart(ctx context.Context, file *common.File, partNumber int32, etag string) error {
+	part := strconv.Itoa(int(partNumber))
+	for attempt := 0; attempt < 2; attempt++ {
+		values := common.PendingUploadValues(file.UploadID)
+		values[":etag"] = &types.AttributeValueMemberS{Value: etag}
+		err := updatePending(ctx, file, "SET uploadedParts.#part = :etag",
+			common.PendingUploadCondition+" AND attribute_exists(uploadedParts)",
+			map[string]string{"#status": "status", "#part": part}, values)
+		if !isConditionFailure(err) {
+			return err
+		}
+
+		values = common.PendingUploadValues(file.UploadID)
+		values[":parts"] = &types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+			part: &types.AttributeValueMemberS{Value: etag},
+		}}
+		err = updatePending(ctx, file, "SET uploadedParts = :parts",
+			common.PendingUploadCondition+" AND attribute_not_exists(uploadedParts)",
+			map[string]string{"#status": "status"}, values)
+		if !isConditionFailure(err) {
+			return err
+		}
+	}
+	// Both conditions failing twice means the upload itself is gone
+	return common.ErrUploadChanged
+}
+
+// updatePending runs a conditional update on file's row
+func updatePending(ctx context.Context, file *common.File, update, condition string, names map[string]string, values map[string]types.AttributeValue) error {
+	opCtx, cancel := common.WithDeadline(ctx)
+	defer cancel()
+	_, err := dynamoClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: file.UserID},
+			"fileId": &types.AttributeValueMemberS{Value: file.FileID},
+		},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+// isConditionFailure reports whether err is a failed condition expression
+func isConditionFailure(err error) bool {
+	var conditionErr *types.ConditionalCheckFailedException
+	return errors.As(err, &conditionErr)
+}
+
+// reportedParts returns the parts stored on the row, in part number order
+func reportedParts(file *common.File) []UploadedPart {
+	parts := make([]UploadedPart, 0, len(file.UploadedParts))
+	for number, etag := range file.UploadedParts {
+		n, err := strconv.ParseInt(number, 10, 32)
+		if err != nil {
+			continue
+		}
+		parts = append(parts, UploadedPart{PartNumber: int32(n), ETag: etag})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return parts
+}
+
+// partsResponse describes file's upload: what was reported and what is left
+func partsResponse(file *common.File) PartsResponse {
+	response := PartsResponse{
+		FileID:        file.FileID,
+		FileName:      file.FileName,
+		UploadID:      file.UploadID,
+		PartSize:      file.MultipartPartSize,
+		Parts:         file.MultipartParts,
+		ReportedParts: reportedParts(file),
+		MissingParts:  []int32{},
+	}
+	for n := int32(1); n <= file.MultipartParts; n++ {
+		if _, ok := file.UploadedParts[strconv.Itoa(int(n))]; !ok {
+			response.MissingParts = append(response.MissingParts, n)
+		}
+	}
+	return response
+}
+
+// listParts reads the uploaded parts back from S3, in part number order,
+// and returns them with the sum of their sizes
+func listParts(ctx context.Context, file *common.File) ([]UploadedPart, int64, error) {
+	var parts []UploadedPart
+	var size int64
+	paginator := s3.NewListPartsPaginator(s3Client, &s3.ListPartsInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(file.S3Key),
+		UploadId: aws.String(file.UploadID),
+	})
+	for paginator.HasMorePages() {
+		opCtx, cancel := common.WithDeadline(ctx)
+		page, err := paginator.NextPage(opCtx)
+		cancel()
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, part := range page.Parts {
+			parts = append(parts, UploadedPart{PartNumber: aws.ToInt32(part.PartNumber), ETag: aws.ToString(part.ETag)})
+			size += aws.ToInt64(part.Size)
+		}
+	}
+	return parts, size, nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+func TestCheckParts(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []UploadedPart
+		ok    bool
+	}{
+		{"in order", []UploadedPart{{1, `"a"`}, {2, `"b"`}, {3, `"c"`}}, true},
+		{"out of order", []UploadedPart{{3, `"c"`}, {1, `"a"`}, {2, `"b"`}}, true},
+		{"missing part", []UploadedPart{{1, `"a"`}, {2, `"b"`}}, false},
+		{"duplicate part", []UploadedPart{{1, `"a"`}, {1, `"a"`}, {3, `"c"`}}, false},
+		{"starts at zero", []UploadedPart{{0, `"a"`}, {1, `"b"`}, {2, `"c"`}}, false},
+		{"missing etag", []UploadedPart{{1, `"a"`}, {2, ""}, {3, `"c"`}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := checkParts(tt.parts, 3)
+			if errs.HasErrors() == tt.ok {
+				t.Fatalf("checkParts = %v, want ok=%v", errs, tt.ok)
+			}
+			if tt.ok {
+				for i, part := range tt.parts {
+					if part.PartNumber != int32(i+1) {
+						t.Errorf("parts not sorted: %v", tt.parts)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+// fakeFiles serves one file record and records the writes made to it.
+// updateErrs are returned by successive UpdateItem calls.
+type fakeFiles struct {
+	file       map[string]types.AttributeValue
+	updateErrs []error
+	deleteErr  error
+	updates    []*dynamodb.UpdateItemInput
+	deletes    []*dynamodb.DeleteItemInput
+	audits     []map[string]types.AttributeValue
+	// mu guards audits, written by the background workers
+	mu sync.Mutex
+}
+
+func (f *fakeFiles) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.file}, nil
+}
+
+func (f *fakeFiles) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.updates = append(f.updates, params)
+	if len(f.updateErrs) > 0 {
+		err := f.updateErrs[0]
+		f.updateErrs = f.updateErrs[1:]
+		return nil, err
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeFiles) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.deletes = append(f.deletes, params)
+	return &dynamodb.DeleteItemOutput{}, f.deleteErr
+}
+
+func (f *fakeFiles) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.audits = append(f.audits, params.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// auditActions lists the actions of the audit entries written
+func (f *fakeFiles) auditActions() []string {
+	var actions []string
+	for _, item := range f.audits {
+		if action, ok := item["action"].(*types.AttributeValueMemberS); ok {
+			actions = append(actions, action.Value)
+		}
+	}
+	return actions
+}
+
+// fakeUploads is an S3 multipart upload holding the listed parts, and the
+// object it completes to with content as its bytes. listErr, completeErr
+// and headErr fail the calls they are named after.
+type fakeUploads struct {
+	listed      []s3types.Part
+	listCalls   int
+	listErr     error
+	completeErr error
+	headErr     error
+	completed   *s3.CompleteMultipartUploadInput
+	aborted     *s3.AbortMultipartUploadInput
+	size        int64
+	content     []byte
+	copies      []string
+	removed     []string
+}
+
+func (f *fakeUploads) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(f.content))}, nil
+}
+
+func (f *fakeUploads) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.copies = append(f.copies, aws.ToString(params.Key))
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeUploads) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.removed = append(f.removed, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeUploads) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	if f.completeErr != nil {
+		return nil, f.completeErr
+	}
+	f.completed = params
+	return &s3.CompleteMultipartUploadOutput{ETag: aws.String(`"abc-3"`)}, nil
+}
+
+func (f *fakeUploads) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if f.headErr != nil {
+		return nil, f.headErr
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(f.size), ETag: aws.String(`"abc-3"`)}, nil
+}
+
+func (f *fakeUploads) ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	f.listCalls++
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	return &s3.ListPartsOutput{Parts: f.listed}, nil
+}
+
+func (f *fakeUploads) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.aborted = params
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// pendingRow is a multipart_pending row for file-1 with three parts
+func pendingRow(reported map[string]string) map[string]types.AttributeValue {
+	row := map[string]types.AttributeValue{
+		"userId":            &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId":            &types.AttributeValueMemberS{Value: "file-1"},
+		"fileName":          &types.AttributeValueMemberS{Value: "video.mp4"},
+		"s3Key":             &types.AttributeValueMemberS{Value: "users/user-123/uploads/file-1-video.mp4"},
+		"status":            &types.AttributeValueMemberS{Value: common.StatusMultipartPending},
+		"uploadId":          &types.AttributeValueMemberS{Value: "upload-1"},
+		"multipartParts":    &types.AttributeValueMemberN{Value: "3"},
+		"multipartPartSize": &types.AttributeValueMemberN{Value: "10485760"},
+	}
+	if reported != nil {
+		parts := map[string]types.AttributeValue{}
+		for number, etag := range reported {
+			parts[number] = &types.AttributeValueMemberS{Value: etag}
+		}
+		row["uploadedParts"] = &types.AttributeValueMemberM{Value: parts}
+	}
+	return row
+}
+
+// call runs the routes with the fakes and returns the status and body
+func call(t *testing.T, files *fakeFiles, uploads *fakeUploads, method, path, body string) (int, string) {
+	t.Helper()
+	dynamoClient, s3Client, auditLog.Client = files, uploads, files
+	quarantine = &common.Quarantine{Client: uploads, Bucket: bucketName, Prefix: common.DefaultQuarantinePrefix}
+
+	handler := common.Chain(common.FlushBackground, common.HandleErrors, common.RequireUser)(routes.Serve)
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		HTTPMethod:            method,
+		Path:                  path,
+		Body:                  body,
+		QueryStringParameters: map[string]string{"fileId": "file-1"},
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Authorizer: map[string]interface{}{"claims": map[string]interface{}{"sub": "user-123"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	return response.StatusCode, response.Body
+}
+
+func TestCheckPart(t *testing.T) {
+	tests := []struct {
+		req PartRequest
+		ok  bool
+	}{
+		{PartRequest{PartNumber: 1, ETag: `"a"`}, true},
+		{PartRequest{PartNumber: 3, ETag: `"c"`}, true},
+		{PartRequest{PartNumber: 0, ETag: `"a"`}, false},
+		{PartRequest{PartNumber: 4, ETag: `"d"`}, false},
+		{PartRequest{PartNumber: 2}, false},
+		{PartRequest{PartNumber: 2, ETag: strings.Repeat("x", maxETagLength+1)}, false},
+	}
+	for _, tt := range tests {
+		if errs := checkPart(tt.req, 3); errs.HasErrors() == tt.ok {
+			t.Errorf("checkPart(%+v) = %v, want ok=%v", tt.req, errs, tt.ok)
+		}
+	}
+}
+
+func TestReportPartCreatesPartsMap(t *testing.T) {
+	// The nested update fails while the row has no uploadedParts yet
+	files := &fakeFiles{file: pendingRow(nil), updateErrs: []error{&types.ConditionalCheckFailedException{}}}
+	status, body := call(t, files, &fakeUploads{}, "POST", "/files/upload/part", `{"fileId":"file-1","partNumber":2,"etag":"\"b\""}`)
+	if status != 200 {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	if len(files.updates) != 2 || aws.ToString(files.updates[1].UpdateExpression) != "SET uploadedParts = :parts" {
+		t.Fatalf("updates = %d, want the map created on the second", len(files.updates))
+	}
+
+	var response PartsResponse
+	json.Unmarshal([]byte(body), &response)
+	if len(response.ReportedParts) != 1 || response.ReportedParts[0].PartNumber != 2 {
+		t.Errorf("reportedParts = %v", response.ReportedParts)
+	}
+	if fmt.Sprint(response.MissingParts) != "[1 3]" {
+		t.Errorf("missingParts = %v, want [1 3]", response.MissingParts)
+	}
+}
+
+func TestReportPartAfterCompletionIsConflict(t *testing.T) {
+	conditionFailed := &types.ConditionalCheckFailedException{}
+	files := &fakeFiles{file: pendingRow(nil), updateErrs: []error{conditionFailed, conditionFailed, conditionFailed, conditionFailed}}
+	if status, body := call(t, files, &fakeUploads{}, "POST", "/files/upload/part", `{"fileId":"file-1","partNumber":1,"etag":"\"a\""}`); status != 409 {
+		t.Errorf("status = %d, want 409: %s", status, body)
+	}
+}
+
+// listedParts are three parts S3 lists with other ETags than the ones
+// reported, 25 MiB in all
+func listedParts() []s3types.Part {
+	return []s3types.Part{
+		{PartNumber: aws.Int32(1), ETag: aws.String(`"x"`), Size: aws.Int64(10 << 20)},
+		{PartNumber: aws.Int32(2), ETag: aws.String(`"y"`), Size: aws.Int64(10 << 20)},
+		{PartNumber: aws.Int32(3), ETag: aws.String(`"z"`), Size: aws.Int64(5 << 20)},
+	}
+}
+
+func TestCompleteUsesReportedParts(t *testing.T) {
+	files := &fakeFiles{file: pendingRow(map[string]string{"3": `"c"`, "1": `"a"`, "2": `"b"`})}
+	uploads := &fakeUploads{size: 25 << 20, listed: listedParts()}
+	status, body := call(t, files, uploads, "POST", "/files/upload/complete", `{"fileId":"file-1"}`)
+	if status != 200 {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	var etags []string
+	for _, part := range uploads.completed.MultipartUpload.Parts {
+		etags = append(etags, aws.ToString(part.ETag))
+	}
+	if fmt.Sprint(etags) != `["a" "b" "c"]` {
+		t.Errorf("completed with %v, want the reported parts in order", etags)
+	}
+}
+
+func TestCompleteWithRequestParts(t *testing.T) {
+	files := &fakeFiles{file: pendingRow(nil)}
+	uploads := &fakeUploads{size: 25 << 20, listed: listedParts()}
+	status, body := call(t, files, uploads, "POST", "/files/upload/complete",
+		`{"fileId":"file-1","parts":[{"partNumber":2,"etag":"\"b\""},{"partNumber":1,"etag":"\"a\""},{"partNumber":3,"etag":"\"c\""}]}`)
+	if status != 200 {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	if uploads.completed == nil || aws.ToString(uploads.completed.UploadId) != "upload-1" {
+		t.Fatal("multipart upload not completed")
+	}
+	if etag := aws.ToString(uploads.completed.MultipartUpload.Parts[0].ETag); etag != `"a"` {
+		t.Errorf("completed with %s, want the request's parts rather than the listed ones", etag)
+	}
+
+	var response UploadResponse
+	json.Unmarshal([]byte(body), &response)
+	if response.Status != "uploaded" || response.FileSize != 25<<20 {
+		t.Errorf("response = %+v, want uploaded with the size S3 reports", response)
+	}
+	if len(files.updates) != 1 || aws.ToString(files.updates[0].ConditionExpression) != common.PendingUploadCondition {
+		t.Fatalf("updates = %d, want one conditioned on the pending upload", len(files.updates))
+	}
+	if size := files.updates[0].ExpressionAttributeValues[":fileSize"].(*types.AttributeValueMemberN).Value; size != "26214400" {
+		t.Errorf("fileSize = %s, want S3's", size)
+	}
+	if actions := files.auditActions(); fmt.Sprint(actions) != "[upload_complete]" {
+		t.Errorf("audit = %v", actions)
+	}
+}
+
+func TestCompleteListsPartsFromS3(t *testing.T) {
+	// One part reported is not enough; S3's list is used instead
+	files := &fakeFiles{file: pendingRow(map[string]string{"1": `"a"`})}
+	uploads := &fakeUploads{size: 25 << 20, listed: []s3types.Part{
+		{PartNumber: aws.Int32(1), ETag: aws.String(`"a"`)},
+		{PartNumber: aws.Int32(2), ETag: aws.String(`"b"`)},
+		{PartNumber: aws.Int32(3), ETag: aws.String(`"c"`)},
+	}}
+	if status, body := call(t, files, uploads, "POST", "/files/upload/complete", `{"fileId":"file-1"}`); status != 200 {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	if uploads.listCalls != 1 || len(uploads.completed.MultipartUpload.Parts) != 3 {
+		t.Errorf("listed %d times, completed with %d parts", uploads.listCalls, len(uploads.completed.MultipartUpload.Parts))
+	}
+}
+
+func TestCompleteFallsBackToPartSizes(t *testing.T) {
+	files := &fakeFiles{file: pendingRow(map[string]string{"1": `"a"`, "2": `"b"`, "3": `"c"`})}
+	uploads := &fakeUploads{listed: listedParts(), headErr: &smithy.GenericAPIError{Code: "InternalError", Fault: smithy.FaultServer}}
+	status, body := call(t, files, uploads, "POST", "/files/upload/complete", `{"fileId":"file-1"}`)
+	if status != 200 {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	values := files.updates[0].ExpressionAttributeValues
+	if size := values[":fileSize"].(*types.AttributeValueMemberN).Value; size != "26214400" {
+		t.Errorf("fileSize = %s, want the listed parts' 26214400", size)
+	}
+	if etag := values[":etag"].(*types.AttributeValueMemberS).Value; etag != `"abc-3"` {
+		t.Errorf("etag = %s, want the one CompleteMultipartUpload returned", etag)
+	}
+}
+
+func TestCompleteFinishesUploadS3AlreadyCompleted(t *testing.T) {
+	// An earlier call completed the upload in S3, then failed
+	noSuchUpload := &smithy.GenericAPIError{Code: "NoSuchUpload", Message: "The specified upload does not exist"}
+	files := &fakeFiles{file: pendingRow(map[string]string{"1": `"a"`, "2": `"b"`, "3": `"c"`})}
+	uploads := &fakeUploads{size: 25 << 20, listErr: noSuchUpload, completeErr: noSuchUpload}
+	status, body := call(t, files, uploads, "POST", "/files/upload/complete", `{"fileId":"file-1"}`)
+	if status != 200 || !strings.Contains(body, `"status":"uploaded"`) {
+		t.Fatalf("complete = %d %s, want 200 uploaded", status, body)
+	}
+	if len(files.updates) != 1 || aws.ToString(files.updates[0].ConditionExpression) != common.PendingUploadCondition {
+		t.Fatalf("updates = %d, want the row moved to uploaded", len(files.updates))
+	}
+	if actions := files.auditActions(); fmt.Sprint(actions) != "[upload_complete]" {
+		t.Errorf("audit = %v", actions)
+	}
+
+	// Without parts S3 isn't asked to complete anything
+	files = &fakeFiles{file: pendingRow(nil)}
+	uploads = &fakeUploads{size: 25 << 20, listErr: noSuchUpload}
+	if status, body := call(t, files, uploads, "POST", "/files/upload/complete", `{"fileId":"file-1"}`); status != 200 {
+		t.Errorf("without parts: status = %d: %s", status, body)
+	}
+	if uploads.completed != nil {
+		t.Error("completed an upload S3 no longer has")
+	}
+
+	// Nor the upload nor the object: it has to start over
+	files = &fakeFiles{file: pendingRow(nil)}
+	uploads = &fakeUploads{listErr: noSuchUpload, headErr: &smithy.GenericAPIError{Code: "NotFound"}}
+	status, body = call(t, files, uploads, "POST", "/files/upload/complete", `{"fileId":"file-1"}`)
+	if status != 409 || !strings.Contains(body, "no longer exists") {
+		t.Errorf("no object: status = %d: %s", status, body)
+	}
+	if len(files.updates) != 0 {
+		t.Error("row updated without an object")
+	}
+}
+
+func TestCompleteWithMissingPartsIsConflict(t *testing.T) {
+	files := &fakeFiles{file: pendingRow(nil)}
+	uploads := &fakeUploads{listed: []s3types.Part{{PartNumber: aws.Int32(1), ETag: aws.String(`"a"`)}}}
+	status, body := call(t, files, uploads, "POST", "/files/upload/complete", `{"fileId":"file-1"}`)
+	if status != 409 || !strings.Contains(body, "1 of 3 parts uploaded") {
+		t.Errorf("status = %d: %s", status, body)
+	}
+	if uploads.completed != nil || len(files.updates) != 0 {
+		t.Error("upload completed with parts missing")
+	}
+}
+
+func TestCompleteRacingAbortIsConflict(t *testing.T) {
+	files := &fakeFiles{
+		file:       pendingRow(map[string]string{"1": `"a"`, "2": `"b"`, "3": `"c"`}),
+		updateErrs: []error{&types.ConditionalCheckFailedException{}},
+	}
+	status, body := call(t, files, &fakeUploads{size: 1}, "POST", "/files/upload/complete", `{"fileId":"file-1"}`)
+	if status != 409 || !strings.Contains(body, "completed or aborted meanwhile") {
+		t.Errorf("status = %d: %s", status, body)
+	}
+	if len(files.audits) != 0 {
+		t.Errorf("audit written for a lost race: %v", files.auditActions())
+	}
+}
+
+func TestCompleteWithoutPendingUpload(t *testing.T) {
+	row := pendingRow(nil)
+	row["status"] = &types.AttributeValueMemberS{Value: "uploaded"}
+	delete(row, "uploadId")
+	uploads := &fakeUploads{}
+	if status, _ := call(t, &fakeFiles{file: row}, uploads, "POST", "/files/upload/complete", `{"fileId":"file-1"}`); status != 409 {
+		t.Errorf("status = %d, want 409", status)
+	}
+	if status, _ := call(t, &fakeFiles{}, uploads, "POST", "/files/upload/complete", `{"fileId":"file-1"}`); status != 404 {
+		t.Errorf("unknown file: status = %d, want 404", status)
+	}
+	if uploads.completed != nil {
+		t.Error("S3 upload completed without a pending row")
+	}
+}
+
+func TestAbort(t *testing.T) {
+	files := &fakeFiles{file: pendingRow(nil)}
+	uploads := &fakeUploads{}
+	if status, body := call(t, files, uploads, "POST", "/files/upload/abort", `{"fileId":"file-1"}`); status != 200 {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	if uploads.aborted == nil || aws.ToString(uploads.aborted.UploadId) != "upload-1" {
+		t.Error("S3 upload not aborted")
+	}
+	if len(files.deletes) != 1 || aws.ToString(files.deletes[0].ConditionExpression) != common.PendingUploadCondition {
+		t.Errorf("deletes = %d, want the row deleted while still pending", len(files.deletes))
+	}
+	if actions := files.auditActions(); fmt.Sprint(actions) != "[upload_abort]" {
+		t.Errorf("audit = %v", actions)
+	}
+
+	// A completion that won the race leaves nothing to abort
+	files = &fakeFiles{file: pendingRow(nil), deleteErr: &types.ConditionalCheckFailedException{}}
+	if status, _ := call(t, files, &fakeUploads{}, "POST", "/files/upload/abort", `{"fileId":"file-1"}`); status != 409 {
+		t.Errorf("racing abort: status = %d, want 409", status)
+	}
+}
+
+func TestCompleteRejectsMismatchedContent(t *testing.T) {
+	row := pendingRow(nil)
+	row["contentType"] = &types.AttributeValueMemberS{Value: "application/pdf"}
+	files := &fakeFiles{file: row}
+	exe := append([]byte("MZ\x90\x00"), make([]byte, 60)...)
+	uploads := &fakeUploads{size: int64(len(exe)), content: exe}
+	body := `{"fileId":"file-1","parts":[{"partNumber":1,"etag":"\"a\""},{"partNumber":2,"etag":"\"b\""},{"partNumber":3,"etag":"\"c\""}]}`
+
+	status, response := call(t, files, uploads, "POST", "/files/upload/complete", body)
+	if status != 200 || !strings.Contains(response, `"status":"rejected"`) {
+		t.Fatalf("complete = %d %s, want 200 rejected", status, response)
+	}
+	values := files.updates[0].ExpressionAttributeValues
+	if v := values[":status"].(*types.AttributeValueMemberS).Value; v != common.StatusRejected {
+		t.Errorf("status = %s, want %s", v, common.StatusRejected)
+	}
+	key := "users/user-123/uploads/file-1-video.mp4"
+	if len(uploads.copies) != 1 || uploads.copies[0] != "quarantine/"+key {
+		t.Errorf("copies = %v, want the object in quarantine", uploads.copies)
+	}
+	if len(uploads.removed) != 1 || uploads.removed[0] != key {
+		t.Errorf("removed = %v, want the original", uploads.removed)
+	}
+	if actions := fmt.Sprint(files.auditActions()); !strings.Contains(actions, "access_attempt") || !strings.Contains(actions, "upload_complete") {
+		t.Errorf("audit actions = %v, want upload_complete and access_attempt", actions)
+	}
+}
@@ -0,0 +1,235 @@
+// Package main implements the compute_checksum Lambda function
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName          = "660348065850-file-bucket"
+	userFilesTable      = "UserFiles"
+	fileAuditTable      = "FileAudit"
+	defaultMaxHashBytes = 1 << 30 // 1 GiB
+)
+
+// ChecksumRequest represents the request body
+type ChecksumRequest struct {
+	FileID string `json:"fileId"`
+	// MD5 also computes an MD5, e.g. to compare with a non-multipart ETag
+	MD5 bool `json:"md5,omitempty"`
+}
+
+// ChecksumResponse represents the response body. Checksums are hex encoded.
+type ChecksumResponse struct {
+	Message        string `json:"message"`
+	FileID         string `json:"fileId"`
+	ChecksumSHA256 string `json:"checksumSha256"`
+	ChecksumMD5    string `json:"checksumMd5,omitempty"`
+	BytesHashed    int64  `json:"bytesHashed"`
+	ChecksumAt     string `json:"checksumAt"`
+}
+
+// checksums is the result of hashing an object
+type checksums struct {
+	sha256 string
+	md5    string
+	bytes  int64
+}
+
+var (
+	s3Client     *s3.Client
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+	// maxHashBytes caps the objects hashed in one invocation, which has to
+	// finish within the Lambda timeout (MAX_CHECKSUM_BYTES)
+	maxHashBytes int64 = defaultMaxHashBytes
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	s3Client = s3.NewFromConfig(cfg)
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+
+	if v := os.Getenv("MAX_CHECKSUM_BYTES"); v != "" {
+		maxHashBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxHashBytes <= 0 {
+			log.Fatalf("Invalid MAX_CHECKSUM_BYTES: %q", v)
+		}
+	}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleChecksum)
+
+// handleChecksum handles an authenticated request
+func handleChecksum(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req ChecksumRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+	if req.FileID == "" {
+		return common.Fail(common.Validation("Missing required field: fileId"))
+	}
+
+	file, err := common.GetOwnedFile(ctx, dynamoClient, userFilesTable, userID, req.FileID, false)
+	switch {
+	case errors.Is(err, common.ErrNotFound), errors.Is(err, common.ErrDeleted):
+		return common.Fail(common.NotFound("File not found"))
+	case err != nil:
+		return common.Fail(common.Internal("DynamoDB get error", err))
+	}
+
+	// Stream the object through the hashes; only a small buffer is held in memory
+	streamCtx, cancel := common.WithStreamDeadline(ctx)
+	defer cancel()
+	object, err := s3Client.GetObject(streamCtx, &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(file.S3Key),
+	})
+	if err != nil {
+		var noSuchKey *s3types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return common.Fail(common.NotFound("File content has not been uploaded"))
+		}
+		return common.Fail(common.Internal("S3 get error", err))
+	}
+	defer object.Body.Close()
+
+	if size := aws.ToInt64(object.ContentLength); size > maxHashBytes {
+		return common.Fail(common.Validation(fmt.Sprintf("File is too large to checksum (%d bytes, max %d)", size, maxHashBytes)))
+	}
+
+	sums, err := hashStream(object.Body, req.MD5, maxHashBytes)
+	if err != nil {
+		return common.Fail(common.Internal("Checksum read error", err))
+	}
+	cancel()
+
+	// Store the checksums, unless the file was deleted or replaced meanwhile
+	checksumAt := time.Now().UTC().Format(time.RFC3339)
+	updateExpression := "SET checksumSha256 = :sha256, checksumAt = :checksumAt, updatedAt = :checksumAt"
+	values := map[string]types.AttributeValue{
+		":sha256":     &types.AttributeValueMemberS{Value: sums.sha256},
+		":checksumAt": &types.AttributeValueMemberS{Value: checksumAt},
+		":s3Key":      &types.AttributeValueMemberS{Value: file.S3Key},
+		":deleted":    &types.AttributeValueMemberS{Value: "deleted"},
+	}
+	if sums.md5 != "" {
+		updateExpression += ", checksumMd5 = :md5"
+		values[":md5"] = &types.AttributeValueMemberS{Value: sums.md5}
+	}
+
+	opCtx, cancel := common.WithDeadline(ctx)
+	_, err = dynamoClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String("s3Key = :s3Key AND #status <> :deleted"),
+		ExpressionAttributeNames:  map[string]string{"#status": "status"},
+		ExpressionAttributeValues: values,
+	})
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return common.Fail(common.Conflict("File was changed or deleted meanwhile, please retry"))
+		}
+		return common.Fail(common.Internal("DynamoDB update error", err))
+	}
+
+	changedFields := []string{"checksumSha256"}
+	if sums.md5 != "" {
+		changedFields = append(changedFields, "checksumMd5")
+	}
+	auditLog.Log(ctx, userID, req.FileID, "update", map[string]interface{}{
+		"fileName":       file.FileName,
+		"changedFields":  changedFields,
+		"checksumSha256": sums.sha256,
+		"bytesHashed":    sums.bytes,
+		"reason":         "checksum",
+	})
+
+	response := ChecksumResponse{
+		Message:        "Checksum computed",
+		FileID:         req.FileID,
+		ChecksumSHA256: sums.sha256,
+		ChecksumMD5:    sums.md5,
+		BytesHashed:    sums.bytes,
+		ChecksumAt:     checksumAt,
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// hashStream computes the SHA-256, and the MD5 if asked to, of r. It reads
+// at most limit bytes and fails if r is longer, in case the object's size
+// was not known up front.
+func hashStream(r io.Reader, withMD5 bool, limit int64) (checksums, error) {
+	sha := sha256.New()
+	writers := []io.Writer{sha}
+	var md5Hash hash.Hash
+	if withMD5 {
+		md5Hash = md5.New()
+		writers = append(writers, md5Hash)
+	}
+
+	n, err := io.Copy(io.MultiWriter(writers...), io.LimitReader(r, limit+1))
+	if err != nil {
+		return checksums{}, err
+	}
+	if n > limit {
+		return checksums{}, fmt.Errorf("object exceeds %d bytes", limit)
+	}
+
+	sums := checksums{sha256: hex.EncodeToString(sha.Sum(nil)), bytes: n}
+	if md5Hash != nil {
+		sums.md5 = hex.EncodeToString(md5Hash.Sum(nil))
+	}
+	return sums, nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashStream(t *testing.T) {
+	sums, err := hashStream(strings.NewReader("hello world"), true, 1024)
+	if err != nil {
+		t.Fatalf("hashStream error: %v", err)
+	}
+	if want := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"; sums.sha256 != want {
+		t.Errorf("sha256 = %s, want %s", sums.sha256, want)
+	}
+	if want := "5eb63bbbe01eeed093cb22bb8f5acdc3"; sums.md5 != want {
+		t.Errorf("md5 = %s, want %s", sums.md5, want)
+	}
+	if sums.bytes != 11 {
+		t.Errorf("bytes = %d, want 11", sums.bytes)
+	}
+}
+
+func TestHashStreamWithoutMD5(t *testing.T) {
+	sums, err := hashStream(strings.NewReader("hello world"), false, 1024)
+	if err != nil {
+		t.Fatalf("hashStream error: %v", err)
+	}
+	if sums.md5 != "" {
+		t.Errorf("md5 computed without being asked: %s", sums.md5)
+	}
+}
+
+func TestHashStreamLimit(t *testing.T) {
+	if _, err := hashStream(strings.NewReader("hello world"), false, 11); err != nil {
+		t.Errorf("object of exactly the limit failed: %v", err)
+	}
+	if _, err := hashStream(strings.NewReader("hello world"), false, 10); err == nil {
+		t.Error("expected an error for an object over the limit")
+	}
+}
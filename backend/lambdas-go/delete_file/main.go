@@ -4,7 +4,10 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -23,44 +26,135 @@ const (
 	bucketName     = "660348065850-file-bucket"
 	userFilesTable = "UserFiles"
 	fileAuditTable = "FileAudit"
+	// maxBatchWriteItems is the most requests DynamoDB takes in one BatchWriteItem
+	maxBatchWriteItems = 25
+	batchWriteAttempts = 3
+	// maxFileIDs bounds the files of one fileIds request
+	maxFileIDs     = 25
+	maxConcurrency = 10
 )
 
-// DeleteRequest represents the request body
+// Outcomes of one file of a fileIds request. Only outcomeDeleted changes the
+// file; dry runs report outcomeWouldDelete instead.
+const (
+	outcomeDeleted        = "deleted"
+	outcomeWouldDelete    = "would_delete"
+	outcomeNotFound       = "not_found"
+	outcomeAlreadyDeleted = "already_deleted"
+	outcomeLegalHold      = "legal_hold"
+	outcomeStale          = "stale"
+	outcomeError          = "error"
+)
+
+// errAuditPurgeIncomplete is returned by purgeAuditTrail when DynamoDB still
+// left deletes unprocessed after retrying
+var errAuditPurgeIncomplete = errors.New("audit purge left entries unprocessed")
+
+// DeleteRequest represents the request body. Exactly one of fileId and
+// fileIds must be given.
 type DeleteRequest struct {
-	FileID     string `json:"fileId"`
-	HardDelete bool   `json:"hardDelete"`
+	FileID string `json:"fileId"`
+	// FileIDs deletes up to maxFileIDs files at once, with an outcome per file
+	FileIDs []string `json:"fileIds,omitempty"`
+	// HardDelete removes the S3 object and the record instead of moving the
+	// file to trash (admins only)
+	HardDelete bool `json:"hardDelete"`
+	// PurgeAudit also deletes the file's FileAudit entries (with hardDelete)
+	PurgeAudit bool `json:"purgeAudit,omitempty"`
+	// DryRun reports the impact of the delete without performing it
+	DryRun bool `json:"dryRun"`
+	// IfUnmodifiedSince (RFC 3339) refuses the delete if the file was
+	// changed after the client last saw it
+	IfUnmodifiedSince string `json:"ifUnmodifiedSince,omitempty"`
 }
 
 // DeleteResponse represents the response body
 type DeleteResponse struct {
-	Message  string `json:"message"`
+	Message  string        `json:"message"`
+	FileID   string        `json:"fileId"`
+	FileName string        `json:"fileName"`
+	DryRun   bool          `json:"dryRun,omitempty"`
+	Impact   *DeleteImpact `json:"impact,omitempty"`
+	// AuditEntriesPurged is set for hard deletes with purgeAudit
+	AuditEntriesPurged *int `json:"auditEntriesPurged,omitempty"`
+	// AuditPurgeIncomplete means some entries could not be purged; the
+	// file itself is gone, so they have to be removed by hand
+	AuditPurgeIncomplete bool `json:"auditPurgeIncomplete,omitempty"`
+}
+
+// BatchDeleteResponse is the response to a fileIds request. It is 200 even
+// when some files were not deleted.
+type BatchDeleteResponse struct {
+	Results []DeleteResult `json:"results"`
+	// Counts is the number of files per outcome
+	Counts map[string]int `json:"counts"`
+	DryRun bool           `json:"dryRun,omitempty"`
+}
+
+// DeleteResult is the outcome for one file of a fileIds request
+type DeleteResult struct {
 	FileID   string `json:"fileId"`
-	FileName string `json:"fileName"`
+	Outcome  string `json:"outcome"`
+	FileName string `json:"fileName,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Impact is set for files a dry run would delete
+	Impact *DeleteImpact `json:"impact,omitempty"`
+
+	// audit is written once the file is done with
+	audit *pendingAudit
+}
+
+// pendingAudit is the audit entry of one file of a fileIds request
+type pendingAudit struct {
+	action   string
+	metadata map[string]interface{}
 }
 
-// FileRecord represents a file record from DynamoDB
-type FileRecord struct {
-	UserID      string `dynamodbav:"userId"`
-	FileID      string `dynamodbav:"fileId"`
-	FileName    string `dynamodbav:"fileName"`
-	ContentType string `dynamodbav:"contentType"`
-	FileSize    int64  `dynamodbav:"fileSize"`
-	S3Key       string `dynamodbav:"s3Key"`
-	Status      string `dynamodbav:"status"`
+// DeleteImpact describes what a delete would affect
+type DeleteImpact struct {
+	// BytesFreed is the storage reclaimed once the file is purged from trash
+	BytesFreed int64 `json:"bytesFreed"`
+	// ACLEntriesRemoved is the number of users who lose access through the acl
+	ACLEntriesRemoved int      `json:"aclEntriesRemoved"`
+	AffectedUserIDs   []string `json:"affectedUserIds"`
 }
 
-// AuditEntry represents an audit log entry
-type AuditEntry struct {
-	UserID    string                 `dynamodbav:"userId"`
-	Timestamp string                 `dynamodbav:"timestamp"`
-	FileID    string                 `dynamodbav:"fileId"`
-	Action    string                 `dynamodbav:"action"`
-	Metadata  map[string]interface{} `dynamodbav:"metadata"`
+// StaleErrorResponse is returned with 409 when the file changed after
+// ifUnmodifiedSince, with the file as it is now
+type StaleErrorResponse struct {
+	Error   string      `json:"error"`
+	Code    string      `json:"code"`
+	Current common.File `json:"current"`
+}
+
+// auditTableAPI is the subset of the DynamoDB client purgeAuditTrail uses
+type auditTableAPI interface {
+	dynamodb.QueryAPIClient
+	BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+}
+
+// objectsAPI is the subset of the S3 client delete_file uses
+type objectsAPI interface {
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	common.DeleteObjectsAPI
+	common.AbortMultipartUploadAPI
+}
+
+// filesAPI is the subset of the DynamoDB client delete_file uses on UserFiles
+type filesAPI interface {
+	common.GetItemAPI
+	common.BatchGetItemAPI
+	common.UpdateItemAPI
+	common.DeleteItemAPI
 }
 
 var (
-	s3Client     *s3.Client
-	dynamoClient *dynamodb.Client
+	// s3Client and dynamoClient are replaced by tests
+	s3Client     objectsAPI
+	dynamoClient filesAPI
+	auditLog     *common.AuditLogger
+	// auditClient reads and deletes FileAudit entries; tests replace it
+	auditClient auditTableAPI
 )
 
 func init() {
@@ -69,132 +163,734 @@ func init() {
 		log.Fatalf("Failed to load AWS config: %v", err)
 	}
 	s3Client = s3.NewFromConfig(cfg)
-	dynamoClient = dynamodb.NewFromConfig(cfg)
+	db := dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	dynamoClient = db
+	auditLog = &common.AuditLogger{Client: db, Table: fileAuditTable, Geo: true}
+	auditClient = db
 }
 
 // Handler is the Lambda function handler
-func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Log authorizer context for debugging
-	log.Printf("Authorizer context: %+v", request.RequestContext.Authorizer)
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleDelete)
 
-	// Extract user ID
-	userID, err := common.ExtractUserID(request)
-	if err != nil {
-		log.Printf("Auth error: %v", err)
-		return common.BuildErrorResponse(401, "Unauthorized: userId not found"), nil
-	}
+// handleDelete handles an authenticated request
+func handleDelete(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
 
 	// Parse request body
 	var req DeleteRequest
 	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
-		return common.BuildErrorResponse(400, "Invalid request body"), nil
+		return common.Fail(common.Validation("Invalid request body"))
 	}
 
 	// Validate required fields
-	if req.FileID == "" {
-		return common.BuildErrorResponse(400, "Missing required field: fileId"), nil
+	batch := req.FileIDs != nil
+	switch {
+	case batch && req.FileID != "":
+		return common.Fail(common.Validation("Use either fileId or fileIds, not both"))
+	case !batch && req.FileID == "":
+		return common.Fail(common.Validation("Missing required field: fileId"))
+	}
+	if req.HardDelete && !common.IsAdmin(request) {
+		return common.Fail(common.Forbidden("Hard delete requires admin access"))
+	}
+	if req.PurgeAudit && !req.HardDelete {
+		return common.Fail(common.Validation("purgeAudit requires hardDelete"))
+	}
+	// Each purge reads the user's whole audit trail
+	if req.PurgeAudit && batch {
+		return common.Fail(common.Validation("purgeAudit only works with a single fileId"))
+	}
+	var unmodifiedSince string
+	if req.IfUnmodifiedSince != "" {
+		var err error
+		if unmodifiedSince, err = parseIfUnmodifiedSince(req.IfUnmodifiedSince); err != nil {
+			return common.Fail(common.Validation("Invalid ifUnmodifiedSince: must be an RFC 3339 timestamp"))
+		}
+	}
+
+	if batch {
+		fileIDs, errs := validateFileIDs(req.FileIDs)
+		if errs.HasErrors() {
+			return common.Fail(errs)
+		}
+		return deleteBatch(ctx, userID, fileIDs, &req, unmodifiedSince)
 	}
 
+	// Clients that just wrote the file can pass consistent=true for read-after-write.
+	// Strongly consistent reads cost twice the read capacity of the default.
+	consistentRead := request.QueryStringParameters["consistent"] == "true"
+
 	// Get file metadata from DynamoDB
-	result, err := dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(userFilesTable),
-		Key: map[string]types.AttributeValue{
-			"userId": &types.AttributeValueMemberS{Value: userID},
-			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
-		},
+	file, err := common.GetOwnedFile(ctx, dynamoClient, userFilesTable, userID, req.FileID, consistentRead)
+	switch {
+	case errors.Is(err, common.ErrNotFound):
+		return common.Fail(common.NotFound("File not found"))
+	case errors.Is(err, common.ErrDeleted):
+		return common.Fail(common.Validation("File is already deleted"))
+	case err != nil:
+		return common.Fail(common.Internal("DynamoDB get error", err))
+	}
+
+	// Files under legal hold can't be deleted until the hold is released
+	if file.LegalHold {
+		if !req.DryRun {
+			auditLog.Log(ctx, userID, req.FileID, "access_attempt", map[string]interface{}{
+				"reason":     "legal_hold",
+				"operation":  "delete",
+				"fileName":   file.FileName,
+				"hardDelete": req.HardDelete,
+			})
+		}
+		return common.Fail(common.Locked("File is under legal hold"))
+	}
+
+	// Refuse deletes based on an outdated view of the file
+	if unmodifiedSince != "" && modifiedAfter(file, unmodifiedSince) {
+		return staleResponse(file), nil
+	}
+
+	// Dry run: report the cascade impact without changing anything or auditing
+	if req.DryRun {
+		return common.BuildResponse(200, DeleteResponse{
+			Message:  "Dry run: no changes made",
+			FileID:   req.FileID,
+			FileName: file.FileName,
+			DryRun:   true,
+			Impact: &DeleteImpact{
+				BytesFreed:        file.FileSize,
+				ACLEntriesRemoved: len(file.ACL),
+				AffectedUserIDs:   revokedUserIDs(file.ACL),
+			},
+		}), nil
+	}
+
+	// An upload that never completed has nothing to trash
+	if file.Status == common.StatusMultipartPending {
+		return abortUpload(ctx, userID, file)
+	}
+
+	if req.HardDelete {
+		return hardDelete(ctx, userID, file, &req, unmodifiedSince)
+	}
+
+	// Soft delete: move to trash by marking as deleted in DynamoDB. The S3
+	// object is kept so the file can be restored until it is purged.
+	attributes, err := moveToTrash(ctx, userID, req.FileID, unmodifiedSince)
+	if err != nil {
+		return conditionFailure(err, "DynamoDB update error")
+	}
+	acl := previousACL(attributes, file)
+
+	// Log audit event
+	auditLog.Log(ctx, userID, req.FileID, "delete", map[string]interface{}{
+		"fileName":       file.FileName,
+		"s3Key":          file.S3Key,
+		"hardDelete":     false,
+		"sharesRevoked":  len(acl),
+		"revokedUserIds": revokedUserIDs(acl),
 	})
+
+	response := DeleteResponse{
+		Message:  "File moved to trash",
+		FileID:   req.FileID,
+		FileName: file.FileName,
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// abortUpload deletes a multipart_pending file: its S3 upload is aborted,
+// which frees the parts already stored, and its record removed
+func abortUpload(ctx context.Context, userID string, file *common.File) (events.APIGatewayProxyResponse, error) {
+	err := common.AbortFileUpload(ctx, s3Client, dynamoClient, bucketName, userFilesTable, file)
+	if errors.Is(err, common.ErrUploadChanged) {
+		return common.Fail(common.Conflict("Upload was completed or aborted meanwhile, retry the delete"))
+	}
 	if err != nil {
-		log.Printf("DynamoDB get error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+		return common.Fail(common.Internal("Abort error", err))
 	}
 
-	if result.Item == nil {
-		return common.BuildErrorResponse(404, "File not found"), nil
+	auditLog.Log(ctx, userID, file.FileID, "upload_abort", map[string]interface{}{
+		"fileName": file.FileName,
+		"s3Key":    file.S3Key,
+		"reason":   "delete",
+	})
+
+	return common.BuildResponse(200, DeleteResponse{
+		Message:  "Upload aborted and file removed",
+		FileID:   file.FileID,
+		FileName: file.FileName,
+	}), nil
+}
+
+// hardDelete deletes the S3 object, then the record, and with purgeAudit
+// the file's audit entries. Right before the object goes the record is
+// checked again under condition, so a legal hold or change landing after the
+// read stops the delete before any content is lost. When the object can't be
+// deleted the record is kept so the delete can be retried.
+func hardDelete(ctx context.Context, userID string, file *common.File, req *DeleteRequest, unmodifiedSince string) (events.APIGatewayProxyResponse, error) {
+	attributes, err := recheckDelete(ctx, userID, req.FileID, unmodifiedSince)
+	if err != nil {
+		return conditionFailure(err, "DynamoDB update error")
 	}
+	acl := previousACL(attributes, file)
 
-	var file FileRecord
-	if err := attributevalue.UnmarshalMap(result.Item, &file); err != nil {
-		log.Printf("Unmarshal error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+	if err := deleteObject(ctx, file.S3Key); err != nil {
+		return common.Fail(common.Internal("S3 delete error", err))
+	}
+	if err := deleteRecord(ctx, userID, req.FileID); err != nil {
+		// The object is already gone; a retry finds nothing to delete in S3
+		// and removes the record
+		return common.Fail(common.Internal("DynamoDB delete error", err))
 	}
 
-	// Check if file is already deleted
-	if file.Status == "deleted" {
-		return common.BuildErrorResponse(400, "File is already deleted"), nil
+	response := DeleteResponse{
+		Message:  "File permanently deleted",
+		FileID:   req.FileID,
+		FileName: file.FileName,
 	}
+	metadata := map[string]interface{}{
+		"fileName":       file.FileName,
+		"s3Key":          file.S3Key,
+		"fileSize":       file.FileSize,
+		"hardDelete":     true,
+		"sharesRevoked":  len(acl),
+		"revokedUserIds": revokedUserIDs(acl),
+	}
+	if req.PurgeAudit {
+		purged, err := purgeAuditTrail(ctx, userID, req.FileID)
+		if err != nil {
+			log.Printf("Audit purge of %s/%s stopped after %d entries: %v", userID, req.FileID, purged, err)
+			response.AuditPurgeIncomplete = true
+			metadata["auditPurgeIncomplete"] = true
+		}
+		response.AuditEntriesPurged = &purged
+		metadata["auditEntriesPurged"] = purged
+	}
+
+	// Written after the purge, so this entry records it and survives it
+	auditLog.Log(ctx, userID, req.FileID, "delete", metadata)
+
+	return common.BuildResponse(200, response), nil
+}
 
-	// Delete file from S3
-	_, err = s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+// deleteObject deletes a file's S3 object
+func deleteObject(ctx context.Context, s3Key string) error {
+	opCtx, cancel := common.WithDeadline(ctx)
+	defer cancel()
+	_, err := s3Client.DeleteObject(opCtx, &s3.DeleteObjectInput{
 		Bucket: aws.String(bucketName),
-		Key:    aws.String(file.S3Key),
+		Key:    aws.String(s3Key),
 	})
-	if err != nil {
-		log.Printf("S3 delete error: %v", err)
-		// Continue with DynamoDB update even if S3 delete fails
+	return err
+}
+
+// deleteCondition returns the condition of a delete's write and its values:
+// the file must still exist, not be under legal hold and, with
+// ifUnmodifiedSince, not have changed after it
+func deleteCondition(unmodifiedSince string) (string, map[string]types.AttributeValue) {
+	condition := "attribute_exists(fileId) AND " + common.NoLegalHoldCondition
+	values := map[string]types.AttributeValue{}
+	if unmodifiedSince != "" {
+		// Repeats the check on the read atomically; files from before
+		// updatedAt was recorded fall back to createdAt
+		condition += " AND (updatedAt <= :since OR (attribute_not_exists(updatedAt) AND createdAt <= :since))"
+		values[":since"] = &types.AttributeValueMemberS{Value: unmodifiedSince}
 	}
+	return condition, values
+}
 
-	// Soft delete: mark as deleted in DynamoDB
+// moveToTrash marks a file deleted under deleteCondition and returns the
+// record as the update found it. Shares are revoked in the same update and
+// not brought back by a restore.
+func moveToTrash(ctx context.Context, userID, fileID, unmodifiedSince string) (map[string]types.AttributeValue, error) {
+	condition, values := deleteCondition(unmodifiedSince)
 	now := time.Now().UTC().Format(time.RFC3339)
-	_, err = dynamoClient.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+	values[":deleted"] = &types.AttributeValueMemberS{Value: common.StatusDeleted}
+	values[":deletedAt"] = &types.AttributeValueMemberS{Value: now}
+	values[":updatedAt"] = &types.AttributeValueMemberS{Value: now}
+
+	opCtx, cancel := common.WithDeadline(ctx)
+	result, err := dynamoClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
 		TableName: aws.String(userFilesTable),
 		Key: map[string]types.AttributeValue{
 			"userId": &types.AttributeValueMemberS{Value: userID},
-			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+			"fileId": &types.AttributeValueMemberS{Value: fileID},
 		},
-		UpdateExpression: aws.String("SET #status = :deleted, deletedAt = :deletedAt, updatedAt = :updatedAt"),
+		UpdateExpression:    aws.String("SET previousStatus = #status, #status = :deleted, deletedAt = :deletedAt, updatedAt = :updatedAt " + common.RevokeSharesUpdate),
+		ConditionExpression: aws.String(condition),
 		ExpressionAttributeNames: map[string]string{
 			"#status": "status",
 		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":deleted":   &types.AttributeValueMemberS{Value: "deleted"},
-			":deletedAt": &types.AttributeValueMemberS{Value: now},
-			":updatedAt": &types.AttributeValueMemberS{Value: now},
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        types.ReturnValueAllOld,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	return result.Attributes, nil
+}
+
+// recheckDelete checks a file's record under deleteCondition right before a
+// hard delete removes its object and returns it as it was. The check stamps
+// deleteStartedAt, which leaves updatedAt and so ifUnmodifiedSince alone.
+func recheckDelete(ctx context.Context, userID, fileID, unmodifiedSince string) (map[string]types.AttributeValue, error) {
+	condition, values := deleteCondition(unmodifiedSince)
+	values[":now"] = &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)}
+
+	opCtx, cancel := common.WithDeadline(ctx)
+	result, err := dynamoClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: fileID},
 		},
+		UpdateExpression:                    aws.String("SET deleteStartedAt = :now"),
+		ConditionExpression:                 aws.String(condition),
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        types.ReturnValueAllOld,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
 	})
+	cancel()
 	if err != nil {
-		log.Printf("DynamoDB update error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+		return nil, err
 	}
+	return result.Attributes, nil
+}
 
-	// Log audit event
-	go logAuditEvent(ctx, userID, req.FileID, "delete", map[string]interface{}{
-		"fileName":   file.FileName,
-		"s3Key":      file.S3Key,
-		"hardDelete": req.HardDelete,
+// deleteRecord deletes a file's record once its object is gone. It has no
+// condition: recheckDelete already checked the file, and a record left
+// behind would point at nothing.
+func deleteRecord(ctx context.Context, userID, fileID string) error {
+	opCtx, cancel := common.WithDeadline(ctx)
+	defer cancel()
+	_, err := dynamoClient.DeleteItem(opCtx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
 	})
+	return err
+}
 
-	response := DeleteResponse{
-		Message:  "File deleted successfully",
-		FileID:   req.FileID,
-		FileName: file.FileName,
+// previousACL is the acl of the record a delete's write returned, which may
+// differ from the earlier read of file
+func previousACL(attributes map[string]types.AttributeValue, file *common.File) []string {
+	var old common.File
+	if err := attributevalue.UnmarshalMap(attributes, &old); err != nil {
+		log.Printf("Unmarshal error for file %s: %v", file.FileID, err)
+		return file.ACL
+	}
+	return old.ACL
+}
+
+// validateFileIDs checks the fileIds of a request and returns them
+// de-duplicated, in request order
+func validateFileIDs(fileIDs []string) ([]string, *common.ValidationErrors) {
+	errs := &common.ValidationErrors{}
+	if len(fileIDs) == 0 {
+		errs.Add("fileIds", "must not be empty")
+		return nil, errs
+	}
+
+	seen := make(map[string]bool, len(fileIDs))
+	unique := make([]string, 0, len(fileIDs))
+	for i, fileID := range fileIDs {
+		if fileID == "" {
+			errs.Add(fmt.Sprintf("fileIds.%d", i), "must not be empty")
+			continue
+		}
+		if !seen[fileID] {
+			seen[fileID] = true
+			unique = append(unique, fileID)
+		}
+	}
+	if len(unique) > maxFileIDs {
+		errs.Addf("fileIds", "must have at most %d entries", maxFileIDs)
 	}
+	return unique, errs
+}
 
+// deleteBatch deletes several files as a single delete would, with an
+// outcome per file so one failure doesn't fail the others. The files are
+// read with one BatchGetItem. Each record is still written on its own:
+// BatchWriteItem can't carry the legal hold and ifUnmodifiedSince conditions.
+// For hard deletes those writes only re-check the records; the objects of
+// the files that pass are then removed with DeleteObjects, and only then
+// their records.
+func deleteBatch(ctx context.Context, userID string, fileIDs []string, req *DeleteRequest, unmodifiedSince string) (events.APIGatewayProxyResponse, error) {
+	files, err := common.GetOwnedFiles(ctx, dynamoClient, userFilesTable, userID, fileIDs)
+	incomplete := errors.Is(err, common.ErrIncompleteBatch)
+	if err != nil && !incomplete {
+		return common.Fail(common.Internal("DynamoDB batch get error", err))
+	}
+
+	results := make([]DeleteResult, len(fileIDs))
+	var pending []*common.File
+	for i, fileID := range fileIDs {
+		file := files[fileID]
+		results[i] = DeleteResult{FileID: fileID}
+		if file != nil {
+			results[i].FileName = file.FileName
+		}
+		switch {
+		case file == nil && incomplete:
+			// Unread rather than missing, so not reported as not_found
+			results[i] = failed(results[i], "DynamoDB batch get error", err)
+		case file == nil:
+			results[i].Outcome = outcomeNotFound
+		case file.Status == common.StatusDeleted:
+			results[i].Outcome = outcomeAlreadyDeleted
+		case file.LegalHold:
+			results[i].Outcome = outcomeLegalHold
+			if !req.DryRun {
+				auditLog.Log(ctx, userID, fileID, "access_attempt", map[string]interface{}{
+					"reason":     "legal_hold",
+					"operation":  "delete",
+					"fileName":   file.FileName,
+					"hardDelete": req.HardDelete,
+				})
+			}
+		case unmodifiedSince != "" && modifiedAfter(file, unmodifiedSince):
+			results[i].Outcome = outcomeStale
+		case req.DryRun:
+			results[i].Outcome = outcomeWouldDelete
+			results[i].Impact = &DeleteImpact{
+				BytesFreed:        file.FileSize,
+				ACLEntriesRemoved: len(file.ACL),
+				AffectedUserIDs:   revokedUserIDs(file.ACL),
+			}
+		default:
+			pending = append(pending, file)
+		}
+	}
+
+	written := runAll(len(pending), func(i int) DeleteResult {
+		return deleteOne(ctx, userID, pending[i], req.HardDelete, unmodifiedSince)
+	})
+
+	// As for a single file, a re-check refused by its condition leaves the
+	// object be and an object S3 keeps leaves its record be
+	if req.HardDelete {
+		deleteObjects(ctx, userID, pending, written)
+	}
+
+	byID := make(map[string]DeleteResult, len(written))
+	for _, result := range written {
+		if result.audit != nil {
+			auditLog.Log(ctx, userID, result.FileID, result.audit.action, result.audit.metadata)
+		}
+		byID[result.FileID] = result
+	}
+
+	response := BatchDeleteResponse{Results: results, Counts: map[string]int{}, DryRun: req.DryRun}
+	for i := range response.Results {
+		if result, ok := byID[response.Results[i].FileID]; ok {
+			response.Results[i] = result
+		}
+		response.Counts[response.Results[i].Outcome]++
+	}
 	return common.BuildResponse(200, response), nil
 }
 
-// logAuditEvent logs an audit event to DynamoDB
-func logAuditEvent(ctx context.Context, userID, fileID, action string, metadata map[string]interface{}) {
-	entry := AuditEntry{
-		UserID:    userID,
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
-		FileID:    fileID,
-		Action:    action,
-		Metadata:  metadata,
+// deleteObjects finishes the hard deletes whose records passed the
+// re-check: it removes their S3 objects, then the records of the files whose
+// object S3 confirmed deleted. A file whose object or record couldn't be
+// deleted becomes an error and keeps its record, so the delete can be
+// retried. written holds the results of files, in the same order.
+func deleteObjects(ctx context.Context, userID string, files []*common.File, written []DeleteResult) {
+	var keys []string
+	byKey := map[string]int{}
+	for i, file := range files {
+		// Pending uploads have no object; deleteOne aborted their upload
+		if written[i].Outcome != outcomeDeleted || file.Status == common.StatusMultipartPending {
+			continue
+		}
+		keys = append(keys, file.S3Key)
+		byKey[file.S3Key] = i
+	}
+	if len(keys) == 0 {
+		return
 	}
 
-	item, err := attributevalue.MarshalMap(entry)
+	for _, failure := range common.DeleteObjectsBatched(ctx, s3Client, bucketName, keys) {
+		i, ok := byKey[failure.Key]
+		if !ok {
+			continue
+		}
+		written[i] = failed(written[i], "S3 delete error", fmt.Errorf("%s: %s", failure.Code, failure.Message))
+		delete(byKey, failure.Key)
+	}
+
+	var deleted []int
+	for _, key := range keys {
+		if i, ok := byKey[key]; ok {
+			deleted = append(deleted, i)
+		}
+	}
+	finished := runAll(len(deleted), func(j int) DeleteResult {
+		i := deleted[j]
+		if err := deleteRecord(ctx, userID, files[i].FileID); err != nil {
+			// The object is already gone; a retry removes the record
+			return failed(written[i], "DynamoDB delete error", err)
+		}
+		return written[i]
+	})
+	for j, i := range deleted {
+		written[i] = finished[j]
+	}
+}
+
+// deleteOne writes the delete of one file of a batch. Its audit entry is
+// left on the result. For a hard delete it only re-checks the record, and
+// deleteObjects finishes the delete.
+func deleteOne(ctx context.Context, userID string, file *common.File, hard bool, unmodifiedSince string) DeleteResult {
+	result := DeleteResult{FileID: file.FileID, FileName: file.FileName}
+
+	if file.Status == common.StatusMultipartPending {
+		err := common.AbortFileUpload(ctx, s3Client, dynamoClient, bucketName, userFilesTable, file)
+		switch {
+		case errors.Is(err, common.ErrUploadChanged):
+			result.Outcome = outcomeStale
+			return result
+		case err != nil:
+			return failed(result, "Abort error", err)
+		}
+		result.Outcome = outcomeDeleted
+		result.audit = &pendingAudit{action: "upload_abort", metadata: map[string]interface{}{
+			"fileName": file.FileName,
+			"s3Key":    file.S3Key,
+			"reason":   "delete",
+			"batch":    true,
+		}}
+		return result
+	}
+
+	var attributes map[string]types.AttributeValue
+	var err error
+	if hard {
+		attributes, err = recheckDelete(ctx, userID, file.FileID, unmodifiedSince)
+	} else {
+		attributes, err = moveToTrash(ctx, userID, file.FileID, unmodifiedSince)
+	}
 	if err != nil {
-		log.Printf("Audit marshal error: %v", err)
-		return
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			// Changed by a concurrent request since it was read
+			result.Outcome = conditionFailureOutcome(conditionErr.Item)
+			return result
+		}
+		return failed(result, "DynamoDB write error", err)
+	}
+	result.Outcome = outcomeDeleted
+
+	acl := previousACL(attributes, file)
+	metadata := map[string]interface{}{
+		"fileName":       file.FileName,
+		"s3Key":          file.S3Key,
+		"hardDelete":     hard,
+		"batch":          true,
+		"sharesRevoked":  len(acl),
+		"revokedUserIds": revokedUserIDs(acl),
+	}
+	if hard {
+		metadata["fileSize"] = file.FileSize
+	}
+	result.audit = &pendingAudit{action: "delete", metadata: metadata}
+	return result
+}
+
+// conditionFailureOutcome explains why the conditional write of a batch
+// delete did not apply, given the record as it was then
+func conditionFailureOutcome(item map[string]types.AttributeValue) string {
+	if len(item) == 0 {
+		return outcomeNotFound
+	}
+	if _, held := item["legalHold"]; held {
+		return outcomeLegalHold
+	}
+	return outcomeStale
+}
+
+// runAll calls fn for 0..n-1 with at most maxConcurrency in flight. Results
+// are in index order.
+func runAll(n int, fn func(i int) DeleteResult) []DeleteResult {
+	results := make([]DeleteResult, n)
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// failed logs err and records it on result without exposing the details.
+// A failed file has no audit entry.
+func failed(result DeleteResult, message string, err error) DeleteResult {
+	log.Printf("%s for file %s: %v", message, result.FileID, err)
+	result.Outcome = outcomeError
+	result.Error = "Could not delete the file, please retry"
+	result.audit = nil
+	return result
+}
+
+// conditionFailure maps an error from the conditional write of a delete:
+// a file removed meanwhile is 404, one put under legal hold 423, one changed
+// after ifUnmodifiedSince 409 with the file as it is now
+func conditionFailure(err error, message string) (events.APIGatewayProxyResponse, error) {
+	var conditionErr *types.ConditionalCheckFailedException
+	if !errors.As(err, &conditionErr) {
+		return common.Fail(common.Internal(message, err))
+	}
+	// Removed between the read and the write
+	if len(conditionErr.Item) == 0 {
+		return common.Fail(common.NotFound("File not found"))
 	}
+	var current common.File
+	if err := attributevalue.UnmarshalMap(conditionErr.Item, &current); err != nil {
+		return common.Fail(common.Internal("Unmarshal error", err))
+	}
+	if current.LegalHold {
+		return common.Fail(common.Locked("File is under legal hold"))
+	}
+	// Changed between the read and the write
+	return staleResponse(&current), nil
+}
 
-	_, err = dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(fileAuditTable),
-		Item:      item,
+// purgeAuditTrail deletes userID's FileAudit entries for fileID and returns
+// how many it deleted. Entries are found with a filtered query over the
+// user's partition, so it reads the user's whole trail.
+func purgeAuditTrail(ctx context.Context, userID, fileID string) (int, error) {
+	purged := 0
+	paginator := dynamodb.NewQueryPaginator(auditClient, &dynamodb.QueryInput{
+		TableName:              aws.String(fileAuditTable),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		FilterExpression:       aws.String("fileId = :fileId"),
+		ProjectionExpression:   aws.String("userId, #ts"),
+		ExpressionAttributeNames: map[string]string{
+			"#ts": "timestamp",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: userID},
+			":fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
 	})
+	for paginator.HasMorePages() {
+		opCtx, cancel := common.WithDeadline(ctx)
+		page, err := paginator.NextPage(opCtx)
+		cancel()
+		if err != nil {
+			return purged, err
+		}
+		for start := 0; start < len(page.Items); start += maxBatchWriteItems {
+			end := min(start+maxBatchWriteItems, len(page.Items))
+			n, err := deleteAuditEntries(ctx, page.Items[start:end])
+			purged += n
+			if err != nil {
+				return purged, err
+			}
+		}
+	}
+	return purged, nil
+}
+
+// deleteAuditEntries deletes up to maxBatchWriteItems entries by key,
+// retrying the ones DynamoDB leaves unprocessed a few times
+func deleteAuditEntries(ctx context.Context, keys []map[string]types.AttributeValue) (int, error) {
+	pending := make([]types.WriteRequest, len(keys))
+	for i, key := range keys {
+		pending[i] = types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}}
+	}
+
+	for attempt := 1; len(pending) > 0; attempt++ {
+		if attempt > batchWriteAttempts {
+			return len(keys) - len(pending), errAuditPurgeIncomplete
+		}
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * 50 * time.Millisecond)
+		}
+
+		opCtx, cancel := common.WithDeadline(ctx)
+		result, err := auditClient.BatchWriteItem(opCtx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{fileAuditTable: pending},
+		})
+		cancel()
+		if err != nil {
+			return len(keys) - len(pending), fmt.Errorf("batch delete audit entries: %w", err)
+		}
+		pending = result.UnprocessedItems[fileAuditTable]
+	}
+	return len(keys), nil
+}
+
+// revokedUserIDs lists the users whose access a delete of a file with acl
+// revokes, never nil so responses and audit entries always carry a list
+func revokedUserIDs(acl []string) []string {
+	if acl == nil {
+		return []string{}
+	}
+	return acl
+}
+
+// parseIfUnmodifiedSince parses an RFC 3339 timestamp into the format of
+// the stored updatedAt (UTC, whole seconds) so the two compare as strings.
+// Fractions are dropped: updatedAt has none, so a file changed within the
+// same second as the timestamp counts as unmodified.
+func parseIfUnmodifiedSince(value string) (string, error) {
+	t, err := time.Parse(time.RFC3339, value)
 	if err != nil {
-		log.Printf("Audit log error: %v", err)
+		return "", err
+	}
+	return t.UTC().Truncate(time.Second).Format(time.RFC3339), nil
+}
+
+// modifiedAfter reports whether file was last changed after since, a
+// timestamp from parseIfUnmodifiedSince
+func modifiedAfter(file *common.File, since string) bool {
+	lastModified := file.UpdatedAt
+	if lastModified == "" {
+		lastModified = file.CreatedAt
 	}
+	return lastModified > since
+}
+
+// staleResponse is the 409 for a delete refused by ifUnmodifiedSince. It
+// carries only what the caller sees in get_files, never userId or s3Key.
+func staleResponse(file *common.File) events.APIGatewayProxyResponse {
+	return common.BuildResponse(409, StaleErrorResponse{
+		Error: "File was modified after ifUnmodifiedSince",
+		Code:  "conflict",
+		Current: common.File{
+			FileID:      file.FileID,
+			FileName:    file.FileName,
+			ContentType: file.ContentType,
+			FileSize:    file.FileSize,
+			Folder:      file.Folder,
+			Status:      file.Status,
+			UpdatedAt:   file.UpdatedAt,
+		},
+	})
 }
 
 func main() {
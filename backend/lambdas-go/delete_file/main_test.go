@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+func TestParseIfUnmodifiedSince(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"2024-05-01T10:00:00Z", "2024-05-01T10:00:00Z", true},
+		{"2024-05-01T12:00:00+02:00", "2024-05-01T10:00:00Z", true},
+		{"2024-05-01T10:00:00.999Z", "2024-05-01T10:00:00Z", true},
+		{"2024-05-01T10:00:00", "", false},
+		{"2024-05-01", "", false},
+		{"Wed, 01 May 2024 10:00:00 GMT", "", false},
+		{"1714557600", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseIfUnmodifiedSince(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseIfUnmodifiedSince(%q) = %q, %v; want %q, ok=%t", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestModifiedAfterBoundary(t *testing.T) {
+	since, err := parseIfUnmodifiedSince("2024-05-01T10:00:00.500Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		file common.File
+		want bool
+	}{
+		{"one second before", common.File{UpdatedAt: "2024-05-01T09:59:59Z"}, false},
+		{"same second", common.File{UpdatedAt: "2024-05-01T10:00:00Z"}, false},
+		{"one second after", common.File{UpdatedAt: "2024-05-01T10:00:01Z"}, true},
+		{"no updatedAt, created before", common.File{CreatedAt: "2024-05-01T09:00:00Z"}, false},
+		{"no updatedAt, created after", common.File{CreatedAt: "2024-05-01T11:00:00Z"}, true},
+	}
+
+	for _, tt := range tests {
+		if got := modifiedAfter(&tt.file, since); got != tt.want {
+			t.Errorf("%s: modifiedAfter() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateFileIDs(t *testing.T) {
+	fileIDs, errs := validateFileIDs([]string{"f1", "f2", "f1"})
+	if errs.HasErrors() {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if want := []string{"f1", "f2"}; !reflect.DeepEqual(fileIDs, want) {
+		t.Errorf("fileIds = %v, want %v", fileIDs, want)
+	}
+
+	tooMany := make([]string, maxFileIDs+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("f%d", i)
+	}
+	for _, fileIDs := range [][]string{{}, {"f1", ""}, tooMany} {
+		if _, errs := validateFileIDs(fileIDs); !errs.HasErrors() {
+			t.Errorf("%d fileIds %q accepted", len(fileIDs), fileIDs)
+		}
+	}
+}
+
+func TestConditionFailureOutcome(t *testing.T) {
+	tests := []struct {
+		name string
+		item map[string]types.AttributeValue
+		want string
+	}{
+		{"removed meanwhile", nil, outcomeNotFound},
+		{"held meanwhile", map[string]types.AttributeValue{
+			"fileId":    &types.AttributeValueMemberS{Value: "f1"},
+			"legalHold": &types.AttributeValueMemberBOOL{Value: true},
+		}, outcomeLegalHold},
+		{"changed meanwhile", map[string]types.AttributeValue{
+			"fileId":    &types.AttributeValueMemberS{Value: "f1"},
+			"updatedAt": &types.AttributeValueMemberS{Value: "2024-05-01T10:00:01Z"},
+		}, outcomeStale},
+	}
+	for _, tt := range tests {
+		if got := conditionFailureOutcome(tt.item); got != tt.want {
+			t.Errorf("%s: outcome %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// fakeAuditTable serves one page of audit keys and leaves the first write's
+// last request unprocessed unless stuck is set, in which case nothing is ever
+// processed
+type fakeAuditTable struct {
+	items   []map[string]types.AttributeValue
+	stuck   bool
+	batches [][]types.WriteRequest
+	deleted int
+}
+
+func (f *fakeAuditTable) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput{Items: f.items}, nil
+}
+
+func (f *fakeAuditTable) BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	requests := params.RequestItems[fileAuditTable]
+	f.batches = append(f.batches, requests)
+	if f.stuck {
+		return &dynamodb.BatchWriteItemOutput{UnprocessedItems: params.RequestItems}, nil
+	}
+	if len(f.batches) == 1 {
+		f.deleted += len(requests) - 1
+		return &dynamodb.BatchWriteItemOutput{UnprocessedItems: map[string][]types.WriteRequest{fileAuditTable: requests[len(requests)-1:]}}, nil
+	}
+	f.deleted += len(requests)
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+func auditKeys(n int) []map[string]types.AttributeValue {
+	items := make([]map[string]types.AttributeValue, n)
+	for i := range items {
+		items[i] = map[string]types.AttributeValue{
+			"userId":    &types.AttributeValueMemberS{Value: "u1"},
+			"timestamp": &types.AttributeValueMemberS{Value: time.Unix(int64(i), 0).UTC().Format(time.RFC3339)},
+		}
+	}
+	return items
+}
+
+func TestPurgeAuditTrail(t *testing.T) {
+	defer func(c auditTableAPI) { auditClient = c }(auditClient)
+	fake := &fakeAuditTable{items: auditKeys(30)}
+	auditClient = fake
+
+	purged, err := purgeAuditTrail(context.Background(), "u1", "f1")
+	if err != nil || purged != 30 || fake.deleted != 30 {
+		t.Fatalf("purgeAuditTrail = %d, %v (deleted %d), want 30 deleted", purged, err, fake.deleted)
+	}
+	// 25 + a retry of the unprocessed one + the remaining 5
+	if len(fake.batches) != 3 || len(fake.batches[0]) != maxBatchWriteItems || len(fake.batches[1]) != 1 || len(fake.batches[2]) != 5 {
+		t.Errorf("batch sizes = %d batches, want 25, 1, 5", len(fake.batches))
+	}
+}
+
+func TestPurgeAuditTrailGivesUp(t *testing.T) {
+	defer func(c auditTableAPI) { auditClient = c }(auditClient)
+	fake := &fakeAuditTable{items: auditKeys(3), stuck: true}
+	auditClient = fake
+
+	purged, err := purgeAuditTrail(context.Background(), "u1", "f1")
+	if !errors.Is(err, errAuditPurgeIncomplete) || purged != 0 {
+		t.Fatalf("purgeAuditTrail = %d, %v, want 0 and errAuditPurgeIncomplete", purged, err)
+	}
+	if len(fake.batches) != batchWriteAttempts {
+		t.Errorf("tried %d times, want %d", len(fake.batches), batchWriteAttempts)
+	}
+}
+
+// fakeStore is the UserFiles table and the bucket in one. It logs every
+// write in order, so tests can check what ran before what. writeErr is
+// returned by every conditional write and objectErr by DeleteObject.
+// DeleteObjects reports the keys in keptKeys as not deleted.
+type fakeStore struct {
+	mu        sync.Mutex
+	files     map[string]map[string]types.AttributeValue
+	writeErr  error
+	objectErr error
+	keptKeys  map[string]bool
+	calls     []string
+	audits    []string
+}
+
+// row is a record of user-123's file fileID with the given status
+func row(fileID, status string) map[string]types.AttributeValue {
+	item := map[string]types.AttributeValue{
+		"userId":   &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId":   &types.AttributeValueMemberS{Value: fileID},
+		"fileName": &types.AttributeValueMemberS{Value: fileID + ".bin"},
+		"s3Key":    &types.AttributeValueMemberS{Value: "users/user-123/uploads/" + fileID},
+		"status":   &types.AttributeValueMemberS{Value: status},
+		"fileSize": &types.AttributeValueMemberN{Value: "10"},
+	}
+	if status == common.StatusMultipartPending {
+		item["uploadId"] = &types.AttributeValueMemberS{Value: "upload-" + fileID}
+	}
+	return item
+}
+
+func newStore(rows ...map[string]types.AttributeValue) *fakeStore {
+	store := &fakeStore{files: map[string]map[string]types.AttributeValue{}}
+	for _, item := range rows {
+		store.files[item["fileId"].(*types.AttributeValueMemberS).Value] = item
+	}
+	return store
+}
+
+func (f *fakeStore) log(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func keyID(key map[string]types.AttributeValue) string {
+	return key["fileId"].(*types.AttributeValueMemberS).Value
+}
+
+func (f *fakeStore) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.files[keyID(params.Key)]}, nil
+}
+
+func (f *fakeStore) BatchGetItem(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	var items []map[string]types.AttributeValue
+	for _, key := range params.RequestItems[userFilesTable].Keys {
+		if item, ok := f.files[keyID(key)]; ok {
+			items = append(items, item)
+		}
+	}
+	return &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{userFilesTable: items}}, nil
+}
+
+func (f *fakeStore) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.log("update " + keyID(params.Key))
+	if f.writeErr != nil {
+		return nil, f.writeErr
+	}
+	return &dynamodb.UpdateItemOutput{Attributes: f.files[keyID(params.Key)]}, nil
+}
+
+func (f *fakeStore) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.log("delete-row " + keyID(params.Key))
+	if f.writeErr != nil && params.ConditionExpression != nil {
+		return nil, f.writeErr
+	}
+	return &dynamodb.DeleteItemOutput{Attributes: f.files[keyID(params.Key)]}, nil
+}
+
+func (f *fakeStore) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.log("delete-object " + aws.ToString(params.Key))
+	if f.objectErr != nil {
+		return nil, f.objectErr
+	}
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeStore) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	var keys []string
+	for _, object := range params.Delete.Objects {
+		keys = append(keys, aws.ToString(object.Key))
+	}
+	f.log("delete-objects " + strings.Join(keys, ","))
+	output := &s3.DeleteObjectsOutput{}
+	for _, key := range keys {
+		if f.keptKeys[key] {
+			output.Errors = append(output.Errors, s3types.Error{Key: aws.String(key), Code: aws.String("AccessDenied"), Message: aws.String("Access Denied")})
+		}
+	}
+	return output, nil
+}
+
+func (f *fakeStore) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.log("abort " + aws.ToString(params.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeStore) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.audits = append(f.audits, params.Item["action"].(*types.AttributeValueMemberS).Value)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// callDelete runs the handler against store as user-123, an admin, and
+// returns the status and body
+func callDelete(t *testing.T, store *fakeStore, body string) (int, string) {
+	t.Helper()
+	defer func(s objectsAPI, d filesAPI, a common.PutItemAPI) {
+		s3Client, dynamoClient, auditLog.Client = s, d, a
+	}(s3Client, dynamoClient, auditLog.Client)
+	s3Client, dynamoClient, auditLog.Client = store, store, store
+
+	handler := common.Chain(common.FlushBackground, common.HandleErrors, common.RequireUser)(handleDelete)
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		HTTPMethod: "DELETE",
+		Body:       body,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Authorizer: map[string]interface{}{"claims": map[string]interface{}{"sub": "user-123", "cognito:groups": "admin"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	return response.StatusCode, response.Body
+}
+
+func TestDeleteAbortsPendingUpload(t *testing.T) {
+	for _, hard := range []bool{false, true} {
+		store := newStore(row("file-1", common.StatusMultipartPending))
+		status, body := callDelete(t, store, fmt.Sprintf(`{"fileId":"file-1","hardDelete":%t}`, hard))
+		if status != 200 {
+			t.Fatalf("hardDelete=%t: status = %d: %s", hard, status, body)
+		}
+		// The upload is aborted and the row removed, never moved to trash
+		if want := "[abort upload-file-1 delete-row file-1]"; fmt.Sprint(store.calls) != want {
+			t.Errorf("hardDelete=%t: calls = %v, want %s", hard, store.calls, want)
+		}
+		if fmt.Sprint(store.audits) != "[upload_abort]" {
+			t.Errorf("hardDelete=%t: audits = %v", hard, store.audits)
+		}
+	}
+}
+
+func TestDeleteBatchAbortsPendingUpload(t *testing.T) {
+	store := newStore(row("file-1", common.StatusMultipartPending))
+	status, body := callDelete(t, store, `{"fileIds":["file-1"],"hardDelete":true}`)
+	if status != 200 {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	var response BatchDeleteResponse
+	json.Unmarshal([]byte(body), &response)
+	if response.Counts[outcomeDeleted] != 1 {
+		t.Errorf("counts = %v", response.Counts)
+	}
+	if want := "[abort upload-file-1 delete-row file-1]"; fmt.Sprint(store.calls) != want {
+		t.Errorf("calls = %v, want %s", store.calls, want)
+	}
+}
+
+func TestHardDeleteRemovesObjectBeforeRecord(t *testing.T) {
+	store := newStore(row("file-1", "uploaded"))
+	if status, body := callDelete(t, store, `{"fileId":"file-1","hardDelete":true}`); status != 200 {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	// The record is checked again, then the object goes before the record
+	if want := "[update file-1 delete-object users/user-123/uploads/file-1 delete-row file-1]"; fmt.Sprint(store.calls) != want {
+		t.Errorf("calls = %v, want %s", store.calls, want)
+	}
+	if fmt.Sprint(store.audits) != "[delete]" {
+		t.Errorf("audits = %v", store.audits)
+	}
+}
+
+func TestHardDeleteKeepsRecordWhenObjectDeleteFails(t *testing.T) {
+	store := newStore(row("file-1", "uploaded"))
+	store.objectErr = errors.New("access denied")
+
+	status, body := callDelete(t, store, `{"fileId":"file-1","hardDelete":true}`)
+	if status != 500 {
+		t.Errorf("status = %d, want 500: %s", status, body)
+	}
+	if want := "[update file-1 delete-object users/user-123/uploads/file-1]"; fmt.Sprint(store.calls) != want {
+		t.Errorf("calls = %v, want the record kept for a retry", store.calls)
+	}
+	if len(store.audits) != 0 {
+		t.Errorf("audits = %v, want none", store.audits)
+	}
+}
+
+func TestHardDeleteKeepsObjectWhenConditionFails(t *testing.T) {
+	// A legal hold placed between the read and the re-check
+	held := row("file-1", "uploaded")
+	held["legalHold"] = &types.AttributeValueMemberBOOL{Value: true}
+	store := newStore(row("file-1", "uploaded"))
+	store.writeErr = &types.ConditionalCheckFailedException{Item: held}
+
+	status, body := callDelete(t, store, `{"fileId":"file-1","hardDelete":true}`)
+	if status != 423 {
+		t.Errorf("status = %d, want 423: %s", status, body)
+	}
+	if want := "[update file-1]"; fmt.Sprint(store.calls) != want {
+		t.Errorf("calls = %v, want only the refused re-check", store.calls)
+	}
+	if len(store.audits) != 0 {
+		t.Errorf("audits = %v, want none", store.audits)
+	}
+}
+
+func TestDeleteBatchRemovesObjectsBeforeRecords(t *testing.T) {
+	store := newStore(row("file-1", "uploaded"), row("file-2", "uploaded"))
+	status, body := callDelete(t, store, `{"fileIds":["file-1","file-2"],"hardDelete":true}`)
+	if status != 200 {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	// Both records are re-checked, then both objects go, then both records
+	if n := len(store.calls); n != 5 || store.calls[2] != "delete-objects users/user-123/uploads/file-1,users/user-123/uploads/file-2" ||
+		!strings.HasPrefix(store.calls[3], "delete-row ") || !strings.HasPrefix(store.calls[4], "delete-row ") {
+		t.Errorf("calls = %v, want both objects deleted, then both records", store.calls)
+	}
+	if fmt.Sprint(store.audits) != "[delete delete]" {
+		t.Errorf("audits = %v", store.audits)
+	}
+}
+
+func TestDeleteBatchKeepsRecordsOfObjectsNotDeleted(t *testing.T) {
+	store := newStore(row("file-1", "uploaded"), row("file-2", "uploaded"))
+	store.keptKeys = map[string]bool{"users/user-123/uploads/file-2": true}
+	status, body := callDelete(t, store, `{"fileIds":["file-1","file-2"],"hardDelete":true}`)
+	if status != 200 {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	var response BatchDeleteResponse
+	json.Unmarshal([]byte(body), &response)
+	if response.Results[0].Outcome != outcomeDeleted || response.Results[1].Outcome != outcomeError {
+		t.Errorf("results = %+v, want file-1 deleted and file-2 an error", response.Results)
+	}
+	for _, call := range store.calls {
+		if call == "delete-row file-2" {
+			t.Errorf("calls = %v, want the record of file-2 kept", store.calls)
+		}
+	}
+	if fmt.Sprint(store.audits) != "[delete]" {
+		t.Errorf("audits = %v, want only file-1 audited", store.audits)
+	}
+}
+
+func TestDeleteBatchKeepsObjectsWhenConditionFails(t *testing.T) {
+	held := row("file-1", "uploaded")
+	held["legalHold"] = &types.AttributeValueMemberBOOL{Value: true}
+	store := newStore(row("file-1", "uploaded"))
+	store.writeErr = &types.ConditionalCheckFailedException{Item: held}
+
+	status, body := callDelete(t, store, `{"fileIds":["file-1"],"hardDelete":true}`)
+	if status != 200 {
+		t.Fatalf("status = %d: %s", status, body)
+	}
+	var response BatchDeleteResponse
+	json.Unmarshal([]byte(body), &response)
+	if response.Results[0].Outcome != outcomeLegalHold {
+		t.Errorf("outcome = %s, want %s", response.Results[0].Outcome, outcomeLegalHold)
+	}
+	if want := "[update file-1]"; fmt.Sprint(store.calls) != want {
+		t.Errorf("calls = %v, want the object left alone", store.calls)
+	}
+}
@@ -3,10 +3,18 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -23,48 +31,135 @@ import (
 const (
 	bucketName     = "660348065850-file-bucket"
 	userFilesTable = "UserFiles"
+	fileIDIndex    = "FileIdIndex"
 	fileAuditTable = "FileAudit"
 	presignExpiry  = 3600 // 1 hour
+	// maxPresignExpiry is the SigV4 limit of 7 days; requested expiries are
+	// clamped to it
+	maxPresignExpiry = 7 * 24 * 3600
+	// maxExpiries bounds how many URLs one request can ask for
+	maxExpiries = 5
+	// maxVersionIDLen bounds versionId; S3 version IDs are far shorter
+	maxVersionIDLen = 1024
+	// maxDownloadAsLen bounds downloadAs, folder path included
+	maxDownloadAsLen = 1024
+
+	defaultPresignRateThreshold = 500
+	presignRateWindow           = time.Hour
+	anomalyHighPresignRate      = "high_presign_rate"
+	downloadBudgetWindow        = 24 * time.Hour
+
+	defaultInlineMaxBytes = 64 << 10
+	// maxInlineBytes caps INLINE_MAX_BYTES: base64 grows the bytes by a
+	// third and Lambda responses can't exceed 6 MB
+	maxInlineBytes = 4 << 20
 )
 
+// dispositionEscaper quotes a file name for a Content-Disposition filename parameter
+var dispositionEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
 // DownloadRequest represents the request body
 type DownloadRequest struct {
 	FileID string `json:"fileId"`
+	// ProbeHead also returns a presigned HEAD URL so clients can check
+	// size and existence before downloading
+	ProbeHead bool `json:"probeHead"`
+	// DownloadAs overrides the suggested file name and may include a folder
+	// path such as "exports/2024/report.pdf". Browsers flatten or drop the
+	// path; desktop clients can use it to place the file.
+	DownloadAs string `json:"downloadAs,omitempty"`
+	// Expiries asks for one GET URL per expiry, in seconds, e.g. a short one
+	// for immediate use and a long one for sharing
+	Expiries []int `json:"expiries,omitempty"`
+	// VersionID presigns a specific S3 version of the object instead of the
+	// current one; only meaningful on versioned buckets
+	VersionID string `json:"versionId,omitempty"`
+	// Inline also returns the file's bytes when it is small enough, saving
+	// the round trip to S3 for thumbnails and icons
+	Inline bool `json:"inline,omitempty"`
+	// Range also returns the object's size and whether S3 serves byte
+	// ranges, for clients that resume downloads with Range requests against
+	// the presigned URL. A presign can't fix the range itself.
+	Range bool `json:"range,omitempty"`
 }
 
 // DownloadResponse represents the response body
 type DownloadResponse struct {
 	PresignedURL string `json:"presignedUrl"`
-	FileName     string `json:"fileName"`
-	ContentType  string `json:"contentType"`
-	FileSize     int64  `json:"fileSize"`
-	ExpiresIn    int    `json:"expiresIn"`
+	// HeadURL is a presigned HEAD for the same object, set when probeHead is true
+	HeadURL     string `json:"headUrl,omitempty"`
+	FileName    string `json:"fileName"`
+	ContentType string `json:"contentType"`
+	// Category groups contentType for display (common.FileCategory)
+	Category  string `json:"category"`
+	FileSize  int64  `json:"fileSize"`
+	ExpiresIn int    `json:"expiresIn"`
+	// PresignedURLs maps each requested expiry, after clamping, to its URL.
+	// PresignedURL and ExpiresIn are then the shortest of them.
+	PresignedURLs map[int]string `json:"presignedUrls,omitempty"`
+	// VersionID is the S3 version the URLs are pinned to when requested,
+	// otherwise the version recorded at upload; empty without versioning
+	VersionID string `json:"versionId,omitempty"`
+	ETag      string `json:"etag,omitempty"`
+	// UploadStartedAt and UploadCompletedAt time the upload; files from
+	// before they were recorded have neither
+	UploadStartedAt   string `json:"uploadStartedAt,omitempty"`
+	UploadCompletedAt string `json:"uploadCompletedAt,omitempty"`
+	// ContentLength and AcceptRanges are the HeadObject values of the
+	// object, set when range was requested. SupportsRange is true when
+	// AcceptRanges is "bytes".
+	ContentLength int64  `json:"contentLength,omitempty"`
+	AcceptRanges  string `json:"acceptRanges,omitempty"`
+	SupportsRange bool   `json:"supportsRange,omitempty"`
+	// Content is the file's bytes, base64 encoded, set when inline was
+	// requested and the file is at most INLINE_MAX_BYTES. The URLs are
+	// returned either way.
+	Content string `json:"content,omitempty"`
+	// Anomalies flags unusual activity on the caller's account, e.g. "high_presign_rate"
+	Anomalies []string `json:"anomalies,omitempty"`
 }
 
-// FileRecord represents a file record from DynamoDB
-type FileRecord struct {
-	UserID      string `dynamodbav:"userId"`
-	FileID      string `dynamodbav:"fileId"`
-	FileName    string `dynamodbav:"fileName"`
-	ContentType string `dynamodbav:"contentType"`
-	FileSize    int64  `dynamodbav:"fileSize"`
-	S3Key       string `dynamodbav:"s3Key"`
-	Status      string `dynamodbav:"status"`
+// BudgetErrorResponse is returned with 429 when the daily download budget is exhausted
+type BudgetErrorResponse struct {
+	Error     string `json:"error"`
+	UsedBytes int64  `json:"usedBytes"`
+	Budget    int64  `json:"budget"`
 }
 
-// AuditEntry represents an audit log entry
-type AuditEntry struct {
-	UserID    string                 `dynamodbav:"userId"`
-	Timestamp string                 `dynamodbav:"timestamp"`
-	FileID    string                 `dynamodbav:"fileId"`
-	Action    string                 `dynamodbav:"action"`
-	Metadata  map[string]interface{} `dynamodbav:"metadata"`
+// objectAPI is the subset of the S3 client inlineContent and headObject use
+type objectAPI interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+}
+
+// filesAPI is the subset of the DynamoDB client used to look up and count
+// downloads of files; tests replace it
+type filesAPI interface {
+	common.GetItemAPI
+	common.QueryAPI
+	common.UpdateItemAPI
 }
 
 var (
-	s3Client        *s3.Client
+	// s3Client reads inlined files and range probes; tests replace it
+	s3Client        objectAPI
 	s3PresignClient *s3.PresignClient
-	dynamoClient    *dynamodb.Client
+	dynamoClient    filesAPI
+	auditLog        *common.AuditLogger
+	presignCounter  *common.RateCounter
+	// presignRateThreshold is the number of presigned URLs per user per hour
+	// above which requests are flagged (PRESIGN_RATE_THRESHOLD)
+	presignRateThreshold int64 = defaultPresignRateThreshold
+	// enforcePresignRate rejects requests over the threshold with 429 instead
+	// of only flagging them (PRESIGN_RATE_ENFORCE=true)
+	enforcePresignRate bool
+	downloadCounter    *common.RateCounter
+	// downloadByteBudget caps the bytes a user may download per UTC day
+	// (DOWNLOAD_BYTE_BUDGET). Zero means unlimited.
+	downloadByteBudget int64
+	// inlineMaxBytes is the largest file returned inline (INLINE_MAX_BYTES).
+	// Zero turns inlining off.
+	inlineMaxBytes int64 = defaultInlineMaxBytes
 )
 
 func init() {
@@ -72,113 +167,536 @@ func init() {
 	if err != nil {
 		log.Fatalf("Failed to load AWS config: %v", err)
 	}
-	s3Client = s3.NewFromConfig(cfg)
-	s3PresignClient = s3.NewPresignClient(s3Client)
-	dynamoClient = dynamodb.NewFromConfig(cfg)
+	client := s3.NewFromConfig(cfg)
+	s3Client = client
+	s3PresignClient = s3.NewPresignClient(client)
+	db := dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	dynamoClient = db
+	auditLog = &common.AuditLogger{Client: db, Table: fileAuditTable, Geo: true}
+	presignCounter = common.NewRateCounter(db, "presign", presignRateWindow)
+
+	if v := os.Getenv("PRESIGN_RATE_THRESHOLD"); v != "" {
+		presignRateThreshold, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || presignRateThreshold <= 0 {
+			log.Fatalf("Invalid PRESIGN_RATE_THRESHOLD: %q", v)
+		}
+	}
+	enforcePresignRate = os.Getenv("PRESIGN_RATE_ENFORCE") == "true"
+
+	downloadCounter = common.NewRateCounter(db, "download-bytes", downloadBudgetWindow)
+	if v := os.Getenv("DOWNLOAD_BYTE_BUDGET"); v != "" {
+		downloadByteBudget, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || downloadByteBudget < 0 {
+			log.Fatalf("Invalid DOWNLOAD_BYTE_BUDGET: %q", v)
+		}
+	}
+	if v := os.Getenv("INLINE_MAX_BYTES"); v != "" {
+		inlineMaxBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || inlineMaxBytes < 0 || inlineMaxBytes > maxInlineBytes {
+			log.Fatalf("Invalid INLINE_MAX_BYTES: %q (max %d)", v, maxInlineBytes)
+		}
+	}
 }
 
 // Handler is the Lambda function handler
-func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Log authorizer context for debugging
-	log.Printf("Authorizer context: %+v", request.RequestContext.Authorizer)
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleDownload)
 
-	// Extract user ID
-	userID, err := common.ExtractUserID(request)
-	if err != nil {
-		log.Printf("Auth error: %v", err)
-		return common.BuildErrorResponse(401, "Unauthorized: userId not found"), nil
-	}
+// handleDownload handles an authenticated request
+func handleDownload(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
 
 	// Parse request body
 	var req DownloadRequest
 	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
-		return common.BuildErrorResponse(400, "Invalid request body"), nil
+		return common.Fail(common.Validation("Invalid request body"))
 	}
 
 	// Validate required fields
 	if req.FileID == "" {
-		return common.BuildErrorResponse(400, "Missing required field: fileId"), nil
+		return common.Fail(common.Validation("Missing required field: fileId"))
 	}
+	errs := validateDownloadAs(&req)
+	if len(req.VersionID) > maxVersionIDLen || strings.IndexFunc(req.VersionID, unicode.IsControl) >= 0 {
+		errs.Addf("versionId", "must be at most %d characters without control characters", maxVersionIDLen)
+	}
+	expiries := normalizeExpiries(req.Expiries, errs)
+	if errs.HasErrors() {
+		return common.Fail(errs)
+	}
+
+	// Clients that just wrote the file can pass consistent=true for read-after-write.
+	// Strongly consistent reads cost twice the read capacity of the default.
+	consistentRead := request.QueryStringParameters["consistent"] == "true"
 
 	// Get file metadata from DynamoDB
-	result, err := dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(userFilesTable),
-		Key: map[string]types.AttributeValue{
-			"userId": &types.AttributeValueMemberS{Value: userID},
-			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
-		},
-	})
-	if err != nil {
-		log.Printf("DynamoDB get error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+	file, err := common.GetOwnedFile(ctx, dynamoClient, userFilesTable, userID, req.FileID, consistentRead)
+	if errors.Is(err, common.ErrNotFound) {
+		// Not the caller's file: allow access if the caller is in the owner's acl
+		file, err = findSharedFile(ctx, req.FileID, userID)
+	} else if err == nil && !common.Confirmed(file.Status) {
+		err = common.ErrNotConfirmed
+	}
+	switch {
+	case errors.Is(err, common.ErrNotFound):
+		return common.Fail(common.NotFound("File not found"))
+	case errors.Is(err, common.ErrDeleted):
+		return common.Fail(common.NotFound("File has been deleted"))
+	case errors.Is(err, common.ErrNotConfirmed):
+		// Pending uploads may have no object yet, and rejected ones are in quarantine
+		return common.Fail(common.Conflict(fmt.Sprintf("File can't be downloaded while %s", file.Status)))
+	case err != nil:
+		return common.Fail(common.Internal("DynamoDB read error", err))
 	}
 
-	if result.Item == nil {
-		return common.BuildErrorResponse(404, "File not found"), nil
+	// Owners can limit where users in the acl may open the file from
+	if file.UserID != userID && len(file.ShareReferers) > 0 && !common.RefererAllowed(request, file.ShareReferers) {
+		auditLog.Log(ctx, file.UserID, req.FileID, "access_attempt", map[string]interface{}{
+			"reason":     "referer",
+			"operation":  "download",
+			"fileName":   file.FileName,
+			"accessedBy": userID,
+			"referer":    common.Referer(request),
+		})
+		return common.Fail(common.Forbidden("File can only be opened from an allowed site"))
+	}
+	if file.UserID != userID && len(file.ShareCIDRs) > 0 && !common.IPAllowed(common.TrustedClientIP(request), file.ShareCIDRs) {
+		auditLog.Log(ctx, file.UserID, req.FileID, "access_attempt", map[string]interface{}{
+			"reason":     "ip_address",
+			"operation":  "download",
+			"fileName":   file.FileName,
+			"accessedBy": userID,
+		})
+		return common.Fail(common.Forbidden("File can only be opened from an allowed network"))
 	}
 
-	var file FileRecord
-	if err := attributevalue.UnmarshalMap(result.Item, &file); err != nil {
-		log.Printf("Unmarshal error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+	// Nothing is presigned for files that haven't been scanned clean
+	if err := common.ScanGate(file); err != nil {
+		return scanBlocked(ctx, file, userID, "download", err)
 	}
 
-	// Check if file is deleted
-	if file.Status == "deleted" {
-		return common.BuildErrorResponse(404, "File has been deleted"), nil
+	// Limited shares are refused once used up, before touching the counters
+	limited := file.UserID != userID && file.ShareMaxDownloads > 0
+	if limited && common.ShareExhausted(file) {
+		return shareExhausted(ctx, file, userID)
 	}
 
-	// Create presigned URL for download
-	presignReq, err := s3PresignClient.PresignGetObject(ctx, &s3.GetObjectInput{
-		Bucket:                     aws.String(bucketName),
-		Key:                        aws.String(file.S3Key),
-		ResponseContentDisposition: aws.String(fmt.Sprintf(`attachment; filename="%s"`, file.FileName)),
-	}, s3.WithPresignExpires(time.Duration(presignExpiry)*time.Second))
+	// Resumable downloads need the actual object size; checked before the
+	// counters so a missing object costs the caller nothing
+	var head *s3.HeadObjectOutput
+	if req.Range {
+		head, err = headObject(ctx, file, req.VersionID)
+		switch {
+		case errors.Is(err, common.ErrObjectMissing):
+			return common.Fail(common.NotFound("File content has not been uploaded"))
+		case err != nil:
+			return common.Fail(common.Internal("S3 head error", err))
+		}
+	}
+
+	// Track presigned URL issuance and flag unusually high rates
+	var anomalies []string
+	presignCount, err := presignCounter.Increment(ctx, userID)
 	if err != nil {
-		log.Printf("Presign error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+		// Never fail a download because the counter is unavailable
+		log.Printf("Presign counter error: %v", err)
+	} else if presignCount > presignRateThreshold {
+		anomalies = append(anomalies, anomalyHighPresignRate)
+		// Audit only the first crossing per window so the trail isn't flooded
+		if presignCount == presignRateThreshold+1 {
+			auditLog.Log(ctx, userID, req.FileID, "access_attempt", map[string]interface{}{
+				"reason":    anomalyHighPresignRate,
+				"count":     presignCount,
+				"threshold": presignRateThreshold,
+				"window":    presignRateWindow.String(),
+				"enforced":  enforcePresignRate,
+			})
+		}
+		if enforcePresignRate {
+			return common.Fail(common.Throttled("Too many download requests, try again later"))
+		}
 	}
 
-	// Log audit event
-	go logAuditEvent(ctx, userID, req.FileID, "download", map[string]interface{}{
-		"fileName": file.FileName,
-		"s3Key":    file.S3Key,
-	})
+	// Meter the caller's daily download bytes; rejected downloads are not counted
+	if downloadByteBudget > 0 {
+		usedBytes, ok, err := downloadCounter.Add(ctx, userID, file.FileSize, downloadByteBudget)
+		if err != nil {
+			// Unlike the presign rate flag the budget is enforced, so fail closed
+			return common.Fail(common.Internal("Download budget counter error", err))
+		}
+		if !ok {
+			return common.BuildResponse(429, BudgetErrorResponse{
+				Error:     "Daily download budget exceeded",
+				UsedBytes: usedBytes,
+				Budget:    downloadByteBudget,
+			}), nil
+		}
+	}
+
+	// Take one download off the share; concurrent requests race for the last one
+	var downloadsLeft int64
+	if limited {
+		downloadsLeft, err = common.ConsumeShareDownload(ctx, dynamoClient, userFilesTable, file)
+		switch {
+		case errors.Is(err, common.ErrShareExhausted):
+			return shareExhausted(ctx, file, userID)
+		case err != nil:
+			return common.Fail(common.Internal("Share download counter error", err))
+		}
+	}
+
+	// Create a presigned URL for download per expiry, shortest first
+	var urls map[int]string
+	var downloadURL string
+	for _, expiry := range expiries {
+		presignReq, err := s3PresignClient.PresignGetObject(ctx, buildGetObjectInput(file, req.DownloadAs, req.VersionID), s3.WithPresignExpires(time.Duration(expiry)*time.Second))
+		if err != nil {
+			return common.Fail(common.Internal("Presign error", err))
+		}
+		// Served through the CDN when DOWNLOAD_URL_HOST is set
+		signedURL, err := common.DownloadURL(presignReq.URL)
+		if err != nil {
+			return urlFailure(ctx, file, err)
+		}
+		if downloadURL == "" {
+			downloadURL = signedURL
+		}
+		if len(req.Expiries) > 0 {
+			if urls == nil {
+				urls = make(map[int]string, len(expiries))
+			}
+			urls[expiry] = signedURL
+		}
+	}
+
+	// S3 presigns are per operation, so HEAD needs its own URL
+	var headURL string
+	if req.ProbeHead {
+		headReq, err := s3PresignClient.PresignHeadObject(ctx, buildHeadObjectInput(file, req.VersionID), s3.WithPresignExpires(time.Duration(presignExpiry)*time.Second))
+		if err != nil {
+			return common.Fail(common.Internal("Presign HEAD error", err))
+		}
+		if headURL, err = common.SecureURL(headReq.URL); err != nil {
+			return urlFailure(ctx, file, err)
+		}
+	}
+
+	// Small files can come back inline; any failure just leaves the URL
+	var content string
+	if req.Inline {
+		content = inlineContent(ctx, file, req.VersionID)
+	}
+
+	// Log audit event, only now that the GET URL is handed out
+	if file.UserID == userID {
+		auditLog.Log(ctx, userID, req.FileID, "download", map[string]interface{}{
+			"fileName":   file.FileName,
+			"s3Key":      file.S3Key,
+			"downloadAs": req.DownloadAs,
+			"expiries":   expiries,
+			"versionId":  req.VersionID,
+			"inline":     content != "",
+		})
+	} else {
+		// Record non-owner access in the owner's audit trail
+		metadata := map[string]interface{}{
+			"fileName":   file.FileName,
+			"s3Key":      file.S3Key,
+			"accessedBy": userID,
+			"accessVia":  "acl",
+			"expiries":   expiries,
+			"versionId":  req.VersionID,
+			"inline":     content != "",
+		}
+		if limited {
+			metadata["downloadsLeft"] = downloadsLeft
+		}
+		auditLog.Log(ctx, file.UserID, req.FileID, "download", metadata)
+		if limited && downloadsLeft == 0 {
+			auditLog.Log(ctx, file.UserID, req.FileID, "share_exhausted", map[string]interface{}{
+				"fileName":     file.FileName,
+				"accessedBy":   userID,
+				"accessVia":    "acl",
+				"maxDownloads": file.ShareMaxDownloads,
+			})
+		}
+	}
 
 	response := DownloadResponse{
-		PresignedURL: presignReq.URL,
-		FileName:     file.FileName,
-		ContentType:  file.ContentType,
-		FileSize:     file.FileSize,
-		ExpiresIn:    presignExpiry,
+		PresignedURL:      downloadURL,
+		HeadURL:           headURL,
+		FileName:          file.FileName,
+		ContentType:       file.ContentType,
+		Category:          common.FileCategory(file.ContentType),
+		FileSize:          file.FileSize,
+		ExpiresIn:         expiries[0],
+		PresignedURLs:     urls,
+		VersionID:         file.VersionID,
+		ETag:              file.ETag,
+		UploadStartedAt:   file.UploadStartedAt,
+		UploadCompletedAt: file.UploadCompletedAt,
+		Content:           content,
+		Anomalies:         anomalies,
+	}
+
+	if req.VersionID != "" {
+		// The recorded ETag belongs to the recorded version only
+		response.VersionID = req.VersionID
+		if req.VersionID != file.VersionID {
+			response.ETag = ""
+		}
+	}
+	if head != nil {
+		// The ETag of the object the URL serves, for If-Range on resume
+		response.ETag = aws.ToString(head.ETag)
+		response.ContentLength = aws.ToInt64(head.ContentLength)
+		response.AcceptRanges = aws.ToString(head.AcceptRanges)
+		response.SupportsRange = response.AcceptRanges == "bytes"
 	}
 
 	return common.BuildResponse(200, response), nil
 }
 
-// logAuditEvent logs an audit event to DynamoDB
-func logAuditEvent(ctx context.Context, userID, fileID, action string, metadata map[string]interface{}) {
-	entry := AuditEntry{
-		UserID:    userID,
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
-		FileID:    fileID,
-		Action:    action,
-		Metadata:  metadata,
+// scanBlocked refuses a download ScanGate rejected. Attempts on infected
+// files are recorded in the owner's audit trail.
+func scanBlocked(ctx context.Context, file *common.File, userID, operation string, err error) (events.APIGatewayProxyResponse, error) {
+	if errors.Is(err, common.ErrInfected) {
+		metadata := map[string]interface{}{
+			"reason":    "infected",
+			"operation": operation,
+			"fileName":  file.FileName,
+		}
+		if file.UserID != userID {
+			metadata["accessedBy"] = userID
+		}
+		auditLog.Log(ctx, file.UserID, file.FileID, "access_attempt", metadata)
 	}
+	return common.ScanBlocked(err), nil
+}
 
-	item, err := attributevalue.MarshalMap(entry)
+// inlineContent returns the base64 encoded bytes of file, or "" when it
+// can't be inlined: inlining is off, the file is over inlineMaxBytes, or it
+// is pre-compressed, since clients would get bytes they have to decode
+// themselves. The recorded fileSize may be stale, so the read is capped too.
+// Read failures are logged; the caller still has the presigned URL.
+func inlineContent(ctx context.Context, file *common.File, versionID string) string {
+	if inlineMaxBytes == 0 || file.FileSize > inlineMaxBytes || file.ContentEncoding != "" {
+		return ""
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(file.S3Key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	opCtx, cancel := common.WithDeadline(ctx)
+	defer cancel()
+	object, err := s3Client.GetObject(opCtx, input)
 	if err != nil {
-		log.Printf("Audit marshal error: %v", err)
-		return
+		log.Printf("Inline read error for %s: %v", file.FileID, err)
+		return ""
 	}
+	defer object.Body.Close()
 
-	_, err = dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(fileAuditTable),
-		Item:      item,
+	data, err := io.ReadAll(io.LimitReader(object.Body, inlineMaxBytes+1))
+	if err != nil {
+		log.Printf("Inline read error for %s: %v", file.FileID, err)
+		return ""
+	}
+	if int64(len(data)) > inlineMaxBytes {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// headObject reads the S3 metadata of file's object, or of one version of
+// it. It returns common.ErrObjectMissing when there is no such object.
+func headObject(ctx context.Context, file *common.File, versionID string) (*s3.HeadObjectOutput, error) {
+	opCtx, cancel := common.WithDeadline(ctx)
+	defer cancel()
+	head, err := s3Client.HeadObject(opCtx, buildHeadObjectInput(file, versionID))
+	if err != nil {
+		if kind, _ := common.ClassifyAWSError(err); kind == common.KindNotFound {
+			return nil, common.ErrObjectMissing
+		}
+		return nil, err
+	}
+	return head, nil
+}
+
+// shareExhausted refuses a download from a share with no downloads left
+func shareExhausted(ctx context.Context, file *common.File, userID string) (events.APIGatewayProxyResponse, error) {
+	auditLog.Log(ctx, file.UserID, file.FileID, "access_attempt", map[string]interface{}{
+		"reason":       "downloads_exhausted",
+		"operation":    "download",
+		"fileName":     file.FileName,
+		"accessedBy":   userID,
+		"maxDownloads": file.ShareMaxDownloads,
+	})
+	return common.Fail(common.Gone("This share has reached its download limit"))
+}
+
+// buildGetObjectInput describes the presigned GET for a file. The stored
+// content type overrides whatever type the object itself carries, which is
+// wrong for some legacy uploads. Pre-compressed files get a Content-Encoding
+// override so browsers decompress them,
+// downloadAs, when set, replaces the file name in Content-Disposition, and
+// versionID, when set, selects that S3 version of the object.
+func buildGetObjectInput(file *common.File, downloadAs, versionID string) *s3.GetObjectInput {
+	name := file.FileName
+	if downloadAs != "" {
+		name = downloadAs
+	}
+	input := &s3.GetObjectInput{
+		Bucket:                     aws.String(bucketName),
+		Key:                        aws.String(file.S3Key),
+		ResponseContentDisposition: aws.String(fmt.Sprintf(`attachment; filename="%s"`, dispositionEscaper.Replace(name))),
+	}
+	if contentType := common.NormalizeContentType(file.ContentType); contentType != "" {
+		input.ResponseContentType = aws.String(contentType)
+	}
+	if file.ContentEncoding != "" {
+		input.ResponseContentEncoding = aws.String(file.ContentEncoding)
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	return input
+}
+
+// validateDownloadAs normalizes downloadAs to a relative path without empty,
+// "." or ".." segments
+func validateDownloadAs(req *DownloadRequest) *common.ValidationErrors {
+	errs := &common.ValidationErrors{}
+	req.DownloadAs = strings.Trim(strings.TrimSpace(req.DownloadAs), "/")
+	if req.DownloadAs == "" {
+		return errs
+	}
+
+	switch {
+	case len(req.DownloadAs) > maxDownloadAsLen:
+		errs.Addf("downloadAs", "must be at most %d characters", maxDownloadAsLen)
+	case strings.IndexFunc(req.DownloadAs, unicode.IsControl) >= 0 || strings.Contains(req.DownloadAs, `\`):
+		errs.Add("downloadAs", "must not contain control characters or backslashes")
+	default:
+		for _, segment := range strings.Split(req.DownloadAs, "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				errs.Add("downloadAs", "must not contain empty, '.' or '..' segments")
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// normalizeExpiries returns the expiries to presign, in seconds, sorted and
+// without duplicates. Values over maxPresignExpiry are clamped to it; none
+// requested means the default presignExpiry.
+func normalizeExpiries(requested []int, errs *common.ValidationErrors) []int {
+	if len(requested) == 0 {
+		return []int{presignExpiry}
+	}
+	if len(requested) > maxExpiries {
+		errs.Addf("expiries", "must have at most %d values", maxExpiries)
+		return nil
+	}
+
+	seen := map[int]bool{}
+	var expiries []int
+	for _, expiry := range requested {
+		if expiry <= 0 {
+			errs.Add("expiries", "must be positive numbers of seconds")
+			return nil
+		}
+		if expiry > maxPresignExpiry {
+			expiry = maxPresignExpiry
+		}
+		if !seen[expiry] {
+			seen[expiry] = true
+			expiries = append(expiries, expiry)
+		}
+	}
+	sort.Ints(expiries)
+	return expiries
+}
+
+// buildHeadObjectInput describes the presigned HEAD for a file, optionally
+// of one S3 version
+func buildHeadObjectInput(file *common.File, versionID string) *s3.HeadObjectInput {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(file.S3Key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	return input
+}
+
+// findSharedFile looks up a file by ID through the fileId GSI and returns it
+// only if userID is in its acl. Like common.GetOwnedFile it returns
+// common.ErrNotFound if no such file is shared with the user and
+// common.ErrDeleted if it is in trash; common.ErrNotConfirmed means the
+// upload isn't confirmed.
+func findSharedFile(ctx context.Context, fileID, userID string) (*common.File, error) {
+	opCtx, cancel := common.WithDeadline(ctx)
+	result, err := dynamoClient.Query(opCtx, &dynamodb.QueryInput{
+		TableName:              aws.String(userFilesTable),
+		IndexName:              aws.String(fileIDIndex),
+		KeyConditionExpression: aws.String("fileId = :fileId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
+		Limit: aws.Int32(1),
 	})
+	cancel()
 	if err != nil {
-		log.Printf("Audit log error: %v", err)
+		return nil, err
+	}
+	if len(result.Items) == 0 {
+		return nil, common.ErrNotFound
+	}
+
+	var file common.File
+	if err := attributevalue.UnmarshalMap(result.Items[0], &file); err != nil {
+		return nil, err
+	}
+
+	for _, grantee := range file.ACL {
+		if grantee == userID {
+			switch {
+			case file.Status == common.StatusDeleted:
+				return &file, common.ErrDeleted
+			case !common.Confirmed(file.Status):
+				return &file, common.ErrNotConfirmed
+			}
+			return &file, nil
+		}
+	}
+	return nil, common.ErrNotFound
+}
+
+// urlFailure answers a presigned URL that can't be handed out with 500.
+// A non-https URL means the S3 endpoint is misconfigured, so it also leaves
+// a security_alert entry in the owner's audit trail.
+func urlFailure(ctx context.Context, file *common.File, err error) (events.APIGatewayProxyResponse, error) {
+	if errors.Is(err, common.ErrInsecureURL) {
+		auditLog.Log(ctx, file.UserID, file.FileID, "security_alert", map[string]interface{}{
+			"reason":   "insecure_url",
+			"fileName": file.FileName,
+			"error":    err.Error(),
+		})
 	}
+	return common.Fail(common.Internal("Download URL error", err))
 }
 
 func main() {
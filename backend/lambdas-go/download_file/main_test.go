@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+func testPresignClient() *s3.PresignClient {
+	return s3.NewPresignClient(s3.New(s3.Options{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+		}),
+	}))
+}
+
+func presignedQuery(t *testing.T, file *common.File) url.Values {
+	t.Helper()
+	req, err := testPresignClient().PresignGetObject(context.Background(), buildGetObjectInput(file, "", ""))
+	if err != nil {
+		t.Fatalf("PresignGetObject error: %v", err)
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		t.Fatalf("invalid presigned URL %q: %v", req.URL, err)
+	}
+	return u.Query()
+}
+
+func TestPresignedGetCarriesContentEncoding(t *testing.T) {
+	query := presignedQuery(t, &common.File{
+		FileName:        "data.json",
+		S3Key:           "users/user-123/uploads/file-1-data.json",
+		ContentEncoding: "gzip",
+	})
+
+	if got := query.Get("response-content-encoding"); got != "gzip" {
+		t.Errorf("response-content-encoding = %q, want gzip", got)
+	}
+	if got := query.Get("response-content-disposition"); got != `attachment; filename="data.json"` {
+		t.Errorf("response-content-disposition = %q", got)
+	}
+}
+
+func TestPresignedGetCarriesStoredContentType(t *testing.T) {
+	query := presignedQuery(t, &common.File{
+		FileName:    "photo.jpg",
+		S3Key:       "users/user-123/uploads/file-1-photo.jpg",
+		ContentType: " Image/JPEG; charset=binary",
+	})
+
+	if got := query.Get("response-content-type"); got != "image/jpeg" {
+		t.Errorf("response-content-type = %q, want image/jpeg", got)
+	}
+
+	query = presignedQuery(t, &common.File{
+		FileName: "notes",
+		S3Key:    "users/user-123/uploads/file-2-notes",
+	})
+	if query.Has("response-content-type") {
+		t.Errorf("response-content-type = %q, want it unset", query.Get("response-content-type"))
+	}
+}
+
+func TestPresignedGetWithDownloadAs(t *testing.T) {
+	file := &common.File{FileName: "report.pdf", S3Key: "users/user-123/uploads/file-4-report.pdf"}
+
+	req, err := testPresignClient().PresignGetObject(context.Background(), buildGetObjectInput(file, `exports/2024/q1 "final".pdf`, ""))
+	if err != nil {
+		t.Fatalf("PresignGetObject error: %v", err)
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		t.Fatalf("invalid presigned URL %q: %v", req.URL, err)
+	}
+	want := `attachment; filename="exports/2024/q1 \"final\".pdf"`
+	if got := u.Query().Get("response-content-disposition"); got != want {
+		t.Errorf("response-content-disposition = %q, want %q", got, want)
+	}
+}
+
+func TestValidateDownloadAs(t *testing.T) {
+	tests := []struct {
+		downloadAs string
+		want       string
+		valid      bool
+	}{
+		{"", "", true},
+		{" /exports/2024/report.pdf ", "exports/2024/report.pdf", true},
+		{"report.pdf", "report.pdf", true},
+		{"exports/../report.pdf", "", false},
+		{"exports//report.pdf", "", false},
+		{`exports\report.pdf`, "", false},
+		{"report\n.pdf", "", false},
+	}
+
+	for _, tt := range tests {
+		req := DownloadRequest{FileID: "file-1", DownloadAs: tt.downloadAs}
+		errs := validateDownloadAs(&req)
+		if errs.HasErrors() == tt.valid {
+			t.Errorf("validateDownloadAs(%q) errors = %v, want valid = %v", tt.downloadAs, errs.Errors, tt.valid)
+			continue
+		}
+		if tt.valid && req.DownloadAs != tt.want {
+			t.Errorf("validateDownloadAs(%q) normalized to %q, want %q", tt.downloadAs, req.DownloadAs, tt.want)
+		}
+	}
+}
+
+func TestPresignedHead(t *testing.T) {
+	file := &common.File{S3Key: "users/user-123/uploads/file-3-photo.png"}
+
+	req, err := testPresignClient().PresignHeadObject(context.Background(), buildHeadObjectInput(file, ""))
+	if err != nil {
+		t.Fatalf("PresignHeadObject error: %v", err)
+	}
+	if req.Method != "HEAD" {
+		t.Errorf("method = %q, want HEAD", req.Method)
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		t.Fatalf("invalid presigned URL %q: %v", req.URL, err)
+	}
+	if u.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("HEAD URL is not signed: %s", req.URL)
+	}
+}
+
+func TestPresignedGetWithoutContentEncoding(t *testing.T) {
+	query := presignedQuery(t, &common.File{
+		FileName: "report.pdf",
+		S3Key:    "users/user-123/uploads/file-2-report.pdf",
+	})
+
+	if _, ok := query["response-content-encoding"]; ok {
+		t.Errorf("unexpected response-content-encoding %q", query.Get("response-content-encoding"))
+	}
+}
+
+func TestPresignedGetForVersion(t *testing.T) {
+	file := &common.File{FileName: "report.pdf", S3Key: "users/user-123/uploads/file-2-report.pdf"}
+
+	req, err := testPresignClient().PresignGetObject(context.Background(), buildGetObjectInput(file, "", "3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY"))
+	if err != nil {
+		t.Fatalf("PresignGetObject error: %v", err)
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		t.Fatalf("invalid presigned URL %q: %v", req.URL, err)
+	}
+	if got := u.Query().Get("versionId"); got != "3HL4kqtJlcpXroDTDmJ+rmSpXd3dIbrHY" {
+		t.Errorf("versionId = %q", got)
+	}
+
+	if _, ok := presignedQuery(t, file)["versionId"]; ok {
+		t.Error("versionId set without one being requested")
+	}
+}
+
+func TestNormalizeExpiries(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []int
+		want      []int
+		valid     bool
+	}{
+		{"default", nil, []int{presignExpiry}, true},
+		{"sorted", []int{86400, 300}, []int{300, 86400}, true},
+		{"clamped", []int{60, 30 * 24 * 3600}, []int{60, maxPresignExpiry}, true},
+		{"duplicates after clamping", []int{maxPresignExpiry, maxPresignExpiry + 1, 60}, []int{60, maxPresignExpiry}, true},
+		{"zero", []int{0}, nil, false},
+		{"negative", []int{300, -1}, nil, false},
+		{"too many", []int{1, 2, 3, 4, 5, 6}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := &common.ValidationErrors{}
+			got := normalizeExpiries(tt.requested, errs)
+			if errs.HasErrors() == tt.valid {
+				t.Fatalf("errors = %v, want valid=%v", errs.Errors, tt.valid)
+			}
+			if tt.valid && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expiries = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeObjects serves GetObject and HeadObject from a map of key to content
+type fakeObjects map[string]string
+
+func (f fakeObjects) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	content, ok := f[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &s3types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(content))}, nil
+}
+
+func (f fakeObjects) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	content, ok := f[aws.ToString(params.Key)]
+	if !ok {
+		return nil, &s3types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(content))),
+		AcceptRanges:  aws.String("bytes"),
+		ETag:          aws.String(`"etag-` + aws.ToString(params.VersionId) + `"`),
+	}, nil
+}
+
+func TestInlineContent(t *testing.T) {
+	defer func(client objectAPI, max int64) { s3Client, inlineMaxBytes = client, max }(s3Client, inlineMaxBytes)
+	s3Client = fakeObjects{
+		"icon.png":  "tiny",
+		"grown.png": "recorded as small but grew",
+	}
+	inlineMaxBytes = 8
+
+	tests := []struct {
+		name string
+		file common.File
+		max  int64
+		want string
+	}{
+		{"small file", common.File{S3Key: "icon.png", FileSize: 4}, 8, "dGlueQ=="},
+		{"over the threshold", common.File{S3Key: "icon.png", FileSize: 9}, 8, ""},
+		{"stale fileSize", common.File{S3Key: "grown.png", FileSize: 4}, 8, ""},
+		{"pre-compressed", common.File{S3Key: "icon.png", FileSize: 4, ContentEncoding: "gzip"}, 8, ""},
+		{"missing object", common.File{S3Key: "gone.png", FileSize: 4}, 8, ""},
+		{"inlining off", common.File{S3Key: "icon.png", FileSize: 4}, 0, ""},
+	}
+	for _, tt := range tests {
+		inlineMaxBytes = tt.max
+		if got := inlineContent(context.Background(), &tt.file, ""); got != tt.want {
+			t.Errorf("%s: inlineContent = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHeadObject(t *testing.T) {
+	defer func(client objectAPI) { s3Client = client }(s3Client)
+	s3Client = fakeObjects{"video.mp4": "0123456789"}
+
+	head, err := headObject(context.Background(), &common.File{S3Key: "video.mp4", FileSize: 4}, "v2")
+	if err != nil {
+		t.Fatalf("headObject error: %v", err)
+	}
+	// The object's own size, not the recorded fileSize
+	if aws.ToInt64(head.ContentLength) != 10 || aws.ToString(head.AcceptRanges) != "bytes" || aws.ToString(head.ETag) != `"etag-v2"` {
+		t.Errorf("head = %d bytes, %q, %q", aws.ToInt64(head.ContentLength), aws.ToString(head.AcceptRanges), aws.ToString(head.ETag))
+	}
+
+	if _, err := headObject(context.Background(), &common.File{S3Key: "gone.mp4"}, ""); !errors.Is(err, common.ErrObjectMissing) {
+		t.Errorf("missing object error = %v, want ErrObjectMissing", err)
+	}
+}
+
+// fakeFiles holds one file row, returned to its owner by GetItem and to
+// anyone through the fileId index
+type fakeFiles struct {
+	row map[string]types.AttributeValue
+}
+
+func (f *fakeFiles) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if reflect.DeepEqual(params.Key["userId"], f.row["userId"]) {
+		return &dynamodb.GetItemOutput{Item: f.row}, nil
+	}
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func (f *fakeFiles) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{f.row}}, nil
+}
+
+func (f *fakeFiles) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeFiles) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// sharedRow is file-1 of user-123 with status, shared with user-456
+func sharedRow(status string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":   &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId":   &types.AttributeValueMemberS{Value: "file-1"},
+		"fileName": &types.AttributeValueMemberS{Value: "report.pdf"},
+		"s3Key":    &types.AttributeValueMemberS{Value: "users/user-123/uploads/file-1-report.pdf"},
+		"status":   &types.AttributeValueMemberS{Value: status},
+		"acl":      &types.AttributeValueMemberSS{Value: []string{"user-456"}},
+	}
+}
+
+func TestDownloadRefusesUnconfirmedFiles(t *testing.T) {
+	defer func(client filesAPI, audit common.PutItemAPI) { dynamoClient, auditLog.Client = client, audit }(dynamoClient, auditLog.Client)
+	handler := common.Chain(common.FlushBackground, common.HandleErrors, common.RequireUser)(handleDownload)
+
+	for _, status := range []string{"pending", common.StatusRejected} {
+		// The owner reads the row directly, user-456 through the share
+		for _, caller := range []string{"user-123", "user-456"} {
+			files := &fakeFiles{row: sharedRow(status)}
+			dynamoClient, auditLog.Client = files, files
+			response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+				HTTPMethod: "POST",
+				Body:       `{"fileId":"file-1"}`,
+				RequestContext: events.APIGatewayProxyRequestContext{
+					Authorizer: map[string]interface{}{"claims": map[string]interface{}{"sub": caller}},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != 409 || !strings.Contains(response.Body, "while "+status) {
+				t.Errorf("%s downloading a %s file = %d %s, want 409", caller, status, response.StatusCode, response.Body)
+			}
+		}
+	}
+}
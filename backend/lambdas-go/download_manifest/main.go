@@ -0,0 +1,353 @@
+// Package main implements the download_manifest Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName     = "660348065850-file-bucket"
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	presignExpiry  = 3600 // 1 hour
+	maxFileIDs     = 100
+	maxConcurrency = 10
+
+	defaultPresignRateThreshold = 500
+	presignRateWindow           = time.Hour
+	anomalyHighPresignRate      = "high_presign_rate"
+)
+
+// ManifestRequest represents the request body
+type ManifestRequest struct {
+	FileIDs []string `json:"fileIds"`
+}
+
+// ManifestResponse represents the response body
+type ManifestResponse struct {
+	Root      *FolderNode `json:"root"`
+	FileCount int         `json:"fileCount"`
+	TotalSize int64       `json:"totalSize"`
+	ExpiresIn int         `json:"expiresIn"`
+	Missing   []string    `json:"missing"`
+	Deleted   []string    `json:"deleted"`
+	// NotReady lists files whose upload isn't confirmed yet, e.g. pending
+	NotReady []string `json:"notReady"`
+	// Scanning and Infected list files ScanGate refused, see download_file
+	Scanning []string `json:"scanning"`
+	Infected []string `json:"infected"`
+	// Anomalies flags unusual activity on the caller's account, e.g. "high_presign_rate"
+	Anomalies []string `json:"anomalies,omitempty"`
+}
+
+// FolderNode is one folder of the manifest tree. Path is relative to the
+// root, which has an empty name and path.
+type FolderNode struct {
+	Name    string         `json:"name"`
+	Path    string         `json:"path"`
+	Folders []*FolderNode  `json:"folders"`
+	Files   []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a file in the manifest with its download URL
+type ManifestFile struct {
+	FileID      string `json:"fileId"`
+	FileName    string `json:"fileName"`
+	ContentType string `json:"contentType"`
+	FileSize    int64  `json:"fileSize"`
+	URL         string `json:"url"`
+}
+
+// manifestEntry is the outcome for one requested file
+type manifestEntry struct {
+	fileID string
+	file   *common.File
+	url    string
+	err    error
+}
+
+var (
+	s3PresignClient *s3.PresignClient
+	dynamoClient    *dynamodb.Client
+	// getClient looks up the files; tests replace it
+	getClient      common.GetItemAPI
+	auditLog       *common.AuditLogger
+	presignCounter *common.RateCounter
+	// presignRateThreshold is shared with download_file (PRESIGN_RATE_THRESHOLD)
+	presignRateThreshold int64 = defaultPresignRateThreshold
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	s3PresignClient = s3.NewPresignClient(s3.NewFromConfig(cfg))
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	getClient = dynamoClient
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+	presignCounter = common.NewRateCounter(dynamoClient, "presign", presignRateWindow)
+
+	if v := os.Getenv("PRESIGN_RATE_THRESHOLD"); v != "" {
+		presignRateThreshold, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || presignRateThreshold <= 0 {
+			log.Fatalf("Invalid PRESIGN_RATE_THRESHOLD: %q", v)
+		}
+	}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleManifest)
+
+// handleManifest handles an authenticated request
+func handleManifest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req ManifestRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+
+	fileIDs, errs := validateManifestRequest(&req)
+	if errs.HasErrors() {
+		return common.Fail(errs)
+	}
+
+	entries := presignAll(ctx, userID, fileIDs)
+
+	response := ManifestResponse{
+		ExpiresIn: presignExpiry,
+		Missing:   []string{},
+		Deleted:   []string{},
+		NotReady:  []string{},
+		Scanning:  []string{},
+		Infected:  []string{},
+	}
+	var found []manifestEntry
+	for _, e := range entries {
+		switch {
+		case e.err == nil:
+			found = append(found, e)
+			response.TotalSize += e.file.FileSize
+		case errors.Is(e.err, common.ErrNotFound):
+			response.Missing = append(response.Missing, e.fileID)
+		case errors.Is(e.err, common.ErrDeleted):
+			response.Deleted = append(response.Deleted, e.fileID)
+		case errors.Is(e.err, common.ErrNotConfirmed):
+			response.NotReady = append(response.NotReady, e.fileID)
+		case errors.Is(e.err, common.ErrScanPending):
+			response.Scanning = append(response.Scanning, e.fileID)
+		case errors.Is(e.err, common.ErrInfected):
+			response.Infected = append(response.Infected, e.fileID)
+			auditLog.Log(ctx, userID, e.fileID, "access_attempt", map[string]interface{}{
+				"reason":    "infected",
+				"operation": "download_manifest",
+				"fileName":  e.file.FileName,
+			})
+		default:
+			return common.Fail(common.Internal("Manifest error for file "+e.fileID, e.err))
+		}
+	}
+	response.Root = buildTree(found)
+	response.FileCount = len(found)
+
+	// Manifest URLs count toward the same hourly presign rate as downloads
+	if n := int64(len(found)); n > 0 {
+		total, _, err := presignCounter.Add(ctx, userID, n, 0)
+		if err != nil {
+			// Never fail a manifest because the counter is unavailable
+			log.Printf("Presign counter error: %v", err)
+		} else if total > presignRateThreshold {
+			response.Anomalies = append(response.Anomalies, anomalyHighPresignRate)
+			// Audit only the first crossing per window so the trail isn't flooded
+			if total-n <= presignRateThreshold {
+				auditLog.Log(ctx, userID, "*", "access_attempt", map[string]interface{}{
+					"reason":    anomalyHighPresignRate,
+					"count":     total,
+					"threshold": presignRateThreshold,
+					"window":    presignRateWindow.String(),
+					"source":    "download_manifest",
+				})
+			}
+		}
+
+		ids := make([]string, len(found))
+		for i, e := range found {
+			ids[i] = e.fileID
+		}
+		auditLog.Log(ctx, userID, "*", "download", map[string]interface{}{
+			"fileIds":   ids,
+			"fileCount": len(found),
+			"totalSize": response.TotalSize,
+			"source":    "download_manifest",
+		})
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// validateManifestRequest checks the request and returns the de-duplicated file IDs
+func validateManifestRequest(req *ManifestRequest) ([]string, *common.ValidationErrors) {
+	errs := &common.ValidationErrors{}
+
+	if len(req.FileIDs) == 0 {
+		errs.Add("fileIds", "is required")
+		return nil, errs
+	}
+
+	seen := make(map[string]bool, len(req.FileIDs))
+	fileIDs := make([]string, 0, len(req.FileIDs))
+	for i, fileID := range req.FileIDs {
+		if fileID == "" {
+			errs.Add(fmt.Sprintf("fileIds.%d", i), "must not be empty")
+			continue
+		}
+		if !seen[fileID] {
+			seen[fileID] = true
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	if len(fileIDs) > maxFileIDs {
+		errs.Addf("fileIds", "must have at most %d entries", maxFileIDs)
+	}
+
+	return fileIDs, errs
+}
+
+// presignAll looks up and presigns every file with at most maxConcurrency
+// lookups in flight. Entries are in the same order as fileIDs.
+func presignAll(ctx context.Context, userID string, fileIDs []string) []manifestEntry {
+	entries := make([]manifestEntry, len(fileIDs))
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+
+	for i, fileID := range fileIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, fileID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			file, url, err := presignOne(ctx, userID, fileID)
+			entries[i] = manifestEntry{fileID: fileID, file: file, url: url, err: err}
+		}(i, fileID)
+	}
+
+	wg.Wait()
+	return entries
+}
+
+// presignOne issues a presigned GET for one of the user's files. Like
+// download_file it only serves confirmed uploads.
+func presignOne(ctx context.Context, userID, fileID string) (*common.File, string, error) {
+	file, err := common.GetOwnedFile(ctx, getClient, userFilesTable, userID, fileID, false)
+	if err != nil {
+		return nil, "", err
+	}
+	if !common.Confirmed(file.Status) {
+		return file, "", common.ErrNotConfirmed
+	}
+	if err := common.ScanGate(file); err != nil {
+		return file, "", err
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket:                     aws.String(bucketName),
+		Key:                        aws.String(file.S3Key),
+		ResponseContentDisposition: aws.String(fmt.Sprintf(`attachment; filename="%s"`, file.FileName)),
+	}
+	if contentType := common.NormalizeContentType(file.ContentType); contentType != "" {
+		input.ResponseContentType = aws.String(contentType)
+	}
+	if file.ContentEncoding != "" {
+		input.ResponseContentEncoding = aws.String(file.ContentEncoding)
+	}
+
+	presignReq, err := s3PresignClient.PresignGetObject(ctx, input, s3.WithPresignExpires(time.Duration(presignExpiry)*time.Second))
+	if err != nil {
+		return nil, "", fmt.Errorf("presign: %w", err)
+	}
+	downloadURL, err := common.DownloadURL(presignReq.URL)
+	if err != nil {
+		return nil, "", fmt.Errorf("download URL: %w", err)
+	}
+	return file, downloadURL, nil
+}
+
+// buildTree arranges files into their folders. Folders and files are sorted
+// by name so the manifest is stable for the same set of files.
+func buildTree(entries []manifestEntry) *FolderNode {
+	root := &FolderNode{Folders: []*FolderNode{}, Files: []ManifestFile{}}
+	byPath := map[string]*FolderNode{"": root}
+
+	for _, e := range entries {
+		folder := folderFor(byPath, strings.Trim(e.file.Folder, "/"))
+		folder.Files = append(folder.Files, ManifestFile{
+			FileID:      e.fileID,
+			FileName:    e.file.FileName,
+			ContentType: e.file.ContentType,
+			FileSize:    e.file.FileSize,
+			URL:         e.url,
+		})
+	}
+
+	for _, folder := range byPath {
+		sort.Slice(folder.Folders, func(i, j int) bool { return folder.Folders[i].Name < folder.Folders[j].Name })
+		sort.Slice(folder.Files, func(i, j int) bool {
+			if folder.Files[i].FileName != folder.Files[j].FileName {
+				return folder.Files[i].FileName < folder.Files[j].FileName
+			}
+			return folder.Files[i].FileID < folder.Files[j].FileID
+		})
+	}
+	return root
+}
+
+// folderFor returns the node for path, creating it and its parents as needed
+func folderFor(byPath map[string]*FolderNode, path string) *FolderNode {
+	if node, ok := byPath[path]; ok {
+		return node
+	}
+
+	parentPath, name := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		parentPath, name = path[:i], path[i+1:]
+	}
+	parent := folderFor(byPath, parentPath)
+
+	node := &FolderNode{Name: name, Path: path, Folders: []*FolderNode{}, Files: []ManifestFile{}}
+	parent.Folders = append(parent.Folders, node)
+	byPath[path] = node
+	return node
+}
+
+func main() {
+	lambda.Start(Handler)
+}
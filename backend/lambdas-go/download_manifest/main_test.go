@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+func entry(fileID, folder, fileName string) manifestEntry {
+	return manifestEntry{
+		fileID: fileID,
+		file:   &common.File{FileID: fileID, Folder: folder, FileName: fileName},
+		url:    "https://example.com/" + fileID,
+	}
+}
+
+func TestBuildTree(t *testing.T) {
+	root := buildTree([]manifestEntry{
+		entry("f3", "projects/2024", "b.pdf"),
+		entry("f1", "", "notes.txt"),
+		entry("f2", "projects/2024", "a.pdf"),
+		entry("f4", "/projects/", "plan.docx"),
+		entry("f5", "archive", "old.txt"),
+	})
+
+	if got := fileNames(root); !reflect.DeepEqual(got, []string{"notes.txt"}) {
+		t.Errorf("root files = %v", got)
+	}
+	if len(root.Folders) != 2 || root.Folders[0].Name != "archive" || root.Folders[1].Name != "projects" {
+		t.Fatalf("unexpected root folders %+v", root.Folders)
+	}
+
+	projects := root.Folders[1]
+	if got := fileNames(projects); !reflect.DeepEqual(got, []string{"plan.docx"}) {
+		t.Errorf("projects files = %v", got)
+	}
+	if len(projects.Folders) != 1 {
+		t.Fatalf("expected one subfolder of projects, got %d", len(projects.Folders))
+	}
+
+	year := projects.Folders[0]
+	if year.Name != "2024" || year.Path != "projects/2024" {
+		t.Errorf("unexpected folder name %q, path %q", year.Name, year.Path)
+	}
+	if got := fileNames(year); !reflect.DeepEqual(got, []string{"a.pdf", "b.pdf"}) {
+		t.Errorf("projects/2024 files = %v", got)
+	}
+	if year.Files[0].URL != "https://example.com/f2" {
+		t.Errorf("unexpected URL %q", year.Files[0].URL)
+	}
+}
+
+func TestBuildTreeEmpty(t *testing.T) {
+	root := buildTree(nil)
+	if root.Folders == nil || root.Files == nil {
+		t.Error("empty tree should have empty, non-nil lists so it encodes as []")
+	}
+}
+
+func fileNames(folder *FolderNode) []string {
+	names := make([]string, len(folder.Files))
+	for i, f := range folder.Files {
+		names[i] = f.FileName
+	}
+	return names
+}
+
+// fakeFiles serves user-123's files by fileId
+type fakeFiles map[string]map[string]types.AttributeValue
+
+func (f fakeFiles) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f[params.Key["fileId"].(*types.AttributeValueMemberS).Value]}, nil
+}
+
+// record is user-123's file fileID, scanned clean
+func record(fileID, status string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":     &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId":     &types.AttributeValueMemberS{Value: fileID},
+		"fileName":   &types.AttributeValueMemberS{Value: fileID + ".txt"},
+		"s3Key":      &types.AttributeValueMemberS{Value: "users/user-123/uploads/" + fileID + ".txt"},
+		"status":     &types.AttributeValueMemberS{Value: status},
+		"scanStatus": &types.AttributeValueMemberS{Value: common.ScanStatusClean},
+	}
+}
+
+func TestPresignSkipsUnconfirmedFiles(t *testing.T) {
+	defer func(c common.GetItemAPI, p *s3.PresignClient) { getClient, s3PresignClient = c, p }(getClient, s3PresignClient)
+	getClient = fakeFiles{
+		"f-pending":   record("f-pending", "pending"),
+		"f-multipart": record("f-multipart", common.StatusMultipartPending),
+		"f-uploaded":  record("f-uploaded", common.StatusUploaded),
+		"f-confirmed": record("f-confirmed", common.StatusConfirmed),
+	}
+	s3PresignClient = s3.NewPresignClient(s3.New(s3.Options{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+		}),
+	}))
+
+	entries := presignAll(context.Background(), "user-123", []string{"f-pending", "f-multipart", "f-uploaded", "f-confirmed"})
+	for _, e := range entries[:2] {
+		if !errors.Is(e.err, common.ErrNotConfirmed) || e.url != "" {
+			t.Errorf("%s: url %q, err %v; want ErrNotConfirmed", e.fileID, e.url, e.err)
+		}
+	}
+	for _, e := range entries[2:] {
+		if e.err != nil || e.url == "" {
+			t.Errorf("%s: url %q, err %v; want a URL", e.fileID, e.url, e.err)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Package main implements the expire_files Lambda function
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName     = "660348065850-file-bucket"
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	scanPageSize   = 100
+	// statusCreatedIndex is the GSI (status, createdAt) stale uploads are found by
+	statusCreatedIndex = "StatusCreatedIndex"
+	// defaultStaleUploadAge is how long a multipart upload may stay pending
+	defaultStaleUploadAge = 24 * time.Hour
+)
+
+// ExpireResult summarizes one run of the expiry job
+type ExpireResult struct {
+	Scanned int `json:"scanned"`
+	Expired int `json:"expired"`
+	// AbortedUploads counts stale multipart uploads aborted by the run
+	AbortedUploads int `json:"abortedUploads"`
+	Failed         int `json:"failed"`
+}
+
+var (
+	s3Client     *s3.Client
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+	// staleUploadAge is how long after upload_file started it a multipart
+	// upload is aborted (MULTIPART_STALE_AFTER, Go duration; 0 disables)
+	staleUploadAge = defaultStaleUploadAge
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	s3Client = s3.NewFromConfig(cfg)
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable, NoClientIP: true}
+
+	if v := os.Getenv("MULTIPART_STALE_AFTER"); v != "" {
+		staleUploadAge, err = time.ParseDuration(v)
+		if err != nil || staleUploadAge < 0 {
+			log.Fatalf("Invalid MULTIPART_STALE_AFTER: %q", v)
+		}
+	}
+}
+
+// Handler is the Lambda function handler, invoked on a schedule by EventBridge
+func Handler(ctx context.Context, event events.CloudWatchEvent) (ExpireResult, error) {
+	var result ExpireResult
+	if common.ReadOnlyMode() {
+		// Expired files are picked up by the first run after maintenance
+		log.Printf("Read-only mode, skipping expiry run")
+		return result, nil
+	}
+	now := time.Now().UTC()
+
+	// Scan for past-due files that are not yet deleted. Files under legal
+	// hold are kept past their expiry until the hold is released.
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(userFilesTable),
+		FilterExpression: aws.String("expiryEpoch <= :now AND #status <> :deleted AND " + common.NoLegalHoldCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			":deleted": &types.AttributeValueMemberS{Value: "deleted"},
+		},
+		Limit: aws.Int32(scanPageSize),
+	}
+
+	paginator := dynamodb.NewScanPaginator(dynamoClient, input)
+	for paginator.HasMorePages() {
+		opCtx, cancel := common.WithDeadline(ctx)
+		page, err := paginator.NextPage(opCtx)
+		cancel()
+		if err != nil {
+			log.Printf("DynamoDB scan error: %v", err)
+			return result, err
+		}
+
+		var files []common.File
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &files); err != nil {
+			log.Printf("Unmarshal error: %v", err)
+			return result, err
+		}
+
+		for _, file := range files {
+			result.Scanned++
+			if err := expireFile(ctx, file, now); err != nil {
+				log.Printf("Failed to expire file %s/%s: %v", file.UserID, file.FileID, err)
+				result.Failed++
+				continue
+			}
+			result.Expired++
+		}
+	}
+
+	if staleUploadAge > 0 {
+		if err := abortStaleUploads(ctx, now.Add(-staleUploadAge), &result); err != nil {
+			log.Printf("Stale upload query error: %v", err)
+			return result, err
+		}
+	}
+
+	log.Printf("Expiry run complete: scanned=%d expired=%d abortedUploads=%d failed=%d", result.Scanned, result.Expired, result.AbortedUploads, result.Failed)
+	return result, nil
+}
+
+// abortStaleUploads aborts the multipart uploads created before cutoff that
+// were never completed, freeing their parts, and removes their files
+func abortStaleUploads(ctx context.Context, cutoff time.Time, result *ExpireResult) error {
+	paginator := dynamodb.NewQueryPaginator(dynamoClient, &dynamodb.QueryInput{
+		TableName:              aws.String(userFilesTable),
+		IndexName:              aws.String(statusCreatedIndex),
+		KeyConditionExpression: aws.String("#status = :status AND createdAt < :cutoff"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: common.StatusMultipartPending},
+			":cutoff": &types.AttributeValueMemberS{Value: cutoff.Format(time.RFC3339)},
+		},
+		Limit: aws.Int32(scanPageSize),
+	})
+	for paginator.HasMorePages() {
+		opCtx, cancel := common.WithDeadline(ctx)
+		page, err := paginator.NextPage(opCtx)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		var files []common.File
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &files); err != nil {
+			return err
+		}
+
+		for i := range files {
+			file := &files[i]
+			err := common.AbortFileUpload(ctx, s3Client, dynamoClient, bucketName, userFilesTable, file)
+			if errors.Is(err, common.ErrUploadChanged) {
+				log.Printf("Upload of %s/%s completed or aborted meanwhile, skipping", file.UserID, file.FileID)
+				continue
+			}
+			if err != nil {
+				log.Printf("Failed to abort stale upload of %s/%s: %v", file.UserID, file.FileID, err)
+				result.Failed++
+				continue
+			}
+			result.AbortedUploads++
+			auditLog.Write(ctx, file.UserID, file.FileID, "upload_abort", map[string]interface{}{
+				"fileName":        file.FileName,
+				"s3Key":           file.S3Key,
+				"reason":          "stale",
+				"parts":           file.MultipartParts,
+				"uploadStartedAt": file.UploadStartedAt,
+			})
+		}
+	}
+	return nil
+}
+
+// expireFile deletes the S3 object and soft-deletes the metadata of an expired file
+func expireFile(ctx context.Context, file common.File, now time.Time) error {
+	// Delete file from S3
+	opCtx, cancel := common.WithDeadline(ctx)
+	_, err := s3Client.DeleteObject(opCtx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(file.S3Key),
+	})
+	cancel()
+	if err != nil {
+		log.Printf("S3 delete error: %v", err)
+		// Continue with DynamoDB update even if S3 delete fails
+	}
+
+	// Soft delete, guarded so a file whose expiry was extended meanwhile is kept
+	timestamp := now.Format(time.RFC3339)
+	opCtx, cancel = common.WithDeadline(ctx)
+	_, err = dynamoClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: file.UserID},
+			"fileId": &types.AttributeValueMemberS{Value: file.FileID},
+		},
+		UpdateExpression:    aws.String("SET previousStatus = #status, #status = :deleted, deletedAt = :deletedAt, updatedAt = :updatedAt"),
+		ConditionExpression: aws.String("expiryEpoch <= :now AND #status <> :deleted AND " + common.NoLegalHoldCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":deleted":   &types.AttributeValueMemberS{Value: "deleted"},
+			":deletedAt": &types.AttributeValueMemberS{Value: timestamp},
+			":updatedAt": &types.AttributeValueMemberS{Value: timestamp},
+			":now":       &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	})
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			log.Printf("File %s/%s no longer expired or under legal hold, skipping", file.UserID, file.FileID)
+			return nil
+		}
+		return err
+	}
+
+	auditLog.Write(ctx, file.UserID, file.FileID, "delete", map[string]interface{}{
+		"fileName":  file.FileName,
+		"s3Key":     file.S3Key,
+		"reason":    "expired",
+		"expiresAt": file.ExpiresAt,
+	})
+
+	return nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
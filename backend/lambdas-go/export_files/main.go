@@ -0,0 +1,704 @@
+// Package main implements the export_files Lambda function
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName     = "660348065850-file-bucket"
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	exportPrefix   = "exports"
+	queryPageSize  = 500
+	presignExpiry  = 900 // 15 minutes
+	// abortReserve is kept back from the Lambda deadline when exporting, so
+	// an export that runs out of time can still abort its upload and answer
+	abortReserve = 5 * time.Second
+	// maxReportEntries bounds how much of a file's trail a report holds in memory
+	maxReportEntries = 10000
+)
+
+// Values of ?type=, what is exported
+const (
+	exportTypeFiles  = "files"
+	exportTypeAudit  = "audit"
+	exportTypeReport = "report"
+)
+
+// contentTypes maps each export format to the Content-Type of its object
+var contentTypes = map[string]string{
+	"csv":    "text/csv",
+	"json":   "application/json",
+	"ndjson": "application/x-ndjson",
+}
+
+// reportContentTypes maps each report format to the Content-Type of its object
+var reportContentTypes = map[string]string{
+	"html": "text/html; charset=utf-8",
+	"json": "application/json",
+}
+
+// reportSigningKey signs reports with HMAC-SHA256 when set, so a recipient
+// holding the key can tell a report came from this service unaltered
+var reportSigningKey = os.Getenv("REPORT_SIGNING_KEY")
+
+// fileColumns lists the exported file columns in order
+var fileColumns = []string{"fileId", "fileName", "contentType", "fileSize", "status", "createdAt", "updatedAt", "expiresAt"}
+
+// auditColumns lists the exported audit columns in order; metadata is a JSON object
+var auditColumns = []string{"timestamp", "userId", "fileId", "action", "ipAddress", "metadata"}
+
+// FileItem represents an exported file record
+type FileItem struct {
+	FileID      string `dynamodbav:"fileId" json:"fileId"`
+	FileName    string `dynamodbav:"fileName" json:"fileName"`
+	ContentType string `dynamodbav:"contentType" json:"contentType"`
+	FileSize    int64  `dynamodbav:"fileSize" json:"fileSize"`
+	Status      string `dynamodbav:"status" json:"status"`
+	CreatedAt   string `dynamodbav:"createdAt" json:"createdAt"`
+	UpdatedAt   string `dynamodbav:"updatedAt" json:"updatedAt,omitempty"`
+	ExpiresAt   string `dynamodbav:"expiresAt" json:"expiresAt,omitempty"`
+}
+
+// csvRecord returns the file's values in fileColumns order
+func (f FileItem) csvRecord() ([]string, error) {
+	return []string{
+		f.FileID,
+		f.FileName,
+		f.ContentType,
+		strconv.FormatInt(f.FileSize, 10),
+		f.Status,
+		f.CreatedAt,
+		f.UpdatedAt,
+		f.ExpiresAt,
+	}, nil
+}
+
+// AuditRow represents an exported audit entry
+type AuditRow struct {
+	Timestamp string                 `dynamodbav:"timestamp" json:"timestamp"`
+	UserID    string                 `dynamodbav:"userId" json:"userId"`
+	FileID    string                 `dynamodbav:"fileId" json:"fileId"`
+	Action    string                 `dynamodbav:"action" json:"action"`
+	IPAddress string                 `dynamodbav:"ipAddress" json:"ipAddress,omitempty"`
+	Metadata  map[string]interface{} `dynamodbav:"metadata" json:"metadata,omitempty"`
+}
+
+// csvRecord returns the entry's values in auditColumns order
+func (a AuditRow) csvRecord() ([]string, error) {
+	metadata, err := json.Marshal(a.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return []string{a.Timestamp, a.UserID, a.FileID, a.Action, a.IPAddress, string(metadata)}, nil
+}
+
+// ExportResponse represents the response body
+type ExportResponse struct {
+	PresignedURL string `json:"presignedUrl"`
+	S3Key        string `json:"s3Key"`
+	Format       string `json:"format"`
+	Type         string `json:"type"`
+	// FileCount is set for file exports, EntryCount for audit exports
+	FileCount  int   `json:"fileCount,omitempty"`
+	EntryCount int   `json:"entryCount,omitempty"`
+	Bytes      int64 `json:"bytes"`
+	ExpiresIn  int   `json:"expiresIn"`
+	// FileID, SHA256 and Signature are only set for reports
+	FileID    string `json:"fileId,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// AuditReport is one file's audit trail as a report export writes it
+type AuditReport struct {
+	GeneratedAt string `json:"generatedAt"`
+	GeneratedBy string `json:"generatedBy"`
+	// File is the file as its owner sees it in get_files
+	File    common.File   `json:"file"`
+	Entries []ReportEntry `json:"entries"`
+	// Truncated is set when the trail had more than maxReportEntries entries;
+	// the report then holds the oldest ones
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ReportEntry is one event in an AuditReport
+type ReportEntry struct {
+	AuditRow
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+// exportRow is one exported record: a FileItem or an AuditRow
+type exportRow interface {
+	csvRecord() ([]string, error)
+}
+
+// rowWriter writes exported rows one at a time
+type rowWriter interface {
+	WriteRow(row exportRow) error
+	Close() error
+}
+
+var (
+	s3Client        *s3.Client
+	s3PresignClient *s3.PresignClient
+	dynamoClient    *dynamodb.Client
+	auditLog        *common.AuditLogger
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	s3Client = s3.NewFromConfig(cfg)
+	s3PresignClient = s3.NewPresignClient(s3Client)
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleExport)
+
+// handleExport handles an authenticated request
+func handleExport(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// A report covers one file and has formats of its own
+	if request.QueryStringParameters["type"] == exportTypeReport {
+		return handleReport(ctx, userID, request.QueryStringParameters)
+	}
+
+	format := request.QueryStringParameters["format"]
+	if format == "" {
+		format = "csv"
+	}
+	contentType, ok := contentTypes[format]
+	if !ok {
+		return common.Fail(common.Validation("Invalid format: must be 'csv', 'json' or 'ndjson'"))
+	}
+
+	exportType := request.QueryStringParameters["type"]
+	if exportType == "" {
+		exportType = exportTypeFiles
+	}
+	if exportType != exportTypeFiles && exportType != exportTypeAudit {
+		return common.Fail(common.Validation("Invalid type: must be 'files', 'audit' or 'report'"))
+	}
+
+	// Exports land under a per-user prefix that the bucket lifecycle rule expires
+	now := time.Now().UTC()
+	s3Key := fmt.Sprintf("%s/%s/%s-%s.%s", exportPrefix, userID, exportType, now.Format("20060102T150405Z"), format)
+
+	// Stream rows straight into a multipart upload so memory stays bounded.
+	// Paging stops early enough to abort the upload if time runs out.
+	exportCtx, cancel := exportContext(ctx)
+	defer cancel()
+	upload := common.NewMultipartWriter(exportCtx, s3Client, bucketName, s3Key, contentType)
+	columns := fileColumns
+	if exportType == exportTypeAudit {
+		columns = auditColumns
+	}
+	var rows rowWriter
+	switch format {
+	case "json":
+		rows = newJSONRowWriter(upload)
+	case "ndjson":
+		rows = newNDJSONRowWriter(upload)
+	default:
+		rows = newCSVRowWriter(upload, columns)
+	}
+
+	var count int
+	var err error
+	if exportType == exportTypeAudit {
+		count, err = exportAudit(exportCtx, userID, rows)
+	} else {
+		count, err = exportFiles(exportCtx, userID, rows)
+	}
+	if err == nil {
+		err = rows.Close()
+	}
+	if err == nil {
+		err = upload.Close()
+	}
+	if err != nil {
+		if abortErr := upload.Abort(); abortErr != nil {
+			log.Printf("Export abort error: %v", abortErr)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.Printf("Export ran out of time after %d rows, %d bytes", count, upload.Written())
+		}
+		return common.Fail(common.Internal("Export error", err))
+	}
+
+	// Create presigned URL for download
+	presignReq, err := s3PresignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:                     aws.String(bucketName),
+		Key:                        aws.String(s3Key),
+		ResponseContentDisposition: aws.String(fmt.Sprintf(`attachment; filename="%s.%s"`, exportType, format)),
+	}, s3.WithPresignExpires(time.Duration(presignExpiry)*time.Second))
+	if err != nil {
+		return common.Fail(common.Internal("Presign error", err))
+	}
+
+	response := ExportResponse{
+		PresignedURL: presignReq.URL,
+		S3Key:        s3Key,
+		Format:       format,
+		Type:         exportType,
+		Bytes:        upload.Written(),
+		ExpiresIn:    presignExpiry,
+	}
+	metadata := map[string]interface{}{
+		"s3Key":  s3Key,
+		"format": format,
+		"type":   exportType,
+		"bytes":  upload.Written(),
+	}
+	if exportType == exportTypeAudit {
+		response.EntryCount = count
+		metadata["entryCount"] = count
+	} else {
+		response.FileCount = count
+		metadata["fileCount"] = count
+	}
+
+	// Log audit event; an export covers every file, so it is not tied to one fileId
+	auditLog.Log(ctx, userID, "*", "export", metadata)
+
+	return common.BuildResponse(200, response), nil
+}
+
+// handleReport writes the audit trail of one of the caller's files, trash
+// included, as a report for compliance: the file's metadata followed by every
+// event, oldest first. The response carries the report's SHA-256 and, with
+// REPORT_SIGNING_KEY, its HMAC signature; the digest is also kept in the
+// export audit entry, so a report can later be checked against the trail.
+func handleReport(ctx context.Context, userID string, query map[string]string) (events.APIGatewayProxyResponse, error) {
+	fileID := query["fileId"]
+	if fileID == "" {
+		return common.Fail(common.Validation("fileId is required for type=report"))
+	}
+	format := query["format"]
+	if format == "" {
+		format = "html"
+	}
+	contentType, ok := reportContentTypes[format]
+	if !ok {
+		return common.Fail(common.Validation("Invalid format for type=report: must be 'html' or 'json'"))
+	}
+
+	file, err := common.GetOwnedFile(ctx, dynamoClient, userFilesTable, userID, fileID, false)
+	switch {
+	case errors.Is(err, common.ErrNotFound):
+		return common.Fail(common.NotFound("File not found"))
+	case err != nil && !errors.Is(err, common.ErrDeleted):
+		return common.Fail(common.Internal("DynamoDB get error", err))
+	}
+
+	exportCtx, cancel := exportContext(ctx)
+	defer cancel()
+	entries, truncated, err := fileAuditTrail(exportCtx, userID, fileID)
+	if err != nil {
+		return common.Fail(common.Internal("DynamoDB query error", err))
+	}
+
+	// The owner sees what get_files shows them, not where the object is stored
+	// or who placed a legal hold and why
+	header := *file
+	header.UserID, header.S3Key = "", ""
+	header.LegalHoldBy, header.LegalHoldReason = "", ""
+	header.Category = common.FileCategory(header.ContentType)
+
+	now := time.Now().UTC()
+	report := AuditReport{
+		GeneratedAt: now.Format(time.RFC3339),
+		GeneratedBy: userID,
+		File:        header,
+		Entries:     entries,
+		Truncated:   truncated,
+	}
+
+	s3Key := fmt.Sprintf("%s/%s/report-%s-%s.%s", exportPrefix, userID, fileID, now.Format("20060102T150405Z"), format)
+	upload := common.NewMultipartWriter(exportCtx, s3Client, bucketName, s3Key, contentType)
+	digest := sha256.New()
+	err = writeReport(io.MultiWriter(upload, digest), &report, format)
+	if err == nil {
+		err = upload.Close()
+	}
+	if err != nil {
+		if abortErr := upload.Abort(); abortErr != nil {
+			log.Printf("Report abort error: %v", abortErr)
+		}
+		return common.Fail(common.Internal("Report error", err))
+	}
+	sum := hex.EncodeToString(digest.Sum(nil))
+
+	presignReq, err := s3PresignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket:                     aws.String(bucketName),
+		Key:                        aws.String(s3Key),
+		ResponseContentDisposition: aws.String(fmt.Sprintf(`attachment; filename="report-%s.%s"`, fileID, format)),
+	}, s3.WithPresignExpires(time.Duration(presignExpiry)*time.Second))
+	if err != nil {
+		return common.Fail(common.Internal("Presign error", err))
+	}
+
+	response := ExportResponse{
+		PresignedURL: presignReq.URL,
+		S3Key:        s3Key,
+		Format:       format,
+		Type:         exportTypeReport,
+		EntryCount:   len(entries),
+		Bytes:        upload.Written(),
+		ExpiresIn:    presignExpiry,
+		FileID:       fileID,
+		SHA256:       sum,
+		Signature:    signReport(sum),
+	}
+
+	auditLog.Log(ctx, userID, fileID, "export", map[string]interface{}{
+		"s3Key":      s3Key,
+		"format":     format,
+		"type":       exportTypeReport,
+		"bytes":      upload.Written(),
+		"entryCount": len(entries),
+		"sha256":     sum,
+	})
+
+	return common.BuildResponse(200, response), nil
+}
+
+// fileAuditTrail reads fileID's entries from the user's audit trail, oldest
+// first. It stops after maxReportEntries and then reports truncated.
+func fileAuditTrail(ctx context.Context, userID, fileID string) ([]ReportEntry, bool, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(fileAuditTable),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		FilterExpression:       aws.String("#fileId = :fileId"),
+		ExpressionAttributeNames: map[string]string{
+			"#fileId": "fileId",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: userID},
+			":fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
+		Limit: aws.Int32(queryPageSize),
+	}
+
+	entries := []ReportEntry{}
+	paginator := dynamodb.NewQueryPaginator(dynamoClient, input)
+	for paginator.HasMorePages() {
+		opCtx, cancel := common.WithDeadline(ctx)
+		page, err := paginator.NextPage(opCtx)
+		cancel()
+		if err != nil {
+			return nil, false, fmt.Errorf("query page: %w", err)
+		}
+
+		var rows []AuditRow
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &rows); err != nil {
+			return nil, false, fmt.Errorf("unmarshal page: %w", err)
+		}
+		for _, row := range rows {
+			if len(entries) == maxReportEntries {
+				return entries, true, nil
+			}
+			entries = append(entries, reportEntry(row))
+		}
+	}
+	return entries, false, nil
+}
+
+// reportEntry pulls the caller details out of an entry's metadata. Entries
+// written before ipAddress was a top-level attribute only have the metadata
+// copy.
+func reportEntry(row AuditRow) ReportEntry {
+	entry := ReportEntry{AuditRow: row}
+	if entry.IPAddress == "" {
+		entry.IPAddress, _ = row.Metadata["ipAddress"].(string)
+	}
+	entry.UserAgent, _ = row.Metadata["userAgent"].(string)
+	return entry
+}
+
+// writeReport renders report as format, "html" or "json"
+func writeReport(w io.Writer, report *AuditReport, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	return reportTemplate.Execute(w, report)
+}
+
+// signReport returns the hex HMAC-SHA256 of a report's hex digest under
+// REPORT_SIGNING_KEY, or "" when no key is configured
+func signReport(sum string) string {
+	if reportSigningKey == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(reportSigningKey))
+	mac.Write([]byte(sum))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// reportTemplate renders an AuditReport as a standalone page that prints
+// cleanly, so it can be saved as PDF from any browser
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Audit report: {{.File.FileName}}</title>
+<style>
+body { font-family: sans-serif; font-size: 12px; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ccc; padding: 4px 6px; text-align: left; vertical-align: top; }
+th { background: #f0f0f0; }
+dl { display: grid; grid-template-columns: max-content auto; gap: 2px 12px; }
+dt { font-weight: bold; }
+dd { margin: 0; }
+</style>
+</head>
+<body>
+<h1>Audit report</h1>
+<p>Generated {{.GeneratedAt}} by {{.GeneratedBy}}</p>
+<h2>File</h2>
+<dl>
+<dt>File ID</dt><dd>{{.File.FileID}}</dd>
+<dt>Name</dt><dd>{{.File.FileName}}</dd>
+{{with .File.Folder}}<dt>Folder</dt><dd>{{.}}</dd>
+{{end}}<dt>Content type</dt><dd>{{.File.ContentType}}</dd>
+<dt>Size</dt><dd>{{.File.FileSize}} bytes</dd>
+<dt>Status</dt><dd>{{.File.Status}}</dd>
+<dt>Created</dt><dd>{{.File.CreatedAt}}</dd>
+{{with .File.UpdatedAt}}<dt>Updated</dt><dd>{{.}}</dd>
+{{end}}{{with .File.DeletedAt}}<dt>Deleted</dt><dd>{{.}}</dd>
+{{end}}{{with .File.ChecksumSHA256}}<dt>SHA-256</dt><dd>{{.}}</dd>
+{{end}}{{if .File.LegalHold}}<dt>Legal hold</dt><dd>since {{.File.LegalHoldAt}}</dd>
+{{end}}</dl>
+<h2>Events ({{len .Entries}})</h2>
+{{if .Truncated}}<p>The trail is longer than this report; only the oldest events are listed.</p>
+{{end}}<table>
+<thead><tr><th>Time (UTC)</th><th>Action</th><th>User</th><th>IP address</th><th>User agent</th><th>Details</th></tr></thead>
+<tbody>
+{{range .Entries}}<tr><td>{{.Timestamp}}</td><td>{{.Action}}</td><td>{{.UserID}}</td><td>{{.IPAddress}}</td><td>{{.UserAgent}}</td><td>{{range $key, $value := .Metadata}}{{$key}}: {{$value}}<br>{{end}}</td></tr>
+{{end}}</tbody>
+</table>
+</body>
+</html>
+`))
+
+// exportContext derives the context an export runs under: it ends
+// abortReserve before the Lambda deadline, if there is one
+func exportContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(ctx, deadline.Add(-abortReserve))
+	}
+	return context.WithCancel(ctx)
+}
+
+// exportFiles pages through the user's whole partition, writing each file as
+// it is read, and returns the number of files written
+func exportFiles(ctx context.Context, userID string, rows rowWriter) (int, error) {
+	return exportPartition(ctx, userFilesTable, userID, rows, func(items []map[string]types.AttributeValue) ([]exportRow, error) {
+		var files []FileItem
+		if err := attributevalue.UnmarshalListOfMaps(items, &files); err != nil {
+			return nil, err
+		}
+		page := make([]exportRow, len(files))
+		for i, file := range files {
+			page[i] = file
+		}
+		return page, nil
+	})
+}
+
+// exportAudit pages through the user's audit trail, oldest entry first, and
+// returns the number of entries written
+func exportAudit(ctx context.Context, userID string, rows rowWriter) (int, error) {
+	return exportPartition(ctx, fileAuditTable, userID, rows, func(items []map[string]types.AttributeValue) ([]exportRow, error) {
+		var entries []AuditRow
+		if err := attributevalue.UnmarshalListOfMaps(items, &entries); err != nil {
+			return nil, err
+		}
+		page := make([]exportRow, len(entries))
+		for i, entry := range entries {
+			page[i] = entry
+		}
+		return page, nil
+	})
+}
+
+// exportPartition walks userID's partition of table in sort key order,
+// writing each page's rows as soon as it is read
+func exportPartition(ctx context.Context, table, userID string, rows rowWriter, decode func([]map[string]types.AttributeValue) ([]exportRow, error)) (int, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: userID},
+		},
+		Limit: aws.Int32(queryPageSize),
+	}
+
+	count := 0
+	paginator := dynamodb.NewQueryPaginator(dynamoClient, input)
+	for paginator.HasMorePages() {
+		opCtx, cancel := common.WithDeadline(ctx)
+		page, err := paginator.NextPage(opCtx)
+		cancel()
+		if err != nil {
+			return count, fmt.Errorf("query page: %w", err)
+		}
+
+		decoded, err := decode(page.Items)
+		if err != nil {
+			return count, fmt.Errorf("unmarshal page: %w", err)
+		}
+
+		for _, row := range decoded {
+			if err := rows.WriteRow(row); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// csvRowWriter writes rows as CSV with a header line
+type csvRowWriter struct {
+	w           *csv.Writer
+	header      []string
+	wroteHeader bool
+}
+
+func newCSVRowWriter(w io.Writer, header []string) *csvRowWriter {
+	return &csvRowWriter{w: csv.NewWriter(w), header: header}
+}
+
+func (c *csvRowWriter) WriteRow(row exportRow) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	record, err := row.csvRecord()
+	if err != nil {
+		return err
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvRowWriter) Close() error {
+	// An empty account still gets a header
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvRowWriter) writeHeader() error {
+	if c.wroteHeader {
+		return nil
+	}
+	c.wroteHeader = true
+	return c.w.Write(c.header)
+}
+
+// jsonRowWriter writes rows as a JSON array, one element at a time
+type jsonRowWriter struct {
+	w     io.Writer
+	count int
+}
+
+func newJSONRowWriter(w io.Writer) *jsonRowWriter {
+	return &jsonRowWriter{w: w}
+}
+
+func (j *jsonRowWriter) WriteRow(row exportRow) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	sep := ",\n"
+	if j.count == 0 {
+		sep = "[\n"
+	}
+	j.count++
+	if _, err := io.WriteString(j.w, sep); err != nil {
+		return err
+	}
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonRowWriter) Close() error {
+	closing := "\n]\n"
+	if j.count == 0 {
+		closing = "[]\n"
+	}
+	_, err := io.WriteString(j.w, closing)
+	return err
+}
+
+// ndjsonRowWriter writes one JSON object per line, the format log pipelines
+// such as OpenSearch ingest directly
+type ndjsonRowWriter struct {
+	w io.Writer
+}
+
+func newNDJSONRowWriter(w io.Writer) *ndjsonRowWriter {
+	return &ndjsonRowWriter{w: w}
+}
+
+func (n *ndjsonRowWriter) WriteRow(row exportRow) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	_, err = n.w.Write(append(data, '\n'))
+	return err
+}
+
+// Close writes nothing; an empty export is an empty object
+func (n *ndjsonRowWriter) Close() error {
+	return nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+func TestNDJSONRowWriter(t *testing.T) {
+	var buf bytes.Buffer
+	rows := newNDJSONRowWriter(&buf)
+	entries := []AuditRow{
+		{Timestamp: "2024-03-10T09:30:00Z", UserID: "user-123", FileID: "f1", Action: "upload", Metadata: map[string]interface{}{"fileName": "a.txt"}},
+		{Timestamp: "2024-03-10T09:31:00Z", UserID: "user-123", FileID: "f1", Action: "download", IPAddress: "203.0.113.42"},
+	}
+	for _, entry := range entries {
+		if err := rows.WriteRow(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(entries) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(entries), buf.String())
+	}
+	for i, line := range lines {
+		var got AuditRow
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %d is not JSON: %v", i, err)
+		}
+		if got.Action != entries[i].Action || got.Timestamp != entries[i].Timestamp {
+			t.Errorf("line %d = %+v, want %+v", i, got, entries[i])
+		}
+	}
+}
+
+func TestCSVRowWriterAudit(t *testing.T) {
+	var buf bytes.Buffer
+	rows := newCSVRowWriter(&buf, auditColumns)
+	entry := AuditRow{Timestamp: "2024-03-10T09:30:00Z", UserID: "user-123", FileID: "f1", Action: "upload", Metadata: map[string]interface{}{"fileName": "a,b.txt"}}
+	if err := rows.WriteRow(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "timestamp,userId,fileId,action,ipAddress,metadata\n" +
+		`2024-03-10T09:30:00Z,user-123,f1,upload,,"{""fileName"":""a,b.txt""}"` + "\n"
+	if buf.String() != want {
+		t.Errorf("csv =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestCSVRowWriterEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	rows := newCSVRowWriter(&buf, fileColumns)
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(fileColumns, ",") + "\n"; buf.String() != want {
+		t.Errorf("csv = %q, want only the header %q", buf.String(), want)
+	}
+}
+
+func TestWriteReportHTML(t *testing.T) {
+	report := AuditReport{
+		GeneratedAt: "2024-03-11T08:00:00Z",
+		GeneratedBy: "user-123",
+		File:        common.File{FileID: "f1", FileName: "<b>q1</b>.pdf", Status: "uploaded"},
+		Entries: []ReportEntry{
+			reportEntry(AuditRow{Timestamp: "2024-03-10T09:30:00Z", UserID: "user-123", FileID: "f1", Action: "download", Metadata: map[string]interface{}{"ipAddress": "203.0.113.42", "userAgent": "curl/8.0"}}),
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeReport(&buf, &report, "html"); err != nil {
+		t.Fatal(err)
+	}
+	html := buf.String()
+	if strings.Contains(html, "<b>q1</b>") || !strings.Contains(html, "&lt;b&gt;q1&lt;/b&gt;.pdf") {
+		t.Errorf("file name is not escaped:\n%s", html)
+	}
+	for _, want := range []string{"Events (1)", "203.0.113.42", "curl/8.0"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("report is missing %q:\n%s", want, html)
+		}
+	}
+}
+
+func TestReportEntryKeepsTopLevelIP(t *testing.T) {
+	entry := reportEntry(AuditRow{IPAddress: "198.51.100.7", Metadata: map[string]interface{}{"ipAddress": "203.0.113.42"}})
+	if entry.IPAddress != "198.51.100.7" {
+		t.Errorf("IPAddress = %q, want the top-level 198.51.100.7", entry.IPAddress)
+	}
+}
+
+func TestSignReport(t *testing.T) {
+	defer func(key string) { reportSigningKey = key }(reportSigningKey)
+
+	reportSigningKey = ""
+	if got := signReport("abc"); got != "" {
+		t.Errorf("signReport without a key = %q, want empty", got)
+	}
+
+	reportSigningKey = "secret"
+	first, second := signReport("abc"), signReport("abd")
+	if len(first) != 64 || first == second {
+		t.Errorf("signReport = %q and %q, want distinct hex HMACs", first, second)
+	}
+}
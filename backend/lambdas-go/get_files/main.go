@@ -3,10 +3,13 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -23,18 +26,119 @@ const (
 	userFilesTable  = "UserFiles"
 	defaultPageSize = 20
 	maxPageSize     = 100
+	// maxFilteredPages bounds how many pages are read to fill one
+	maxFilteredPages = 5
+	// maxTagFilters bounds the tag query parameters of one request
+	maxTagFilters = 10
+	// maxContentTypeFilters bounds the contentType values of one request
+	maxContentTypeFilters = 10
+	// maxNameContainsLen bounds nameContains, like a file name
+	maxNameContainsLen = 255
+	// pinnedIndex is the sparse GSI (userId, pinnedAt) holding only pinned
+	// files; set_pinned keeps at most 50 of them per user
+	pinnedIndex = "PinnedIndex"
+	// pinnedFirstKey marks nextTokens issued with pinnedFirst=true
+	pinnedFirstKey = "pinnedFirst"
+	// syncedAtKey carries a delta listing's syncedAt in its nextTokens
+	syncedAtKey = "syncedAt"
+	// sortKey and sortOffsetKey carry a sorted listing's order and position
+	// in its nextTokens
+	sortKey       = "sort"
+	sortOffsetKey = "sortOffset"
+	// maxSortedFiles caps how many matching files a sorted listing reads and
+	// sorts in memory; beyond it the listing is marked truncated
+	maxSortedFiles = 1000
+	// maxSortScanPages bounds the Query pages read for one sorted listing,
+	// since filters may discard most of a large partition
+	maxSortScanPages = 50
+	// syncSkew is subtracted from the start of a delta listing to get its
+	// syncedAt. Writers stamp updatedAt before their write lands, so a change
+	// stamped just before the listing started may not be visible to it yet.
+	syncSkew = time.Minute
 )
 
-// FileItem represents a file record from DynamoDB
+const (
+	// statusActive lists every file that is not in trash
+	statusActive = "active"
+	// statusAll lists every file regardless of status
+	statusAll = "all"
+)
+
+// listConflicts are the parameter combinations get_files refuses with 400.
+// A delta listing has to report files that stopped matching a filter, so
+// since takes no other filter.
+var listConflicts = []common.ParamConflict{
+	{Params: []string{"since", "status"}, Reason: "since lists files of every status, trash included"},
+	{Params: []string{"since", "tag"}, Reason: "since can't be filtered by tag"},
+	{Params: []string{"since", "pinnedFirst"}, Reason: "since lists changes in one order, without pinned files first"},
+	{Params: []string{"since", "contentType"}, Reason: "since can't be filtered by contentType"},
+	{Params: []string{"since", "nameContains"}, Reason: "since can't be filtered by name"},
+	{Params: []string{"since", "createdAfter"}, Reason: "since can't be filtered by creation date"},
+	{Params: []string{"since", "createdBefore"}, Reason: "since can't be filtered by creation date"},
+	{Params: []string{"since", "sort"}, Reason: "since lists changes in one order"},
+}
+
+// sortFields compare two files by the attribute a sort value names, ascending
+var sortFields = map[string]func(a, b *common.File) int{
+	"createdAt": func(a, b *common.File) int { return strings.Compare(a.CreatedAt, b.CreatedAt) },
+	"name": func(a, b *common.File) int {
+		return strings.Compare(strings.ToLower(a.FileName), strings.ToLower(b.FileName))
+	},
+	"size": func(a, b *common.File) int {
+		switch {
+		case a.FileSize < b.FileSize:
+			return -1
+		case a.FileSize > b.FileSize:
+			return 1
+		}
+		return 0
+	},
+}
+
+// errTokenMode is returned by decodeListToken for a token issued with
+// another pinnedFirst, since or sort
+var errTokenMode = errors.New("nextToken issued in another listing mode")
+
+// validStatuses are the accepted values of the status query parameter. Any
+// value other than active, all and uploaded (which includes confirmed files)
+// matches the stored status exactly.
+var validStatuses = map[string]bool{
+	statusActive: true,
+	"pending":    true,
+	"uploaded":   true,
+	"confirmed":  true,
+	"deleted":    true,
+	"rejected":   true,
+	// set by verify_batch
+	"size_mismatch": true,
+	"corrupt":       true,
+	// started by upload_file, finished by complete_upload
+	common.StatusMultipartPending: true,
+	statusAll:                     true,
+}
+
+// fileSearch holds the search parameters of a listing. Like status and tag
+// they become FilterExpressions: the only key condition is userId, since the
+// sort key is the random fileId.
+type fileSearch struct {
+	// contentTypes match exactly, or by prefix for "type/*" entries
+	contentTypes []string
+	// nameContains is a case-sensitive substring of fileName
+	nameContains string
+	// createdAfter and createdBefore bound createdAt, both exclusive
+	createdAfter  string
+	createdBefore string
+}
+
+// FileItem is a file as get_files lists it, with what the caller may do
+// with it
 type FileItem struct {
-	UserID      string `dynamodbav:"userId" json:"userId,omitempty"`
-	FileID      string `dynamodbav:"fileId" json:"fileId"`
-	FileName    string `dynamodbav:"fileName" json:"fileName"`
-	ContentType string `dynamodbav:"contentType" json:"contentType"`
-	FileSize    int64  `dynamodbav:"fileSize" json:"fileSize"`
-	Status      string `dynamodbav:"status" json:"status"`
-	CreatedAt   string `dynamodbav:"createdAt" json:"createdAt"`
-	UpdatedAt   string `dynamodbav:"updatedAt" json:"updatedAt,omitempty"`
+	common.File
+	// Deleted is true for files in trash, so sync clients can remove them
+	Deleted bool `json:"deleted,omitempty"`
+	// AllowedActions is what the caller may do with the file, from its
+	// status, legal hold and the caller's groups
+	AllowedActions []string `json:"allowedActions"`
 }
 
 // ListFilesResponse represents the response body
@@ -42,109 +146,557 @@ type ListFilesResponse struct {
 	Files     []FileItem `json:"files"`
 	Count     int        `json:"count"`
 	NextToken *string    `json:"nextToken"`
+	// HasMore is true whenever nextToken is set, even if this page is empty
+	HasMore bool `json:"hasMore"`
+	// SyncedAt is set when listing with since: once the last page is read,
+	// it is the since of the next delta listing. Every page of one listing
+	// carries the same value.
+	SyncedAt string `json:"syncedAt,omitempty"`
+	// SortTruncated is set when more files matched than a sorted listing
+	// reads, so only the first maxSortedFiles found were sorted
+	SortTruncated bool `json:"sortTruncated,omitempty"`
 }
 
-var dynamoClient *dynamodb.Client
+var (
+	dynamoClient *dynamodb.Client
+	// queryClient runs the list queries; tests replace it
+	queryClient common.QueryAPI
+)
 
 func init() {
 	cfg, err := config.LoadDefaultConfig(context.Background())
 	if err != nil {
 		log.Fatalf("Failed to load AWS config: %v", err)
 	}
-	dynamoClient = dynamodb.NewFromConfig(cfg)
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	queryClient = dynamoClient
 }
 
 // Handler is the Lambda function handler
-func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Log authorizer context for debugging
-	log.Printf("Authorizer context: %+v", request.RequestContext.Authorizer)
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.HandleErrors,
+	common.CORS,
+	common.RequireUser,
+)(handleListFiles)
 
-	// Extract user ID
-	userID, err := common.ExtractUserID(request)
-	if err != nil {
-		log.Printf("Auth error: %v", err)
-		return common.BuildErrorResponse(401, "Unauthorized: userId not found"), nil
-	}
+// handleListFiles handles an authenticated request
+func handleListFiles(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
 
 	// Parse pagination parameters
 	limit := defaultPageSize
 	if limitStr := request.QueryStringParameters["limit"]; limitStr != "" {
-		if parsedLimit, err := strconv.Atoi(limitStr); err == nil {
-			limit = parsedLimit
+		parsedLimit, err := strconv.Atoi(limitStr)
+		if err != nil || parsedLimit < 1 {
+			return common.Fail(common.Validation("Invalid limit: must be a positive integer"))
 		}
+		limit = parsedLimit
 	}
 	if limit > maxPageSize {
 		limit = maxPageSize
 	}
 
+	// Parse status filter, defaulting to non-deleted files
+	status := request.QueryStringParameters["status"]
+	if status == "" {
+		status = statusActive
+	}
+	if !validStatuses[status] {
+		return common.Fail(common.Validation("Invalid status: must be one of active, pending, uploaded, confirmed, deleted, rejected, size_mismatch, corrupt, multipart_pending, all"))
+	}
+
+	// Parse tag filters: tag=key or tag=key:value, repeated or comma-separated.
+	// A file must match all of them.
+	tagFilters := common.QueryValues(request, "tag")
+	if len(tagFilters) > maxTagFilters {
+		return common.Fail(common.Validation(fmt.Sprintf("At most %d tag filters are allowed", maxTagFilters)))
+	}
+	for _, tag := range tagFilters {
+		if strings.HasPrefix(tag, ":") {
+			return common.Fail(common.Validation(fmt.Sprintf("Invalid tag filter '%s'", tag)))
+		}
+	}
+
+	// pinnedFirst lists pinned files ahead of the first page
+	pinnedFirst := false
+	if v := request.QueryStringParameters["pinnedFirst"]; v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return common.Fail(common.Validation("Invalid pinnedFirst: must be true or false"))
+		}
+		pinnedFirst = parsed
+	}
+
+	// since lists what changed from that time on, trashed files included,
+	// for delta sync. The other filters would hide files that stopped
+	// matching them, which clients need to hear about too.
+	var since string
+	if v := request.QueryStringParameters["since"]; v != "" {
+		parsed, err := parseSince(v)
+		if err != nil {
+			return common.Fail(common.Validation("Invalid since: must be an RFC 3339 timestamp"))
+		}
+		since = parsed
+		status = statusAll
+	}
+
+	// sort=field_dir orders the listing in memory instead of by key
+	sortBy := request.QueryStringParameters["sort"]
+	var compare func(a, b *common.File) int
+	if sortBy != "" {
+		compare = parseSort(sortBy)
+		if compare == nil {
+			return common.Fail(common.Validation("Invalid sort: must be one of createdAt_asc, createdAt_desc, name_asc, name_desc, size_asc, size_desc"))
+		}
+	}
+
+	search, errs := parseSearch(request)
+
+	// Refuse combinations that can't all be honoured instead of dropping one
+	common.CheckParamConflicts(errs, listConflicts, map[string]bool{
+		"since":         since != "",
+		"status":        request.QueryStringParameters["status"] != "",
+		"tag":           len(tagFilters) > 0,
+		"pinnedFirst":   pinnedFirst,
+		"contentType":   len(search.contentTypes) > 0,
+		"nameContains":  search.nameContains != "",
+		"createdAfter":  search.createdAfter != "",
+		"createdBefore": search.createdBefore != "",
+		"sort":          sortBy != "",
+	})
+	if errs.HasErrors() {
+		return common.Fail(errs)
+	}
+
 	// Parse next token for pagination
-	var exclusiveStartKey map[string]types.AttributeValue
-	if nextToken := request.QueryStringParameters["nextToken"]; nextToken != "" {
-		decoded, err := base64.StdEncoding.DecodeString(nextToken)
-		if err == nil {
-			var keyMap map[string]interface{}
-			if json.Unmarshal(decoded, &keyMap) == nil {
-				exclusiveStartKey, _ = attributevalue.MarshalMap(keyMap)
-			}
+	exclusiveStartKey, syncedAt, err := decodeListToken(request.QueryStringParameters["nextToken"], userID, pinnedFirst, since != "", sortBy)
+	if errors.Is(err, errTokenMode) {
+		errs.Add("nextToken", "nextToken was issued with a different pinnedFirst, since or sort; repeat them as in the request that returned it")
+		return common.Fail(errs)
+	}
+	if err != nil {
+		return common.Fail(common.Validation("Invalid nextToken"))
+	}
+	// A sorted listing's token holds an offset into the sorted files
+	offset := 0
+	if sortBy != "" && exclusiveStartKey != nil {
+		if offset, err = tokenOffset(exclusiveStartKey); err != nil {
+			return common.Fail(common.Validation("Invalid nextToken"))
 		}
 	}
+	if since != "" && syncedAt == "" {
+		syncedAt = time.Now().UTC().Add(-syncSkew).Format(time.RFC3339)
+	}
 
 	// Query DynamoDB
 	input := &dynamodb.QueryInput{
 		TableName:              aws.String(userFilesTable),
 		KeyConditionExpression: aws.String("userId = :userId"),
-		FilterExpression:       aws.String("#status <> :deleted"),
-		ExpressionAttributeNames: map[string]string{
-			"#status": "status",
-		},
 		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":userId":  &types.AttributeValueMemberS{Value: userID},
-			":deleted": &types.AttributeValueMemberS{Value: "deleted"},
+			":userId": &types.AttributeValueMemberS{Value: userID},
 		},
 		Limit:             aws.Int32(int32(limit)),
 		ExclusiveStartKey: exclusiveStartKey,
 		ScanIndexForward:  aws.Bool(false), // Most recent first
 	}
 
-	result, err := dynamoClient.Query(ctx, input)
-	if err != nil {
-		log.Printf("DynamoDB query error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+	// Filter by status; "all" lists every file including trash
+	var filters []string
+	names := map[string]string{}
+	switch status {
+	case statusActive:
+		filters = append(filters, "#status <> :deleted")
+		input.ExpressionAttributeValues[":deleted"] = &types.AttributeValueMemberS{Value: "deleted"}
+	case statusAll:
+	case common.StatusUploaded:
+		// Files confirmed through verify_batch's /confirm count as uploaded
+		filters = append(filters, "#status IN (:status, :confirmed)")
+		input.ExpressionAttributeValues[":status"] = &types.AttributeValueMemberS{Value: status}
+		input.ExpressionAttributeValues[":confirmed"] = &types.AttributeValueMemberS{Value: common.StatusConfirmed}
+	default:
+		filters = append(filters, "#status = :status")
+		input.ExpressionAttributeValues[":status"] = &types.AttributeValueMemberS{Value: status}
+	}
+	if len(filters) > 0 {
+		names["#status"] = "status"
+	}
+
+	// Filter by tags; names are placeholders since tag keys can contain any character
+	for i, tag := range tagFilters {
+		key, value, hasValue := strings.Cut(tag, ":")
+		keyName := fmt.Sprintf("#tag%d", i)
+		names["#tags"] = "tags"
+		names[keyName] = key
+		if hasValue {
+			valueName := fmt.Sprintf(":tag%d", i)
+			filters = append(filters, fmt.Sprintf("#tags.%s = %s", keyName, valueName))
+			input.ExpressionAttributeValues[valueName] = &types.AttributeValueMemberS{Value: value}
+		} else {
+			filters = append(filters, fmt.Sprintf("attribute_exists(#tags.%s)", keyName))
+		}
+	}
+
+	filters = append(filters, search.filters(input.ExpressionAttributeValues)...)
+
+	// Files written before updatedAt existed only have createdAt. Reads are
+	// strongly consistent so a change made before syncedAt can't be missed.
+	if since != "" {
+		filters = append(filters, "(updatedAt >= :since OR (attribute_not_exists(updatedAt) AND createdAt >= :since))")
+		input.ExpressionAttributeValues[":since"] = &types.AttributeValueMemberS{Value: since}
+		input.ConsistentRead = aws.Bool(true)
+	}
+
+	// Pinned files come from the index on the first page and are left out
+	// of the regular pages, so each file is listed once
+	var items []map[string]types.AttributeValue
+	if pinnedFirst && exclusiveStartKey == nil {
+		items, err = queryPinned(ctx, userID, filters, names, input.ExpressionAttributeValues)
+		if err != nil {
+			return common.Fail(common.Internal("DynamoDB query error", err))
+		}
+	}
+	if pinnedFirst {
+		filters = append(filters, "attribute_not_exists(pinnedAt)")
+	}
+
+	if len(filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+		if len(names) > 0 {
+			input.ExpressionAttributeNames = names
+		}
+	}
+
+	// Keep reading until the page is full, so filters that match few files
+	// still return limit of them; the token resumes after the last one.
+	// Sorted listings read every match instead and page through them by
+	// offset, re-reading the partition for each page.
+	var lastKey map[string]types.AttributeValue
+	sortTruncated := false
+	if compare != nil {
+		var sorted []map[string]types.AttributeValue
+		sorted, sortTruncated, err = querySorted(ctx, input, compare)
+		if err != nil {
+			return common.Fail(common.Internal("DynamoDB query error", err))
+		}
+		offset = min(offset, len(sorted))
+		end := min(offset+limit, len(sorted))
+		items = append(items, sorted[offset:end]...)
+		if end < len(sorted) {
+			lastKey = map[string]types.AttributeValue{
+				"userId":      &types.AttributeValueMemberS{Value: userID},
+				sortOffsetKey: &types.AttributeValueMemberN{Value: strconv.Itoa(end)},
+			}
+		}
+	} else {
+		var page []map[string]types.AttributeValue
+		page, lastKey, err = common.QueryFill(ctx, queryClient, input, limit, maxFilteredPages, "userId", "fileId")
+		if err != nil {
+			return common.Fail(common.Internal("DynamoDB query error", err))
+		}
+		items = append(items, page...)
 	}
 
 	// Unmarshal items
-	var files []FileItem
-	if err := attributevalue.UnmarshalListOfMaps(result.Items, &files); err != nil {
-		log.Printf("Unmarshal error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+	var rows []common.File
+	if err := attributevalue.UnmarshalListOfMaps(items, &rows); err != nil {
+		return common.Fail(common.Internal("Unmarshal error", err))
 	}
 
-	// Remove userId from response items
-	for i := range files {
-		files[i].UserID = ""
+	// Owners don't see where the object is stored or who placed a legal
+	// hold and why; each file says what the caller can do with it
+	admin := common.IsAdmin(request)
+	files := make([]FileItem, len(rows))
+	for i, file := range rows {
+		file.UserID, file.S3Key = "", ""
+		file.LegalHoldBy, file.LegalHoldReason = "", ""
+		file.Category = common.FileCategory(file.ContentType)
+		files[i] = FileItem{
+			File:           file,
+			Deleted:        file.Status == common.StatusDeleted,
+			AllowedActions: common.AllowedActions(file.Status, file.LegalHold, admin),
+		}
 	}
 
 	// Build next token
 	var nextToken *string
-	if result.LastEvaluatedKey != nil {
-		var keyMap map[string]interface{}
-		if attributevalue.UnmarshalMap(result.LastEvaluatedKey, &keyMap) == nil {
-			if encoded, err := json.Marshal(keyMap); err == nil {
-				token := base64.StdEncoding.EncodeToString(encoded)
-				nextToken = &token
-			}
-		}
+	if token, err := encodeListToken(lastKey, pinnedFirst, syncedAt, sortBy); err != nil {
+		log.Printf("Token encode error: %v", err)
+	} else if token != "" {
+		nextToken = &token
 	}
 
 	response := ListFilesResponse{
-		Files:     files,
-		Count:     len(files),
-		NextToken: nextToken,
+		Files:         files,
+		Count:         len(files),
+		NextToken:     nextToken,
+		HasMore:       nextToken != nil,
+		SyncedAt:      syncedAt,
+		SortTruncated: sortTruncated,
 	}
 
 	return common.BuildResponse(200, response), nil
 }
 
+// parseSort returns the comparison for a sort value such as name_asc, or nil
+// if it isn't one. Ties are broken by fileId so every page of a listing sees
+// the same order.
+func parseSort(value string) func(a, b *common.File) int {
+	field, dir, ok := strings.Cut(value, "_")
+	compareField := sortFields[field]
+	if !ok || compareField == nil || (dir != "asc" && dir != "desc") {
+		return nil
+	}
+	return func(a, b *common.File) int {
+		c := compareField(a, b)
+		if dir == "desc" {
+			c = -c
+		}
+		if c == 0 {
+			c = strings.Compare(a.FileID, b.FileID)
+		}
+		return c
+	}
+}
+
+// querySorted reads every file matching input, up to maxSortedFiles of them
+// in maxSortScanPages pages, and returns them sorted by compare. truncated
+// reports whether files were left unread.
+func querySorted(ctx context.Context, input *dynamodb.QueryInput, compare func(a, b *common.File) int) (items []map[string]types.AttributeValue, truncated bool, err error) {
+	in := *input
+	in.Limit = nil
+	in.ExclusiveStartKey = nil
+
+	truncated = true
+	for page := 0; page < maxSortScanPages; page++ {
+		opCtx, cancel := common.WithDeadline(ctx)
+		result, err := queryClient.Query(opCtx, &in)
+		cancel()
+		if err != nil {
+			return nil, false, err
+		}
+		items = append(items, result.Items...)
+		if len(items) > maxSortedFiles {
+			items = items[:maxSortedFiles]
+			break
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			truncated = false
+			break
+		}
+		in.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	var files []common.File
+	if err := attributevalue.UnmarshalListOfMaps(items, &files); err != nil {
+		return nil, false, err
+	}
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return compare(&files[order[i]], &files[order[j]]) < 0 })
+	sorted := make([]map[string]types.AttributeValue, len(items))
+	for i, k := range order {
+		sorted[i] = items[k]
+	}
+	return sorted, truncated, nil
+}
+
+// tokenOffset reads the position stored in a sorted listing's nextToken
+func tokenOffset(key map[string]types.AttributeValue) (int, error) {
+	v, ok := key[sortOffsetKey].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, common.ErrInvalidToken
+	}
+	offset, err := strconv.Atoi(v.Value)
+	if err != nil || offset < 0 {
+		return 0, common.ErrInvalidToken
+	}
+	return offset, nil
+}
+
+// parseSearch reads the contentType, nameContains, createdAfter and
+// createdBefore parameters, reporting every invalid one
+func parseSearch(request events.APIGatewayProxyRequest) (fileSearch, *common.ValidationErrors) {
+	var search fileSearch
+	errs := &common.ValidationErrors{}
+
+	// contentType=image/png,application/pdf or contentType=image/*
+	for _, v := range common.QueryValues(request, "contentType") {
+		contentType := common.NormalizeContentType(v)
+		if strings.Count(contentType, "/") != 1 || strings.HasPrefix(contentType, "/") || strings.HasSuffix(contentType, "/") ||
+			(strings.Contains(contentType, "*") && !strings.HasSuffix(contentType, "/*")) || contentType == "*/*" {
+			errs.Addf("contentType", "'%s' is not a content type or a type/* prefix", v)
+			continue
+		}
+		search.contentTypes = append(search.contentTypes, contentType)
+	}
+	if len(search.contentTypes) > maxContentTypeFilters {
+		errs.Addf("contentType", "at most %d values are allowed", maxContentTypeFilters)
+	}
+
+	search.nameContains = request.QueryStringParameters["nameContains"]
+	if len(search.nameContains) > maxNameContainsLen {
+		errs.Addf("nameContains", "must be at most %d characters", maxNameContainsLen)
+	}
+
+	// Stored createdAt values are UTC whole seconds and compare as strings
+	for _, param := range []struct {
+		name  string
+		value *string
+	}{
+		{"createdAfter", &search.createdAfter},
+		{"createdBefore", &search.createdBefore},
+	} {
+		if v := request.QueryStringParameters[param.name]; v != "" {
+			parsed, err := parseSince(v)
+			if err != nil {
+				errs.Add(param.name, "must be an RFC 3339 timestamp")
+				continue
+			}
+			*param.value = parsed
+		}
+	}
+	if search.createdAfter != "" && search.createdBefore != "" && search.createdAfter >= search.createdBefore {
+		errs.Add("createdAfter+createdBefore", "createdAfter must be before createdBefore")
+	}
+	return search, errs
+}
+
+// filters returns the FilterExpression clauses of the search, adding their
+// values to values
+func (s fileSearch) filters(values map[string]types.AttributeValue) []string {
+	var filters []string
+	if len(s.contentTypes) > 0 {
+		var alternatives []string
+		for i, contentType := range s.contentTypes {
+			name := fmt.Sprintf(":contentType%d", i)
+			if prefix, ok := strings.CutSuffix(contentType, "*"); ok {
+				alternatives = append(alternatives, fmt.Sprintf("begins_with(contentType, %s)", name))
+				values[name] = &types.AttributeValueMemberS{Value: prefix}
+			} else {
+				alternatives = append(alternatives, "contentType = "+name)
+				values[name] = &types.AttributeValueMemberS{Value: contentType}
+			}
+		}
+		filters = append(filters, "("+strings.Join(alternatives, " OR ")+")")
+	}
+	if s.nameContains != "" {
+		filters = append(filters, "contains(fileName, :nameContains)")
+		values[":nameContains"] = &types.AttributeValueMemberS{Value: s.nameContains}
+	}
+	if s.createdAfter != "" {
+		filters = append(filters, "createdAt > :createdAfter")
+		values[":createdAfter"] = &types.AttributeValueMemberS{Value: s.createdAfter}
+	}
+	if s.createdBefore != "" {
+		filters = append(filters, "createdAt < :createdBefore")
+		values[":createdBefore"] = &types.AttributeValueMemberS{Value: s.createdBefore}
+	}
+	return filters
+}
+
+// parseSince parses an RFC 3339 timestamp into the format of the stored
+// updatedAt (UTC, whole seconds) so the two compare as strings. Fractions
+// are dropped and the comparison is inclusive: a change within the same
+// second is listed again rather than missed.
+func parseSince(value string) (string, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Truncate(time.Second).Format(time.RFC3339), nil
+}
+
+// queryPinned reads all of the user's pinned files that pass the list
+// filters, most recently pinned first. It reuses the regular query's filter
+// names and values; the index holds at most a few dozen items per user.
+func queryPinned(ctx context.Context, userID string, filters []string, names map[string]string, values map[string]types.AttributeValue) ([]map[string]types.AttributeValue, error) {
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(userFilesTable),
+		IndexName:                 aws.String(pinnedIndex),
+		KeyConditionExpression:    aws.String("userId = :userId"),
+		ExpressionAttributeValues: values,
+		ScanIndexForward:          aws.Bool(false),
+	}
+	if len(filters) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filters, " AND "))
+		input.ExpressionAttributeNames = names
+	}
+
+	var items []map[string]types.AttributeValue
+	for {
+		opCtx, cancel := common.WithDeadline(ctx)
+		result, err := queryClient.Query(opCtx, input)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, result.Items...)
+		if len(result.LastEvaluatedKey) == 0 {
+			return items, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// encodeListToken encodes lastKey, marking tokens issued with pinnedFirst
+// and carrying the syncedAt of a delta listing. A token resumes the table
+// query right after its key; switching modes midway would repeat or drop
+// the pinned files.
+func encodeListToken(lastKey map[string]types.AttributeValue, pinnedFirst bool, syncedAt, sortBy string) (string, error) {
+	if len(lastKey) == 0 || (!pinnedFirst && syncedAt == "" && sortBy == "") {
+		return common.EncodeToken(lastKey)
+	}
+	key := make(map[string]types.AttributeValue, len(lastKey)+1)
+	for k, v := range lastKey {
+		key[k] = v
+	}
+	if pinnedFirst {
+		key[pinnedFirstKey] = &types.AttributeValueMemberS{Value: "true"}
+	}
+	if syncedAt != "" {
+		key[syncedAtKey] = &types.AttributeValueMemberS{Value: syncedAt}
+	}
+	if sortBy != "" {
+		key[sortKey] = &types.AttributeValueMemberS{Value: sortBy}
+	}
+	return common.EncodeToken(key)
+}
+
+// decodeListToken decodes a nextToken and returns the syncedAt it carries,
+// rejecting tokens of another user. Tokens issued in the other pinnedFirst
+// or delta mode, or with another sort, return errTokenMode.
+func decodeListToken(token, userID string, pinnedFirst, delta bool, sortBy string) (map[string]types.AttributeValue, string, error) {
+	key, err := common.DecodeToken(token)
+	if err != nil || key == nil {
+		return key, "", err
+	}
+	if common.TokenOwner(key) != userID {
+		return nil, "", common.ErrInvalidToken
+	}
+	_, marked := key[pinnedFirstKey]
+	if marked != pinnedFirst {
+		return nil, "", errTokenMode
+	}
+	var syncedAt string
+	if v, ok := key[syncedAtKey].(*types.AttributeValueMemberS); ok {
+		syncedAt = v.Value
+	}
+	if (syncedAt != "") != delta {
+		return nil, "", errTokenMode
+	}
+	if v, _ := key[sortKey].(*types.AttributeValueMemberS); (v == nil && sortBy != "") || (v != nil && v.Value != sortBy) {
+		return nil, "", errTokenMode
+	}
+	delete(key, pinnedFirstKey)
+	delete(key, syncedAtKey)
+	delete(key, sortKey)
+	return key, syncedAt, nil
+}
+
 func main() {
 	lambda.Start(Handler)
 }
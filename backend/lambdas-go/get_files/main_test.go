@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+// fakeFilesTable simulates one user's UserFiles partition, newest fileId
+// first, and the sparse PinnedIndex over it
+type fakeFilesTable struct {
+	items         []map[string]types.AttributeValue // descending by fileId
+	pinnedQueries int
+	// inconsistentReads counts queries that weren't strongly consistent
+	inconsistentReads int
+}
+
+func (f *fakeFilesTable) Query(ctx context.Context, in *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	if aws.ToString(in.IndexName) == pinnedIndex {
+		f.pinnedQueries++
+		out := &dynamodb.QueryOutput{}
+		for _, item := range f.items {
+			if _, ok := item["pinnedAt"]; ok {
+				out.Items = append(out.Items, item)
+			}
+		}
+		return out, nil
+	}
+
+	start := 0
+	if in.ExclusiveStartKey != nil {
+		for i, item := range f.items {
+			if fileID(item) == fileID(in.ExclusiveStartKey) {
+				start = i + 1
+			}
+		}
+	}
+	end := start + int(aws.ToInt32(in.Limit))
+	if in.Limit == nil || end > len(f.items) {
+		end = len(f.items)
+	}
+
+	if !aws.ToBool(in.ConsistentRead) {
+		f.inconsistentReads++
+	}
+	out := &dynamodb.QueryOutput{}
+	for _, item := range f.items[start:end] {
+		if _, pinned := item["pinnedAt"]; pinned && strings.Contains(aws.ToString(in.FilterExpression), "attribute_not_exists(pinnedAt)") {
+			continue
+		}
+		if since, ok := in.ExpressionAttributeValues[":since"]; ok && lastChange(item) < since.(*types.AttributeValueMemberS).Value {
+			continue
+		}
+		if name, ok := in.ExpressionAttributeValues[":nameContains"]; ok {
+			fileName, _ := item["fileName"].(*types.AttributeValueMemberS)
+			if fileName == nil || !strings.Contains(fileName.Value, name.(*types.AttributeValueMemberS).Value) {
+				continue
+			}
+		}
+		out.Items = append(out.Items, item)
+	}
+	if end < len(f.items) {
+		out.LastEvaluatedKey = map[string]types.AttributeValue{"userId": f.items[end-1]["userId"], "fileId": f.items[end-1]["fileId"]}
+	}
+	return out, nil
+}
+
+func fileID(item map[string]types.AttributeValue) string {
+	return item["fileId"].(*types.AttributeValueMemberS).Value
+}
+
+// lastChange is updatedAt, or createdAt for files never updated
+func lastChange(item map[string]types.AttributeValue) string {
+	if v, ok := item["updatedAt"].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return item["createdAt"].(*types.AttributeValueMemberS).Value
+}
+
+func listFiles(t *testing.T, params map[string]string) (ListFilesResponse, int) {
+	t.Helper()
+	request := events.APIGatewayProxyRequest{QueryStringParameters: params}
+	request.RequestContext.Authorizer = map[string]interface{}{
+		"claims": map[string]interface{}{"sub": "user-123"},
+	}
+	response, err := common.Chain(common.HandleErrors, common.RequireUser)(handleListFiles)(context.Background(), request)
+	if err != nil {
+		t.Fatalf("handleListFiles error: %v", err)
+	}
+	var body ListFilesResponse
+	if response.StatusCode == 200 {
+		if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+			t.Fatalf("response body is not JSON: %v", err)
+		}
+	}
+	return body, response.StatusCode
+}
+
+func TestListFilesPinnedFirst(t *testing.T) {
+	defer func(client common.QueryAPI) { queryClient = client }(queryClient)
+
+	// file-09 ... file-00, with file-07 and file-02 pinned
+	table := &fakeFilesTable{}
+	for i := 9; i >= 0; i-- {
+		item := map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: "user-123"},
+			"fileId": &types.AttributeValueMemberS{Value: fmt.Sprintf("file-%02d", i)},
+			"status": &types.AttributeValueMemberS{Value: "uploaded"},
+		}
+		if i == 7 || i == 2 {
+			item["pinned"] = &types.AttributeValueMemberBOOL{Value: true}
+			item["pinnedAt"] = &types.AttributeValueMemberS{Value: "2024-01-01T00:00:00Z"}
+		}
+		table.items = append(table.items, item)
+	}
+	queryClient = table
+
+	params := map[string]string{"pinnedFirst": "true", "limit": "4"}
+	var got []string
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("listing did not end")
+		}
+		page, status := listFiles(t, params)
+		if status != 200 {
+			t.Fatalf("status %d", status)
+		}
+		for _, file := range page.Files {
+			got = append(got, file.FileID)
+		}
+		if !page.HasMore {
+			break
+		}
+		params["nextToken"] = *page.NextToken
+	}
+
+	want := []string{"file-07", "file-02", "file-09", "file-08", "file-06", "file-05", "file-04", "file-03", "file-01", "file-00"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	if table.pinnedQueries != 1 {
+		t.Errorf("pinned index queried %d times, want once", table.pinnedQueries)
+	}
+
+	// Tokens don't carry over between modes
+	page, _ := listFiles(t, map[string]string{"pinnedFirst": "true", "limit": "4"})
+	if _, status := listFiles(t, map[string]string{"limit": "4", "nextToken": *page.NextToken}); status != 400 {
+		t.Error("pinnedFirst token accepted without pinnedFirst")
+	}
+	page, _ = listFiles(t, map[string]string{"limit": "4"})
+	if _, status := listFiles(t, map[string]string{"pinnedFirst": "true", "nextToken": *page.NextToken}); status != 400 {
+		t.Error("plain token accepted with pinnedFirst")
+	}
+}
+
+func TestListFilesSince(t *testing.T) {
+	defer func(client common.QueryAPI) { queryClient = client }(queryClient)
+
+	file := func(id, status, createdAt, updatedAt string) map[string]types.AttributeValue {
+		item := map[string]types.AttributeValue{
+			"userId":    &types.AttributeValueMemberS{Value: "user-123"},
+			"fileId":    &types.AttributeValueMemberS{Value: id},
+			"status":    &types.AttributeValueMemberS{Value: status},
+			"createdAt": &types.AttributeValueMemberS{Value: createdAt},
+		}
+		if updatedAt != "" {
+			item["updatedAt"] = &types.AttributeValueMemberS{Value: updatedAt}
+		}
+		return item
+	}
+	table := &fakeFilesTable{items: []map[string]types.AttributeValue{
+		file("file-05", "uploaded", "2024-03-02T00:00:00Z", ""),
+		file("file-04", "uploaded", "2024-01-01T00:00:00Z", "2024-01-05T00:00:00Z"),
+		file("file-03", "deleted", "2024-01-01T00:00:00Z", "2024-03-01T10:00:00Z"),
+		file("file-02", "uploaded", "2024-01-01T00:00:00Z", ""),
+		file("file-01", "uploaded", "2024-01-01T00:00:00Z", "2024-03-01T10:00:00Z"),
+	}}
+	queryClient = table
+
+	params := map[string]string{"since": "2024-03-01T11:00:00.5+01:00", "limit": "2"}
+	var got []string
+	var deleted []string
+	syncedAt := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("listing did not end")
+		}
+		page, status := listFiles(t, params)
+		if status != 200 {
+			t.Fatalf("status %d", status)
+		}
+		if syncedAt == "" {
+			syncedAt = page.SyncedAt
+		} else if page.SyncedAt != syncedAt {
+			t.Errorf("syncedAt changed between pages: %q, then %q", syncedAt, page.SyncedAt)
+		}
+		for _, f := range page.Files {
+			got = append(got, f.FileID)
+			if f.Deleted {
+				deleted = append(deleted, f.FileID)
+			}
+		}
+		if !page.HasMore {
+			break
+		}
+		params["nextToken"] = *page.NextToken
+	}
+
+	// The boundary second is included; file-05 only has createdAt
+	if want := []string{"file-05", "file-03", "file-01"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+	if want := []string{"file-03"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted = %v, want %v", deleted, want)
+	}
+	if synced, err := time.Parse(time.RFC3339, syncedAt); err != nil || time.Since(synced) < syncSkew {
+		t.Errorf("syncedAt = %q, want at least %s ago", syncedAt, syncSkew)
+	}
+	if table.inconsistentReads != 0 {
+		t.Errorf("%d delta queries were eventually consistent", table.inconsistentReads)
+	}
+
+	// Delta tokens only resume delta listings
+	page, _ := listFiles(t, map[string]string{"since": "2024-01-01T00:00:00Z", "limit": "2"})
+	if _, status := listFiles(t, map[string]string{"limit": "2", "nextToken": *page.NextToken}); status != 400 {
+		t.Error("delta token accepted without since")
+	}
+	page, _ = listFiles(t, map[string]string{"limit": "2"})
+	if _, status := listFiles(t, map[string]string{"since": "2024-01-01T00:00:00Z", "nextToken": *page.NextToken}); status != 400 {
+		t.Error("plain token accepted with since")
+	}
+
+	for _, params := range []map[string]string{
+		{"since": "yesterday"},
+		{"since": "2024-01-01T00:00:00Z", "status": "deleted"},
+		{"since": "2024-01-01T00:00:00Z", "tag": "project"},
+		{"since": "2024-01-01T00:00:00Z", "pinnedFirst": "true"},
+	} {
+		if _, status := listFiles(t, params); status != 400 {
+			t.Errorf("%v: status %d, want 400", params, status)
+		}
+	}
+}
+
+func TestListFilesFillsFilteredPages(t *testing.T) {
+	defer func(client common.QueryAPI) { queryClient = client }(queryClient)
+
+	// file-09 ... file-00; only the even ones are reports
+	var items []map[string]types.AttributeValue
+	for i := 9; i >= 0; i-- {
+		name := fmt.Sprintf("photo-%d.jpg", i)
+		if i%2 == 0 {
+			name = fmt.Sprintf("report-%d.pdf", i)
+		}
+		items = append(items, map[string]types.AttributeValue{
+			"userId":    &types.AttributeValueMemberS{Value: "user-123"},
+			"fileId":    &types.AttributeValueMemberS{Value: fmt.Sprintf("file-%02d", i)},
+			"fileName":  &types.AttributeValueMemberS{Value: name},
+			"status":    &types.AttributeValueMemberS{Value: "uploaded"},
+			"createdAt": &types.AttributeValueMemberS{Value: "2024-01-01T00:00:00Z"},
+		})
+	}
+	queryClient = &fakeFilesTable{items: items}
+
+	params := map[string]string{"nameContains": "report", "limit": "2"}
+	var pages [][]string
+	for {
+		if len(pages) > 10 {
+			t.Fatal("listing did not end")
+		}
+		page, status := listFiles(t, params)
+		if status != 200 {
+			t.Fatalf("status %d", status)
+		}
+		var ids []string
+		for _, f := range page.Files {
+			ids = append(ids, f.FileID)
+		}
+		pages = append(pages, ids)
+		if !page.HasMore {
+			break
+		}
+		params["nextToken"] = *page.NextToken
+	}
+
+	// Every page is full even though a Query page of 2 holds one report
+	want := [][]string{{"file-08", "file-06"}, {"file-04", "file-02"}, {"file-00"}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+}
+
+func TestListFilesSorted(t *testing.T) {
+	defer func(client common.QueryAPI) { queryClient = client }(queryClient)
+
+	file := func(id, name string, size int, createdAt string) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			"userId":    &types.AttributeValueMemberS{Value: "user-123"},
+			"fileId":    &types.AttributeValueMemberS{Value: id},
+			"fileName":  &types.AttributeValueMemberS{Value: name},
+			"fileSize":  &types.AttributeValueMemberN{Value: fmt.Sprint(size)},
+			"status":    &types.AttributeValueMemberS{Value: "uploaded"},
+			"createdAt": &types.AttributeValueMemberS{Value: createdAt},
+		}
+	}
+	queryClient = &fakeFilesTable{items: []map[string]types.AttributeValue{
+		file("file-04", "b.txt", 300, "2024-01-02T00:00:00Z"),
+		file("file-03", "C.txt", 100, "2024-01-04T00:00:00Z"),
+		file("file-02", "a.txt", 300, "2024-01-01T00:00:00Z"),
+		file("file-01", "d.txt", 200, "2024-01-03T00:00:00Z"),
+	}}
+
+	list := func(sort string) []string {
+		params := map[string]string{"sort": sort, "limit": "3"}
+		var got []string
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatal("listing did not end")
+			}
+			page, status := listFiles(t, params)
+			if status != 200 {
+				t.Fatalf("sort=%s: status %d", sort, status)
+			}
+			for _, f := range page.Files {
+				got = append(got, f.FileID)
+			}
+			if !page.HasMore {
+				return got
+			}
+			params["nextToken"] = *page.NextToken
+		}
+	}
+
+	for sort, want := range map[string][]string{
+		"createdAt_asc":  {"file-02", "file-04", "file-01", "file-03"},
+		"createdAt_desc": {"file-03", "file-01", "file-04", "file-02"},
+		"name_asc":       {"file-02", "file-04", "file-03", "file-01"},
+		// ties go by fileId, ascending either way
+		"size_desc": {"file-02", "file-04", "file-01", "file-03"},
+		"size_asc":  {"file-03", "file-01", "file-02", "file-04"},
+	} {
+		if got := list(sort); !reflect.DeepEqual(got, want) {
+			t.Errorf("sort=%s: files = %v, want %v", sort, got, want)
+		}
+	}
+
+	page, _ := listFiles(t, map[string]string{"sort": "name_asc", "limit": "2"})
+	for _, params := range []map[string]string{
+		{"sort": "fileName"},
+		{"sort": "name_up"},
+		{"sort": "name_asc", "since": "2024-01-01T00:00:00Z"},
+		{"sort": "size_asc", "nextToken": *page.NextToken},
+		{"nextToken": *page.NextToken},
+		{"sort": "name_asc", "limit": "0"},
+		{"sort": "name_asc", "limit": "-1"},
+		{"limit": "0"},
+		{"limit": "-1"},
+	} {
+		if _, status := listFiles(t, params); status != 400 {
+			t.Errorf("%v: status %d, want 400", params, status)
+		}
+	}
+}
+
+func TestParseSearch(t *testing.T) {
+	request := func(params map[string]string) events.APIGatewayProxyRequest {
+		return events.APIGatewayProxyRequest{QueryStringParameters: params}
+	}
+
+	search, errs := parseSearch(request(map[string]string{
+		"contentType":   "Image/*, application/pdf",
+		"createdAfter":  "2024-01-01T01:00:00+01:00",
+		"createdBefore": "2024-02-01T00:00:00.9Z",
+	}))
+	if errs.HasErrors() {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	values := map[string]types.AttributeValue{}
+	filters := search.filters(values)
+	want := []string{
+		"(begins_with(contentType, :contentType0) OR contentType = :contentType1)",
+		"createdAt > :createdAfter",
+		"createdAt < :createdBefore",
+	}
+	if !reflect.DeepEqual(filters, want) {
+		t.Errorf("filters = %v, want %v", filters, want)
+	}
+	for name, want := range map[string]string{
+		":contentType0":  "image/",
+		":contentType1":  "application/pdf",
+		":createdAfter":  "2024-01-01T00:00:00Z",
+		":createdBefore": "2024-02-01T00:00:00Z",
+	} {
+		if got := values[name].(*types.AttributeValueMemberS).Value; got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	for _, params := range []map[string]string{
+		{"contentType": "pdf"},
+		{"contentType": "*/*"},
+		{"contentType": "image/p*"},
+		{"nameContains": strings.Repeat("a", maxNameContainsLen+1)},
+		{"createdAfter": "last week"},
+		{"createdAfter": "2024-02-01T00:00:00Z", "createdBefore": "2024-01-01T00:00:00Z"},
+	} {
+		if _, errs := parseSearch(request(params)); !errs.HasErrors() {
+			t.Errorf("%v accepted", params)
+		}
+	}
+}
+
+func TestListFilesListsConflicts(t *testing.T) {
+	defer func(client common.QueryAPI) { queryClient = client }(queryClient)
+	queryClient = &fakeFilesTable{}
+
+	request := events.APIGatewayProxyRequest{QueryStringParameters: map[string]string{
+		"since":  "2024-01-01T00:00:00Z",
+		"status": "deleted",
+		"tag":    "project",
+	}}
+	request.RequestContext.Authorizer = map[string]interface{}{
+		"claims": map[string]interface{}{"sub": "user-123"},
+	}
+	response, err := common.Chain(common.HandleErrors, common.RequireUser)(handleListFiles)(context.Background(), request)
+	if err != nil || response.StatusCode != 400 {
+		t.Fatalf("status %d, %v; want 400", response.StatusCode, err)
+	}
+
+	var body common.ValidationErrorResponse
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("body is not JSON: %v", err)
+	}
+	var fields []string
+	for _, e := range body.Errors {
+		fields = append(fields, e.Field)
+	}
+	if want := []string{"since+status", "since+tag"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("conflicts = %v, want %v", fields, want)
+	}
+
+	// pinnedFirst=false changes nothing, so it doesn't conflict with since
+	if _, status := listFiles(t, map[string]string{"since": "2024-01-01T00:00:00Z", "pinnedFirst": "false"}); status == 400 {
+		t.Error("since refused with pinnedFirst=false")
+	}
+}
@@ -0,0 +1,291 @@
+// Package main implements the grant_access Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	maxACLSize     = 50
+)
+
+// AccessRequest represents the request body
+type AccessRequest struct {
+	FileID  string   `json:"fileId"`
+	UserIDs []string `json:"userIds"`
+	// AllowedReferers, when present, replaces the origins that users in the
+	// acl must download the file from (see proxy_share); [] removes the limit
+	AllowedReferers *[]string `json:"allowedReferers,omitempty"`
+	// AllowedCIDRs, when present, replaces the addresses or networks that
+	// users in the acl must download the file from; [] removes the limit
+	AllowedCIDRs *[]string `json:"allowedCidrs,omitempty"`
+	// MaxDownloads, when present, limits how many times users in the acl may
+	// download the file in total, restarting the count; 0 removes the limit
+	MaxDownloads *int64 `json:"maxDownloads,omitempty"`
+}
+
+// AccessResponse represents the response body
+type AccessResponse struct {
+	Message string   `json:"message"`
+	FileID  string   `json:"fileId"`
+	ACL     []string `json:"acl"`
+	// AllowedReferers is the file's referer allowlist after the update
+	AllowedReferers []string `json:"allowedReferers,omitempty"`
+	// AllowedCIDRs is the file's network allowlist after the update
+	AllowedCIDRs []string `json:"allowedCidrs,omitempty"`
+	// MaxDownloads and DownloadsLeft describe the download limit, if any
+	MaxDownloads  int64  `json:"maxDownloads,omitempty"`
+	DownloadsLeft *int64 `json:"downloadsLeft,omitempty"`
+}
+
+var (
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleGrant)
+
+// handleGrant handles an authenticated request
+func handleGrant(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req AccessRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+
+	// Validate required fields
+	if req.FileID == "" || len(req.UserIDs) == 0 {
+		return common.Fail(common.Validation("Missing required fields: fileId, userIds"))
+	}
+	if len(req.UserIDs) > maxACLSize {
+		return common.Fail(common.Validation(fmt.Sprintf("Cannot grant access to more than %d users", maxACLSize)))
+	}
+
+	// Validate grantees
+	grantees := make([]string, 0, len(req.UserIDs))
+	seen := make(map[string]bool)
+	for _, grantee := range req.UserIDs {
+		if !common.IsValidUserID(grantee) {
+			return common.Fail(common.Validation(fmt.Sprintf("Invalid userId '%s'", grantee)))
+		}
+		if grantee == userID {
+			return common.Fail(common.Validation("Owners always have access to their own files"))
+		}
+		if !seen[grantee] {
+			seen[grantee] = true
+			grantees = append(grantees, grantee)
+		}
+	}
+
+	referers, err := normalizeReferers(req.AllowedReferers)
+	if err != nil {
+		return common.Fail(err)
+	}
+	cidrs, err := normalizeCIDRs(req.AllowedCIDRs)
+	if err != nil {
+		return common.Fail(err)
+	}
+	if req.MaxDownloads != nil && (*req.MaxDownloads < 0 || *req.MaxDownloads > common.MaxShareDownloads) {
+		return common.Fail(common.Validation(fmt.Sprintf("maxDownloads must be between 0 and %d", common.MaxShareDownloads)))
+	}
+
+	// Add grantees to the file's acl set
+	update := "ADD acl :grantees SET updatedAt = :updatedAt"
+	values := map[string]types.AttributeValue{
+		":grantees":  &types.AttributeValueMemberSS{Value: grantees},
+		":updatedAt": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		":deleted":   &types.AttributeValueMemberS{Value: "deleted"},
+		":room":      &types.AttributeValueMemberN{Value: strconv.Itoa(maxACLSize - len(grantees))},
+	}
+	var removed []string
+	switch {
+	case len(referers) > 0:
+		update += ", shareReferers = :referers"
+		values[":referers"] = &types.AttributeValueMemberSS{Value: referers}
+	case req.AllowedReferers != nil:
+		removed = append(removed, "shareReferers")
+	}
+	switch {
+	case len(cidrs) > 0:
+		update += ", shareCidrs = :cidrs"
+		values[":cidrs"] = &types.AttributeValueMemberSS{Value: cidrs}
+	case req.AllowedCIDRs != nil:
+		removed = append(removed, "shareCidrs")
+	}
+	switch {
+	case req.MaxDownloads == nil:
+	case *req.MaxDownloads > 0:
+		update += ", shareMaxDownloads = :maxDownloads, shareDownloadsLeft = :maxDownloads"
+		values[":maxDownloads"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(*req.MaxDownloads, 10)}
+	default:
+		removed = append(removed, "shareMaxDownloads", "shareDownloadsLeft")
+	}
+	if len(removed) > 0 {
+		update += " REMOVE " + strings.Join(removed, ", ")
+	}
+
+	opCtx, cancel := common.WithDeadline(ctx)
+	result, err := dynamoClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+		},
+		UpdateExpression:    aws.String(update),
+		ConditionExpression: aws.String("attribute_exists(fileId) AND #status <> :deleted AND (attribute_not_exists(acl) OR size(acl) <= :room)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        types.ReturnValueAllNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			if status, ok := conditionErr.Item["status"].(*types.AttributeValueMemberS); ok && status.Value != "deleted" {
+				return common.Fail(common.Validation(fmt.Sprintf("A file can be shared with at most %d users", maxACLSize)))
+			}
+			return common.Fail(common.NotFound("File not found"))
+		}
+		return common.Fail(common.Internal("DynamoDB update error", err))
+	}
+
+	var file common.File
+	if err := attributevalue.UnmarshalMap(result.Attributes, &file); err != nil {
+		return common.Fail(common.Internal("Unmarshal error", err))
+	}
+
+	// Log audit event
+	metadata := map[string]interface{}{
+		"operation": "grant",
+		"userIds":   grantees,
+	}
+	if req.AllowedReferers != nil {
+		metadata["allowedReferers"] = referers
+	}
+	if req.AllowedCIDRs != nil {
+		metadata["allowedCidrs"] = cidrs
+	}
+	if req.MaxDownloads != nil {
+		metadata["maxDownloads"] = *req.MaxDownloads
+	}
+	auditLog.Log(ctx, userID, req.FileID, "share", metadata)
+
+	response := AccessResponse{
+		Message:         "Access granted successfully",
+		FileID:          req.FileID,
+		ACL:             file.ACL,
+		AllowedReferers: file.ShareReferers,
+		AllowedCIDRs:    file.ShareCIDRs,
+	}
+	if file.ShareMaxDownloads > 0 {
+		response.MaxDownloads = file.ShareMaxDownloads
+		response.DownloadsLeft = &file.ShareDownloadsLeft
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// normalizeReferers validates and de-duplicates a requested referer
+// allowlist. Nil means the request leaves the allowlist as it is.
+func normalizeReferers(requested *[]string) ([]string, error) {
+	if requested == nil {
+		return nil, nil
+	}
+	errs := &common.ValidationErrors{}
+	referers := make([]string, 0, len(*requested))
+	seen := make(map[string]bool)
+	for i, entry := range *requested {
+		pattern, ok := common.NormalizeRefererPattern(entry)
+		if !ok {
+			errs.Add(fmt.Sprintf("allowedReferers.%d", i), "must be an origin such as https://blog.example.com or https://*.example.com")
+			continue
+		}
+		if !seen[pattern] {
+			seen[pattern] = true
+			referers = append(referers, pattern)
+		}
+	}
+	if len(referers) > common.MaxShareReferers {
+		errs.Addf("allowedReferers", "must have at most %d entries", common.MaxShareReferers)
+	}
+	if errs.HasErrors() {
+		return nil, errs
+	}
+	return referers, nil
+}
+
+// normalizeCIDRs validates and de-duplicates a requested network
+// allowlist. Nil means the request leaves the allowlist as it is.
+func normalizeCIDRs(requested *[]string) ([]string, error) {
+	if requested == nil {
+		return nil, nil
+	}
+	errs := &common.ValidationErrors{}
+	cidrs := make([]string, 0, len(*requested))
+	seen := make(map[string]bool)
+	for i, entry := range *requested {
+		cidr, ok := common.NormalizeCIDR(entry)
+		if !ok {
+			errs.Add(fmt.Sprintf("allowedCidrs.%d", i), "must be an IP address or CIDR such as 203.0.113.0/24 or 2001:db8::/48")
+			continue
+		}
+		if !seen[cidr] {
+			seen[cidr] = true
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	if len(cidrs) > common.MaxShareCIDRs {
+		errs.Addf("allowedCidrs", "must have at most %d entries", common.MaxShareCIDRs)
+	}
+	if errs.HasErrors() {
+		return nil, errs
+	}
+	return cidrs, nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -2,11 +2,35 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"runtime"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName     = "660348065850-file-bucket"
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	defaultService = "compinche-file-manager"
+)
+
+// Build metadata, set at build time with
+// -ldflags "-X main.version=... -X main.commitSha=... -X main.buildTime=..."
+var (
+	version   = "dev"
+	commitSha = "unknown"
+	buildTime = "unknown"
 )
 
 // HealthResponse represents the health check response
@@ -16,40 +40,119 @@ type HealthResponse struct {
 	Service   string `json:"service"`
 	Version   string `json:"version"`
 	Runtime   string `json:"runtime"`
+	GoVersion string `json:"goVersion"`
+	CommitSha string `json:"commitSha"`
+	BuildTime string `json:"buildTime"`
+	// Checks is only set for deep checks (?deep=true)
+	Checks []DependencyCheck `json:"checks,omitempty"`
+}
+
+// DependencyCheck reports the result of probing one dependency
+type DependencyCheck struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
 }
 
-// Handler is the Lambda function handler for health check
-func Handler(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+var (
+	s3Client     *s3.Client
+	dynamoClient *dynamodb.Client
+	// serviceName identifies the deployment (SERVICE_NAME)
+	serviceName = defaultService
+	// guestLimiter rate limits callers by IP since health needs no auth
+	guestLimiter common.GuestLimiter
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	s3Client = s3.NewFromConfig(cfg)
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	guestLimiter.SetClient(dynamoClient)
+
+	if v := os.Getenv("SERVICE_NAME"); v != "" {
+		serviceName = v
+	}
+}
+
+// Handler is the Lambda function handler for health check. It takes the REST
+// API (v1) payload like every other handler; an HTTP API (v2) event decodes
+// into it too since only queryStringParameters is read, and the v1 response
+// shape is accepted by both.
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.CORS,
+	guestLimiter.Limit,
+)(handleHealth)
+
+// handleHealth reports liveness and, with ?deep=true, probes DynamoDB and S3
+func handleHealth(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	response := HealthResponse{
 		Status:    "healthy",
 		Timestamp: time.Now().UTC().Format(time.RFC3339),
-		Service:   "compinche-file-manager",
-		Version:   "1.0.0",
+		Service:   serviceName,
+		Version:   version,
 		Runtime:   "go",
+		GoVersion: runtime.Version(),
+		CommitSha: commitSha,
+		BuildTime: buildTime,
+	}
+
+	if request.QueryStringParameters["deep"] != "true" {
+		return common.BuildResponse(200, response), nil
+	}
+
+	response.Checks = []DependencyCheck{
+		runCheck(ctx, "dynamodb:"+userFilesTable, func(ctx context.Context) error {
+			_, err := dynamoClient.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(userFilesTable)})
+			return err
+		}),
+		runCheck(ctx, "dynamodb:"+fileAuditTable, func(ctx context.Context) error {
+			_, err := dynamoClient.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(fileAuditTable)})
+			return err
+		}),
+		runCheck(ctx, "s3:"+bucketName, func(ctx context.Context) error {
+			_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucketName)})
+			return err
+		}),
+	}
+
+	for _, check := range response.Checks {
+		if check.Status != "healthy" {
+			response.Status = "unhealthy"
+			return common.BuildResponse(503, response), nil
+		}
 	}
 
-	body, err := json.Marshal(response)
+	return common.BuildResponse(200, response), nil
+}
+
+// runCheck runs probe under a per-operation deadline and records its outcome
+func runCheck(ctx context.Context, name string, probe func(context.Context) error) DependencyCheck {
+	opCtx, cancel := common.WithDeadline(ctx)
+	defer cancel()
+
+	start := time.Now()
+	err := probe(opCtx)
+	check := DependencyCheck{
+		Name:      name,
+		Status:    "healthy",
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
 	if err != nil {
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: 500,
-			Headers: map[string]string{
-				"Content-Type":                "application/json",
-				"Access-Control-Allow-Origin": "*",
-			},
-			Body: `{"error": "Internal server error"}`,
-		}, nil
-	}
-
-	return events.APIGatewayV2HTTPResponse{
-		StatusCode: 200,
-		Headers: map[string]string{
-			"Content-Type":                     "application/json",
-			"Access-Control-Allow-Origin":      "*",
-			"Access-Control-Allow-Headers":     "Content-Type,Authorization",
-			"Access-Control-Allow-Methods":     "GET,OPTIONS",
-		},
-		Body: string(body),
-	}, nil
+		log.Printf("Health check %s failed: %v", name, err)
+		check.Status = "unhealthy"
+		// Keep AWS error details in the logs, not on the public endpoint
+		check.Error = "error"
+		if errors.Is(err, context.DeadlineExceeded) {
+			check.Error = "timeout"
+		}
+	}
+	return check
 }
 
 func main() {
@@ -0,0 +1,350 @@
+// Package main implements the migrate_files Lambda function
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	userFilesTable  = "UserFiles"
+	migrationsTable = "Migrations"
+	// derivedFieldsMigration is the checkpoint used when the event names none
+	derivedFieldsMigration = "derived-fields-v1"
+
+	defaultPageSize        = 100
+	defaultWritesPerSecond = 25
+	// stopMargin is the time left before the Lambda deadline at which a run
+	// stops after its current page
+	stopMargin = 30 * time.Second
+
+	statusRunning  = "running"
+	statusComplete = "complete"
+)
+
+// Outcomes of migrating one row
+const (
+	outcomeUpdated   = "updated"
+	outcomeUnchanged = "unchanged"
+	outcomeSkipped   = "skipped"
+	outcomeFailed    = "failed"
+)
+
+// MigrateEvent is the invocation payload. An EventBridge schedule can send
+// {} to keep working through the default migration.
+type MigrateEvent struct {
+	// MigrationID names the checkpoint; a new ID starts over from the
+	// beginning of the table
+	MigrationID string `json:"migrationId,omitempty"`
+	// MaxPages bounds the pages this run scans; 0 runs until the table is
+	// done or the Lambda is about to time out
+	MaxPages int `json:"maxPages,omitempty"`
+	// DryRun counts the rows that would change without writing anything,
+	// the checkpoint included
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// MigrateResult summarizes one run
+type MigrateResult struct {
+	MigrationID string `json:"migrationId"`
+	Scanned     int    `json:"scanned"`
+	Updated     int    `json:"updated"`
+	Unchanged   int    `json:"unchanged"`
+	// Skipped rows changed or disappeared between the scan and the update
+	Skipped  int  `json:"skipped"`
+	Failed   int  `json:"failed"`
+	Complete bool `json:"complete"`
+	DryRun   bool `json:"dryRun,omitempty"`
+}
+
+// Migration is a checkpoint item in the Migrations table
+type Migration struct {
+	MigrationID string `dynamodbav:"migrationId"`
+	Status      string `dynamodbav:"status"`
+	// Checkpoint is the LastEvaluatedKey of the last finished page, encoded
+	// with common.EncodeToken
+	Checkpoint string `dynamodbav:"checkpoint,omitempty"`
+	Scanned    int    `dynamodbav:"scanned"`
+	Updated    int    `dynamodbav:"updated"`
+	Failed     int    `dynamodbav:"failed"`
+	StartedAt  string `dynamodbav:"startedAt"`
+	UpdatedAt  string `dynamodbav:"updatedAt"`
+}
+
+// migrateAPI is the subset of the DynamoDB client the migration uses
+type migrateAPI interface {
+	common.GetItemAPI
+	common.UpdateItemAPI
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+}
+
+var (
+	// db is the DynamoDB client; tests replace it
+	db migrateAPI
+	// pageSize is the Limit of each scan page (MIGRATE_PAGE_SIZE)
+	pageSize = intFromEnv("MIGRATE_PAGE_SIZE", defaultPageSize)
+	// writesPerSecond paces row updates so the migration leaves write
+	// capacity for production traffic (MIGRATE_WRITES_PER_SECOND)
+	writesPerSecond = intFromEnv("MIGRATE_WRITES_PER_SECOND", defaultWritesPerSecond)
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	db = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+}
+
+// Handler is the Lambda function handler, invoked directly or on a schedule.
+// It backfills the fields derived from each file's contentType: category,
+// as common.FileCategory computes it, and contentType itself in the form
+// common.NormalizeContentType returns. Every run continues from the
+// checkpoint the previous one saved after each page, so a table too large
+// for one invocation is migrated over several, and rows already migrated
+// are left alone.
+func Handler(ctx context.Context, event MigrateEvent) (MigrateResult, error) {
+	migrationID := event.MigrationID
+	if migrationID == "" {
+		migrationID = derivedFieldsMigration
+	}
+	result := MigrateResult{MigrationID: migrationID, DryRun: event.DryRun}
+	if common.ReadOnlyMode() && !event.DryRun {
+		log.Printf("Read-only mode, skipping migration run")
+		return result, nil
+	}
+
+	migration, err := loadMigration(ctx, migrationID)
+	if err != nil {
+		return result, fmt.Errorf("load checkpoint: %w", err)
+	}
+	if migration.Status == statusComplete {
+		result.Complete = true
+		return result, nil
+	}
+
+	startKey, err := common.DecodeToken(migration.Checkpoint)
+	if err != nil {
+		return result, fmt.Errorf("decode checkpoint: %w", err)
+	}
+
+	pace := time.NewTicker(time.Second / time.Duration(writesPerSecond))
+	defer pace.Stop()
+
+	for pages := 0; event.MaxPages == 0 || pages < event.MaxPages; pages++ {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < stopMargin {
+			break
+		}
+
+		opCtx, cancel := common.WithDeadline(ctx)
+		page, err := db.Scan(opCtx, &dynamodb.ScanInput{
+			TableName:            aws.String(userFilesTable),
+			ProjectionExpression: aws.String("userId, fileId, contentType, category"),
+			ExclusiveStartKey:    startKey,
+			Limit:                aws.Int32(int32(pageSize)),
+		})
+		cancel()
+		if err != nil {
+			return result, fmt.Errorf("scan: %w", err)
+		}
+
+		before := result
+		for _, item := range page.Items {
+			result.Scanned++
+			switch migrateItem(ctx, item, pace.C, event.DryRun) {
+			case outcomeUpdated:
+				result.Updated++
+			case outcomeUnchanged:
+				result.Unchanged++
+			case outcomeSkipped:
+				result.Skipped++
+			default:
+				result.Failed++
+			}
+		}
+
+		startKey = page.LastEvaluatedKey
+		if migration.Checkpoint, err = common.EncodeToken(startKey); err != nil {
+			return result, fmt.Errorf("encode checkpoint: %w", err)
+		}
+		migration.Scanned += result.Scanned - before.Scanned
+		migration.Updated += result.Updated - before.Updated
+		migration.Failed += result.Failed - before.Failed
+		if len(startKey) == 0 {
+			migration.Status = statusComplete
+			result.Complete = true
+		}
+		if !event.DryRun {
+			if err := saveMigration(ctx, migration); err != nil {
+				return result, fmt.Errorf("save checkpoint: %w", err)
+			}
+		}
+		if result.Complete {
+			break
+		}
+	}
+
+	log.Printf("Migration %s run: scanned=%d updated=%d unchanged=%d skipped=%d failed=%d complete=%t dryRun=%t",
+		migrationID, result.Scanned, result.Updated, result.Unchanged, result.Skipped, result.Failed, result.Complete, event.DryRun)
+	return result, nil
+}
+
+// derivedFields returns the attributes a row with contentType and category
+// should be updated with, or nil when it is already migrated
+func derivedFields(contentType, category string) map[string]string {
+	fields := map[string]string{}
+	if normalized := common.NormalizeContentType(contentType); normalized != contentType {
+		fields["contentType"] = normalized
+	}
+	if derived := common.FileCategory(contentType); derived != category {
+		fields["category"] = derived
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields
+}
+
+// migrateItem writes the derived fields of one scanned row, waiting for
+// pace before the write. The update is conditional on contentType being
+// what was scanned, so a row changed meanwhile is skipped rather than
+// overwritten. updatedAt is left alone: the file itself didn't change.
+func migrateItem(ctx context.Context, item map[string]types.AttributeValue, pace <-chan time.Time, dryRun bool) string {
+	var row struct {
+		UserID      string `dynamodbav:"userId"`
+		FileID      string `dynamodbav:"fileId"`
+		ContentType string `dynamodbav:"contentType"`
+		Category    string `dynamodbav:"category"`
+	}
+	if err := attributevalue.UnmarshalMap(item, &row); err != nil {
+		log.Printf("Unmarshal error: %v", err)
+		return outcomeFailed
+	}
+
+	fields := derivedFields(row.ContentType, row.Category)
+	if fields == nil {
+		return outcomeUnchanged
+	}
+	if dryRun {
+		return outcomeUpdated
+	}
+
+	select {
+	case <-pace:
+	case <-ctx.Done():
+		return outcomeFailed
+	}
+
+	update := "SET category = :category"
+	values := map[string]types.AttributeValue{
+		":category":    &types.AttributeValueMemberS{Value: common.FileCategory(row.ContentType)},
+		":contentType": &types.AttributeValueMemberS{Value: row.ContentType},
+	}
+	if normalized, ok := fields["contentType"]; ok {
+		update += ", contentType = :normalized"
+		values[":normalized"] = &types.AttributeValueMemberS{Value: normalized}
+	}
+
+	opCtx, cancel := common.WithDeadline(ctx)
+	_, err := db.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: row.UserID},
+			"fileId": &types.AttributeValueMemberS{Value: row.FileID},
+		},
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("contentType = :contentType"),
+		ExpressionAttributeValues: values,
+	})
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return outcomeSkipped
+		}
+		log.Printf("Failed to migrate file %s/%s: %v", row.UserID, row.FileID, err)
+		return outcomeFailed
+	}
+	return outcomeUpdated
+}
+
+// loadMigration reads the checkpoint of migrationID, or starts a new one
+func loadMigration(ctx context.Context, migrationID string) (*Migration, error) {
+	opCtx, cancel := common.WithDeadline(ctx)
+	result, err := db.GetItem(opCtx, &dynamodb.GetItemInput{
+		TableName: aws.String(migrationsTable),
+		Key: map[string]types.AttributeValue{
+			"migrationId": &types.AttributeValueMemberS{Value: migrationID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Item) == 0 {
+		return &Migration{
+			MigrationID: migrationID,
+			Status:      statusRunning,
+			StartedAt:   time.Now().UTC().Format(time.RFC3339),
+		}, nil
+	}
+
+	var migration Migration
+	if err := attributevalue.UnmarshalMap(result.Item, &migration); err != nil {
+		return nil, err
+	}
+	return &migration, nil
+}
+
+// saveMigration stores the checkpoint after a finished page
+func saveMigration(ctx context.Context, migration *Migration) error {
+	migration.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	item, err := attributevalue.MarshalMap(migration)
+	if err != nil {
+		return err
+	}
+	return common.Retry(ctx, func(ctx context.Context) error {
+		opCtx, cancel := common.WithDeadline(ctx)
+		defer cancel()
+		_, err := db.PutItem(opCtx, &dynamodb.PutItemInput{
+			TableName: aws.String(migrationsTable),
+			Item:      item,
+		})
+		return err
+	})
+}
+
+// intFromEnv parses a positive integer environment variable, falling back to
+// def when it is unset or invalid
+func intFromEnv(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s %q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeTables holds UserFiles rows in scan order and Migrations items
+type fakeTables struct {
+	files      []map[string]types.AttributeValue
+	migrations map[string]map[string]types.AttributeValue
+	updates    int
+}
+
+func str(av types.AttributeValue) string {
+	if s, ok := av.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
+
+func (f *fakeTables) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	start := 0
+	if params.ExclusiveStartKey != nil {
+		for i, row := range f.files {
+			if str(row["fileId"]) == str(params.ExclusiveStartKey["fileId"]) {
+				start = i + 1
+			}
+		}
+	}
+	end := min(start+int(aws.ToInt32(params.Limit)), len(f.files))
+	output := &dynamodb.ScanOutput{Items: f.files[start:end]}
+	if end < len(f.files) {
+		last := f.files[end-1]
+		output.LastEvaluatedKey = map[string]types.AttributeValue{"userId": last["userId"], "fileId": last["fileId"]}
+	}
+	return output, nil
+}
+
+func (f *fakeTables) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	for _, row := range f.files {
+		if str(row["fileId"]) != str(params.Key["fileId"]) {
+			continue
+		}
+		if str(row["contentType"]) != str(params.ExpressionAttributeValues[":contentType"]) {
+			return nil, &types.ConditionalCheckFailedException{}
+		}
+		f.updates++
+		row["category"] = params.ExpressionAttributeValues[":category"]
+		if normalized, ok := params.ExpressionAttributeValues[":normalized"]; ok {
+			row["contentType"] = normalized
+		}
+	}
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeTables) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.migrations[str(params.Key["migrationId"])]}, nil
+}
+
+func (f *fakeTables) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.migrations[str(params.Item["migrationId"])] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func fileRow(fileID, contentType, category string) map[string]types.AttributeValue {
+	row := map[string]types.AttributeValue{
+		"userId":      &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId":      &types.AttributeValueMemberS{Value: fileID},
+		"contentType": &types.AttributeValueMemberS{Value: contentType},
+	}
+	if category != "" {
+		row["category"] = &types.AttributeValueMemberS{Value: category}
+	}
+	return row
+}
+
+func useFakeTables(t *testing.T, files ...map[string]types.AttributeValue) *fakeTables {
+	t.Helper()
+	fake := &fakeTables{files: files, migrations: map[string]map[string]types.AttributeValue{}}
+	db, pageSize, writesPerSecond = fake, 2, 1000
+	return fake
+}
+
+func TestDerivedFields(t *testing.T) {
+	tests := []struct {
+		contentType, category string
+		want                  map[string]string
+	}{
+		{"image/png", "image", nil},
+		{"image/png", "", map[string]string{"category": "image"}},
+		{"Text/Plain; charset=utf-8", "text", map[string]string{"contentType": "text/plain"}},
+		{"Application/PDF", "", map[string]string{"contentType": "application/pdf", "category": "document"}},
+	}
+	for _, tt := range tests {
+		got := derivedFields(tt.contentType, tt.category)
+		if len(got) != len(tt.want) {
+			t.Errorf("derivedFields(%q, %q) = %v, want %v", tt.contentType, tt.category, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("derivedFields(%q, %q)[%s] = %q, want %q", tt.contentType, tt.category, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestMigrationResumesFromCheckpoint(t *testing.T) {
+	fake := useFakeTables(t,
+		fileRow("a", "image/png", ""),
+		fileRow("b", "Text/Plain; charset=utf-8", ""),
+		fileRow("c", "application/pdf", "document"),
+		fileRow("d", "application/zip", ""),
+		fileRow("e", "video/mp4", ""),
+	)
+
+	first, err := Handler(context.Background(), MigrateEvent{MaxPages: 1})
+	if err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	if first.Scanned != 2 || first.Updated != 2 || first.Complete {
+		t.Errorf("first run = %+v, want 2 scanned and updated, not complete", first)
+	}
+
+	second, err := Handler(context.Background(), MigrateEvent{})
+	if err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if second.Scanned != 3 || second.Updated != 2 || second.Unchanged != 1 || !second.Complete {
+		t.Errorf("second run = %+v, want the last 3 rows and complete", second)
+	}
+	if got := str(fake.files[1]["contentType"]); got != "text/plain" {
+		t.Errorf("contentType = %q, want text/plain", got)
+	}
+	if got := str(fake.files[4]["category"]); got != "other" {
+		t.Errorf("category = %q, want other", got)
+	}
+
+	// A finished migration doesn't scan again
+	third, err := Handler(context.Background(), MigrateEvent{})
+	if err != nil || third.Scanned != 0 || !third.Complete {
+		t.Errorf("third run = %+v, %v; want complete without scanning", third, err)
+	}
+	if fake.updates != 4 {
+		t.Errorf("updates = %d, want 4", fake.updates)
+	}
+}
+
+func TestMigrationDryRunWritesNothing(t *testing.T) {
+	fake := useFakeTables(t, fileRow("a", "image/png", ""), fileRow("b", "image/png", "image"))
+
+	result, err := Handler(context.Background(), MigrateEvent{DryRun: true})
+	if err != nil {
+		t.Fatalf("Handler error: %v", err)
+	}
+	if result.Updated != 1 || result.Unchanged != 1 || fake.updates != 0 || len(fake.migrations) != 0 {
+		t.Errorf("dry run = %+v with %d updates and %d checkpoints, want nothing written", result, fake.updates, len(fake.migrations))
+	}
+}
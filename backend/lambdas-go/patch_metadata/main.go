@@ -0,0 +1,282 @@
+// Package main implements the patch_metadata Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	userFilesTable    = "UserFiles"
+	fileAuditTable    = "FileAudit"
+	maxFileNameLen    = 255
+	maxDescriptionLen = 1024
+)
+
+var allowedMimeTypes = map[string]bool{
+	"image/jpeg":         true,
+	"image/png":          true,
+	"image/gif":          true,
+	"image/webp":         true,
+	"application/pdf":    true,
+	"application/msword": true,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": true,
+	"text/plain":       true,
+	"application/json": true,
+}
+
+// PatchRequest represents the request body. Only the fields present are
+// changed; folder and description can be cleared with an empty string.
+type PatchRequest struct {
+	FileID      string  `json:"fileId"`
+	FileName    *string `json:"fileName"`
+	ContentType *string `json:"contentType"`
+	Folder      *string `json:"folder"`
+	Description *string `json:"description"`
+}
+
+// PatchResponse represents the response body
+type PatchResponse struct {
+	Message       string   `json:"message"`
+	FileID        string   `json:"fileId"`
+	File          FileItem `json:"file"`
+	ChangedFields []string `json:"changedFields"`
+}
+
+// FileItem represents the mutable view of a file record
+type FileItem struct {
+	FileID      string `dynamodbav:"fileId" json:"fileId"`
+	FileName    string `dynamodbav:"fileName" json:"fileName"`
+	ContentType string `dynamodbav:"contentType" json:"contentType"`
+	Folder      string `dynamodbav:"folder" json:"folder,omitempty"`
+	Description string `dynamodbav:"description" json:"description,omitempty"`
+	UpdatedAt   string `dynamodbav:"updatedAt" json:"updatedAt,omitempty"`
+}
+
+// fieldPatch is one requested change to a mutable attribute
+type fieldPatch struct {
+	attr  string
+	value string
+}
+
+var (
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handlePatch)
+
+// handlePatch handles an authenticated request
+func handlePatch(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req PatchRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+
+	if errs := validatePatchRequest(&req); errs.HasErrors() {
+		return common.Fail(errs)
+	}
+
+	// Build the update from the provided fields only. The key attributes and
+	// s3Key are never part of it, so the S3 object is left untouched.
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	sets := []string{"updatedAt = :updatedAt"}
+	var removes []string
+	names := map[string]string{"#status": "status"}
+	values := map[string]types.AttributeValue{
+		":deleted":   &types.AttributeValueMemberS{Value: "deleted"},
+		":updatedAt": &types.AttributeValueMemberS{Value: timestamp},
+	}
+	patches := requestedPatches(&req)
+	for _, p := range patches {
+		names["#"+p.attr] = p.attr
+		if p.value == "" {
+			removes = append(removes, "#"+p.attr)
+			continue
+		}
+		sets = append(sets, "#"+p.attr+" = :"+p.attr)
+		values[":"+p.attr] = &types.AttributeValueMemberS{Value: p.value}
+	}
+	updateExpression := "SET " + strings.Join(sets, ", ")
+	if len(removes) > 0 {
+		updateExpression += " REMOVE " + strings.Join(removes, ", ")
+	}
+
+	opCtx, cancel := common.WithDeadline(ctx)
+	result, err := dynamoClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+		},
+		UpdateExpression:          aws.String(updateExpression),
+		ConditionExpression:       aws.String("attribute_exists(fileId) AND #status <> :deleted"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllOld,
+	})
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return common.Fail(common.NotFound("File not found"))
+		}
+		return common.Fail(common.Internal("DynamoDB update error", err))
+	}
+
+	var old FileItem
+	if err := attributevalue.UnmarshalMap(result.Attributes, &old); err != nil {
+		return common.Fail(common.Internal("Unmarshal error", err))
+	}
+
+	// Work out which fields actually changed and the resulting record
+	file := old
+	file.UpdatedAt = timestamp
+	changes := map[string]interface{}{}
+	changedFields := []string{}
+	for _, p := range patches {
+		field := fileItemField(&file, p.attr)
+		if *field != p.value {
+			changedFields = append(changedFields, p.attr)
+			changes[p.attr] = map[string]interface{}{"from": *field, "to": p.value}
+		}
+		*field = p.value
+	}
+
+	// Log audit event
+	auditLog.Log(ctx, userID, req.FileID, "update", map[string]interface{}{
+		"fileName":      file.FileName,
+		"changedFields": changedFields,
+		"changes":       changes,
+	})
+
+	response := PatchResponse{
+		Message:       "File metadata updated",
+		FileID:        req.FileID,
+		File:          file,
+		ChangedFields: changedFields,
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// requestedPatches lists the fields present in the request, in a fixed order
+func requestedPatches(req *PatchRequest) []fieldPatch {
+	var patches []fieldPatch
+	if req.FileName != nil {
+		patches = append(patches, fieldPatch{"fileName", strings.TrimSpace(*req.FileName)})
+	}
+	if req.ContentType != nil {
+		patches = append(patches, fieldPatch{"contentType", *req.ContentType})
+	}
+	if req.Folder != nil {
+		patches = append(patches, fieldPatch{"folder", strings.TrimSpace(*req.Folder)})
+	}
+	if req.Description != nil {
+		patches = append(patches, fieldPatch{"description", strings.TrimSpace(*req.Description)})
+	}
+	return patches
+}
+
+// fileItemField returns a pointer to the FileItem field for a mutable attribute
+func fileItemField(file *FileItem, attr string) *string {
+	switch attr {
+	case "fileName":
+		return &file.FileName
+	case "contentType":
+		return &file.ContentType
+	case "folder":
+		return &file.Folder
+	default:
+		return &file.Description
+	}
+}
+
+// validatePatchRequest collects every invalid field in the request and
+// normalizes contentType
+func validatePatchRequest(req *PatchRequest) *common.ValidationErrors {
+	errs := &common.ValidationErrors{}
+
+	if req.FileID == "" {
+		errs.Add("fileId", "is required")
+	}
+
+	if req.FileName == nil && req.ContentType == nil && req.Folder == nil && req.Description == nil {
+		errs.Add("body", "at least one of fileName, contentType, folder, description is required")
+		return errs
+	}
+
+	if req.FileName != nil {
+		name := strings.TrimSpace(*req.FileName)
+		switch {
+		case name == "":
+			errs.Add("fileName", "must not be empty")
+		case len(name) > maxFileNameLen:
+			errs.Addf("fileName", "must be at most %d characters", maxFileNameLen)
+		case strings.ContainsAny(name, `/\`) || strings.IndexFunc(name, unicode.IsControl) >= 0:
+			errs.Add("fileName", "must not contain path separators or control characters")
+		}
+	}
+
+	if req.ContentType != nil {
+		// Accept "Image/JPEG" or "text/plain; charset=utf-8" and store the base type
+		normalized := common.NormalizeContentType(*req.ContentType)
+		req.ContentType = &normalized
+	}
+	if req.ContentType != nil && !allowedMimeTypes[*req.ContentType] {
+		errs.Addf("contentType", "'%s' is not allowed", *req.ContentType)
+	}
+
+	if req.Folder != nil {
+		if err := common.ValidateFolder(strings.TrimSpace(*req.Folder)); err != nil {
+			errs.Add("folder", err.Error())
+		}
+	}
+
+	if req.Description != nil && len(strings.TrimSpace(*req.Description)) > maxDescriptionLen {
+		errs.Addf("description", "must be at most %d characters", maxDescriptionLen)
+	}
+
+	return errs
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,321 @@
+// Package main implements the proxy_share Lambda function
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName     = "660348065850-file-bucket"
+	userFilesTable = "UserFiles"
+	fileIDIndex    = "FileIdIndex"
+	fileAuditTable = "FileAudit"
+	// redirectExpiry is kept short: the URL is followed right away, and a
+	// copied URL shouldn't outlive the referer check by much
+	redirectExpiry = 60
+
+	downloadBudgetWindow = 24 * time.Hour
+)
+
+// dispositionEscaper quotes a file name for a Content-Disposition filename parameter
+var dispositionEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// filesAPI is the subset of the DynamoDB client used to look up and count
+// downloads of files; tests replace it
+type filesAPI interface {
+	common.GetItemAPI
+	common.QueryAPI
+	common.UpdateItemAPI
+}
+
+var (
+	s3PresignClient *s3.PresignClient
+	dynamoClient    filesAPI
+	auditLog        *common.AuditLogger
+	downloadCounter *common.RateCounter
+	// downloadByteBudget caps the bytes a user may download per UTC day
+	// (DOWNLOAD_BYTE_BUDGET, shared with download_file). Zero means unlimited.
+	downloadByteBudget int64
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	s3PresignClient = s3.NewPresignClient(s3.NewFromConfig(cfg))
+	db := dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	dynamoClient = db
+	auditLog = &common.AuditLogger{Client: db, Table: fileAuditTable, Geo: true}
+
+	downloadCounter = common.NewRateCounter(db, "download-bytes", downloadBudgetWindow)
+	if v := os.Getenv("DOWNLOAD_BYTE_BUDGET"); v != "" {
+		downloadByteBudget, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || downloadByteBudget < 0 {
+			log.Fatalf("Invalid DOWNLOAD_BYTE_BUDGET: %q", v)
+		}
+	}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleProxyShare)
+
+// handleProxyShare redirects to a short-lived presigned GET for a file the
+// caller owns or that is shared with them. Unlike download_file it answers
+// with a 302, so it can be used directly as a link or embed URL, and it
+// checks the file's referer allowlist before every redirect.
+func handleProxyShare(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	fileID := request.QueryStringParameters["fileId"]
+	if fileID == "" {
+		return common.Fail(common.Validation("Missing required parameter: fileId"))
+	}
+
+	file, err := common.GetOwnedFile(ctx, dynamoClient, userFilesTable, userID, fileID, false)
+	if errors.Is(err, common.ErrNotFound) {
+		// Not the caller's file: allow access if the caller is in the owner's acl
+		file, err = findSharedFile(ctx, fileID, userID)
+	} else if err == nil && !common.Confirmed(file.Status) {
+		err = common.ErrNotConfirmed
+	}
+	switch {
+	case errors.Is(err, common.ErrNotFound), errors.Is(err, common.ErrDeleted):
+		return common.Fail(common.NotFound("File not found"))
+	case errors.Is(err, common.ErrNotConfirmed):
+		// Pending uploads may have no object yet, and rejected ones are in quarantine
+		return common.Fail(common.Conflict(fmt.Sprintf("File can't be downloaded while %s", file.Status)))
+	case err != nil:
+		return common.Fail(common.Internal("DynamoDB read error", err))
+	}
+
+	// The owner is never limited by their own allowlist
+	shared := file.UserID != userID
+	if shared && len(file.ShareReferers) > 0 && !common.RefererAllowed(request, file.ShareReferers) {
+		auditLog.Log(ctx, file.UserID, fileID, "access_attempt", map[string]interface{}{
+			"reason":     "referer",
+			"operation":  "proxy_share",
+			"fileName":   file.FileName,
+			"accessedBy": userID,
+			"referer":    common.Referer(request),
+		})
+		return common.Fail(common.Forbidden("File can only be opened from an allowed site"))
+	}
+	if shared && len(file.ShareCIDRs) > 0 && !common.IPAllowed(common.TrustedClientIP(request), file.ShareCIDRs) {
+		auditLog.Log(ctx, file.UserID, fileID, "access_attempt", map[string]interface{}{
+			"reason":     "ip_address",
+			"operation":  "proxy_share",
+			"fileName":   file.FileName,
+			"accessedBy": userID,
+		})
+		return common.Fail(common.Forbidden("File can only be opened from an allowed network"))
+	}
+
+	// Nothing is presigned for files that haven't been scanned clean
+	if err := common.ScanGate(file); err != nil {
+		return scanBlocked(ctx, file, userID, "proxy_share", err)
+	}
+
+	// Limited shares are refused once used up, before touching the budget
+	limited := shared && file.ShareMaxDownloads > 0
+	if limited && common.ShareExhausted(file) {
+		return shareExhausted(ctx, file, userID)
+	}
+
+	// Count against the caller's daily download bytes, like download_file
+	if downloadByteBudget > 0 {
+		_, ok, err := downloadCounter.Add(ctx, userID, file.FileSize, downloadByteBudget)
+		if err != nil {
+			return common.Fail(common.Internal("Download budget counter error", err))
+		}
+		if !ok {
+			return common.Fail(common.Throttled("Daily download budget exceeded"))
+		}
+	}
+
+	// Take one download off the share; concurrent requests race for the last one
+	var downloadsLeft int64
+	if limited {
+		downloadsLeft, err = common.ConsumeShareDownload(ctx, dynamoClient, userFilesTable, file)
+		switch {
+		case errors.Is(err, common.ErrShareExhausted):
+			return shareExhausted(ctx, file, userID)
+		case err != nil:
+			return common.Fail(common.Internal("Share download counter error", err))
+		}
+	}
+
+	presignReq, err := s3PresignClient.PresignGetObject(ctx, buildGetObjectInput(file), s3.WithPresignExpires(redirectExpiry*time.Second))
+	if err != nil {
+		return common.Fail(common.Internal("Presign error", err))
+	}
+	// Served through the CDN when DOWNLOAD_URL_HOST is set
+	location, err := common.DownloadURL(presignReq.URL)
+	if err != nil {
+		return urlFailure(ctx, file, err)
+	}
+
+	metadata := map[string]interface{}{
+		"fileName":  file.FileName,
+		"s3Key":     file.S3Key,
+		"accessVia": "proxy_share",
+		"referer":   common.Referer(request),
+	}
+	if shared {
+		// Record non-owner access in the owner's audit trail
+		metadata["accessedBy"] = userID
+	}
+	if limited {
+		metadata["downloadsLeft"] = downloadsLeft
+	}
+	auditLog.Log(ctx, file.UserID, fileID, "download", metadata)
+	if limited && downloadsLeft == 0 {
+		auditLog.Log(ctx, file.UserID, fileID, "share_exhausted", map[string]interface{}{
+			"fileName":     file.FileName,
+			"accessedBy":   userID,
+			"accessVia":    "proxy_share",
+			"maxDownloads": file.ShareMaxDownloads,
+		})
+	}
+
+	response := common.BuildResponse(302, map[string]string{"location": location})
+	response.Headers["Location"] = location
+	// Every visit must go through the referer check again
+	response.Headers["Cache-Control"] = "no-store"
+	return response, nil
+}
+
+// scanBlocked refuses a download ScanGate rejected. Attempts on infected
+// files are recorded in the owner's audit trail.
+func scanBlocked(ctx context.Context, file *common.File, userID, operation string, err error) (events.APIGatewayProxyResponse, error) {
+	if errors.Is(err, common.ErrInfected) {
+		metadata := map[string]interface{}{
+			"reason":    "infected",
+			"operation": operation,
+			"fileName":  file.FileName,
+		}
+		if file.UserID != userID {
+			metadata["accessedBy"] = userID
+		}
+		auditLog.Log(ctx, file.UserID, file.FileID, "access_attempt", metadata)
+	}
+	return common.ScanBlocked(err), nil
+}
+
+// shareExhausted refuses a download from a share with no downloads left
+func shareExhausted(ctx context.Context, file *common.File, userID string) (events.APIGatewayProxyResponse, error) {
+	auditLog.Log(ctx, file.UserID, file.FileID, "access_attempt", map[string]interface{}{
+		"reason":       "downloads_exhausted",
+		"operation":    "proxy_share",
+		"fileName":     file.FileName,
+		"accessedBy":   userID,
+		"maxDownloads": file.ShareMaxDownloads,
+	})
+	return common.Fail(common.Gone("This share has reached its download limit"))
+}
+
+// buildGetObjectInput describes the presigned GET for a file, shown inline
+// so images and PDFs can be embedded, with the stored content type so they
+// render even if the object's own type is wrong. Pre-compressed files get a
+// Content-Encoding override so browsers decompress them.
+func buildGetObjectInput(file *common.File) *s3.GetObjectInput {
+	input := &s3.GetObjectInput{
+		Bucket:                     aws.String(bucketName),
+		Key:                        aws.String(file.S3Key),
+		ResponseContentDisposition: aws.String(fmt.Sprintf(`inline; filename="%s"`, dispositionEscaper.Replace(file.FileName))),
+	}
+	if contentType := common.NormalizeContentType(file.ContentType); contentType != "" {
+		input.ResponseContentType = aws.String(contentType)
+	}
+	if file.ContentEncoding != "" {
+		input.ResponseContentEncoding = aws.String(file.ContentEncoding)
+	}
+	return input
+}
+
+// findSharedFile looks up a file by ID through the fileId GSI and returns it
+// only if userID is in its acl. Like common.GetOwnedFile it returns
+// common.ErrNotFound if no such file is shared with the user and
+// common.ErrDeleted if it is in trash; common.ErrNotConfirmed means the
+// upload isn't confirmed.
+func findSharedFile(ctx context.Context, fileID, userID string) (*common.File, error) {
+	opCtx, cancel := common.WithDeadline(ctx)
+	result, err := dynamoClient.Query(opCtx, &dynamodb.QueryInput{
+		TableName:              aws.String(userFilesTable),
+		IndexName:              aws.String(fileIDIndex),
+		KeyConditionExpression: aws.String("fileId = :fileId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
+		Limit: aws.Int32(1),
+	})
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Items) == 0 {
+		return nil, common.ErrNotFound
+	}
+
+	var file common.File
+	if err := attributevalue.UnmarshalMap(result.Items[0], &file); err != nil {
+		return nil, err
+	}
+
+	for _, grantee := range file.ACL {
+		if grantee == userID {
+			switch {
+			case file.Status == common.StatusDeleted:
+				return &file, common.ErrDeleted
+			case !common.Confirmed(file.Status):
+				return &file, common.ErrNotConfirmed
+			}
+			return &file, nil
+		}
+	}
+	return nil, common.ErrNotFound
+}
+
+// urlFailure answers a presigned URL that can't be handed out with 500.
+// A non-https URL means the S3 endpoint is misconfigured, so it also leaves
+// a security_alert entry in the owner's audit trail.
+func urlFailure(ctx context.Context, file *common.File, err error) (events.APIGatewayProxyResponse, error) {
+	if errors.Is(err, common.ErrInsecureURL) {
+		auditLog.Log(ctx, file.UserID, file.FileID, "security_alert", map[string]interface{}{
+			"reason":   "insecure_url",
+			"fileName": file.FileName,
+			"error":    err.Error(),
+		})
+	}
+	return common.Fail(common.Internal("Download URL error", err))
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+func TestBuildGetObjectInput(t *testing.T) {
+	input := buildGetObjectInput(&common.File{FileName: `chart "v2".png`, S3Key: "users/u/uploads/f-chart.png"})
+	if got, want := aws.ToString(input.ResponseContentDisposition), `inline; filename="chart \"v2\".png"`; got != want {
+		t.Errorf("ResponseContentDisposition = %q, want %q", got, want)
+	}
+	if input.ResponseContentEncoding != nil {
+		t.Errorf("ResponseContentEncoding = %q, want unset", aws.ToString(input.ResponseContentEncoding))
+	}
+
+	input = buildGetObjectInput(&common.File{FileName: "data.json", ContentEncoding: "gzip"})
+	if got := aws.ToString(input.ResponseContentEncoding); got != "gzip" {
+		t.Errorf("ResponseContentEncoding = %q, want gzip", got)
+	}
+
+	input = buildGetObjectInput(&common.File{FileName: "chart.png", ContentType: "Image/PNG"})
+	if got := aws.ToString(input.ResponseContentType); got != "image/png" {
+		t.Errorf("ResponseContentType = %q, want image/png", got)
+	}
+}
+
+// fakeFiles holds one file row, returned to its owner by GetItem and to
+// anyone through the fileId index
+type fakeFiles struct {
+	row map[string]types.AttributeValue
+}
+
+func (f *fakeFiles) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	if reflect.DeepEqual(params.Key["userId"], f.row["userId"]) {
+		return &dynamodb.GetItemOutput{Item: f.row}, nil
+	}
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func (f *fakeFiles) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	return &dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{f.row}}, nil
+}
+
+func (f *fakeFiles) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeFiles) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// sharedRow is file-1 of user-123 with status, shared with user-456
+func sharedRow(status string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":   &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId":   &types.AttributeValueMemberS{Value: "file-1"},
+		"fileName": &types.AttributeValueMemberS{Value: "report.pdf"},
+		"s3Key":    &types.AttributeValueMemberS{Value: "users/user-123/uploads/file-1-report.pdf"},
+		"status":   &types.AttributeValueMemberS{Value: status},
+		"acl":      &types.AttributeValueMemberSS{Value: []string{"user-456"}},
+	}
+}
+
+func TestProxyShareRefusesUnconfirmedFiles(t *testing.T) {
+	defer func(client filesAPI, audit common.PutItemAPI) { dynamoClient, auditLog.Client = client, audit }(dynamoClient, auditLog.Client)
+	handler := common.Chain(common.FlushBackground, common.HandleErrors, common.RequireUser)(handleProxyShare)
+
+	for _, status := range []string{"pending", common.StatusRejected} {
+		// The owner reads the row directly, user-456 through the share
+		for _, caller := range []string{"user-123", "user-456"} {
+			files := &fakeFiles{row: sharedRow(status)}
+			dynamoClient, auditLog.Client = files, files
+			response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+				HTTPMethod:            "GET",
+				QueryStringParameters: map[string]string{"fileId": "file-1"},
+				RequestContext: events.APIGatewayProxyRequestContext{
+					Authorizer: map[string]interface{}{"claims": map[string]interface{}{"sub": caller}},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != 409 || !strings.Contains(response.Body, "while "+status) {
+				t.Errorf("%s opening a %s file = %d %s, want 409", caller, status, response.StatusCode, response.Body)
+			}
+		}
+	}
+}
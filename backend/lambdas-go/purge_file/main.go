@@ -0,0 +1,201 @@
+// Package main implements the purge_file Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName     = "660348065850-file-bucket"
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+)
+
+// PurgeRequest represents the request body
+type PurgeRequest struct {
+	FileID string `json:"fileId"`
+}
+
+// PurgeResponse represents the response body
+type PurgeResponse struct {
+	Message  string `json:"message"`
+	FileID   string `json:"fileId"`
+	FileName string `json:"fileName"`
+}
+
+var (
+	s3Client     *s3.Client
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+	// minTrashAge is how long a file must sit in trash before it can be
+	// purged, from PURGE_MIN_TRASH_AGE (Go duration, e.g. "24h"). Zero disables it.
+	minTrashAge time.Duration
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	s3Client = s3.NewFromConfig(cfg)
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+
+	if v := os.Getenv("PURGE_MIN_TRASH_AGE"); v != "" {
+		minTrashAge, err = time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid PURGE_MIN_TRASH_AGE: %v", err)
+		}
+	}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handlePurge)
+
+// handlePurge handles an authenticated request
+func handlePurge(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req PurgeRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+
+	// Validate required fields
+	if req.FileID == "" {
+		return common.Fail(common.Validation("Missing required field: fileId"))
+	}
+
+	// Get file metadata from DynamoDB
+	opCtx, cancel := common.WithDeadline(ctx)
+	result, err := dynamoClient.GetItem(opCtx, &dynamodb.GetItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	cancel()
+	if err != nil {
+		return common.Fail(common.Internal("DynamoDB get error", err))
+	}
+
+	if result.Item == nil {
+		return common.Fail(common.NotFound("File not found"))
+	}
+
+	var file common.File
+	if err := attributevalue.UnmarshalMap(result.Item, &file); err != nil {
+		return common.Fail(common.Internal("Unmarshal error", err))
+	}
+
+	// Only files already in trash can be purged
+	if file.Status != "deleted" {
+		return common.Fail(common.Conflict("File must be moved to trash before it can be purged"))
+	}
+
+	// Files under legal hold can't be purged until the hold is released
+	if file.LegalHold {
+		auditLog.Log(ctx, userID, req.FileID, "access_attempt", map[string]interface{}{
+			"reason":    "legal_hold",
+			"operation": "purge",
+			"fileName":  file.FileName,
+		})
+		return common.Fail(common.Locked("File is under legal hold"))
+	}
+
+	// Enforce the minimum time in trash
+	if minTrashAge > 0 {
+		deletedAt, err := time.Parse(time.RFC3339, file.DeletedAt)
+		if err != nil {
+			return common.Fail(common.Internal(fmt.Sprintf("Invalid deletedAt %q on file %s", file.DeletedAt, file.FileID), err))
+		}
+		if wait := time.Until(deletedAt.Add(minTrashAge)); wait > 0 {
+			return common.Fail(common.Conflict(fmt.Sprintf("File can be purged in %s", wait.Round(time.Second))))
+		}
+	}
+
+	// Delete file from S3. Keep the metadata if this fails so the purge can be retried.
+	opCtx, cancel = common.WithDeadline(ctx)
+	_, err = s3Client.DeleteObject(opCtx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(file.S3Key),
+	})
+	cancel()
+	if err != nil {
+		return common.Fail(common.Internal("S3 delete error", err))
+	}
+
+	// Remove metadata, guarded against a concurrent restore or legal hold
+	opCtx, cancel = common.WithDeadline(ctx)
+	_, err = dynamoClient.DeleteItem(opCtx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+		},
+		ConditionExpression: aws.String("#status = :deleted AND " + common.NoLegalHoldCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":deleted": &types.AttributeValueMemberS{Value: "deleted"},
+		},
+	})
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return common.Fail(common.Conflict("File is no longer in trash or was put under legal hold"))
+		}
+		return common.Fail(common.Internal("DynamoDB delete error", err))
+	}
+
+	// Log audit event
+	auditLog.Log(ctx, userID, req.FileID, "purge", map[string]interface{}{
+		"fileName":  file.FileName,
+		"s3Key":     file.S3Key,
+		"fileSize":  file.FileSize,
+		"deletedAt": file.DeletedAt,
+	})
+
+	response := PurgeResponse{
+		Message:  "File permanently deleted",
+		FileID:   req.FileID,
+		FileName: file.FileName,
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
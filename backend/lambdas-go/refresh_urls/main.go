@@ -0,0 +1,268 @@
+// Package main implements the refresh_urls Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName     = "660348065850-file-bucket"
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	presignExpiry  = 3600 // 1 hour
+	maxFileIDs     = 100
+	maxConcurrency = 10
+
+	defaultPresignRateThreshold = 500
+	presignRateWindow           = time.Hour
+	anomalyHighPresignRate      = "high_presign_rate"
+)
+
+// RefreshRequest represents the request body
+type RefreshRequest struct {
+	FileIDs []string `json:"fileIds"`
+}
+
+// RefreshResponse represents the response body
+type RefreshResponse struct {
+	URLs    map[string]PresignedURL `json:"urls"`
+	Missing []string                `json:"missing"`
+	Deleted []string                `json:"deleted"`
+	// NotReady lists files whose upload isn't confirmed yet, e.g. pending
+	NotReady []string `json:"notReady"`
+	// Scanning and Infected list files ScanGate refused, see download_file
+	Scanning []string `json:"scanning"`
+	Infected []string `json:"infected"`
+	// Anomalies flags unusual activity on the caller's account, e.g. "high_presign_rate"
+	Anomalies []string `json:"anomalies,omitempty"`
+}
+
+// PresignedURL is a re-issued download URL for one file
+type PresignedURL struct {
+	URL       string `json:"url"`
+	ExpiresIn int    `json:"expiresIn"`
+}
+
+// refreshResult is the outcome for one file
+type refreshResult struct {
+	fileID string
+	url    string
+	err    error
+}
+
+var (
+	s3PresignClient *s3.PresignClient
+	dynamoClient    *dynamodb.Client
+	// getClient looks up the files; tests replace it
+	getClient      common.GetItemAPI
+	auditLog       *common.AuditLogger
+	presignCounter *common.RateCounter
+	// presignRateThreshold is shared with download_file (PRESIGN_RATE_THRESHOLD)
+	presignRateThreshold int64 = defaultPresignRateThreshold
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	s3PresignClient = s3.NewPresignClient(s3.NewFromConfig(cfg))
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	getClient = dynamoClient
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+	presignCounter = common.NewRateCounter(dynamoClient, "presign", presignRateWindow)
+
+	if v := os.Getenv("PRESIGN_RATE_THRESHOLD"); v != "" {
+		presignRateThreshold, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || presignRateThreshold <= 0 {
+			log.Fatalf("Invalid PRESIGN_RATE_THRESHOLD: %q", v)
+		}
+	}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleRefresh)
+
+// handleRefresh handles an authenticated request
+func handleRefresh(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req RefreshRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+
+	fileIDs, errs := validateRefreshRequest(&req)
+	if errs.HasErrors() {
+		return common.Fail(errs)
+	}
+
+	results := refreshAll(ctx, userID, fileIDs)
+
+	response := RefreshResponse{
+		URLs:     make(map[string]PresignedURL, len(results)),
+		Missing:  []string{},
+		Deleted:  []string{},
+		NotReady: []string{},
+		Scanning: []string{},
+		Infected: []string{},
+	}
+	for _, r := range results {
+		switch {
+		case r.err == nil:
+			response.URLs[r.fileID] = PresignedURL{URL: r.url, ExpiresIn: presignExpiry}
+		case errors.Is(r.err, common.ErrNotFound):
+			response.Missing = append(response.Missing, r.fileID)
+		case errors.Is(r.err, common.ErrDeleted):
+			response.Deleted = append(response.Deleted, r.fileID)
+		case errors.Is(r.err, common.ErrNotConfirmed):
+			response.NotReady = append(response.NotReady, r.fileID)
+		case errors.Is(r.err, common.ErrScanPending):
+			response.Scanning = append(response.Scanning, r.fileID)
+		case errors.Is(r.err, common.ErrInfected):
+			response.Infected = append(response.Infected, r.fileID)
+			auditLog.Log(ctx, userID, r.fileID, "access_attempt", map[string]interface{}{
+				"reason":    "infected",
+				"operation": "refresh_urls",
+			})
+		default:
+			return common.Fail(common.Internal("Refresh error for file "+r.fileID, r.err))
+		}
+	}
+
+	// Refreshed URLs count toward the same hourly presign rate as downloads
+	if n := int64(len(response.URLs)); n > 0 {
+		total, _, err := presignCounter.Add(ctx, userID, n, 0)
+		if err != nil {
+			// Never fail a refresh because the counter is unavailable
+			log.Printf("Presign counter error: %v", err)
+		} else if total > presignRateThreshold {
+			response.Anomalies = append(response.Anomalies, anomalyHighPresignRate)
+			// Audit only the first crossing per window so the trail isn't flooded
+			if total-n <= presignRateThreshold {
+				auditLog.Log(ctx, userID, "*", "access_attempt", map[string]interface{}{
+					"reason":    anomalyHighPresignRate,
+					"count":     total,
+					"threshold": presignRateThreshold,
+					"window":    presignRateWindow.String(),
+					"source":    "refresh_urls",
+				})
+			}
+		}
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// validateRefreshRequest checks the request and returns the de-duplicated file IDs
+func validateRefreshRequest(req *RefreshRequest) ([]string, *common.ValidationErrors) {
+	errs := &common.ValidationErrors{}
+
+	if len(req.FileIDs) == 0 {
+		errs.Add("fileIds", "is required")
+		return nil, errs
+	}
+
+	seen := make(map[string]bool, len(req.FileIDs))
+	fileIDs := make([]string, 0, len(req.FileIDs))
+	for i, fileID := range req.FileIDs {
+		if fileID == "" {
+			errs.Add(fmt.Sprintf("fileIds.%d", i), "must not be empty")
+			continue
+		}
+		if !seen[fileID] {
+			seen[fileID] = true
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	if len(fileIDs) > maxFileIDs {
+		errs.Addf("fileIds", "must have at most %d entries", maxFileIDs)
+	}
+
+	return fileIDs, errs
+}
+
+// refreshAll looks up and presigns every file with at most maxConcurrency
+// lookups in flight. Results are in the same order as fileIDs.
+func refreshAll(ctx context.Context, userID string, fileIDs []string) []refreshResult {
+	results := make([]refreshResult, len(fileIDs))
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+
+	for i, fileID := range fileIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, fileID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			url, err := refreshOne(ctx, userID, fileID)
+			results[i] = refreshResult{fileID: fileID, url: url, err: err}
+		}(i, fileID)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// refreshOne issues a new presigned GET for one of the user's files. Like
+// download_file it only serves confirmed uploads.
+func refreshOne(ctx context.Context, userID, fileID string) (string, error) {
+	file, err := common.GetOwnedFile(ctx, getClient, userFilesTable, userID, fileID, false)
+	if err != nil {
+		return "", err
+	}
+	if !common.Confirmed(file.Status) {
+		return "", common.ErrNotConfirmed
+	}
+	if err := common.ScanGate(file); err != nil {
+		return "", err
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket:                     aws.String(bucketName),
+		Key:                        aws.String(file.S3Key),
+		ResponseContentDisposition: aws.String(fmt.Sprintf(`attachment; filename="%s"`, file.FileName)),
+	}
+	if contentType := common.NormalizeContentType(file.ContentType); contentType != "" {
+		input.ResponseContentType = aws.String(contentType)
+	}
+	if file.ContentEncoding != "" {
+		input.ResponseContentEncoding = aws.String(file.ContentEncoding)
+	}
+
+	presignReq, err := s3PresignClient.PresignGetObject(ctx, input, s3.WithPresignExpires(time.Duration(presignExpiry)*time.Second))
+	if err != nil {
+		return "", fmt.Errorf("presign: %w", err)
+	}
+	return common.DownloadURL(presignReq.URL)
+}
+
+func main() {
+	lambda.Start(Handler)
+}
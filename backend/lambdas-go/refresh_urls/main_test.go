@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+// fakeFiles serves user-123's files by fileId
+type fakeFiles map[string]map[string]types.AttributeValue
+
+func (f fakeFiles) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f[params.Key["fileId"].(*types.AttributeValueMemberS).Value]}, nil
+}
+
+// file is a record of user-123's file fileID, scanned clean
+func file(fileID, status string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":     &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId":     &types.AttributeValueMemberS{Value: fileID},
+		"fileName":   &types.AttributeValueMemberS{Value: fileID + ".txt"},
+		"s3Key":      &types.AttributeValueMemberS{Value: "users/user-123/uploads/" + fileID + ".txt"},
+		"status":     &types.AttributeValueMemberS{Value: status},
+		"scanStatus": &types.AttributeValueMemberS{Value: common.ScanStatusClean},
+	}
+}
+
+func TestRefreshSkipsUnconfirmedFiles(t *testing.T) {
+	defer func(c common.GetItemAPI, p *s3.PresignClient) { getClient, s3PresignClient = c, p }(getClient, s3PresignClient)
+	getClient = fakeFiles{
+		"f-pending":   file("f-pending", "pending"),
+		"f-rejected":  file("f-rejected", common.StatusRejected),
+		"f-uploaded":  file("f-uploaded", common.StatusUploaded),
+		"f-confirmed": file("f-confirmed", common.StatusConfirmed),
+	}
+	s3PresignClient = s3.NewPresignClient(s3.New(s3.Options{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}, nil
+		}),
+	}))
+
+	results := refreshAll(context.Background(), "user-123", []string{"f-pending", "f-rejected", "f-uploaded", "f-confirmed"})
+	for _, r := range results[:2] {
+		if !errors.Is(r.err, common.ErrNotConfirmed) || r.url != "" {
+			t.Errorf("%s: url %q, err %v; want ErrNotConfirmed", r.fileID, r.url, r.err)
+		}
+	}
+	for _, r := range results[2:] {
+		if r.err != nil || r.url == "" {
+			t.Errorf("%s: url %q, err %v; want a URL", r.fileID, r.url, r.err)
+		}
+	}
+}
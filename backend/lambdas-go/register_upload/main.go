@@ -0,0 +1,234 @@
+// Package main implements the register_upload Lambda function
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+)
+
+// errRejected marks an object that can never be registered; retrying the
+// event would not help
+var errRejected = errors.New("rejected")
+
+var (
+	s3Client     *s3.Client
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+	// quarantine has no Bucket: objects are quarantined within the bucket
+	// their event came from
+	quarantine *common.Quarantine
+	// registrationSecret verifies tokens signed by upload_file (REGISTRATION_TOKEN_SECRET)
+	registrationSecret []byte
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	s3Client = s3.NewFromConfig(cfg)
+	quarantine = common.NewQuarantine(s3Client, "")
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable, NoClientIP: true}
+
+	registrationSecret = []byte(os.Getenv("REGISTRATION_TOKEN_SECRET"))
+	if len(registrationSecret) == 0 {
+		log.Fatalf("REGISTRATION_TOKEN_SECRET is required")
+	}
+}
+
+// Handler handles S3 ObjectCreated events. Objects that can't be registered
+// are logged and skipped; other failures are returned so Lambda retries the
+// event.
+func Handler(ctx context.Context, event events.S3Event) error {
+	var failed int
+	for _, record := range event.Records {
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			log.Printf("Invalid object key %q: %v", record.S3.Object.Key, err)
+			continue
+		}
+
+		err = registerObject(ctx, record.S3.Bucket.Name, key, record.S3.Object.Size)
+		switch {
+		case errors.Is(err, errRejected):
+			log.Printf("Not registering s3://%s/%s: %v", record.S3.Bucket.Name, key, err)
+		case isNotFound(err):
+			// Deleted before the event arrived; retrying would find it gone again
+			log.Printf("Not registering s3://%s/%s: object no longer exists", record.S3.Bucket.Name, key)
+		case err != nil:
+			log.Printf("Failed to register s3://%s/%s: %v", record.S3.Bucket.Name, key, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to register %d of %d objects", failed, len(event.Records))
+	}
+	return nil
+}
+
+// registerObject writes the UserFiles row for an uploaded object from its
+// registration token
+func registerObject(ctx context.Context, bucket, key string, size int64) error {
+	var head *s3.HeadObjectOutput
+	err := common.Retry(ctx, func(ctx context.Context) error {
+		opCtx, cancel := common.WithDeadline(ctx)
+		defer cancel()
+		var err error
+		head, err = s3Client.HeadObject(opCtx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("head object: %w", err)
+	}
+
+	token, ok := head.Metadata[common.RegistrationMetaKey]
+	if !ok {
+		// Uploaded through the presign flow, which already wrote the row
+		return fmt.Errorf("%w: no registration metadata", errRejected)
+	}
+	reg, err := common.VerifyRegistration(token, registrationSecret)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errRejected, err)
+	}
+	if err := checkRegistration(reg, key, size); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	metadata := common.File{
+		UserID:            reg.UserID,
+		FileID:            reg.FileID,
+		FileName:          reg.FileName,
+		ContentType:       reg.ContentType,
+		Folder:            reg.Folder,
+		FileSize:          size,
+		S3Key:             key,
+		Status:            common.StatusUploaded,
+		CreatedAt:         now.Format(time.RFC3339),
+		UploadStartedAt:   reg.UploadStartedAt,
+		UploadCompletedAt: common.UploadCompletedAt(head.LastModified, now),
+		ContentEncoding:   reg.ContentEncoding,
+		VersionID:         common.ObjectVersionID(head.VersionId),
+		ETag:              aws.ToString(head.ETag),
+		ChecksumSHA256:    reg.ChecksumSHA256,
+	}
+	if reg.ExpiresAt != "" {
+		if expiresAt, err := time.Parse(time.RFC3339, reg.ExpiresAt); err == nil {
+			metadata.ExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+			metadata.ExpiryEpoch = expiresAt.Unix()
+		}
+	}
+
+	// Content that doesn't look like its declared type is registered as
+	// rejected, with the object in quarantine
+	checker := *quarantine
+	checker.Bucket = bucket
+	quarantined, err := checker.Check(ctx, &metadata, metadata.VersionID, size)
+	if err != nil {
+		return err
+	}
+	versionID := metadata.VersionID
+	if quarantined != nil {
+		metadata.Status = common.StatusRejected
+		metadata.QuarantineKey = quarantined.Key
+		metadata.SniffedContentType = quarantined.SniffedContentType
+		metadata.VersionID = ""
+	}
+
+	item, err := attributevalue.MarshalMap(metadata)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	// S3 delivers events at least once, so a row for this fileId with the
+	// same key is a duplicate delivery; any other row is a collision
+	err = common.Retry(ctx, func(ctx context.Context) error {
+		opCtx, cancel := common.WithDeadline(ctx)
+		defer cancel()
+		_, err := dynamoClient.PutItem(opCtx, &dynamodb.PutItemInput{
+			TableName:           aws.String(userFilesTable),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(fileId) OR s3Key = :s3Key"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":s3Key": &types.AttributeValueMemberS{Value: key},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		if quarantined != nil {
+			checker.Discard(ctx, quarantined)
+		}
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return fmt.Errorf("%w: fileId %s already exists", errRejected, reg.FileID)
+		}
+		return fmt.Errorf("put item: %w", err)
+	}
+	if quarantined != nil {
+		checker.Finish(ctx, &metadata, versionID)
+	}
+
+	auditLog.Write(ctx, reg.UserID, reg.FileID, "upload", map[string]interface{}{
+		"fileName":        reg.FileName,
+		"contentType":     reg.ContentType,
+		"fileSize":        size,
+		"s3Key":           key,
+		"contentEncoding": reg.ContentEncoding,
+		"folder":          reg.Folder,
+		"registration":    "event",
+		"versionId":       metadata.VersionID,
+		"status":          metadata.Status,
+	})
+	if quarantined != nil {
+		auditLog.Write(ctx, reg.UserID, reg.FileID, "access_attempt", quarantined.AuditMetadata(&metadata))
+	}
+	return nil
+}
+
+// isNotFound reports whether err means the object or item does not exist
+func isNotFound(err error) bool {
+	kind, _ := common.ClassifyAWSError(err)
+	return kind == common.KindNotFound
+}
+
+// checkRegistration makes sure the token belongs to this object
+func checkRegistration(reg *common.Registration, key string, size int64) error {
+	if reg.S3Key != key {
+		return fmt.Errorf("%w: token is for key %q", errRejected, reg.S3Key)
+	}
+	if reg.FileSize != size {
+		return fmt.Errorf("%w: object is %d bytes, token declares %d", errRejected, size, reg.FileSize)
+	}
+	return nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
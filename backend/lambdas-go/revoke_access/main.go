@@ -0,0 +1,152 @@
+// Package main implements the revoke_access Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	maxACLSize     = 50
+)
+
+// AccessRequest represents the request body
+type AccessRequest struct {
+	FileID  string   `json:"fileId"`
+	UserIDs []string `json:"userIds"`
+}
+
+// AccessResponse represents the response body
+type AccessResponse struct {
+	Message string   `json:"message"`
+	FileID  string   `json:"fileId"`
+	ACL     []string `json:"acl"`
+}
+
+var (
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleRevoke)
+
+// handleRevoke handles an authenticated request
+func handleRevoke(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req AccessRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+
+	// Validate required fields
+	if req.FileID == "" || len(req.UserIDs) == 0 {
+		return common.Fail(common.Validation("Missing required fields: fileId, userIds"))
+	}
+	if len(req.UserIDs) > maxACLSize {
+		return common.Fail(common.Validation(fmt.Sprintf("Cannot revoke access for more than %d users", maxACLSize)))
+	}
+
+	// Validate revoked users. The owner's access comes from owning the
+	// partition, so it can never be revoked.
+	revoked := make([]string, 0, len(req.UserIDs))
+	seen := make(map[string]bool)
+	for _, revokee := range req.UserIDs {
+		if !common.IsValidUserID(revokee) {
+			return common.Fail(common.Validation(fmt.Sprintf("Invalid userId '%s'", revokee)))
+		}
+		if revokee == userID {
+			return common.Fail(common.Validation("Owners cannot remove their own access"))
+		}
+		if !seen[revokee] {
+			seen[revokee] = true
+			revoked = append(revoked, revokee)
+		}
+	}
+
+	// Remove users from the file's acl set
+	opCtx, cancel := common.WithDeadline(ctx)
+	result, err := dynamoClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+		},
+		UpdateExpression:    aws.String("DELETE acl :revoked SET updatedAt = :updatedAt"),
+		ConditionExpression: aws.String("attribute_exists(fileId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":revoked":   &types.AttributeValueMemberSS{Value: revoked},
+			":updatedAt": &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return common.Fail(common.NotFound("File not found"))
+		}
+		return common.Fail(common.Internal("DynamoDB update error", err))
+	}
+
+	acl := []string{}
+	if av, ok := result.Attributes["acl"]; ok {
+		if err := attributevalue.Unmarshal(av, &acl); err != nil {
+			return common.Fail(common.Internal("Unmarshal error", err))
+		}
+	}
+
+	// Log audit event
+	auditLog.Log(ctx, userID, req.FileID, "share", map[string]interface{}{
+		"operation": "revoke",
+		"userIds":   revoked,
+	})
+
+	response := AccessResponse{
+		Message: "Access revoked successfully",
+		FileID:  req.FileID,
+		ACL:     acl,
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+func main() {
+	lambda.Start(Handler)
+}
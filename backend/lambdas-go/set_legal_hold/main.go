@@ -0,0 +1,214 @@
+// Package main implements the set_legal_hold Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName     = "660348065850-file-bucket"
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	maxReasonLen   = 500
+)
+
+// LegalHoldRequest represents the request body. An admin sets or releases
+// the hold on another user's file.
+type LegalHoldRequest struct {
+	UserID string `json:"userId"`
+	FileID string `json:"fileId"`
+	Hold   *bool  `json:"hold"`
+	// Reason is required when setting a hold, e.g. a case reference
+	Reason string `json:"reason"`
+}
+
+// LegalHoldResponse represents the response body
+type LegalHoldResponse struct {
+	Message   string `json:"message"`
+	UserID    string `json:"userId"`
+	FileID    string `json:"fileId"`
+	LegalHold bool   `json:"legalHold"`
+}
+
+var (
+	s3Client     *s3.Client
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+	// objectLock also puts an S3 Object Lock legal hold on the object. The
+	// bucket must have Object Lock enabled (LEGAL_HOLD_OBJECT_LOCK).
+	objectLock bool
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	s3Client = s3.NewFromConfig(cfg)
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+
+	switch v := os.Getenv("LEGAL_HOLD_OBJECT_LOCK"); v {
+	case "", "false":
+	case "true":
+		objectLock = true
+	default:
+		log.Fatalf("Invalid LEGAL_HOLD_OBJECT_LOCK: %q", v)
+	}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+	common.RequireAdmin,
+)(handleLegalHold)
+
+// handleLegalHold handles a request from an admin
+func handleLegalHold(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	adminID := common.UserID(ctx)
+
+	// Parse request body
+	var req LegalHoldRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+	if errs := validateLegalHoldRequest(&req); errs.HasErrors() {
+		return common.Fail(errs)
+	}
+	hold := *req.Hold
+
+	// Files in trash can be held too, which keeps them from being purged
+	file, err := common.GetOwnedFile(ctx, dynamoClient, userFilesTable, req.UserID, req.FileID, true)
+	switch {
+	case errors.Is(err, common.ErrNotFound):
+		return common.Fail(common.NotFound("File not found"))
+	case err != nil && !errors.Is(err, common.ErrDeleted):
+		return common.Fail(common.Internal("DynamoDB get error", err))
+	}
+
+	response := LegalHoldResponse{UserID: req.UserID, FileID: req.FileID, LegalHold: hold}
+	if file.LegalHold == hold {
+		response.Message = "Legal hold unchanged"
+		return common.BuildResponse(200, response), nil
+	}
+
+	// Lock the object first so the record never claims a hold S3 doesn't enforce
+	if objectLock {
+		status := s3types.ObjectLockLegalHoldStatusOff
+		if hold {
+			status = s3types.ObjectLockLegalHoldStatusOn
+		}
+		opCtx, cancel := common.WithDeadline(ctx)
+		_, err = s3Client.PutObjectLegalHold(opCtx, &s3.PutObjectLegalHoldInput{
+			Bucket:    aws.String(bucketName),
+			Key:       aws.String(file.S3Key),
+			LegalHold: &s3types.ObjectLockLegalHold{Status: status},
+		})
+		cancel()
+		if err != nil {
+			return common.Fail(common.Internal("S3 legal hold error", err))
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: req.UserID},
+			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+		},
+		ConditionExpression: aws.String("s3Key = :s3Key"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":s3Key":     &types.AttributeValueMemberS{Value: file.S3Key},
+			":updatedAt": &types.AttributeValueMemberS{Value: now},
+		},
+	}
+	if hold {
+		input.UpdateExpression = aws.String("SET legalHold = :hold, legalHoldAt = :updatedAt, legalHoldBy = :adminId, legalHoldReason = :reason, updatedAt = :updatedAt")
+		input.ExpressionAttributeValues[":hold"] = &types.AttributeValueMemberBOOL{Value: true}
+		input.ExpressionAttributeValues[":adminId"] = &types.AttributeValueMemberS{Value: adminID}
+		input.ExpressionAttributeValues[":reason"] = &types.AttributeValueMemberS{Value: req.Reason}
+	} else {
+		// Removing the attribute is what common.NoLegalHoldCondition checks for
+		input.UpdateExpression = aws.String("REMOVE legalHold, legalHoldAt, legalHoldBy, legalHoldReason SET updatedAt = :updatedAt")
+	}
+
+	opCtx, cancel := common.WithDeadline(ctx)
+	_, err = dynamoClient.UpdateItem(opCtx, input)
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return common.Fail(common.Conflict("File was changed or purged meanwhile, please retry"))
+		}
+		return common.Fail(common.Internal("DynamoDB update error", err))
+	}
+
+	// Audited on the owner's trail so it shows up next to the file's history
+	metadata := map[string]interface{}{
+		"hold":       hold,
+		"fileName":   file.FileName,
+		"s3Key":      file.S3Key,
+		"adminId":    adminID,
+		"objectLock": objectLock,
+	}
+	if req.Reason != "" {
+		metadata["reason"] = req.Reason
+	}
+	auditLog.Log(ctx, req.UserID, req.FileID, "legal_hold", metadata)
+
+	response.Message = "Legal hold released"
+	if hold {
+		response.Message = "Legal hold set"
+	}
+	return common.BuildResponse(200, response), nil
+}
+
+// validateLegalHoldRequest checks the request fields
+func validateLegalHoldRequest(req *LegalHoldRequest) *common.ValidationErrors {
+	errs := &common.ValidationErrors{}
+
+	if !common.IsValidUserID(req.UserID) {
+		errs.Add("userId", "is required and must be a valid user ID")
+	}
+	if req.FileID == "" {
+		errs.Add("fileId", "is required")
+	}
+	if req.Hold == nil {
+		errs.Add("hold", "is required")
+	} else if *req.Hold && req.Reason == "" {
+		errs.Add("reason", "is required when setting a hold")
+	}
+	if len(req.Reason) > maxReasonLen {
+		errs.Addf("reason", "must be at most %d characters", maxReasonLen)
+	}
+
+	return errs
+}
+
+func main() {
+	lambda.Start(Handler)
+}
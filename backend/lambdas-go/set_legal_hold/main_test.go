@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateLegalHoldRequest(t *testing.T) {
+	on, off := true, false
+	tests := []struct {
+		name   string
+		req    LegalHoldRequest
+		fields []string
+	}{
+		{"set", LegalHoldRequest{UserID: "user-1", FileID: "file-1", Hold: &on, Reason: "case 42"}, nil},
+		{"release without reason", LegalHoldRequest{UserID: "user-1", FileID: "file-1", Hold: &off}, nil},
+		{"set without reason", LegalHoldRequest{UserID: "user-1", FileID: "file-1", Hold: &on}, []string{"reason"}},
+		{"missing hold", LegalHoldRequest{UserID: "user-1", FileID: "file-1"}, []string{"hold"}},
+		{"missing ids", LegalHoldRequest{Hold: &off}, []string{"userId", "fileId"}},
+		{"long reason", LegalHoldRequest{UserID: "user-1", FileID: "file-1", Hold: &on, Reason: strings.Repeat("x", maxReasonLen+1)}, []string{"reason"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateLegalHoldRequest(&tt.req)
+			if len(errs.Errors) != len(tt.fields) {
+				t.Fatalf("got errors %+v, want fields %v", errs.Errors, tt.fields)
+			}
+			for i, field := range tt.fields {
+				if errs.Errors[i].Field != field {
+					t.Errorf("error %d on %q, want %q", i, errs.Errors[i].Field, field)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+// Package main implements the set_pinned Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	// pinnedIndex is the sparse GSI (userId, pinnedAt) holding only pinned files
+	pinnedIndex = "PinnedIndex"
+	// maxPinnedFiles bounds how many files a user can pin, so get_files can
+	// always list all of them ahead of the first page
+	maxPinnedFiles = 50
+)
+
+// PinRequest represents the request body
+type PinRequest struct {
+	FileID string `json:"fileId"`
+	Pinned *bool  `json:"pinned"`
+}
+
+// PinResponse represents the response body
+type PinResponse struct {
+	Message  string `json:"message"`
+	FileID   string `json:"fileId"`
+	Pinned   bool   `json:"pinned"`
+	PinnedAt string `json:"pinnedAt,omitempty"`
+}
+
+var (
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleSetPinned)
+
+// handleSetPinned handles an authenticated request
+func handleSetPinned(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req PinRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+	if errs := validatePinRequest(&req); errs.HasErrors() {
+		return common.Fail(errs)
+	}
+	pinned := *req.Pinned
+
+	file, err := common.GetOwnedFile(ctx, dynamoClient, userFilesTable, userID, req.FileID, false)
+	switch {
+	case errors.Is(err, common.ErrNotFound), errors.Is(err, common.ErrDeleted):
+		return common.Fail(common.NotFound("File not found"))
+	case err != nil:
+		return common.Fail(common.Internal("DynamoDB get error", err))
+	}
+
+	// Pinning twice keeps the original pinnedAt, so the order doesn't change
+	if file.Pinned == pinned {
+		response := PinResponse{Message: "File unchanged", FileID: req.FileID, Pinned: pinned, PinnedAt: file.PinnedAt}
+		return common.BuildResponse(200, response), nil
+	}
+
+	if pinned {
+		// The index is eventually consistent, so concurrent pins can go
+		// slightly over the limit
+		count, err := countPinned(ctx, userID)
+		if err != nil {
+			return common.Fail(common.Internal("DynamoDB query error", err))
+		}
+		if count >= maxPinnedFiles {
+			return common.Fail(common.Conflict(fmt.Sprintf("At most %d files can be pinned", maxPinnedFiles)))
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+		},
+		ConditionExpression:      aws.String("attribute_exists(fileId) AND #status <> :deleted"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":deleted":   &types.AttributeValueMemberS{Value: common.StatusDeleted},
+			":updatedAt": &types.AttributeValueMemberS{Value: now},
+		},
+	}
+	if pinned {
+		// pinnedAt is the index sort key; unpinned files don't have it
+		input.UpdateExpression = aws.String("SET pinned = :pinned, pinnedAt = :pinnedAt, updatedAt = :updatedAt")
+		input.ExpressionAttributeValues[":pinned"] = &types.AttributeValueMemberBOOL{Value: true}
+		input.ExpressionAttributeValues[":pinnedAt"] = &types.AttributeValueMemberS{Value: now}
+	} else {
+		input.UpdateExpression = aws.String("SET updatedAt = :updatedAt REMOVE pinned, pinnedAt")
+	}
+
+	opCtx, cancel := common.WithDeadline(ctx)
+	_, err = dynamoClient.UpdateItem(opCtx, input)
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return common.Fail(common.NotFound("File not found"))
+		}
+		return common.Fail(common.Internal("DynamoDB update error", err))
+	}
+
+	// Log audit event
+	auditLog.Log(ctx, userID, req.FileID, "update", map[string]interface{}{
+		"fileName":      file.FileName,
+		"changedFields": []string{"pinned"},
+		"changes": map[string]interface{}{
+			"pinned": map[string]interface{}{"from": file.Pinned, "to": pinned},
+		},
+		"reason": "pin",
+	})
+
+	response := PinResponse{Message: "File pinned", FileID: req.FileID, Pinned: true, PinnedAt: now}
+	if !pinned {
+		response = PinResponse{Message: "File unpinned", FileID: req.FileID}
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// validatePinRequest collects every invalid field in the request
+func validatePinRequest(req *PinRequest) *common.ValidationErrors {
+	errs := &common.ValidationErrors{}
+
+	if req.FileID == "" {
+		errs.Add("fileId", "is required")
+	}
+	if req.Pinned == nil {
+		errs.Add("pinned", "is required")
+	}
+
+	return errs
+}
+
+// countPinned counts the user's pinned files through the sparse index
+func countPinned(ctx context.Context, userID string) (int, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(userFilesTable),
+		IndexName:              aws.String(pinnedIndex),
+		KeyConditionExpression: aws.String("userId = :userId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":userId": &types.AttributeValueMemberS{Value: userID},
+		},
+		Select: types.SelectCount,
+	}
+
+	count := 0
+	for {
+		opCtx, cancel := common.WithDeadline(ctx)
+		result, err := dynamoClient.Query(opCtx, input)
+		cancel()
+		if err != nil {
+			return 0, err
+		}
+		count += int(result.Count)
+		if len(result.LastEvaluatedKey) == 0 {
+			return count, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+func main() {
+	lambda.Start(Handler)
+}
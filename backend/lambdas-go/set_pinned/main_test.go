@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestValidatePinRequest(t *testing.T) {
+	on := true
+	tests := []struct {
+		name   string
+		req    PinRequest
+		fields []string
+	}{
+		{"pin", PinRequest{FileID: "file-1", Pinned: &on}, nil},
+		{"missing pinned", PinRequest{FileID: "file-1"}, []string{"pinned"}},
+		{"missing fileId", PinRequest{Pinned: &on}, []string{"fileId"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validatePinRequest(&tt.req)
+			if len(errs.Errors) != len(tt.fields) {
+				t.Fatalf("got errors %+v, want fields %v", errs.Errors, tt.fields)
+			}
+			for i, field := range tt.fields {
+				if errs.Errors[i].Field != field {
+					t.Errorf("error %d on %q, want %q", i, errs.Errors[i].Field, field)
+				}
+			}
+		})
+	}
+}
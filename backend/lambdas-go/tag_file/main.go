@@ -0,0 +1,266 @@
+// Package main implements the tag_file Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName     = "660348065850-file-bucket"
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	maxTags        = 50
+	maxTagKeyLen   = 128 // S3 object tag key limit
+	maxTagValueLen = 256 // S3 object tag value limit
+	maxS3Tags      = 10  // S3 object tag count limit
+)
+
+// tagPattern is the character set S3 accepts in tag keys and values, applied
+// to all tags so any of them can be mirrored
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// TagRequest represents the request body. Tags replaces the file's tags;
+// an empty map removes them all.
+type TagRequest struct {
+	FileID string            `json:"fileId"`
+	Tags   map[string]string `json:"tags"`
+}
+
+// TagResponse represents the response body
+type TagResponse struct {
+	Message string            `json:"message"`
+	FileID  string            `json:"fileId"`
+	Tags    map[string]string `json:"tags"`
+	// S3Mirror is set when MIRROR_S3_TAGS is enabled
+	S3Mirror *S3MirrorResult `json:"s3Mirror,omitempty"`
+}
+
+// S3MirrorResult reports which tags were copied to the S3 object
+type S3MirrorResult struct {
+	Mirrored  bool     `json:"mirrored"`
+	Keys      []string `json:"keys"`
+	Truncated bool     `json:"truncated"`
+}
+
+var (
+	s3Client     *s3.Client
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+	// mirrorS3Tags copies tags to S3 object tags so lifecycle rules and cost
+	// allocation can use them (MIRROR_S3_TAGS=true)
+	mirrorS3Tags bool
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	s3Client = s3.NewFromConfig(cfg)
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+	mirrorS3Tags = os.Getenv("MIRROR_S3_TAGS") == "true"
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleTag)
+
+// handleTag handles an authenticated request
+func handleTag(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req TagRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+
+	if errs := validateTagRequest(&req); errs.HasErrors() {
+		return common.Fail(errs)
+	}
+
+	// Replace tags, guarded so deleted or missing files are not touched
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+		},
+		ConditionExpression: aws.String("attribute_exists(fileId) AND #status <> :deleted"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":deleted":   &types.AttributeValueMemberS{Value: "deleted"},
+			":updatedAt": &types.AttributeValueMemberS{Value: timestamp},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	}
+	if len(req.Tags) == 0 {
+		input.UpdateExpression = aws.String("SET updatedAt = :updatedAt REMOVE tags")
+	} else {
+		tags, err := attributevalue.Marshal(req.Tags)
+		if err != nil {
+			return common.Fail(common.Internal("Marshal error", err))
+		}
+		input.UpdateExpression = aws.String("SET tags = :tags, updatedAt = :updatedAt")
+		input.ExpressionAttributeValues[":tags"] = tags
+	}
+
+	opCtx, cancel := common.WithDeadline(ctx)
+	result, err := dynamoClient.UpdateItem(opCtx, input)
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return common.Fail(common.NotFound("File not found"))
+		}
+		return common.Fail(common.Internal("DynamoDB update error", err))
+	}
+
+	var file common.File
+	if err := attributevalue.UnmarshalMap(result.Attributes, &file); err != nil {
+		return common.Fail(common.Internal("Unmarshal error", err))
+	}
+
+	response := TagResponse{
+		Message: "Tags updated",
+		FileID:  req.FileID,
+		Tags:    req.Tags,
+	}
+
+	// DynamoDB stays the source of truth; a failed mirror is reported, not fatal
+	if mirrorS3Tags {
+		response.S3Mirror = mirrorTags(ctx, file.S3Key, req.Tags)
+	}
+
+	// Log audit event
+	metadata := map[string]interface{}{
+		"fileName": file.FileName,
+		"tagCount": len(req.Tags),
+	}
+	if response.S3Mirror != nil {
+		metadata["s3Mirrored"] = response.S3Mirror.Mirrored
+	}
+	auditLog.Log(ctx, userID, req.FileID, "tag", metadata)
+
+	return common.BuildResponse(200, response), nil
+}
+
+// validateTagRequest checks the request against S3's tag limits so every tag
+// can be mirrored, collecting every invalid field
+func validateTagRequest(req *TagRequest) *common.ValidationErrors {
+	errs := &common.ValidationErrors{}
+
+	if req.FileID == "" {
+		errs.Add("fileId", "is required")
+	}
+	if req.Tags == nil {
+		errs.Add("tags", "is required")
+		return errs
+	}
+	if len(req.Tags) > maxTags {
+		errs.Addf("tags", "must have at most %d tags", maxTags)
+	}
+
+	for _, key := range sortedKeys(req.Tags) {
+		value := req.Tags[key]
+		field := "tags." + key
+		switch {
+		case key == "":
+			errs.Add("tags", "keys must not be empty")
+		case len(key) > maxTagKeyLen:
+			errs.Addf(field, "key must be at most %d characters", maxTagKeyLen)
+		case !tagPattern.MatchString(key):
+			errs.Add(field, "key contains characters not allowed in S3 tags")
+		}
+		if len(value) > maxTagValueLen {
+			errs.Addf(field, "value must be at most %d characters", maxTagValueLen)
+		} else if !tagPattern.MatchString(value) {
+			errs.Add(field, "value contains characters not allowed in S3 tags")
+		}
+	}
+
+	return errs
+}
+
+// mirrorTags copies tags to the S3 object. S3 allows only 10 tags per object,
+// so beyond that the first 10 keys in sorted order are kept.
+func mirrorTags(ctx context.Context, s3Key string, tags map[string]string) *S3MirrorResult {
+	keys := sortedKeys(tags)
+	mirror := &S3MirrorResult{Keys: keys}
+	if len(keys) > maxS3Tags {
+		mirror.Keys = keys[:maxS3Tags]
+		mirror.Truncated = true
+	}
+
+	var err error
+	opCtx, cancel := common.WithDeadline(ctx)
+	if len(mirror.Keys) == 0 {
+		_, err = s3Client.DeleteObjectTagging(opCtx, &s3.DeleteObjectTaggingInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(s3Key),
+		})
+	} else {
+		tagSet := make([]s3types.Tag, 0, len(mirror.Keys))
+		for _, key := range mirror.Keys {
+			tagSet = append(tagSet, s3types.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+		}
+		_, err = s3Client.PutObjectTagging(opCtx, &s3.PutObjectTaggingInput{
+			Bucket:  aws.String(bucketName),
+			Key:     aws.String(s3Key),
+			Tagging: &s3types.Tagging{TagSet: tagSet},
+		})
+	}
+	cancel()
+	if err != nil {
+		log.Printf("S3 tagging error: %v", err)
+		return mirror
+	}
+
+	mirror.Mirrored = true
+	return mirror
+}
+
+// sortedKeys returns the map's keys in sorted order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,207 @@
+// Package main implements the touch_file Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	userFilesTable         = "UserFiles"
+	fileAuditTable         = "FileAudit"
+	defaultExtensionPeriod = 7 * 24 * time.Hour
+)
+
+// TouchRequest represents the request body
+type TouchRequest struct {
+	FileID string `json:"fileId"`
+	// ExpiresAt sets the new expiry (RFC3339) instead of extending by the
+	// configured period. It must be later than the current expiry.
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	// CreateExpiry allows touching a file that has no expiry, giving it one
+	CreateExpiry bool `json:"createExpiry,omitempty"`
+}
+
+// TouchResponse represents the response body
+type TouchResponse struct {
+	Message           string `json:"message"`
+	FileID            string `json:"fileId"`
+	ExpiresAt         string `json:"expiresAt"`
+	PreviousExpiresAt string `json:"previousExpiresAt,omitempty"`
+}
+
+var (
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+	// extensionPeriod is how far a touch pushes the expiry, from
+	// TOUCH_EXTENSION_PERIOD (Go duration, e.g. "168h")
+	extensionPeriod = defaultExtensionPeriod
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+
+	if v := os.Getenv("TOUCH_EXTENSION_PERIOD"); v != "" {
+		extensionPeriod, err = time.ParseDuration(v)
+		if err != nil || extensionPeriod <= 0 {
+			log.Fatalf("Invalid TOUCH_EXTENSION_PERIOD: %q", v)
+		}
+	}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleTouch)
+
+// handleTouch handles an authenticated request
+func handleTouch(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req TouchRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+
+	now := time.Now().UTC()
+	if errs := validateTouchRequest(&req, now); errs.HasErrors() {
+		return common.Fail(errs)
+	}
+
+	// Read the current expiry; the update below is conditional on it
+	file, err := common.GetOwnedFile(ctx, dynamoClient, userFilesTable, userID, req.FileID, true)
+	switch {
+	case errors.Is(err, common.ErrNotFound), errors.Is(err, common.ErrDeleted):
+		return common.Fail(common.NotFound("File not found"))
+	case err != nil:
+		return common.Fail(common.Internal("DynamoDB get error", err))
+	}
+
+	if file.ExpiryEpoch == 0 && !req.CreateExpiry {
+		return common.Fail(common.Conflict("File does not expire; set createExpiry to give it an expiry"))
+	}
+
+	// Work out the new expiry: the requested time, or the configured period
+	// from the current expiry (or from now, if that has already passed)
+	var newExpiry time.Time
+	if req.ExpiresAt != "" {
+		newExpiry, _ = time.Parse(time.RFC3339, req.ExpiresAt)
+		if file.ExpiryEpoch != 0 && newExpiry.Unix() <= file.ExpiryEpoch {
+			return common.Fail(common.Validation("expiresAt must be later than the current expiry"))
+		}
+	} else {
+		base := now
+		if current := time.Unix(file.ExpiryEpoch, 0); file.ExpiryEpoch != 0 && current.After(now) {
+			base = current
+		}
+		newExpiry = base.Add(extensionPeriod)
+	}
+	newExpiry = newExpiry.UTC().Truncate(time.Second)
+
+	// Only apply if the expiry is unchanged since it was read, so a
+	// concurrent touch or the expiry job can't be overwritten
+	condition := "#status <> :deleted AND expiryEpoch = :oldEpoch"
+	values := map[string]types.AttributeValue{
+		":deleted":     &types.AttributeValueMemberS{Value: "deleted"},
+		":expiresAt":   &types.AttributeValueMemberS{Value: newExpiry.Format(time.RFC3339)},
+		":expiryEpoch": &types.AttributeValueMemberN{Value: strconv.FormatInt(newExpiry.Unix(), 10)},
+		":updatedAt":   &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+	}
+	if file.ExpiryEpoch == 0 {
+		condition = "attribute_exists(fileId) AND #status <> :deleted AND attribute_not_exists(expiryEpoch)"
+	} else {
+		values[":oldEpoch"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(file.ExpiryEpoch, 10)}
+	}
+
+	opCtx, cancel := common.WithDeadline(ctx)
+	_, err = dynamoClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+		},
+		UpdateExpression:    aws.String("SET expiresAt = :expiresAt, expiryEpoch = :expiryEpoch, updatedAt = :updatedAt"),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: values,
+	})
+	cancel()
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return common.Fail(common.Conflict("File was changed or expired meanwhile, please retry"))
+		}
+		return common.Fail(common.Internal("DynamoDB update error", err))
+	}
+
+	// Log audit event
+	auditLog.Log(ctx, userID, req.FileID, "update", map[string]interface{}{
+		"fileName":      file.FileName,
+		"changedFields": []string{"expiresAt"},
+		"changes": map[string]interface{}{
+			"expiresAt": map[string]interface{}{"from": file.ExpiresAt, "to": newExpiry.Format(time.RFC3339)},
+		},
+		"reason": "touch",
+	})
+
+	response := TouchResponse{
+		Message:           "File retention extended",
+		FileID:            req.FileID,
+		ExpiresAt:         newExpiry.Format(time.RFC3339),
+		PreviousExpiresAt: file.ExpiresAt,
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// validateTouchRequest collects every invalid field in the request
+func validateTouchRequest(req *TouchRequest, now time.Time) *common.ValidationErrors {
+	errs := &common.ValidationErrors{}
+
+	if req.FileID == "" {
+		errs.Add("fileId", "is required")
+	}
+
+	if req.ExpiresAt != "" {
+		if parsed, err := time.Parse(time.RFC3339, req.ExpiresAt); err != nil {
+			errs.Add("expiresAt", "must be an RFC3339 timestamp")
+		} else if !parsed.After(now) {
+			errs.Add("expiresAt", "must be in the future")
+		}
+	}
+
+	return errs
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,350 @@
+// Package main implements the transfer_file Lambda function
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName     = "660348065850-file-bucket"
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+)
+
+// droppedAttributes are not carried over to the new owner: sharing and
+// pinning are the previous owner's choices
+var droppedAttributes = []string{"acl", "pinned", "pinnedAt"}
+
+// TransferRequest represents the request body. Owners transfer their own
+// files; admins can set fromUserId to transfer another user's file.
+type TransferRequest struct {
+	FileID     string `json:"fileId"`
+	ToUserID   string `json:"toUserId"`
+	FromUserID string `json:"fromUserId,omitempty"`
+}
+
+// TransferResponse represents the response body
+type TransferResponse struct {
+	Message    string `json:"message"`
+	FileID     string `json:"fileId"`
+	FromUserID string `json:"fromUserId"`
+	ToUserID   string `json:"toUserId"`
+	// SourceCleanup is false when the old S3 object could not be deleted and
+	// was left behind; the transfer itself succeeded
+	SourceCleanup bool `json:"sourceCleanup"`
+}
+
+var (
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+	s3Client     *s3.Client
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+	s3Client = s3.NewFromConfig(cfg)
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleTransfer)
+
+// handleTransfer moves a file to another user. userId is the partition key,
+// so the row is rewritten under the new owner and the object copied to
+// their prefix:
+//
+//  1. copy the S3 object to the target key
+//  2. in one transaction, put the target row and delete the source row
+//  3. delete the source object
+//
+// A failure in 1 or 2 leaves the source untouched and removes the copy; a
+// failure in 3 only leaves an orphaned object, which is logged.
+func handleTransfer(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	callerID := common.UserID(ctx)
+
+	// Parse request body
+	var req TransferRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+	if req.FromUserID == "" {
+		req.FromUserID = callerID
+	}
+	if errs := validateTransferRequest(&req); errs.HasErrors() {
+		return common.Fail(errs)
+	}
+	if req.FromUserID != callerID && !common.IsAdmin(request) {
+		// Don't reveal whether another user's file exists
+		return common.Fail(common.NotFound("File not found"))
+	}
+
+	item, file, err := getFileItem(ctx, req.FromUserID, req.FileID)
+	switch {
+	case errors.Is(err, common.ErrNotFound):
+		return common.Fail(common.NotFound("File not found"))
+	case err != nil:
+		return common.Fail(common.Internal("DynamoDB get error", err))
+	}
+	switch {
+	case file.Status == common.StatusDeleted:
+		return common.Fail(common.NotFound("File not found"))
+	case file.LegalHold:
+		auditLog.Log(ctx, req.FromUserID, req.FileID, "access_attempt", map[string]interface{}{
+			"fileName": file.FileName,
+			"reason":   "legal_hold",
+			"attempt":  "transfer",
+			"toUserId": req.ToUserID,
+		})
+		return common.Fail(common.Locked("File is under legal hold"))
+	case !common.Confirmed(file.Status):
+		return common.Fail(common.Conflict(fmt.Sprintf("Only uploaded or confirmed files can be transferred (status %s)", file.Status)))
+	}
+
+	targetKey := transferKey(file.S3Key, req.FromUserID, req.ToUserID, req.FileID)
+
+	// 1. Copy the object to the new owner's prefix
+	opCtx, cancel := common.WithDeadline(ctx)
+	_, err = s3Client.CopyObject(opCtx, &s3.CopyObjectInput{
+		Bucket:     aws.String(bucketName),
+		Key:        aws.String(targetKey),
+		CopySource: aws.String(copySource(bucketName, file.S3Key)),
+	})
+	cancel()
+	if err != nil {
+		return common.Fail(common.Internal("S3 copy error", err))
+	}
+
+	// 2. Move the row, guarded against concurrent changes to the source
+	now := time.Now().UTC().Format(time.RFC3339)
+	target, err := transferredItem(item, req.ToUserID, targetKey, req.FromUserID, now)
+	if err != nil {
+		removeObject(ctx, targetKey)
+		return common.Fail(common.Internal("Marshal error", err))
+	}
+	opCtx, cancel = common.WithDeadline(ctx)
+	_, err = dynamoClient.TransactWriteItems(opCtx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName:           aws.String(userFilesTable),
+				Item:                target,
+				ConditionExpression: aws.String("attribute_not_exists(fileId)"),
+			}},
+			{Delete: &types.Delete{
+				TableName: aws.String(userFilesTable),
+				Key: map[string]types.AttributeValue{
+					"userId": &types.AttributeValueMemberS{Value: req.FromUserID},
+					"fileId": &types.AttributeValueMemberS{Value: req.FileID},
+				},
+				ConditionExpression:      aws.String("#status = :status AND s3Key = :s3Key AND " + common.NoLegalHoldCondition),
+				ExpressionAttributeNames: map[string]string{"#status": "status"},
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":status": &types.AttributeValueMemberS{Value: file.Status},
+					":s3Key":  &types.AttributeValueMemberS{Value: file.S3Key},
+				},
+			}},
+		},
+	})
+	cancel()
+	if err != nil {
+		removeObject(ctx, targetKey)
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) {
+			return common.Fail(transactionError(canceled))
+		}
+		return common.Fail(common.Internal("DynamoDB transaction error", err))
+	}
+
+	// 3. The file now belongs to the target; the old object is only clutter
+	cleaned := removeObject(ctx, file.S3Key)
+
+	auditLog.Log(ctx, req.FromUserID, req.FileID, "transfer", map[string]interface{}{
+		"fileName":      file.FileName,
+		"direction":     "out",
+		"toUserId":      req.ToUserID,
+		"transferredBy": callerID,
+		"s3Key":         file.S3Key,
+		"sourceCleanup": cleaned,
+	})
+	auditLog.Log(ctx, req.ToUserID, req.FileID, "transfer", map[string]interface{}{
+		"fileName":      file.FileName,
+		"direction":     "in",
+		"fromUserId":    req.FromUserID,
+		"transferredBy": callerID,
+		"s3Key":         targetKey,
+	})
+
+	response := TransferResponse{
+		Message:       "File transferred",
+		FileID:        req.FileID,
+		FromUserID:    req.FromUserID,
+		ToUserID:      req.ToUserID,
+		SourceCleanup: cleaned,
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// validateTransferRequest collects every invalid field in the request.
+// fromUserId has already defaulted to the caller.
+func validateTransferRequest(req *TransferRequest) *common.ValidationErrors {
+	errs := &common.ValidationErrors{}
+
+	if req.FileID == "" {
+		errs.Add("fileId", "is required")
+	}
+	switch {
+	case req.ToUserID == "":
+		errs.Add("toUserId", "is required")
+	case !common.IsValidUserID(req.ToUserID):
+		errs.Add("toUserId", "is not a valid userId")
+	case req.ToUserID == req.FromUserID:
+		errs.Add("toUserId", "must differ from the current owner")
+	}
+	if !common.IsValidUserID(req.FromUserID) {
+		errs.Add("fromUserId", "is not a valid userId")
+	}
+
+	return errs
+}
+
+// getFileItem reads the raw row, so attributes common.File doesn't model are
+// carried over too, along with its decoded form
+func getFileItem(ctx context.Context, userID, fileID string) (map[string]types.AttributeValue, *common.File, error) {
+	opCtx, cancel := common.WithDeadline(ctx)
+	result, err := dynamoClient.GetItem(opCtx, &dynamodb.GetItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	cancel()
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.Item == nil {
+		return nil, nil, common.ErrNotFound
+	}
+
+	var file common.File
+	if err := attributevalue.UnmarshalMap(result.Item, &file); err != nil {
+		return nil, nil, err
+	}
+	return result.Item, &file, nil
+}
+
+// transferKey moves an S3 key from one user's upload prefix to the other's,
+// so "users/a/uploads/<fileId>-x.pdf" becomes "users/b/uploads/<fileId>-x.pdf".
+// Keys outside the prefix keep only their base name.
+func transferKey(s3Key, fromUserID, toUserID, fileID string) string {
+	fromPrefix := fmt.Sprintf("users/%s/uploads/", fromUserID)
+	toPrefix := fmt.Sprintf("users/%s/uploads/", toUserID)
+	if rest, ok := strings.CutPrefix(s3Key, fromPrefix); ok {
+		return toPrefix + rest
+	}
+	name := path.Base(s3Key)
+	if !strings.HasPrefix(name, fileID) {
+		name = fileID + "-" + name
+	}
+	return toPrefix + name
+}
+
+// copySource formats the URL-encoded "bucket/key" CopyObject expects
+func copySource(bucket, key string) string {
+	return (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+}
+
+// transferredItem returns the row as stored under the new owner
+func transferredItem(item map[string]types.AttributeValue, toUserID, s3Key, fromUserID, now string) (map[string]types.AttributeValue, error) {
+	target := make(map[string]types.AttributeValue, len(item)+2)
+	for k, v := range item {
+		target[k] = v
+	}
+	for _, attr := range droppedAttributes {
+		delete(target, attr)
+	}
+
+	changes, err := attributevalue.MarshalMap(map[string]string{
+		"userId":          toUserID,
+		"s3Key":           s3Key,
+		"updatedAt":       now,
+		"transferredFrom": fromUserID,
+		"transferredAt":   now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range changes {
+		target[k] = v
+	}
+	return target, nil
+}
+
+// transactionError maps a canceled transfer transaction to the failing side:
+// the target already has the fileId, or the source changed since it was read
+func transactionError(canceled *types.TransactionCanceledException) error {
+	for i, reason := range canceled.CancellationReasons {
+		if aws.ToString(reason.Code) != "ConditionalCheckFailed" {
+			continue
+		}
+		if i == 0 {
+			return common.Conflict("The target user already has a file with this fileId")
+		}
+		return common.Conflict("File was changed meanwhile, please retry")
+	}
+	return common.Internal("DynamoDB transaction canceled", canceled)
+}
+
+// removeObject deletes an object that is no longer referenced, reporting
+// whether it succeeded. Failures are logged, not returned: the caller has
+// already decided the outcome of the request.
+func removeObject(ctx context.Context, key string) bool {
+	opCtx, cancel := common.WithDeadline(ctx)
+	defer cancel()
+	_, err := s3Client.DeleteObject(opCtx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.Printf("Orphaned object s3://%s/%s: %v", bucketName, key, err)
+		return false
+	}
+	return true
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestTransferKey(t *testing.T) {
+	tests := []struct {
+		s3Key string
+		want  string
+	}{
+		{"users/alice/uploads/f1-report.pdf", "users/bob/uploads/f1-report.pdf"},
+		{"legacy/f1-report.pdf", "users/bob/uploads/f1-report.pdf"},
+		{"legacy/report.pdf", "users/bob/uploads/f1-report.pdf"},
+		// Another user's prefix that merely starts with the same characters
+		{"users/alice2/uploads/f1-x.pdf", "users/bob/uploads/f1-x.pdf"},
+	}
+	for _, tt := range tests {
+		if got := transferKey(tt.s3Key, "alice", "bob", "f1"); got != tt.want {
+			t.Errorf("transferKey(%q) = %q, want %q", tt.s3Key, got, tt.want)
+		}
+	}
+}
+
+func TestCopySource(t *testing.T) {
+	got := copySource("bucket", "users/alice/uploads/f1-my report+1.pdf")
+	if want := "bucket/users/alice/uploads/f1-my%20report+1.pdf"; got != want {
+		t.Errorf("copySource = %q, want %q", got, want)
+	}
+}
+
+func TestTransferredItem(t *testing.T) {
+	item := map[string]types.AttributeValue{
+		"userId":      &types.AttributeValueMemberS{Value: "alice"},
+		"fileId":      &types.AttributeValueMemberS{Value: "f1"},
+		"s3Key":       &types.AttributeValueMemberS{Value: "users/alice/uploads/f1-x.pdf"},
+		"description": &types.AttributeValueMemberS{Value: "kept"},
+		"acl":         &types.AttributeValueMemberSS{Value: []string{"carol"}},
+		"pinned":      &types.AttributeValueMemberBOOL{Value: true},
+		"pinnedAt":    &types.AttributeValueMemberS{Value: "2024-01-01T00:00:00Z"},
+	}
+	target, err := transferredItem(item, "bob", "users/bob/uploads/f1-x.pdf", "alice", "2024-02-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("transferredItem error: %v", err)
+	}
+
+	for attr, want := range map[string]string{
+		"userId":          "bob",
+		"fileId":          "f1",
+		"s3Key":           "users/bob/uploads/f1-x.pdf",
+		"description":     "kept",
+		"transferredFrom": "alice",
+	} {
+		if v, ok := target[attr].(*types.AttributeValueMemberS); !ok || v.Value != want {
+			t.Errorf("%s = %v, want %q", attr, target[attr], want)
+		}
+	}
+	for _, attr := range droppedAttributes {
+		if _, ok := target[attr]; ok {
+			t.Errorf("%s carried over", attr)
+		}
+	}
+	if item["userId"].(*types.AttributeValueMemberS).Value != "alice" {
+		t.Error("source item modified")
+	}
+}
+
+func TestTransactionError(t *testing.T) {
+	failed := types.CancellationReason{Code: aws.String("ConditionalCheckFailed")}
+	none := types.CancellationReason{Code: aws.String("None")}
+
+	err := transactionError(&types.TransactionCanceledException{CancellationReasons: []types.CancellationReason{failed, none}})
+	if err.Error() != "The target user already has a file with this fileId" {
+		t.Errorf("target conflict = %v", err)
+	}
+	err = transactionError(&types.TransactionCanceledException{CancellationReasons: []types.CancellationReason{none, failed}})
+	if err.Error() != "File was changed meanwhile, please retry" {
+		t.Errorf("source conflict = %v", err)
+	}
+}
+
+func TestValidateTransferRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    TransferRequest
+		fields []string
+	}{
+		{"valid", TransferRequest{FileID: "f1", ToUserID: "bob", FromUserID: "alice"}, nil},
+		{"missing", TransferRequest{FromUserID: "alice"}, []string{"fileId", "toUserId"}},
+		{"to self", TransferRequest{FileID: "f1", ToUserID: "alice", FromUserID: "alice"}, []string{"toUserId"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateTransferRequest(&tt.req)
+			if len(errs.Errors) != len(tt.fields) {
+				t.Fatalf("got errors %+v, want fields %v", errs.Errors, tt.fields)
+			}
+			for i, field := range tt.fields {
+				if errs.Errors[i].Field != field {
+					t.Errorf("error %d on %q, want %q", i, errs.Errors[i].Field, field)
+				}
+			}
+		})
+	}
+}
@@ -3,10 +3,17 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
+	"os"
+	"path"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -15,6 +22,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/google/uuid"
 
@@ -24,9 +32,20 @@ import (
 const (
 	bucketName     = "660348065850-file-bucket"
 	userFilesTable = "UserFiles"
+	fileIDIndex    = "FileIdIndex"
 	fileAuditTable = "FileAudit"
 	maxFileSize    = 10 * 1024 * 1024 // 10 MB
 	presignExpiry  = 3600             // 1 hour
+	maxRedirectLen = 2048
+
+	// Multipart uploads, for files above multipartThreshold
+	multipartPartSize       = 10 * 1024 * 1024 // grown for files that would need more than maxMultipartParts
+	maxMultipartParts       = 1000             // presigned part URLs in one response
+	defaultMaxMultipartSize = 5 * 1024 * 1024 * 1024
+
+	// Values of UPLOAD_REGISTRATION
+	registrationPresign = "presign" // write the UserFiles row when presigning (default)
+	registrationEvent   = "event"   // let register_upload write it once the object exists
 )
 
 var allowedMimeTypes = map[string]bool{
@@ -41,46 +60,95 @@ var allowedMimeTypes = map[string]bool{
 	"application/json": true,
 }
 
+// allowedContentEncodings lists the encodings a pre-compressed upload may declare
+var allowedContentEncodings = map[string]bool{
+	"gzip":    true,
+	"br":      true,
+	"deflate": true,
+}
+
 // UploadRequest represents the request body
 type UploadRequest struct {
 	FileName    string `json:"fileName"`
 	ContentType string `json:"contentType"`
 	FileSize    int64  `json:"fileSize"`
+	// UploadMethod selects "put" (default) or "post" presigning
+	UploadMethod string `json:"uploadMethod,omitempty"`
+	// ExpiresAt is an optional RFC3339 time after which the file is auto-deleted
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	// ContentEncoding is set for pre-compressed files, e.g. "gzip", so
+	// downloads tell the browser to decompress them
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+	// FileID lets clients choose a deterministic ID (a UUID). When omitted
+	// one is generated.
+	FileID string `json:"fileId,omitempty"`
+	// Folder places the file in a folder, e.g. "projects/2024"; empty is the root
+	Folder string `json:"folder,omitempty"`
+	// DedupeName renames the file to "name (2).ext", "name (3).ext", ... when
+	// an active file in the same folder already has its name
+	DedupeName bool `json:"dedupeName,omitempty"`
+	// SuccessActionRedirect (a URL on an allowed origin) or SuccessActionStatus
+	// ("200", "201" or "204") set how S3 answers a plain HTML form POST
+	SuccessActionRedirect string `json:"successActionRedirect,omitempty"`
+	SuccessActionStatus   string `json:"successActionStatus,omitempty"`
+	// ChecksumSHA256 is the hex SHA-256 of the content. When an uploaded file
+	// with the same fileName and folder already has it, nothing is presigned.
+	ChecksumSHA256 string `json:"checksumSha256,omitempty"`
 }
 
 // UploadResponse represents the response body
 type UploadResponse struct {
-	PresignedURL string `json:"presignedUrl"`
-	FileID       string `json:"fileId"`
-	S3Key        string `json:"s3Key"`
-	ExpiresIn    int    `json:"expiresIn"`
+	PresignedURL  string         `json:"presignedUrl,omitempty"`
+	PresignedPost *PresignedPost `json:"presignedPost,omitempty"`
+	FileID        string         `json:"fileId"`
+	FileName      string         `json:"fileName"`
+	// RequiredHeaders must be sent with the presigned PUT as is (event mode)
+	RequiredHeaders map[string]string `json:"requiredHeaders,omitempty"`
+	S3Key           string            `json:"s3Key"`
+	ExpiresIn       int               `json:"expiresIn,omitempty"`
+	// Unchanged means the existing file FileID already has this content and
+	// there is nothing to upload
+	Unchanged bool `json:"unchanged,omitempty"`
+	// Multipart replaces PresignedURL for files above MULTIPART_THRESHOLD
+	Multipart *MultipartUpload `json:"multipart,omitempty"`
 }
 
-// FileMetadata represents file metadata in DynamoDB
-type FileMetadata struct {
-	UserID      string `dynamodbav:"userId"`
-	FileID      string `dynamodbav:"fileId"`
-	FileName    string `dynamodbav:"fileName"`
-	ContentType string `dynamodbav:"contentType"`
-	FileSize    int64  `dynamodbav:"fileSize"`
-	S3Key       string `dynamodbav:"s3Key"`
-	Status      string `dynamodbav:"status"`
-	CreatedAt   string `dynamodbav:"createdAt"`
+// MultipartUpload is an S3 multipart upload started for the client. Each part
+// is PUT to its URL with exactly Size bytes, then complete_upload finishes it.
+type MultipartUpload struct {
+	UploadID string          `json:"uploadId"`
+	PartSize int64           `json:"partSize"`
+	Parts    []PresignedPart `json:"parts"`
 }
 
-// AuditEntry represents an audit log entry
-type AuditEntry struct {
-	UserID    string                 `dynamodbav:"userId"`
-	Timestamp string                 `dynamodbav:"timestamp"`
-	FileID    string                 `dynamodbav:"fileId"`
-	Action    string                 `dynamodbav:"action"`
-	Metadata  map[string]interface{} `dynamodbav:"metadata"`
+// PresignedPart is the presigned UploadPart request for one part
+type PresignedPart struct {
+	PartNumber int32  `json:"partNumber"`
+	URL        string `json:"url"`
+	Size       int64  `json:"size"`
 }
 
 var (
+	awsConfig       aws.Config
 	s3Client        *s3.Client
 	s3PresignClient *s3.PresignClient
 	dynamoClient    *dynamodb.Client
+	auditLog        *common.AuditLogger
+	// fileIDClient looks client file IDs up in FileIdIndex; tests replace it
+	fileIDClient common.QueryAPI
+	// registrationMode decides when the UserFiles row is written (UPLOAD_REGISTRATION)
+	registrationMode = registrationPresign
+	// registrationSecret signs registration tokens in event mode
+	// (REGISTRATION_TOKEN_SECRET, shared with register_upload)
+	registrationSecret []byte
+	// redirectOrigins are the origins a POST form may redirect to after the
+	// upload, e.g. "https://app.example.com" (UPLOAD_REDIRECT_ORIGINS)
+	redirectOrigins = map[string]bool{}
+	// multipartThreshold is the size in bytes above which uploads use S3
+	// multipart (MULTIPART_THRESHOLD, at most maxFileSize)
+	multipartThreshold int64 = maxFileSize
+	// maxMultipartSize caps multipart uploads (MAX_MULTIPART_FILE_SIZE, bytes)
+	maxMultipartSize int64 = defaultMaxMultipartSize
 )
 
 func init() {
@@ -88,104 +156,614 @@ func init() {
 	if err != nil {
 		log.Fatalf("Failed to load AWS config: %v", err)
 	}
+	awsConfig = cfg
 	s3Client = s3.NewFromConfig(cfg)
 	s3PresignClient = s3.NewPresignClient(s3Client)
-	dynamoClient = dynamodb.NewFromConfig(cfg)
-}
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	fileIDClient = dynamoClient
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable, Geo: true}
+
+	switch v := os.Getenv("UPLOAD_REGISTRATION"); v {
+	case "", registrationPresign:
+	case registrationEvent:
+		registrationMode = v
+		registrationSecret = []byte(os.Getenv("REGISTRATION_TOKEN_SECRET"))
+		if len(registrationSecret) == 0 {
+			log.Fatalf("REGISTRATION_TOKEN_SECRET is required when UPLOAD_REGISTRATION=%s", registrationEvent)
+		}
+	default:
+		log.Fatalf("Invalid UPLOAD_REGISTRATION: %q", v)
+	}
 
-// Handler is the Lambda function handler
-func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	// Log authorizer context for debugging
-	log.Printf("Authorizer context: %+v", request.RequestContext.Authorizer)
+	for _, origin := range strings.Split(os.Getenv("UPLOAD_REDIRECT_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin == "" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			log.Fatalf("Invalid UPLOAD_REDIRECT_ORIGINS entry: %q", origin)
+		}
+		redirectOrigins[strings.ToLower(origin)] = true
+	}
 
-	// Extract user ID
-	userID, err := common.ExtractUserID(request)
-	if err != nil {
-		log.Printf("Auth error: %v", err)
-		return common.BuildErrorResponse(401, "Unauthorized: userId not found"), nil
+	if v := os.Getenv("MULTIPART_THRESHOLD"); v != "" {
+		multipartThreshold, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || multipartThreshold <= 0 || multipartThreshold > maxFileSize {
+			log.Fatalf("Invalid MULTIPART_THRESHOLD: %q (must be 1 to %d bytes)", v, maxFileSize)
+		}
+	}
+	if v := os.Getenv("MAX_MULTIPART_FILE_SIZE"); v != "" {
+		maxMultipartSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxMultipartSize < multipartThreshold {
+			log.Fatalf("Invalid MAX_MULTIPART_FILE_SIZE: %q", v)
+		}
 	}
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(handleUpload)
+
+// handleUpload handles an authenticated request
+func handleUpload(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
 
 	// Parse request body
 	var req UploadRequest
 	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
-		return common.BuildErrorResponse(400, "Invalid request body"), nil
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+
+	// Validate all fields, reporting every problem at once
+	if errs := validateUploadRequest(&req); errs.HasErrors() {
+		return common.Fail(errs)
 	}
 
-	// Validate required fields
-	if req.FileName == "" || req.ContentType == "" || req.FileSize == 0 {
-		return common.BuildErrorResponse(400, "Missing required fields: fileName, contentType, fileSize"), nil
+	var expiresAt time.Time
+	if req.ExpiresAt != "" {
+		parsed, _ := time.Parse(time.RFC3339, req.ExpiresAt)
+		expiresAt = parsed.UTC()
 	}
 
-	// Validate file size
-	if req.FileSize > maxFileSize {
-		return common.BuildErrorResponse(400, fmt.Sprintf("File size exceeds maximum allowed (%d MB)", maxFileSize/1024/1024)), nil
+	// Sync clients re-send files every cycle; skip the upload when the same
+	// logical file already has this content. No audit entry, nothing changed.
+	if req.ChecksumSHA256 != "" {
+		existing, err := findUnchangedFile(ctx, userID, req.Folder, req.FileName, req.ChecksumSHA256)
+		if err != nil {
+			return common.Fail(common.Internal("DynamoDB query error", err))
+		}
+		if existing != nil {
+			return common.BuildResponse(200, UploadResponse{
+				FileID:    existing.FileID,
+				FileName:  existing.FileName,
+				S3Key:     existing.S3Key,
+				Unchanged: true,
+			}), nil
+		}
 	}
 
-	// Validate MIME type
-	if !allowedMimeTypes[req.ContentType] {
-		return common.BuildErrorResponse(400, fmt.Sprintf("Content type '%s' is not allowed", req.ContentType)), nil
+	// Pick a free display name if asked to. The S3 key below always includes
+	// the file ID, so it is unique whatever the display name.
+	fileName := req.FileName
+	if req.DedupeName {
+		taken, err := takenFileNames(ctx, userID, req.Folder, fileName)
+		if err != nil {
+			return common.Fail(common.Internal("DynamoDB query error", err))
+		}
+		fileName = dedupeFileName(fileName, taken)
 	}
 
-	// Generate unique file ID and S3 key
-	fileID := uuid.New().String()
+	// Use the client's file ID or generate one, then build the S3 key
+	fileID := req.FileID
+	if fileID == "" {
+		fileID = uuid.New().String()
+	} else {
+		taken, err := fileIDTaken(ctx, fileID)
+		switch {
+		case err != nil:
+			return common.Fail(common.Internal("DynamoDB query error", err))
+		case taken:
+			return common.Fail(common.Conflict("A file with this fileId already exists"))
+		}
+	}
 	sanitizedName := sanitizeFileName(req.FileName)
-	s3Key := fmt.Sprintf("users/%s/uploads/%s-%s", userID, fileID, sanitizedName)
-
-	// Create presigned URL
-	presignReq, err := s3PresignClient.PresignPutObject(ctx, &s3.PutObjectInput{
-		Bucket:        aws.String(bucketName),
-		Key:           aws.String(s3Key),
-		ContentType:   aws.String(req.ContentType),
-		ContentLength: aws.Int64(req.FileSize),
-	}, s3.WithPresignExpires(time.Duration(presignExpiry)*time.Second))
-	if err != nil {
-		log.Printf("Presign error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+	keyPrefix := fmt.Sprintf("users/%s/uploads/", userID)
+	s3Key := fmt.Sprintf("%s%s-%s", keyPrefix, fileID, sanitizedName)
+
+	response := UploadResponse{
+		FileID:    fileID,
+		FileName:  fileName,
+		S3Key:     s3Key,
+		ExpiresIn: presignExpiry,
+	}
+
+	// When the client was handed the upload; the object lands later
+	startedAt := time.Now().UTC().Format(time.RFC3339)
+
+	// Multipart uploads always get a row, whatever UPLOAD_REGISTRATION says,
+	// so complete_upload and the expire_files reaper can find the upload.
+	// Their objects carry no registration token and register_upload skips them.
+	multipart := req.FileSize > multipartThreshold
+
+	// In event mode the row is only written once the object exists, so the
+	// file's details travel with the object as signed user metadata
+	var objectMetadata map[string]string
+	if registrationMode == registrationEvent && !multipart {
+		token, err := common.SignRegistration(common.Registration{
+			UserID:          userID,
+			FileID:          fileID,
+			FileName:        fileName,
+			ContentType:     req.ContentType,
+			ContentEncoding: req.ContentEncoding,
+			Folder:          req.Folder,
+			FileSize:        req.FileSize,
+			S3Key:           s3Key,
+			ExpiresAt:       req.ExpiresAt,
+			ChecksumSHA256:  req.ChecksumSHA256,
+			UploadStartedAt: startedAt,
+		}, registrationSecret)
+		if err != nil {
+			return common.Fail(common.Internal("Registration token error", err))
+		}
+		if len(token) > common.MaxRegistrationTokenLen {
+			return common.Fail(common.Validation("fileName and folder are too long to upload"))
+		}
+		objectMetadata = map[string]string{common.RegistrationMetaKey: token}
+		if req.UploadMethod == "put" {
+			response.RequiredHeaders = map[string]string{"x-amz-meta-" + common.RegistrationMetaKey: token}
+		}
+	}
+
+	if multipart {
+		upload, err := startMultipartUpload(ctx, &req, s3Key)
+		if err != nil {
+			return common.Fail(common.Internal("Multipart upload error", err))
+		}
+		response.Multipart = upload
+	} else if req.UploadMethod == "post" {
+		// Create presigned POST with a policy locked to this key and content type
+		creds, err := awsConfig.Credentials.Retrieve(ctx)
+		if err != nil {
+			return common.Fail(common.Internal("Credentials error", err))
+		}
+
+		presignedPost, err := presignPost(PostPolicyParams{
+			Bucket:          bucketName,
+			Key:             s3Key,
+			KeyPrefix:       keyPrefix,
+			ContentType:     req.ContentType,
+			ContentEncoding: req.ContentEncoding,
+			Metadata:        objectMetadata,
+			FileSize:        req.FileSize,
+			Region:          awsConfig.Region,
+			Credentials:     creds,
+			Expires:         time.Duration(presignExpiry) * time.Second,
+			Now:             time.Now(),
+
+			SuccessActionRedirect: req.SuccessActionRedirect,
+			SuccessActionStatus:   req.SuccessActionStatus,
+		})
+		if err != nil {
+			return common.Fail(common.Internal("Presign POST error", err))
+		}
+		response.PresignedPost = presignedPost
+	} else {
+		// Create presigned URL
+		input := &s3.PutObjectInput{
+			Bucket:        aws.String(bucketName),
+			Key:           aws.String(s3Key),
+			ContentType:   aws.String(req.ContentType),
+			ContentLength: aws.Int64(req.FileSize),
+			// Signed, so the client must send the same x-amz-meta-* headers
+			Metadata: objectMetadata,
+		}
+		if req.ContentEncoding != "" {
+			// Signed, so the client must send the same Content-Encoding header
+			input.ContentEncoding = aws.String(req.ContentEncoding)
+		}
+		presignReq, err := s3PresignClient.PresignPutObject(ctx, input, s3.WithPresignExpires(time.Duration(presignExpiry)*time.Second))
+		if err != nil {
+			return common.Fail(common.Internal("Presign error", err))
+		}
+		response.PresignedURL = presignReq.URL
+	}
+
+	if registrationMode == registrationEvent && !multipart {
+		// register_upload writes the row and the upload audit entry
+		return common.BuildResponse(200, response), nil
 	}
 
 	// Save file metadata to DynamoDB
-	metadata := FileMetadata{
-		UserID:      userID,
-		FileID:      fileID,
-		FileName:    req.FileName,
-		ContentType: req.ContentType,
-		FileSize:    req.FileSize,
-		S3Key:       s3Key,
-		Status:      "pending",
-		CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+	metadata := common.File{
+		UserID:          userID,
+		FileID:          fileID,
+		FileName:        fileName,
+		ContentType:     req.ContentType,
+		Folder:          req.Folder,
+		FileSize:        req.FileSize,
+		S3Key:           s3Key,
+		Status:          "pending",
+		CreatedAt:       startedAt,
+		UploadStartedAt: startedAt,
+		ContentEncoding: req.ContentEncoding,
+		ChecksumSHA256:  req.ChecksumSHA256,
+	}
+	if !expiresAt.IsZero() {
+		metadata.ExpiresAt = expiresAt.Format(time.RFC3339)
+		metadata.ExpiryEpoch = expiresAt.Unix()
+	}
+	if multipart {
+		metadata.Status = common.StatusMultipartPending
+		metadata.UploadID = response.Multipart.UploadID
+		metadata.MultipartParts = int32(len(response.Multipart.Parts))
+		metadata.MultipartPartSize = response.Multipart.PartSize
 	}
 
 	item, err := attributevalue.MarshalMap(metadata)
 	if err != nil {
-		log.Printf("Marshal error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+		return common.Fail(common.Internal("Marshal error", err))
 	}
 
-	_, err = dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(userFilesTable),
-		Item:      item,
+	// Never overwrite an existing file; fileIDTaken only saw the index as
+	// it was a moment ago
+	opCtx, cancel := common.WithDeadline(ctx)
+	_, err = dynamoClient.PutItem(opCtx, &dynamodb.PutItemInput{
+		TableName:           aws.String(userFilesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(fileId)"),
 	})
+	cancel()
 	if err != nil {
-		log.Printf("DynamoDB put error: %v", err)
-		return common.BuildErrorResponse(500, "Internal server error"), nil
+		if multipart {
+			// Without a row nothing could complete or reap the upload
+			abortMultipartUpload(ctx, s3Key, response.Multipart.UploadID)
+		}
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return common.Fail(common.Conflict("A file with this fileId already exists"))
+		}
+		return common.Fail(common.Internal("DynamoDB put error", err))
 	}
 
 	// Log audit event
-	go logAuditEvent(ctx, userID, fileID, "upload", map[string]interface{}{
-		"fileName":    req.FileName,
-		"contentType": req.ContentType,
-		"fileSize":    req.FileSize,
-		"s3Key":       s3Key,
+	auditMetadata := map[string]interface{}{
+		"fileName":        fileName,
+		"contentType":     req.ContentType,
+		"fileSize":        req.FileSize,
+		"s3Key":           s3Key,
+		"uploadMethod":    req.UploadMethod,
+		"contentEncoding": req.ContentEncoding,
+		"folder":          req.Folder,
+	}
+	if fileName != req.FileName {
+		auditMetadata["requestedFileName"] = req.FileName
+	}
+	if multipart {
+		auditMetadata["multipart"] = true
+		auditMetadata["parts"] = len(response.Multipart.Parts)
+	}
+	auditLog.Log(ctx, userID, fileID, "upload", auditMetadata)
+
+	return common.BuildResponse(200, response), nil
+}
+
+// validateUploadRequest checks every field of the request and fills in defaults
+func validateUploadRequest(req *UploadRequest) *common.ValidationErrors {
+	errs := &common.ValidationErrors{}
+
+	if req.FileName == "" {
+		errs.Add("fileName", "is required")
+	}
+
+	// Accept "Image/JPEG" or "text/plain; charset=utf-8" and store the base type
+	req.ContentType = common.NormalizeContentType(req.ContentType)
+	if req.ContentType == "" {
+		errs.Add("contentType", "is required")
+	} else if !allowedMimeTypes[req.ContentType] {
+		errs.Addf("contentType", "'%s' is not allowed", req.ContentType)
+	}
+
+	switch {
+	case req.FileSize == 0:
+		errs.Add("fileSize", "is required")
+	case req.FileSize < 0:
+		errs.Add("fileSize", "must be positive")
+	case req.FileSize > maxMultipartSize:
+		errs.Addf("fileSize", "exceeds maximum allowed (%d MB)", maxMultipartSize/1024/1024)
+	}
+
+	if req.FileID != "" {
+		if parsed, err := uuid.Parse(req.FileID); err != nil {
+			errs.Add("fileId", "must be a UUID")
+		} else {
+			req.FileID = parsed.String()
+		}
+	}
+
+	if req.ContentEncoding != "" && !allowedContentEncodings[req.ContentEncoding] {
+		errs.Add("contentEncoding", "must be one of: gzip, br, deflate")
+	}
+
+	req.Folder = strings.TrimSpace(req.Folder)
+	if err := common.ValidateFolder(req.Folder); err != nil {
+		errs.Add("folder", err.Error())
+	}
+
+	if req.ChecksumSHA256 != "" {
+		req.ChecksumSHA256 = strings.ToLower(req.ChecksumSHA256)
+		if !isHexSHA256(req.ChecksumSHA256) {
+			errs.Add("checksumSha256", "must be a hex SHA-256 digest")
+		}
+	}
+
+	if req.UploadMethod == "" {
+		req.UploadMethod = "put"
+	}
+	if req.UploadMethod != "put" && req.UploadMethod != "post" {
+		errs.Add("uploadMethod", "must be one of: put, post")
+	} else if req.UploadMethod == "post" && req.FileSize > multipartThreshold {
+		errs.Addf("uploadMethod", "must be put for files larger than %d bytes", multipartThreshold)
+	}
+
+	if req.SuccessActionRedirect != "" || req.SuccessActionStatus != "" {
+		switch {
+		case req.UploadMethod != "post":
+			errs.Add("uploadMethod", "must be post to use successActionRedirect or successActionStatus")
+		case req.SuccessActionRedirect != "" && req.SuccessActionStatus != "":
+			errs.Add("successActionStatus", "cannot be combined with successActionRedirect")
+		case req.SuccessActionStatus != "" && !successActionStatuses[req.SuccessActionStatus]:
+			errs.Add("successActionStatus", "must be one of: 200, 201, 204")
+		case req.SuccessActionRedirect != "":
+			if err := checkRedirect(req.SuccessActionRedirect, redirectOrigins); err != nil {
+				errs.Add("successActionRedirect", err.Error())
+			}
+		}
+	}
+
+	if req.ExpiresAt != "" {
+		if parsed, err := time.Parse(time.RFC3339, req.ExpiresAt); err != nil {
+			errs.Add("expiresAt", "must be an RFC3339 timestamp")
+		} else if !parsed.After(time.Now()) {
+			errs.Add("expiresAt", "must be in the future")
+		}
+	}
+
+	return errs
+}
+
+// startMultipartUpload creates an S3 multipart upload for s3Key and presigns
+// an UploadPart request for each part. Part sizes are signed, so the parts
+// add up to exactly req.FileSize.
+func startMultipartUpload(ctx context.Context, req *UploadRequest, s3Key string) (*MultipartUpload, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(s3Key),
+		ContentType: aws.String(req.ContentType),
+	}
+	if req.ContentEncoding != "" {
+		input.ContentEncoding = aws.String(req.ContentEncoding)
+	}
+	opCtx, cancel := common.WithDeadline(ctx)
+	created, err := s3Client.CreateMultipartUpload(opCtx, input)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &MultipartUpload{UploadID: aws.ToString(created.UploadId)}
+	partSize, sizes := multipartPlan(req.FileSize)
+	upload.PartSize = partSize
+	for i, size := range sizes {
+		partNumber := int32(i + 1)
+		presigned, err := s3PresignClient.PresignUploadPart(ctx, &s3.UploadPartInput{
+			Bucket:        aws.String(bucketName),
+			Key:           aws.String(s3Key),
+			UploadId:      created.UploadId,
+			PartNumber:    aws.Int32(partNumber),
+			ContentLength: aws.Int64(size),
+		}, s3.WithPresignExpires(time.Duration(presignExpiry)*time.Second))
+		if err != nil {
+			abortMultipartUpload(ctx, s3Key, upload.UploadID)
+			return nil, err
+		}
+		upload.Parts = append(upload.Parts, PresignedPart{PartNumber: partNumber, URL: presigned.URL, Size: size})
+	}
+	return upload, nil
+}
+
+// multipartPlan splits fileSize into parts of multipartPartSize, or larger
+// ones when that would take more than maxMultipartParts. It returns the part
+// size and the size of each part; only the last one is smaller.
+func multipartPlan(fileSize int64) (int64, []int64) {
+	partSize := int64(multipartPartSize)
+	if fileSize > partSize*maxMultipartParts {
+		partSize = (fileSize + maxMultipartParts - 1) / maxMultipartParts
+	}
+	var sizes []int64
+	for left := fileSize; left > 0; left -= partSize {
+		sizes = append(sizes, min(left, partSize))
+	}
+	return partSize, sizes
+}
+
+// abortMultipartUpload discards an upload the client can no longer use,
+// logging failures; the bucket's lifecycle rule is the fallback
+func abortMultipartUpload(ctx context.Context, s3Key, uploadID string) {
+	opCtx, cancel := common.WithDeadline(ctx)
+	defer cancel()
+	_, err := s3Client.AbortMultipartUpload(opCtx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(s3Key),
+		UploadId: aws.String(uploadID),
 	})
+	if err != nil {
+		log.Printf("Failed to abort multipart upload %s for %s: %v", uploadID, s3Key, err)
+	}
+}
 
-	response := UploadResponse{
-		PresignedURL: presignReq.URL,
-		FileID:       fileID,
-		S3Key:        s3Key,
-		ExpiresIn:    presignExpiry,
+// checkRedirect makes sure a success_action_redirect URL is absolute and on
+// one of the allowed origins, so upload forms can't be used as an open redirect
+func checkRedirect(raw string, allowed map[string]bool) error {
+	if len(raw) > maxRedirectLen {
+		return fmt.Errorf("must be at most %d characters", maxRedirectLen)
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.User != nil {
+		return errors.New("must be an absolute http(s) URL")
+	}
+	if !allowed[strings.ToLower(u.Scheme+"://"+u.Host)] {
+		return errors.New("is not on an allowed origin")
 	}
+	return nil
+}
 
-	return common.BuildResponse(200, response), nil
+// takenFileNames returns the names of the user's active files in folder that
+// could clash with fileName, i.e. that start with its stem. It reads the whole
+// partition, so it costs one query per page of the user's files.
+func takenFileNames(ctx context.Context, userID, folder, fileName string) (map[string]bool, error) {
+	stem, _ := splitFileName(fileName)
+	filter := "#status <> :deleted AND begins_with(fileName, :stem) AND "
+	values := map[string]types.AttributeValue{
+		":userId":  &types.AttributeValueMemberS{Value: userID},
+		":deleted": &types.AttributeValueMemberS{Value: "deleted"},
+		":stem":    &types.AttributeValueMemberS{Value: stem},
+	}
+	filter += folderCondition(folder, values)
+
+	taken := map[string]bool{}
+	paginator := dynamodb.NewQueryPaginator(dynamoClient, &dynamodb.QueryInput{
+		TableName:                 aws.String(userFilesTable),
+		KeyConditionExpression:    aws.String("userId = :userId"),
+		FilterExpression:          aws.String(filter),
+		ProjectionExpression:      aws.String("fileName"),
+		ExpressionAttributeNames:  map[string]string{"#status": "status"},
+		ExpressionAttributeValues: values,
+	})
+	for paginator.HasMorePages() {
+		opCtx, cancel := common.WithDeadline(ctx)
+		page, err := paginator.NextPage(opCtx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			if name, ok := item["fileName"].(*types.AttributeValueMemberS); ok {
+				taken[name.Value] = true
+			}
+		}
+	}
+	return taken, nil
+}
+
+// fileIDTaken reports whether any user, not only the caller, has a file
+// with a client-provided fileID. UserFiles is keyed per user, so the PutItem
+// condition alone would let two users share an ID, which breaks lookups by
+// FileIdIndex such as shares. The index is eventually consistent: two
+// uploads racing with the same ID can both pass.
+func fileIDTaken(ctx context.Context, fileID string) (bool, error) {
+	opCtx, cancel := common.WithDeadline(ctx)
+	defer cancel()
+	result, err := fileIDClient.Query(opCtx, &dynamodb.QueryInput{
+		TableName:              aws.String(userFilesTable),
+		IndexName:              aws.String(fileIDIndex),
+		KeyConditionExpression: aws.String("fileId = :fileId"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
+		ProjectionExpression: aws.String("userId"),
+		Limit:                aws.Int32(1),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(result.Items) > 0, nil
+}
+
+// findUnchangedFile returns the user's confirmed file named fileName in folder
+// whose stored SHA-256 is checksum, or nil. Only the same logical file
+// counts; identical content under another name is a different file.
+func findUnchangedFile(ctx context.Context, userID, folder, fileName, checksum string) (*common.File, error) {
+	values := map[string]types.AttributeValue{
+		":userId":    &types.AttributeValueMemberS{Value: userID},
+		":uploaded":  &types.AttributeValueMemberS{Value: common.StatusUploaded},
+		":confirmed": &types.AttributeValueMemberS{Value: common.StatusConfirmed},
+		":fileName":  &types.AttributeValueMemberS{Value: fileName},
+		":checksum":  &types.AttributeValueMemberS{Value: checksum},
+	}
+	filter := "#status IN (:uploaded, :confirmed) AND fileName = :fileName AND checksumSha256 = :checksum AND " + folderCondition(folder, values)
+
+	paginator := dynamodb.NewQueryPaginator(dynamoClient, &dynamodb.QueryInput{
+		TableName:                 aws.String(userFilesTable),
+		KeyConditionExpression:    aws.String("userId = :userId"),
+		FilterExpression:          aws.String(filter),
+		ProjectionExpression:      aws.String("fileId, fileName, s3Key"),
+		ExpressionAttributeNames:  map[string]string{"#status": "status"},
+		ExpressionAttributeValues: values,
+	})
+	for paginator.HasMorePages() {
+		opCtx, cancel := common.WithDeadline(ctx)
+		page, err := paginator.NextPage(opCtx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Items) > 0 {
+			var file common.File
+			if err := attributevalue.UnmarshalMap(page.Items[0], &file); err != nil {
+				return nil, err
+			}
+			return &file, nil
+		}
+	}
+	return nil, nil
+}
+
+// folderCondition returns the filter matching files directly in folder,
+// adding its value to values. Root files have no folder attribute.
+func folderCondition(folder string, values map[string]types.AttributeValue) string {
+	if folder == "" {
+		return "attribute_not_exists(folder)"
+	}
+	values[":folder"] = &types.AttributeValueMemberS{Value: folder}
+	return "folder = :folder"
+}
+
+// isHexSHA256 reports whether s is 64 hex digits
+func isHexSHA256(s string) bool {
+	sum, err := hex.DecodeString(s)
+	return err == nil && len(sum) == 32
+}
+
+// dedupeFileName returns fileName, or the first of "stem (2).ext",
+// "stem (3).ext", ... that isn't taken
+func dedupeFileName(fileName string, taken map[string]bool) string {
+	if !taken[fileName] {
+		return fileName
+	}
+	stem, ext := splitFileName(fileName)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, n, ext)
+		if !taken[candidate] {
+			return candidate
+		}
+	}
+}
+
+// splitFileName splits "report.pdf" into "report" and ".pdf". Names without a
+// stem, like ".env", have no extension.
+func splitFileName(fileName string) (string, string) {
+	ext := path.Ext(fileName)
+	if ext == fileName {
+		return fileName, ""
+	}
+	return strings.TrimSuffix(fileName, ext), ext
 }
 
 // sanitizeFileName removes dangerous characters from file names
@@ -206,31 +784,6 @@ func sanitizeFileName(fileName string) string {
 	return sanitized
 }
 
-// logAuditEvent logs an audit event to DynamoDB
-func logAuditEvent(ctx context.Context, userID, fileID, action string, metadata map[string]interface{}) {
-	entry := AuditEntry{
-		UserID:    userID,
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
-		FileID:    fileID,
-		Action:    action,
-		Metadata:  metadata,
-	}
-
-	item, err := attributevalue.MarshalMap(entry)
-	if err != nil {
-		log.Printf("Audit marshal error: %v", err)
-		return
-	}
-
-	_, err = dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(fileAuditTable),
-		Item:      item,
-	})
-	if err != nil {
-		log.Printf("Audit log error: %v", err)
-	}
-}
-
 func main() {
 	lambda.Start(Handler)
 }
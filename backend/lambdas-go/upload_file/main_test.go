@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+func TestDedupeFileName(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		taken    []string
+		want     string
+	}{
+		{"free", "report.pdf", []string{"other.pdf"}, "report.pdf"},
+		{"first copy", "report.pdf", []string{"report.pdf"}, "report (2).pdf"},
+		{"next free", "report.pdf", []string{"report.pdf", "report (2).pdf", "report (3).pdf"}, "report (4).pdf"},
+		{"fills gap", "report.pdf", []string{"report.pdf", "report (3).pdf"}, "report (2).pdf"},
+		{"no extension", "README", []string{"README"}, "README (2)"},
+		{"dotfile", ".env", []string{".env"}, ".env (2)"},
+		{"last extension only", "backup.tar.gz", []string{"backup.tar.gz"}, "backup.tar (2).gz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taken := map[string]bool{}
+			for _, name := range tt.taken {
+				taken[name] = true
+			}
+			if got := dedupeFileName(tt.fileName, taken); got != tt.want {
+				t.Errorf("dedupeFileName(%q) = %q, want %q", tt.fileName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateUploadRequestFolder(t *testing.T) {
+	req := UploadRequest{FileName: "a.txt", ContentType: "text/plain", FileSize: 1, Folder: " projects/2024 "}
+	if errs := validateUploadRequest(&req); errs.HasErrors() {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if req.Folder != "projects/2024" {
+		t.Errorf("folder = %q, want %q", req.Folder, "projects/2024")
+	}
+
+	for _, folder := range []string{"projects/../secrets", "/projects/2024/", "projects//2024", strings.Repeat("a/", 20) + "a"} {
+		req = UploadRequest{FileName: "a.txt", ContentType: "text/plain", FileSize: 1, Folder: folder}
+		if errs := validateUploadRequest(&req); !errs.HasErrors() {
+			t.Errorf("folder %q accepted", folder)
+		}
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	allowed := map[string]bool{"https://app.example.com": true, "http://localhost:3000": true}
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://app.example.com/uploads/done?x=1", true},
+		{"https://APP.example.com/done", true},
+		{"http://localhost:3000/done", true},
+		{"https://evil.example.com/done", false},
+		{"https://app.example.com.evil.com/done", false},
+		{"http://app.example.com/done", false},
+		{"https://user@app.example.com/done", false},
+		{"/relative/path", false},
+		{"javascript:alert(1)", false},
+	}
+
+	for _, tt := range tests {
+		if err := checkRedirect(tt.url, allowed); (err == nil) != tt.ok {
+			t.Errorf("checkRedirect(%q) = %v, want ok=%t", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestValidateUploadRequestChecksum(t *testing.T) {
+	sum := strings.Repeat("AB", 32)
+	req := UploadRequest{FileName: "a.txt", ContentType: "text/plain", FileSize: 1, ChecksumSHA256: sum}
+	if errs := validateUploadRequest(&req); errs.HasErrors() {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if req.ChecksumSHA256 != strings.ToLower(sum) {
+		t.Errorf("checksumSha256 = %q, want it lowercased", req.ChecksumSHA256)
+	}
+
+	for _, bad := range []string{"abc", strings.Repeat("a", 63), strings.Repeat("g", 64), strings.Repeat("a", 66)} {
+		req := UploadRequest{FileName: "a.txt", ContentType: "text/plain", FileSize: 1, ChecksumSHA256: bad}
+		if errs := validateUploadRequest(&req); !strings.Contains(errs.Error(), "checksumSha256") {
+			t.Errorf("checksumSha256 %q: errors = %v, want a checksumSha256 error", bad, errs)
+		}
+	}
+}
+
+func TestMultipartPlan(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileSize int64
+		partSize int64
+		parts    int
+		last     int64
+	}{
+		{"one short part", 1024, multipartPartSize, 1, 1024},
+		{"exact parts", 3 * multipartPartSize, multipartPartSize, 3, multipartPartSize},
+		{"short last part", 100*1024*1024 + 1, multipartPartSize, 11, 1},
+		{"grown parts", 20 * 1024 * 1024 * 1024, 21474837, maxMultipartParts, 21474317},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			partSize, sizes := multipartPlan(tt.fileSize)
+			if partSize != tt.partSize || len(sizes) != tt.parts || sizes[len(sizes)-1] != tt.last {
+				t.Fatalf("multipartPlan(%d) = %d, %d parts ending with %d; want %d, %d parts ending with %d",
+					tt.fileSize, partSize, len(sizes), sizes[len(sizes)-1], tt.partSize, tt.parts, tt.last)
+			}
+			var total int64
+			for _, size := range sizes {
+				total += size
+			}
+			if total != tt.fileSize {
+				t.Errorf("parts add up to %d, want %d", total, tt.fileSize)
+			}
+		})
+	}
+}
+
+func TestValidateUploadRequestMultipart(t *testing.T) {
+	req := UploadRequest{FileName: "a.mp4", ContentType: "text/plain", FileSize: 200 * 1024 * 1024}
+	if errs := validateUploadRequest(&req); errs.HasErrors() {
+		t.Fatalf("unexpected errors for a multipart PUT: %v", errs)
+	}
+
+	req = UploadRequest{FileName: "a.mp4", ContentType: "text/plain", FileSize: 200 * 1024 * 1024, UploadMethod: "post"}
+	if errs := validateUploadRequest(&req); !strings.Contains(errs.Error(), "uploadMethod") {
+		t.Errorf("multipart POST: errors = %v, want an uploadMethod error", errs)
+	}
+
+	req = UploadRequest{FileName: "a.mp4", ContentType: "text/plain", FileSize: maxMultipartSize + 1}
+	if errs := validateUploadRequest(&req); !strings.Contains(errs.Error(), "fileSize") {
+		t.Errorf("oversized file: errors = %v, want a fileSize error", errs)
+	}
+}
+
+// fakeFileIDIndex serves FileIdIndex from owners, fileId to userId
+type fakeFileIDIndex struct {
+	owners map[string]string
+}
+
+func (f *fakeFileIDIndex) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	fileID := params.ExpressionAttributeValues[":fileId"].(*types.AttributeValueMemberS).Value
+	output := &dynamodb.QueryOutput{}
+	if owner, ok := f.owners[fileID]; ok {
+		output.Items = append(output.Items, map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: owner},
+			"fileId": &types.AttributeValueMemberS{Value: fileID},
+		})
+	}
+	return output, nil
+}
+
+func TestUploadRejectsFileIDOfAnotherUser(t *testing.T) {
+	const fileID = "6f1c2a4e-8b3d-4c5e-9f7a-1b2c3d4e5f60"
+	defer func(c common.QueryAPI) { fileIDClient = c }(fileIDClient)
+	fileIDClient = &fakeFileIDIndex{owners: map[string]string{fileID: "user-a"}}
+
+	// user-b picks the ID user-a's file already has
+	handler := common.Chain(common.HandleErrors, common.RequireUser)(handleUpload)
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Body:       `{"fileName":"a.txt","contentType":"text/plain","fileSize":1,"fileId":"` + fileID + `"}`,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Authorizer: map[string]interface{}{"claims": map[string]interface{}{"sub": "user-b"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	var body common.ErrorResponse
+	json.Unmarshal([]byte(response.Body), &body)
+	if response.StatusCode != 409 || body.Code != "conflict" {
+		t.Errorf("upload = %d %s, want 409 conflict", response.StatusCode, body.Code)
+	}
+
+	if taken, err := fileIDTaken(context.Background(), "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d"); err != nil || taken {
+		t.Errorf("fileIDTaken(unused) = %t, %v; want false", taken, err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const (
+	postPolicyAlgorithm = "AWS4-HMAC-SHA256"
+	postPolicyService   = "s3"
+)
+
+// PostPolicyParams holds the inputs used to build a presigned POST policy
+type PostPolicyParams struct {
+	Bucket      string
+	Key         string
+	KeyPrefix   string
+	ContentType string
+	// ContentEncoding is optional; when set it is locked like Content-Type
+	ContentEncoding string
+	// Metadata is optional S3 user metadata, sent as x-amz-meta-<key> and
+	// locked to the given values
+	Metadata    map[string]string
+	FileSize    int64
+	Region      string
+	Credentials aws.Credentials
+	Expires     time.Duration
+	Now         time.Time
+
+	// SuccessActionRedirect and SuccessActionStatus are optional and tell S3
+	// how to answer a browser form once the upload succeeds
+	SuccessActionRedirect string
+	SuccessActionStatus   string
+}
+
+// successActionStatuses are the statuses S3 accepts for success_action_status
+var successActionStatuses = map[string]bool{"200": true, "201": true, "204": true}
+
+// PostPolicy represents the S3 POST policy document
+type PostPolicy struct {
+	Expiration string        `json:"expiration"`
+	Conditions []interface{} `json:"conditions"`
+}
+
+// PresignedPost holds the URL and form fields for a presigned POST upload
+type PresignedPost struct {
+	URL    string            `json:"url"`
+	Fields map[string]string `json:"fields"`
+}
+
+// buildPostPolicy builds the policy document and the unsigned form fields.
+// The policy locks the key and content type to exact values and the
+// content length to the declared file size, so the signed policy cannot be
+// reused to upload other content types or to other keys.
+func buildPostPolicy(p PostPolicyParams) (PostPolicy, map[string]string) {
+	date := p.Now.UTC()
+	amzDate := date.Format("20060102T150405Z")
+	credential := fmt.Sprintf("%s/%s", p.Credentials.AccessKeyID, credentialScope(date, p.Region))
+
+	fields := map[string]string{
+		"key":              p.Key,
+		"Content-Type":     p.ContentType,
+		"x-amz-algorithm":  postPolicyAlgorithm,
+		"x-amz-credential": credential,
+		"x-amz-date":       amzDate,
+	}
+
+	conditions := []interface{}{
+		map[string]string{"bucket": p.Bucket},
+		map[string]string{"key": p.Key},
+		[]interface{}{"starts-with", "$key", p.KeyPrefix},
+		map[string]string{"Content-Type": p.ContentType},
+		[]interface{}{"content-length-range", p.FileSize, p.FileSize},
+		map[string]string{"x-amz-algorithm": postPolicyAlgorithm},
+		map[string]string{"x-amz-credential": credential},
+		map[string]string{"x-amz-date": amzDate},
+	}
+
+	if p.ContentEncoding != "" {
+		fields["Content-Encoding"] = p.ContentEncoding
+		conditions = append(conditions, map[string]string{"Content-Encoding": p.ContentEncoding})
+	}
+
+	for key, value := range p.Metadata {
+		field := "x-amz-meta-" + key
+		fields[field] = value
+		conditions = append(conditions, map[string]string{field: value})
+	}
+
+	if p.SuccessActionRedirect != "" {
+		fields["success_action_redirect"] = p.SuccessActionRedirect
+		conditions = append(conditions, map[string]string{"success_action_redirect": p.SuccessActionRedirect})
+	}
+	if p.SuccessActionStatus != "" {
+		fields["success_action_status"] = p.SuccessActionStatus
+		conditions = append(conditions, map[string]string{"success_action_status": p.SuccessActionStatus})
+	}
+
+	if p.Credentials.SessionToken != "" {
+		fields["x-amz-security-token"] = p.Credentials.SessionToken
+		conditions = append(conditions, map[string]string{"x-amz-security-token": p.Credentials.SessionToken})
+	}
+
+	policy := PostPolicy{
+		Expiration: date.Add(p.Expires).Format("2006-01-02T15:04:05.000Z"),
+		Conditions: conditions,
+	}
+
+	return policy, fields
+}
+
+// validatePostPolicy checks that the policy inputs are safe to sign
+func validatePostPolicy(p PostPolicyParams) error {
+	if p.KeyPrefix == "" || !strings.HasSuffix(p.KeyPrefix, "/") {
+		return fmt.Errorf("invalid key prefix: %q", p.KeyPrefix)
+	}
+	if !strings.HasPrefix(p.Key, p.KeyPrefix) || len(p.Key) == len(p.KeyPrefix) {
+		return fmt.Errorf("key %q does not match prefix %q", p.Key, p.KeyPrefix)
+	}
+	if strings.Contains(p.Key, "..") {
+		return fmt.Errorf("key %q contains a relative path segment", p.Key)
+	}
+	if !allowedMimeTypes[p.ContentType] {
+		return fmt.Errorf("content type %q is not allowed", p.ContentType)
+	}
+	if p.FileSize <= 0 || p.FileSize > maxFileSize {
+		return fmt.Errorf("file size %d is out of range", p.FileSize)
+	}
+	if p.SuccessActionStatus != "" && !successActionStatuses[p.SuccessActionStatus] {
+		return fmt.Errorf("invalid success_action_status %q", p.SuccessActionStatus)
+	}
+	if p.Credentials.AccessKeyID == "" || p.Credentials.SecretAccessKey == "" {
+		return fmt.Errorf("missing signing credentials")
+	}
+	if p.Region == "" {
+		return fmt.Errorf("missing region")
+	}
+	return nil
+}
+
+// presignPost validates the inputs, builds the POST policy and signs it
+func presignPost(p PostPolicyParams) (*PresignedPost, error) {
+	if err := validatePostPolicy(p); err != nil {
+		return nil, err
+	}
+
+	policy, fields := buildPostPolicy(p)
+
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal POST policy: %w", err)
+	}
+
+	encodedPolicy := base64.StdEncoding.EncodeToString(policyJSON)
+	signingKey := deriveSigningKey(p.Credentials.SecretAccessKey, p.Now.UTC(), p.Region)
+
+	fields["policy"] = encodedPolicy
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey, []byte(encodedPolicy)))
+
+	return &PresignedPost{
+		URL:    fmt.Sprintf("https://%s.s3.%s.amazonaws.com/", p.Bucket, p.Region),
+		Fields: fields,
+	}, nil
+}
+
+// credentialScope returns the SigV4 credential scope for S3
+func credentialScope(date time.Time, region string) string {
+	return fmt.Sprintf("%s/%s/%s/aws4_request", date.Format("20060102"), region, postPolicyService)
+}
+
+// deriveSigningKey derives the SigV4 signing key for S3
+func deriveSigningKey(secret string, date time.Time, region string) []byte {
+	kDate := hmacSHA256([]byte("AWS4"+secret), []byte(date.Format("20060102")))
+	kRegion := hmacSHA256(kDate, []byte(region))
+	kService := hmacSHA256(kRegion, []byte(postPolicyService))
+	return hmacSHA256(kService, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func testPostPolicyParams() PostPolicyParams {
+	return PostPolicyParams{
+		Bucket:      "test-bucket",
+		Key:         "users/user-123/uploads/file-1-report.pdf",
+		KeyPrefix:   "users/user-123/uploads/",
+		ContentType: "application/pdf",
+		FileSize:    2048,
+		Region:      "us-east-1",
+		Credentials: aws.Credentials{
+			AccessKeyID:     "AKIDEXAMPLE",
+			SecretAccessKey: "secret",
+			SessionToken:    "session-token",
+		},
+		Expires: time.Hour,
+		Now:     time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func hasCondition(conditions []interface{}, want interface{}) bool {
+	for _, c := range conditions {
+		if reflect.DeepEqual(c, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBuildPostPolicyConditions(t *testing.T) {
+	p := testPostPolicyParams()
+	policy, fields := buildPostPolicy(p)
+
+	want := []interface{}{
+		map[string]string{"bucket": "test-bucket"},
+		map[string]string{"key": p.Key},
+		[]interface{}{"starts-with", "$key", "users/user-123/uploads/"},
+		map[string]string{"Content-Type": "application/pdf"},
+		[]interface{}{"content-length-range", int64(2048), int64(2048)},
+		map[string]string{"x-amz-algorithm": "AWS4-HMAC-SHA256"},
+		map[string]string{"x-amz-credential": "AKIDEXAMPLE/20240102/us-east-1/s3/aws4_request"},
+		map[string]string{"x-amz-date": "20240102T030405Z"},
+		map[string]string{"x-amz-security-token": "session-token"},
+	}
+	for _, c := range want {
+		if !hasCondition(policy.Conditions, c) {
+			t.Errorf("policy is missing condition %v", c)
+		}
+	}
+
+	if policy.Expiration != "2024-01-02T04:04:05.000Z" {
+		t.Errorf("unexpected expiration %q", policy.Expiration)
+	}
+	if fields["key"] != p.Key || fields["Content-Type"] != p.ContentType {
+		t.Errorf("form fields do not match policy: %v", fields)
+	}
+}
+
+func TestBuildPostPolicyContentEncoding(t *testing.T) {
+	p := testPostPolicyParams()
+	if _, fields := buildPostPolicy(p); fields["Content-Encoding"] != "" {
+		t.Error("Content-Encoding field set without an encoding")
+	}
+
+	p.ContentEncoding = "gzip"
+	policy, fields := buildPostPolicy(p)
+	if fields["Content-Encoding"] != "gzip" {
+		t.Errorf("Content-Encoding field = %q, want gzip", fields["Content-Encoding"])
+	}
+	if !hasCondition(policy.Conditions, map[string]string{"Content-Encoding": "gzip"}) {
+		t.Error("policy is missing the Content-Encoding condition")
+	}
+}
+
+func TestBuildPostPolicyMetadata(t *testing.T) {
+	p := testPostPolicyParams()
+	p.Metadata = map[string]string{"registration": "payload.signature"}
+
+	policy, fields := buildPostPolicy(p)
+	if fields["x-amz-meta-registration"] != "payload.signature" {
+		t.Errorf("x-amz-meta-registration field = %q", fields["x-amz-meta-registration"])
+	}
+	if !hasCondition(policy.Conditions, map[string]string{"x-amz-meta-registration": "payload.signature"}) {
+		t.Error("policy is missing the x-amz-meta-registration condition")
+	}
+}
+
+func TestPresignPostSignsPolicy(t *testing.T) {
+	post, err := presignPost(testPostPolicyParams())
+	if err != nil {
+		t.Fatalf("presignPost returned error: %v", err)
+	}
+
+	if post.URL != "https://test-bucket.s3.us-east-1.amazonaws.com/" {
+		t.Errorf("unexpected URL %q", post.URL)
+	}
+	if post.Fields["x-amz-signature"] == "" {
+		t.Error("missing x-amz-signature field")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(post.Fields["policy"])
+	if err != nil {
+		t.Fatalf("policy is not base64: %v", err)
+	}
+	var policy map[string]interface{}
+	if err := json.Unmarshal(decoded, &policy); err != nil {
+		t.Fatalf("policy is not JSON: %v", err)
+	}
+	if _, ok := policy["conditions"]; !ok {
+		t.Error("policy has no conditions")
+	}
+}
+
+func TestValidatePostPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(p *PostPolicyParams)
+	}{
+		{"key outside prefix", func(p *PostPolicyParams) { p.Key = "users/other/uploads/file.pdf" }},
+		{"key equals prefix", func(p *PostPolicyParams) { p.Key = p.KeyPrefix }},
+		{"relative key", func(p *PostPolicyParams) { p.Key = p.KeyPrefix + "../other/file.pdf" }},
+		{"prefix without slash", func(p *PostPolicyParams) { p.KeyPrefix = "users/user-123" }},
+		{"disallowed content type", func(p *PostPolicyParams) { p.ContentType = "application/x-msdownload" }},
+		{"zero size", func(p *PostPolicyParams) { p.FileSize = 0 }},
+		{"oversized", func(p *PostPolicyParams) { p.FileSize = maxFileSize + 1 }},
+		{"missing credentials", func(p *PostPolicyParams) { p.Credentials = aws.Credentials{} }},
+		{"missing region", func(p *PostPolicyParams) { p.Region = "" }},
+	}
+
+	if err := validatePostPolicy(testPostPolicyParams()); err != nil {
+		t.Fatalf("valid params rejected: %v", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPostPolicyParams()
+			tt.mutate(&p)
+			if err := validatePostPolicy(p); err == nil {
+				t.Error("expected validation error")
+			}
+		})
+	}
+}
+
+func TestBuildPostPolicySuccessAction(t *testing.T) {
+	p := testPostPolicyParams()
+	p.SuccessActionRedirect = "https://app.example.com/done"
+
+	policy, fields := buildPostPolicy(p)
+	if fields["success_action_redirect"] != p.SuccessActionRedirect {
+		t.Errorf("success_action_redirect field = %q", fields["success_action_redirect"])
+	}
+	if !hasCondition(policy.Conditions, map[string]string{"success_action_redirect": p.SuccessActionRedirect}) {
+		t.Error("policy is missing the success_action_redirect condition")
+	}
+	if _, ok := fields["success_action_status"]; ok {
+		t.Error("success_action_status set without being asked for")
+	}
+
+	p = testPostPolicyParams()
+	p.SuccessActionStatus = "201"
+	policy, fields = buildPostPolicy(p)
+	if fields["success_action_status"] != "201" || !hasCondition(policy.Conditions, map[string]string{"success_action_status": "201"}) {
+		t.Error("success_action_status is missing from the fields or policy")
+	}
+
+	p.SuccessActionStatus = "302"
+	if err := validatePostPolicy(p); err == nil {
+		t.Error("expected an error for success_action_status 302")
+	}
+}
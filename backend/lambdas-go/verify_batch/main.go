@@ -0,0 +1,435 @@
+// Package main implements the verify_batch Lambda function
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+const (
+	bucketName     = "660348065850-file-bucket"
+	userFilesTable = "UserFiles"
+	fileAuditTable = "FileAudit"
+	maxFileIDs     = 100
+	maxConcurrency = 10
+)
+
+// Statuses set by verification. Files that pass the batch become
+// "uploaded", like files registered by register_upload, and files confirmed
+// one at a time become "confirmed".
+const (
+	statusPending      = "pending"
+	statusUploaded     = common.StatusUploaded
+	statusConfirmed    = common.StatusConfirmed
+	statusSizeMismatch = "size_mismatch"
+	statusCorrupt      = "corrupt"
+)
+
+// Outcomes that leave the file untouched
+const (
+	outcomeNotFound   = "not_found"
+	outcomeNotPending = "not_pending"
+	outcomeMissing    = "missing_object"
+	outcomeError      = "error"
+)
+
+// errNotPending is returned by confirmFile for a file that isn't pending,
+// e.g. because it was confirmed already
+var errNotPending = errors.New("file is not pending")
+
+// VerifyRequest represents the request body
+type VerifyRequest struct {
+	FileIDs []string `json:"fileIds"`
+}
+
+// ConfirmRequest represents the request body of POST .../confirm
+type ConfirmRequest struct {
+	FileID string `json:"fileId"`
+}
+
+// VerifyResponse represents the response body
+type VerifyResponse struct {
+	Results []VerifyResult `json:"results"`
+	// Counts is the number of results per outcome
+	Counts map[string]int `json:"counts"`
+}
+
+// VerifyResult is the outcome for one file. Outcome is the new status when
+// the file was verified, or why it was skipped.
+type VerifyResult struct {
+	FileID           string `json:"fileId"`
+	Outcome          string `json:"outcome"`
+	ExpectedSize     int64  `json:"expectedSize,omitempty"`
+	ActualSize       int64  `json:"actualSize,omitempty"`
+	ChecksumVerified bool   `json:"checksumVerified,omitempty"`
+	// SniffedContentType is what a rejected file's content looked like
+	SniffedContentType string `json:"sniffedContentType,omitempty"`
+	Error              string `json:"error,omitempty"`
+	// VersionID is the S3 version recorded for the file, on versioned buckets
+	VersionID string `json:"versionId,omitempty"`
+}
+
+// headObjectAPI is the subset of the S3 client confirmFile uses
+type headObjectAPI interface {
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+}
+
+var (
+	dynamoClient *dynamodb.Client
+	auditLog     *common.AuditLogger
+	// getClient and headClient look up the file and its object,
+	// updateClient stores the outcome and quarantine sniffs and moves the
+	// object; tests replace them
+	getClient    common.GetItemAPI
+	updateClient common.UpdateItemAPI
+	headClient   headObjectAPI
+	quarantine   *common.Quarantine
+)
+
+func init() {
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to load AWS config: %v", err)
+	}
+	s3Client := s3.NewFromConfig(cfg)
+	headClient = s3Client
+	quarantine = common.NewQuarantine(s3Client, bucketName)
+	dynamoClient = dynamodb.NewFromConfig(cfg, common.DynamoDBCircuitBreaker)
+	auditLog = &common.AuditLogger{Client: dynamoClient, Table: fileAuditTable}
+	getClient = dynamoClient
+	updateClient = dynamoClient
+}
+
+// Handler is the Lambda function handler
+var Handler = common.Chain(
+	common.Recover,
+	common.LogRequest,
+	common.FlushBackground,
+	common.HandleErrors,
+	common.CORS,
+	common.ReadOnlyGuard(),
+	common.CaptureSourceIP,
+	common.RequireUser,
+)(routes.Serve)
+
+// routes serves the batch on the base path and single files on .../confirm
+var routes = common.NewRouter().
+	Handle("POST", "", handleVerify).
+	Handle("POST", "confirm", handleConfirm)
+
+// handleVerify handles an authenticated request
+func handleVerify(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	// Parse request body
+	var req VerifyRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+
+	fileIDs, errs := validateVerifyRequest(&req)
+	if errs.HasErrors() {
+		return common.Fail(errs)
+	}
+
+	// Failures are reported per file so one bad file doesn't hide the others
+	results := verifyAll(ctx, userID, fileIDs)
+	response := VerifyResponse{Results: results, Counts: map[string]int{}}
+	for _, result := range results {
+		response.Counts[result.Outcome]++
+	}
+
+	return common.BuildResponse(200, response), nil
+}
+
+// handleConfirm confirms a single pending file, storing the size and ETag S3
+// reports. Unlike the batch it answers with an HTTP status: 404 when the
+// caller has no such file or its object isn't in S3 yet (the file stays
+// pending) and 409 when it isn't pending.
+func handleConfirm(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	userID := common.UserID(ctx)
+
+	var req ConfirmRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return common.Fail(common.Validation("Invalid request body"))
+	}
+	if req.FileID == "" {
+		return common.Fail(common.Validation("Missing required field: fileId"))
+	}
+
+	result, err := confirmFile(ctx, userID, req.FileID, true)
+	switch {
+	case errors.Is(err, common.ErrNotFound):
+		return common.Fail(common.NotFound("File not found"))
+	case errors.Is(err, common.ErrObjectMissing):
+		return common.Fail(common.NotFound("File has not been uploaded yet"))
+	case errors.Is(err, errNotPending):
+		return common.Fail(common.Conflict("File is not pending confirmation"))
+	case err != nil:
+		return common.Fail(common.Internal("Confirm error", err))
+	}
+
+	return common.BuildResponse(200, result), nil
+}
+
+// validateVerifyRequest checks the request and returns the de-duplicated file IDs
+func validateVerifyRequest(req *VerifyRequest) ([]string, *common.ValidationErrors) {
+	errs := &common.ValidationErrors{}
+
+	if len(req.FileIDs) == 0 {
+		errs.Add("fileIds", "is required")
+		return nil, errs
+	}
+
+	seen := make(map[string]bool, len(req.FileIDs))
+	fileIDs := make([]string, 0, len(req.FileIDs))
+	for i, fileID := range req.FileIDs {
+		if fileID == "" {
+			errs.Add(fmt.Sprintf("fileIds.%d", i), "must not be empty")
+			continue
+		}
+		if !seen[fileID] {
+			seen[fileID] = true
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+	if len(fileIDs) > maxFileIDs {
+		errs.Addf("fileIds", "must have at most %d entries", maxFileIDs)
+	}
+
+	return fileIDs, errs
+}
+
+// verifyAll verifies every file with at most maxConcurrency in flight.
+// Results are in the same order as fileIDs.
+func verifyAll(ctx context.Context, userID string, fileIDs []string) []VerifyResult {
+	results := make([]VerifyResult, len(fileIDs))
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+
+	for i, fileID := range fileIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, fileID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = verifyOne(ctx, userID, fileID)
+		}(i, fileID)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// verifyOne confirms one file of a batch, turning confirmFile's errors into
+// outcomes so one bad file doesn't fail the others
+func verifyOne(ctx context.Context, userID, fileID string) VerifyResult {
+	result, err := confirmFile(ctx, userID, fileID, false)
+	switch {
+	case errors.Is(err, common.ErrNotFound):
+		result.Outcome = outcomeNotFound
+	case errors.Is(err, errNotPending):
+		result.Outcome = outcomeNotPending
+	case errors.Is(err, common.ErrObjectMissing):
+		result.Outcome = outcomeMissing
+	case err != nil:
+		return failed(result, "Verification error", err)
+	}
+	return result
+}
+
+// confirmFile checks a pending file's object against its record and stores
+// the resulting status. It returns common.ErrNotFound when the caller has no
+// such file or it is in trash, errNotPending when the file isn't pending and
+// common.ErrObjectMissing when its object isn't in S3 yet; the file is left
+// untouched in all three cases. With single set a file that passes becomes
+// confirmed, and the size S3 reports replaces the recorded one instead of
+// failing the file.
+func confirmFile(ctx context.Context, userID, fileID string, single bool) (VerifyResult, error) {
+	result := VerifyResult{FileID: fileID}
+
+	file, err := common.GetOwnedFile(ctx, getClient, userFilesTable, userID, fileID, true)
+	switch {
+	case errors.Is(err, common.ErrNotFound), errors.Is(err, common.ErrDeleted):
+		return result, common.ErrNotFound
+	case err != nil:
+		return result, fmt.Errorf("DynamoDB get: %w", err)
+	}
+	if file.Status != statusPending {
+		return result, errNotPending
+	}
+	result.ExpectedSize = file.FileSize
+
+	opCtx, cancel := common.WithDeadline(ctx)
+	head, err := headClient.HeadObject(opCtx, &s3.HeadObjectInput{
+		Bucket:       aws.String(bucketName),
+		Key:          aws.String(file.S3Key),
+		ChecksumMode: s3types.ChecksumModeEnabled,
+	})
+	cancel()
+	if err != nil {
+		if kind, _ := common.ClassifyAWSError(err); kind == common.KindNotFound {
+			// Not uploaded yet; the file stays pending
+			return result, common.ErrObjectMissing
+		}
+		return result, fmt.Errorf("S3 head: %w", err)
+	}
+	result.ActualSize = aws.ToInt64(head.ContentLength)
+
+	checked := file
+	if single {
+		actual := *file
+		actual.FileSize = result.ActualSize
+		checked = &actual
+	}
+	status, checksumVerified := verifyObject(checked, result.ActualSize, aws.ToString(head.ChecksumSHA256))
+	if single && status == statusUploaded {
+		status = statusConfirmed
+	}
+	result.ChecksumVerified = checksumVerified
+	result.VersionID = common.ObjectVersionID(head.VersionId)
+
+	// Content that doesn't look like its declared type is rejected
+	var quarantined *common.Quarantined
+	if common.Confirmed(status) {
+		quarantined, err = quarantine.Check(ctx, file, result.VersionID, result.ActualSize)
+		if err != nil {
+			return result, err
+		}
+		if quarantined != nil {
+			status = common.StatusRejected
+			result.SniffedContentType = quarantined.SniffedContentType
+		}
+	}
+
+	// Guarded so a file confirmed, deleted or replaced meanwhile is left alone
+	now := time.Now().UTC().Format(time.RFC3339)
+	update := "SET #status = :status, verifiedAt = :now, updatedAt = :now, etag = :etag, uploadCompletedAt = :completed"
+	values := map[string]types.AttributeValue{
+		":status":    &types.AttributeValueMemberS{Value: status},
+		":now":       &types.AttributeValueMemberS{Value: now},
+		":completed": &types.AttributeValueMemberS{Value: common.UploadCompletedAt(head.LastModified, time.Now())},
+		":pending":   &types.AttributeValueMemberS{Value: statusPending},
+		":s3Key":     &types.AttributeValueMemberS{Value: file.S3Key},
+		":etag":      &types.AttributeValueMemberS{Value: aws.ToString(head.ETag)},
+	}
+	changedFields := []string{"status"}
+	if single {
+		update += ", fileSize = :fileSize"
+		values[":fileSize"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(result.ActualSize, 10)}
+		if result.ActualSize != file.FileSize {
+			changedFields = append(changedFields, "fileSize")
+		}
+	}
+	if quarantined != nil {
+		update += ", " + common.QuarantineUpdate
+		quarantined.AddValues(values)
+	} else if result.VersionID != "" {
+		update += ", versionId = :versionId"
+		values[":versionId"] = &types.AttributeValueMemberS{Value: result.VersionID}
+	}
+	opCtx, cancel = common.WithDeadline(ctx)
+	_, err = updateClient.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userFilesTable),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userID},
+			"fileId": &types.AttributeValueMemberS{Value: fileID},
+		},
+		UpdateExpression:    aws.String(update),
+		ConditionExpression: aws.String("#status = :pending AND s3Key = :s3Key"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: values,
+	})
+	cancel()
+	if err != nil {
+		if quarantined != nil {
+			quarantine.Discard(ctx, quarantined)
+		}
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return result, errNotPending
+		}
+		return result, fmt.Errorf("DynamoDB update: %w", err)
+	}
+	result.Outcome = status
+	if quarantined != nil {
+		quarantine.Finish(ctx, file, result.VersionID)
+		result.VersionID = ""
+	}
+
+	reason := "verify_batch"
+	if single {
+		reason = "confirm"
+	}
+	auditLog.Log(ctx, userID, fileID, "update", map[string]interface{}{
+		"fileName":         file.FileName,
+		"changedFields":    changedFields,
+		"status":           status,
+		"expectedSize":     file.FileSize,
+		"actualSize":       result.ActualSize,
+		"checksumVerified": checksumVerified,
+		"versionId":        result.VersionID,
+		"etag":             aws.ToString(head.ETag),
+		"reason":           reason,
+	})
+	if quarantined != nil {
+		auditLog.Log(ctx, userID, fileID, "access_attempt", quarantined.AuditMetadata(file))
+	}
+	return result, nil
+}
+
+// verifyObject decides the status of a pending file from its object's size
+// and base64 SHA-256 as reported by S3. The checksum is compared only when
+// the record has one and S3 has a full-object checksum to compare it with.
+func verifyObject(file *common.File, size int64, objectSHA256 string) (string, bool) {
+	if size != file.FileSize {
+		return statusSizeMismatch, false
+	}
+	if file.ChecksumSHA256 == "" || objectSHA256 == "" {
+		return statusUploaded, false
+	}
+
+	// Multipart objects report a checksum of part checksums ("...-N"), which
+	// doesn't decode to a digest and can't be compared
+	digest, err := base64.StdEncoding.DecodeString(objectSHA256)
+	if err != nil || len(digest) != 32 {
+		return statusUploaded, false
+	}
+	if hex.EncodeToString(digest) != file.ChecksumSHA256 {
+		return statusCorrupt, true
+	}
+	return statusUploaded, true
+}
+
+// failed logs err and records it on result without exposing the details
+func failed(result VerifyResult, message string, err error) VerifyResult {
+	log.Printf("%s for file %s: %v", message, result.FileID, err)
+	result.Outcome = outcomeError
+	result.Error = "Could not verify the file, please retry"
+	return result
+}
+
+func main() {
+	lambda.Start(Handler)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+
+	"compinche-file-manager/lambdas-go/common"
+)
+
+func TestVerifyObject(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello world"))
+	hexSum := hex.EncodeToString(sum[:])
+	b64Sum := base64.StdEncoding.EncodeToString(sum[:])
+	other := sha256.Sum256([]byte("tampered"))
+
+	tests := []struct {
+		name     string
+		file     common.File
+		size     int64
+		checksum string
+		status   string
+		verified bool
+	}{
+		{"size only", common.File{FileSize: 11}, 11, "", statusUploaded, false},
+		{"size mismatch", common.File{FileSize: 12}, 11, b64Sum, statusSizeMismatch, false},
+		{"checksum match", common.File{FileSize: 11, ChecksumSHA256: hexSum}, 11, b64Sum, statusUploaded, true},
+		{"checksum mismatch", common.File{FileSize: 11, ChecksumSHA256: hex.EncodeToString(other[:])}, 11, b64Sum, statusCorrupt, true},
+		{"no object checksum", common.File{FileSize: 11, ChecksumSHA256: hexSum}, 11, "", statusUploaded, false},
+		{"multipart checksum", common.File{FileSize: 11, ChecksumSHA256: hexSum}, 11, b64Sum + "-3", statusUploaded, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, verified := verifyObject(&tt.file, tt.size, tt.checksum)
+			if status != tt.status || verified != tt.verified {
+				t.Errorf("verifyObject = (%s, %t), want (%s, %t)", status, verified, tt.status, tt.verified)
+			}
+		})
+	}
+}
+
+// fakeFiles serves one file record, or none when file is nil, and records
+// updates and audit events
+type fakeFiles struct {
+	file    map[string]types.AttributeValue
+	updates []*dynamodb.UpdateItemInput
+	audits  []map[string]types.AttributeValue
+	// mu guards audits, written by the background workers
+	mu sync.Mutex
+}
+
+func (f *fakeFiles) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.file}, nil
+}
+
+func (f *fakeFiles) UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.updates = append(f.updates, params)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeFiles) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.audits = append(f.audits, params.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// missingObjects answers every HeadObject like S3 does for a missing key
+type missingObjects struct{}
+
+func (missingObjects) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return nil, &smithy.GenericAPIError{Code: "NotFound", Message: "Not Found"}
+}
+
+// storedObject answers HeadObject with output
+type storedObject struct {
+	output *s3.HeadObjectOutput
+}
+
+func (o storedObject) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return o.output, nil
+}
+
+func confirm(t *testing.T, files *fakeFiles, head headObjectAPI) (int, string) {
+	t.Helper()
+	getClient = files
+	updateClient = files
+	auditLog.Client = files
+	headClient = head
+
+	handler := common.Chain(common.FlushBackground, common.HandleErrors, common.RequireUser)(routes.Serve)
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Path:       "/files/verify/confirm",
+		Body:       `{"fileId":"file-1"}`,
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Authorizer: map[string]interface{}{"claims": map[string]interface{}{"sub": "user-123"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("handler error: %v", err)
+	}
+	var body common.ErrorResponse
+	json.Unmarshal([]byte(response.Body), &body)
+	return response.StatusCode, body.Code
+}
+
+func TestConfirmUnknownFileIsNotFound(t *testing.T) {
+	if status, code := confirm(t, &fakeFiles{}, missingObjects{}); status != 404 || code != "not_found" {
+		t.Errorf("confirm = %d %s, want 404 not_found", status, code)
+	}
+}
+
+// pendingFile is a pending text file declared as 11 bytes
+func pendingFile() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"userId":      &types.AttributeValueMemberS{Value: "user-123"},
+		"fileId":      &types.AttributeValueMemberS{Value: "file-1"},
+		"fileName":    &types.AttributeValueMemberS{Value: "notes.txt"},
+		"s3Key":       &types.AttributeValueMemberS{Value: "users/user-123/uploads/file-1-notes.txt"},
+		"contentType": &types.AttributeValueMemberS{Value: "text/plain"},
+		"status":      &types.AttributeValueMemberS{Value: statusPending},
+		"fileSize":    &types.AttributeValueMemberN{Value: "11"},
+	}
+}
+
+func TestConfirmMissingObjectIsNotFound(t *testing.T) {
+	files := &fakeFiles{file: pendingFile()}
+	if status, code := confirm(t, files, missingObjects{}); status != 404 || code != "not_found" {
+		t.Errorf("confirm = %d %s, want 404 not_found", status, code)
+	}
+	if len(files.updates) != 0 {
+		t.Errorf("missing object updated the file: %v", files.updates)
+	}
+
+	// The batch reports the same file as missing_object instead
+	if result := verifyOne(context.Background(), "user-123", "file-1"); result.Outcome != outcomeMissing {
+		t.Errorf("verifyOne outcome = %s, want %s", result.Outcome, outcomeMissing)
+	}
+}
+
+func TestConfirmStoresActualSize(t *testing.T) {
+	useContent(t, []byte("hello world, again"))
+	files := &fakeFiles{file: pendingFile()}
+	head := storedObject{output: &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(18),
+		ETag:          aws.String(`"5eb63bbbe01eeed093cb22bb8f5acdc3"`),
+	}}
+
+	if status, code := confirm(t, files, head); status != 200 {
+		t.Fatalf("confirm = %d %s, want 200", status, code)
+	}
+	if len(files.updates) != 1 {
+		t.Fatalf("got %d updates, want 1", len(files.updates))
+	}
+	values := files.updates[0].ExpressionAttributeValues
+	if v := values[":status"].(*types.AttributeValueMemberS).Value; v != statusConfirmed {
+		t.Errorf("status = %s, want %s", v, statusConfirmed)
+	}
+	if v := values[":fileSize"].(*types.AttributeValueMemberN).Value; v != "18" {
+		t.Errorf("fileSize = %s, want the 18 bytes S3 reports", v)
+	}
+	if v := values[":etag"].(*types.AttributeValueMemberS).Value; v != `"5eb63bbbe01eeed093cb22bb8f5acdc3"` {
+		t.Errorf("etag = %s", v)
+	}
+	if len(files.audits) != 1 {
+		t.Errorf("got %d audit events, want 1", len(files.audits))
+	}
+}
+
+// fakeContent serves an object's bytes and records the keys copied to and
+// deleted from
+type fakeContent struct {
+	data    []byte
+	copies  []string
+	deletes []string
+}
+
+func (f *fakeContent) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(f.data))}, nil
+}
+
+func (f *fakeContent) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.copies = append(f.copies, aws.ToString(params.Key))
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeContent) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.deletes = append(f.deletes, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// useContent makes quarantine read data until the test ends
+func useContent(t *testing.T, data []byte) *fakeContent {
+	previous := quarantine
+	t.Cleanup(func() { quarantine = previous })
+	content := &fakeContent{data: data}
+	quarantine = &common.Quarantine{Client: content, Bucket: bucketName, Prefix: common.DefaultQuarantinePrefix}
+	return content
+}
+
+func TestConfirmQuarantinesMismatchedContent(t *testing.T) {
+	content := useContent(t, append([]byte("MZ\x90\x00"), make([]byte, 7)...))
+	files := &fakeFiles{file: pendingFile()}
+	head := storedObject{output: &s3.HeadObjectOutput{ContentLength: aws.Int64(11)}}
+
+	if status, code := confirm(t, files, head); status != 200 {
+		t.Fatalf("confirm = %d %s, want 200", status, code)
+	}
+	values := files.updates[0].ExpressionAttributeValues
+	if v := values[":status"].(*types.AttributeValueMemberS).Value; v != common.StatusRejected {
+		t.Errorf("status = %s, want %s", v, common.StatusRejected)
+	}
+	key := "users/user-123/uploads/file-1-notes.txt"
+	if len(content.copies) != 1 || content.copies[0] != "quarantine/"+key {
+		t.Errorf("copies = %v, want the object in quarantine", content.copies)
+	}
+	if len(content.deletes) != 1 || content.deletes[0] != key {
+		t.Errorf("deletes = %v, want the original removed", content.deletes)
+	}
+	if len(files.audits) != 2 {
+		t.Errorf("got %d audit events, want update and access_attempt", len(files.audits))
+	}
+}